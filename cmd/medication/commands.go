@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+
+	"github.com/chestnut42/test-medication/internal/encryption"
+	"github.com/chestnut42/test-medication/internal/storage"
+	"github.com/chestnut42/test-medication/internal/storage/postgres"
+	"github.com/chestnut42/test-medication/internal/utils/logx"
+)
+
+// runCommand runs a one-off command instead of the service, e.g. `medication migrate` or `medication schema apply`
+// before a rollout:
+//
+//	migrate                            applies Postgres migrations
+//	schema apply|diff                  creates or checks DynamoDB tables
+//	data status                        prints DynamoDB item migrations
+//	data migrate [-dry-run]            runs pending DynamoDB item migrations, see storage.Migration
+//	restore -owner -id -at -operator   restores a medication from the history table, see restore.go
+func runCommand(ctx context.Context, cfg Config, args []string) error {
+	switch args[0] {
+	case "migrate":
+		return migrate(ctx, cfg)
+	case "data":
+		return data(ctx, cfg, args[1:])
+	case "restore":
+		return restore(ctx, cfg, args[1:])
+	case "schema":
+		if len(args) != 2 || (args[1] != "apply" && args[1] != "diff") {
+			return errors.New("usage: schema apply|diff")
+		}
+		return schema(ctx, cfg, args[1] == "apply")
+	default:
+		return fmt.Errorf("unknown command: %s", args[0])
+	}
+}
+
+// schema prints the drift of DynamoDB tables, one line per difference, see storage.Drift. Apply fixes what it can
+// first. It fails if any drift is left, so that a deployment pipeline stops.
+func schema(ctx context.Context, cfg Config, apply bool) error {
+	awsCfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return fmt.Errorf("loading aws config: %w", err)
+	}
+	s := storage.NewSchema(runDynamo(cfg, awsCfg, nil), storage.Tables(cfg.StorageConfig(), cfg.SchemaPITR))
+
+	var drift []storage.Drift
+	if apply {
+		drift, err = s.Apply(ctx)
+	} else {
+		drift, err = s.Diff(ctx)
+	}
+	if err != nil {
+		return err
+	}
+	for _, d := range drift {
+		fmt.Println(d)
+	}
+	if len(drift) > 0 {
+		return fmt.Errorf("%d differences from the expected schema", len(drift))
+	}
+	logx.Logger(ctx).Info("dynamodb schema is up to date")
+	return nil
+}
+
+// openDynamoStore returns the DynamoDB storage. Encrypted items are read and written with the keyring if it's configured.
+func openDynamoStore(ctx context.Context, cfg Config) (*storage.Service, error) {
+	awsCfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("loading aws config: %w", err)
+	}
+	store := storage.NewService(cfg.StorageConfig(), runDynamo(cfg, awsCfg, nil))
+	if cfg.EncryptionKeyFile != "" {
+		provider, err := encryption.NewFileProvider(cfg.EncryptionKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading encryption keys: %w", err)
+		}
+		store = store.WithCipher(encryption.NewKeyring(encryption.Config{CacheTTL: cfg.DataKeyCacheTTL}, provider, store))
+	}
+	return store, nil
+}
+
+// data runs DynamoDB item migrations.
+func data(ctx context.Context, cfg Config, args []string) error {
+	if len(args) == 0 || (args[0] != "status" && args[0] != "migrate") {
+		return errors.New("usage: data status|migrate [flags]")
+	}
+	flags := flag.NewFlagSet("data "+args[0], flag.ContinueOnError)
+	var opts storage.MigrationOptions
+	flags.BoolVar(&opts.DryRun, "dry-run", false, "transform items and count changes without writing anything")
+	flags.IntVar(&opts.Segments, "segments", 4, "parallel scan segments")
+	flags.Float64Var(&opts.CapacityPerSecond, "capacity", 100, "read and write capacity units a second, 0 is unlimited")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	store, err := openDynamoStore(ctx, cfg)
+	if err != nil {
+		return err
+	}
+
+	var states []storage.MigrationState
+	if args[0] == "status" {
+		states, err = store.MigrationStatus(ctx)
+	} else {
+		states, err = store.RunMigrations(ctx, opts)
+	}
+	for _, state := range states {
+		fmt.Printf("%s\t%s\tscanned %d\tchanged %d\t%s\n",
+			state.Id, state.Status, state.Scanned, state.Changed, state.Description)
+	}
+	return err
+}
+
+// migrate applies Postgres migrations.
+func migrate(ctx context.Context, cfg Config) error {
+	if cfg.PostgresDSN == "" {
+		return errors.New("MED_POSTGRES_DSN is not set")
+	}
+	store, err := postgres.Open(ctx, cfg.PostgresDSN)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	version, err := store.Migrate(ctx)
+	if err != nil {
+		return err
+	}
+	logx.Logger(ctx).Info("postgres schema is up to date", slog.Int("version", version))
+	return nil
+}
@@ -3,13 +3,17 @@ package main
 import (
 	"log/slog"
 	"testing"
+	"time"
 )
 
 func TestConfig(t *testing.T) {
 	t.Setenv("MED_LISTEN", ":42")
+	t.Setenv("MED_ADMIN_LISTEN", ":43")
 	t.Setenv("MED_LOG_LEVEL", "warn")
 	t.Setenv("MED_DYNAMO_ENDPOINT", "http://localhost:8000")
 	t.Setenv("MED_MEDICATION_TABLE", "my_table")
+	t.Setenv("MED_FORM_CATALOGUE", "/etc/forms.json")
+	t.Setenv("MED_FORM_CATALOGUE_RELOAD", "30s")
 
 	c, err := NewConfig()
 	if err != nil {
@@ -19,6 +23,9 @@ func TestConfig(t *testing.T) {
 	if c.Listen != ":42" {
 		t.Fatalf("invalid listen: %s", c.Listen)
 	}
+	if c.AdminListen != ":43" {
+		t.Fatalf("invalid admin_listen: %s", c.AdminListen)
+	}
 	if c.LogLevel != slog.LevelWarn {
 		t.Fatalf("invalid log level: %s", c.LogLevel)
 	}
@@ -28,4 +35,10 @@ func TestConfig(t *testing.T) {
 	if c.MedicationTable != "my_table" {
 		t.Fatalf("invalid medication_table: %s", c.MedicationTable)
 	}
+	if c.FormCatalogue != "/etc/forms.json" {
+		t.Fatalf("invalid form_catalogue: %s", c.FormCatalogue)
+	}
+	if c.FormCatalogueReload != 30*time.Second {
+		t.Fatalf("invalid form_catalogue_reload: %s", c.FormCatalogueReload)
+	}
 }
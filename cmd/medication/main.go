@@ -3,8 +3,10 @@ package main
 import (
 	"context"
 	"errors"
+	"fmt"
 	"log/slog"
 	"net/http"
+	"net/http/pprof"
 	"os"
 	"syscall"
 	"time"
@@ -13,74 +15,368 @@ import (
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/aws/aws-sdk-go-v2/otelaws"
 	"golang.org/x/sync/errgroup"
 
+	"github.com/chestnut42/test-medication/internal/apikey"
+	"github.com/chestnut42/test-medication/internal/audit"
+	"github.com/chestnut42/test-medication/internal/encryption"
+	"github.com/chestnut42/test-medication/internal/health"
 	"github.com/chestnut42/test-medication/internal/medication"
+	"github.com/chestnut42/test-medication/internal/model"
+	"github.com/chestnut42/test-medication/internal/ratelimit"
 	"github.com/chestnut42/test-medication/internal/storage"
+	"github.com/chestnut42/test-medication/internal/storage/bolt"
+	"github.com/chestnut42/test-medication/internal/storage/cache"
+	"github.com/chestnut42/test-medication/internal/storage/memory"
+	"github.com/chestnut42/test-medication/internal/storage/postgres"
+	"github.com/chestnut42/test-medication/internal/tenant"
+	"github.com/chestnut42/test-medication/internal/transfer"
+	httpadmin "github.com/chestnut42/test-medication/internal/transport/http/admin"
+	httpaudit "github.com/chestnut42/test-medication/internal/transport/http/audit"
+	httpfhir "github.com/chestnut42/test-medication/internal/transport/http/fhir"
 	httpmedication "github.com/chestnut42/test-medication/internal/transport/http/medication"
+	"github.com/chestnut42/test-medication/internal/transport/http/principal"
+	httpratelimit "github.com/chestnut42/test-medication/internal/transport/http/ratelimit"
 	"github.com/chestnut42/test-medication/internal/utils/httpx"
 	"github.com/chestnut42/test-medication/internal/utils/logx"
 	"github.com/chestnut42/test-medication/internal/utils/metrics"
 	"github.com/chestnut42/test-medication/internal/utils/signalx"
+	"github.com/chestnut42/test-medication/internal/utils/tracing"
 )
 
-const dynamoPingTimeout = 10 * time.Second
+const (
+	tracingShutdownTimeout = 5 * time.Second
+	auditStopTimeout       = 10 * time.Second
+)
+
+// Rate limit costs of routes in tokens. Roughly proportional to DynamoDB capacity a request consumes.
+const (
+	costGet    = 1
+	costWrite  = 2
+	costList   = 5
+	costImport = 20
+)
 
 func main() {
 	ctx := context.Background()
 	cfg := MustNewConfig()
 
 	// logger setup
-	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: cfg.LogLevel}))
+	logLevel := &slog.LevelVar{} // Can be changed via admin API
+	logLevel.Set(cfg.LogLevel)
+	logger := slog.New(logx.NewHandler(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: logLevel})))
 	ctx = logx.WithLogger(ctx, logger)
 
+	if len(os.Args) > 1 {
+		if err := runCommand(ctx, cfg, os.Args[1:]); err != nil {
+			logger.Error("command failed", slog.String("command", os.Args[1]), slog.Any("error", err))
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Tracing must be set up before anything captures the global provider
+	shutdownTracing, err := tracing.Setup(ctx, tracing.Config{
+		ServiceName:  "medication",
+		Exporter:     cfg.TraceExporter,
+		OTLPEndpoint: cfg.TraceEndpoint,
+		SampleRatio:  cfg.TraceSampleRatio,
+	})
+	if err != nil {
+		logger.Error("setting up tracing", slog.Any("error", err))
+		panic(err)
+	}
+	flushTraces := func() {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), tracingShutdownTimeout)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			logger.Error("flushing traces", slog.Any("error", err))
+		}
+	}
+
 	// Dependencies
 	awsCfg, err := config.LoadDefaultConfig(ctx)
 	if err != nil {
 		logger.Error("loading aws config", slog.Any("error", err))
 		panic(err)
 	}
+	otelaws.AppendMiddlewares(&awsCfg.APIOptions)
 
-	dyn := runDynamo(cfg.DynamoEndpoint, awsCfg)
-	if err := pingTable(ctx, dyn, cfg.MedicationTable, dynamoPingTimeout); err != nil {
-		logx.Logger(ctx).Error("ping table error",
-			slog.String("table", cfg.MedicationTable),
-			slog.Any("error", ctx.Err()))
-		panic(err)
+	if cfg.FormCatalogue != "" {
+		// Checked against the embedded one, so that a restart doesn't accept a file that a reload would reject
+		if err := reloadCatalogueOnce(ctx, cfg.FormCatalogue); err != nil {
+			logger.Error("loading form catalogue", slog.Any("error", err))
+			panic(err)
+		}
 	}
+	logger.Info("form catalogue", slog.String("version", model.CurrentCatalogue().Version))
 
 	// Services
-	store := storage.NewService(storage.Config{
-		MedicationTable: cfg.MedicationTable,
-	}, dyn)
-	medSvc := medication.NewService(store)
+	var (
+		store     storage.Storage
+		keyring   *encryption.Keyring
+		rewrapper *encryption.Rewrapper
+		breaker   *storage.Breaker
+	)
+	switch cfg.StorageBackend {
+	case "dynamodb":
+		breaker = storage.NewBreaker(cfg.ResilienceConfig())
+		dyn := runDynamo(cfg, awsCfg, breaker)
+		if err := checkSchema(ctx, cfg, dyn); err != nil {
+			logger.Error("applying dynamodb schema", slog.Any("error", err))
+			panic(err)
+		}
+		dynamoStore := storage.NewService(cfg.StorageConfig(), dyn)
+		if cfg.HistoryTable == "" {
+			logger.Info("medication history is disabled, MED_HISTORY_TABLE is not set")
+		}
+		if cfg.OutboxTable == "" {
+			logger.Info("delta sync is disabled, MED_OUTBOX_TABLE is not set")
+		}
+		if cfg.EncryptionKeyFile != "" {
+			provider, err := encryption.NewFileProvider(cfg.EncryptionKeyFile)
+			if err != nil {
+				logger.Error("loading encryption keys", slog.Any("error", err))
+				panic(err)
+			}
+			// Data keys are stored unencrypted by the cipher, they are wrapped by the provider
+			keyring = encryption.NewKeyring(encryption.Config{
+				CacheTTL: cfg.DataKeyCacheTTL,
+			}, provider, dynamoStore)
+			dynamoStore = dynamoStore.WithCipher(keyring)
+			rewrapper = encryption.NewRewrapper(keyring, dynamoStore)
+			logger.Info("field encryption enabled", slog.String("master_key", provider.CurrentKeyId()))
+		}
+		store = dynamoStore
+	case "postgres":
+		pgStore, err := postgres.Open(ctx, cfg.PostgresDSN)
+		if err != nil {
+			logger.Error("connecting to postgres", slog.Any("error", err))
+			panic(err)
+		}
+		defer pgStore.Close()
+		if cfg.PostgresMigrate {
+			version, err := pgStore.Migrate(ctx)
+			if err != nil {
+				logger.Error("migrating postgres", slog.Any("error", err))
+				panic(err)
+			}
+			logger.Info("postgres schema is up to date", slog.Int("version", version))
+		}
+		store = pgStore
+	case "bolt":
+		boltStore, err := bolt.Open(cfg.BoltFile)
+		if err != nil {
+			logger.Error("opening bolt file", slog.Any("error", err))
+			panic(err)
+		}
+		defer boltStore.Close()
+		store = boltStore
+	case "memory":
+		store = memory.New()
+	default:
+		panic(fmt.Sprintf("unknown storage backend: %s", cfg.StorageBackend))
+	}
+	if cfg.EncryptionKeyFile != "" && keyring == nil {
+		panic(fmt.Sprintf("encryption is not supported by %s storage backend", cfg.StorageBackend))
+	}
+	logger.Info("storage backend", slog.String("backend", cfg.StorageBackend))
+
+	// Medications go through the cache, so that wiping a tenant drops cached ones as well
+	var medStore storage.Storage = store
+	if cfg.MedicationCacheSize > 0 {
+		medStore = cache.New(cache.Config{
+			Size:        cfg.MedicationCacheSize,
+			TTL:         cfg.MedicationCacheTTL,
+			NegativeTTL: cfg.MedicationCacheNegativeTTL,
+		}, store, nil)
+	}
+	tenantSvc := tenant.NewService(tenant.Config{
+		CacheTTL: cfg.TenantCacheTTL,
+	}, medStore)
+	medSvc := medication.NewService(medStore, tenantSvc)
+	transferSvc := transfer.NewService(medStore)
+	keySvc := apikey.NewService(apikey.Config{
+		CacheTTL: cfg.APIKeyCacheTTL,
+	}, store)
+	healthSvc := health.NewService(health.Config{
+		CacheTTL: cfg.ReadinessCacheTTL,
+		Timeout:  cfg.ReadinessTimeout,
+	})
+	healthSvc.AddCheck(cfg.StorageBackend, store.Ping)
+	if breaker != nil {
+		healthSvc.AddCheck("dynamodb_breaker", breaker.Check)
+	}
+
+	// The storage not being available is reported by readiness rather than crashing, so that a restart loop doesn't
+	// make an outage of DynamoDB worse.
+	if report := healthSvc.Ready(ctx); !report.Ready {
+		logger.Warn("dependencies are not ready on startup")
+	}
+
+	auditSink, closeAudit, err := openAuditSink(cfg, store)
+	if err != nil {
+		logger.Error("opening audit sink", slog.Any("error", err))
+		panic(err)
+	}
+	defer closeAudit()
+	auditSvc := audit.NewService(audit.Config{
+		BufferSize:    cfg.AuditBufferSize,
+		BatchSize:     25, // DynamoDB batch write limit
+		FlushInterval: cfg.AuditFlushInterval,
+		MaxAttempts:   5,
+		RetryBackoff:  100 * time.Millisecond,
+		StopTimeout:   auditStopTimeout,
+	}, auditSink)
+	aud := httpaudit.NewAuditor(auditSvc)
+
+	var limiter ratelimit.Limiter
+	switch cfg.RateLimitBackend {
+	case "memory":
+		limiter = ratelimit.NewMemory()
+	case "dynamodb":
+		limiter = ratelimit.NewShared(store)
+	default:
+		panic(fmt.Sprintf("unknown rate limit backend: %s", cfg.RateLimitBackend))
+	}
+	rl := httpratelimit.NewLimiter(limiter, tenantSvc, model.RateLimit{
+		RequestsPerSecond: cfg.RateLimitRPS,
+		Burst:             cfg.RateLimitBurst,
+	})
+
+	shedder, err := httpx.NewShedder(httpx.ShedConfig{
+		SoftHeapBytes:  cfg.ShedSoftHeapBytes,
+		HardHeapBytes:  cfg.ShedHardHeapBytes,
+		SoftInFlight:   cfg.ShedSoftInFlight,
+		HardInFlight:   cfg.ShedHardInFlight,
+		SampleInterval: cfg.ShedSampleInterval,
+		RetryAfter:     cfg.ShedRetryAfter,
+	})
+	if err != nil {
+		logger.Error("creating load shedder", slog.Any("error", err))
+		panic(err)
+	}
+
+	// Audit outlives the servers, so that calls served during graceful shutdown are written too
+	auditCtx, stopAudit := context.WithCancel(ctx)
+	auditDone := make(chan struct{})
+	go func() {
+		defer close(auditDone)
+		auditSvc.Run(auditCtx)
+	}()
 
 	eg, ctx := errgroup.WithContext(ctx)
 	eg.Go(func() error {
-		// Running HTTP server
+		shedder.Run(ctx)
+		return nil
+	})
+	if rewrapper != nil && cfg.EncryptionRewrapInterval > 0 {
+		eg.Go(func() error {
+			rewrapper.Run(ctx, cfg.EncryptionRewrapInterval)
+			return nil
+		})
+	}
+	eg.Go(func() error {
+		// Running public HTTP server
 		router := http.NewServeMux()
 
-		// Application
-		router.Handle("PUT /v1/medication/{id}", httpmedication.CreateMedication(medSvc))
-		router.Handle("PATCH /v1/medication/{id}", httpmedication.UpdateMedication(medSvc))
-		router.Handle("DELETE /v1/medication/{id}", httpmedication.DeleteMedication(medSvc))
-		router.Handle("GET /v1/medication/{id}", httpmedication.GetMedication(medSvc))
+		// Application. Every call that touches patient data is audited, including rejected ones
+		router.Handle("PUT /v1/medication/{id}", aud.Audit("medication.create", rl.Limit(costWrite, httpmedication.CreateMedication(medSvc))))
+		router.Handle("PATCH /v1/medication/{id}", aud.Audit("medication.update", rl.Limit(costWrite, httpmedication.UpdateMedication(medSvc))))
+		router.Handle("DELETE /v1/medication/{id}", aud.Audit("medication.delete", rl.Limit(costWrite, httpmedication.DeleteMedication(medSvc))))
+		router.Handle("GET /v1/medication/{id}", aud.Audit("medication.get", rl.Limit(costGet, httpmedication.GetMedication(medSvc))))
+		router.Handle("GET /v1/medication", aud.Audit("medication.list", rl.Limit(costList, httpmedication.ListMedications(medSvc))))
+		router.Handle("GET /v1/medication:changes", aud.Audit("medication.changes", rl.Limit(costList, changesHandler(cfg, medSvc))))
+		router.Handle("GET /v1/forms", httpmedication.ListForms()) // No storage calls
 
-		// System
-		router.Handle("GET /health", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }))
-		router.Handle("GET /metrics", metrics.NewHandler())
+		// FHIR R4
+		router.Handle("GET /fhir/MedicationStatement/{id}", aud.Audit("fhir.get", rl.Limit(costGet, httpfhir.GetMedicationStatement(medSvc))))
+		router.Handle("GET /fhir/MedicationStatement", aud.Audit("fhir.search", rl.Limit(costList, httpfhir.SearchMedicationStatement(medSvc))))
+		router.Handle("POST /fhir", aud.Audit("fhir.import", rl.Limit(costImport, httpfhir.ImportBundle(medSvc))))
 
 		logger.Info("running http server", slog.String("addr", cfg.Listen))
-		h := httpx.WithLogging(router)
+		h := principal.WithAuthentication(router, keySvc, func(err error) bool {
+			return errors.Is(err, apikey.ErrUnauthenticated)
+		}, cfg.RequireAPIKey)
+		// Shedding goes before authentication, which may call DynamoDB
+		h = httpx.WithDeadline(h, cfg.RequestTimeout)
+		h = httpx.WithShedding(h, shedder)
+		h = httpx.WithLogging(h)
+		h = httpx.WithRequestId(h)
 		h = httpx.WithTelemetry(h)
 		return httpx.ServeContext(ctx, h, cfg.Listen)
 	})
+	eg.Go(func() error {
+		// Running internal HTTP server. It's not authenticated, so it must only be reachable from inside the cluster.
+		router := http.NewServeMux()
+
+		// Tenants
+		router.Handle("GET /admin/tenants/{tenant}", httpadmin.GetTenant(tenantSvc))
+		router.Handle("PUT /admin/tenants/{tenant}", httpadmin.PutTenant(tenantSvc, tenantSvc))
+		router.Handle("GET /admin/tenants/{tenant}/export", httpadmin.ExportTenant(tenantSvc))
+		router.Handle("DELETE /admin/tenants/{tenant}/medications", httpadmin.WipeTenant(tenantSvc))
+		router.Handle("POST /admin/tenants/{tenant}/owners/{owner}/transfer", httpadmin.TransferOwner(transferSvc))
+
+		// API keys
+		router.Handle("POST /admin/tenants/{tenant}/apikeys", httpadmin.CreateAPIKey(keySvc))
+		router.Handle("GET /admin/tenants/{tenant}/apikeys", httpadmin.ListAPIKeys(keySvc))
+		router.Handle("DELETE /admin/tenants/{tenant}/apikeys/{id}", httpadmin.RevokeAPIKey(keySvc))
+
+		// Data keys
+		if keyring != nil {
+			router.Handle("GET /admin/tenants/{tenant}/datakeys", httpadmin.ListDataKeys(keyring))
+			router.Handle("POST /admin/tenants/{tenant}/datakeys", httpadmin.RotateDataKey(keyring))
+		}
+
+		// Audit
+		router.Handle("GET /admin/tenants/{tenant}/audit", httpadmin.QueryAudit(auditSvc))
+
+		// Runtime
+		router.Handle("GET /admin/config", httpadmin.Config(cfg))
+		router.Handle("GET /admin/loglevel", httpadmin.GetLogLevel(logLevel))
+		router.Handle("PUT /admin/loglevel", httpadmin.PutLogLevel(logLevel))
+		router.HandleFunc("/debug/pprof/", pprof.Index)
+		router.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		router.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		router.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		router.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+		// System
+		router.Handle("GET /health", health.Livez()) // Kept for the existing probes, same as /livez
+		router.Handle("GET /livez", health.Livez())
+		router.Handle("GET /readyz", health.Readyz(healthSvc))
+		router.Handle("GET /metrics", metrics.NewHandler())
+
+		logger.Info("running admin http server", slog.String("addr", cfg.AdminListen))
+		return httpx.ServeContext(ctx, httpx.WithRequestId(httpx.WithLogging(router)), cfg.AdminListen)
+	})
+	if cfg.FormCatalogue != "" && cfg.FormCatalogueReload > 0 {
+		eg.Go(func() error {
+			reloadCatalogue(ctx, cfg.FormCatalogue, cfg.FormCatalogueReload)
+			return nil
+		})
+	}
 	eg.Go(func() error {
 		logger.Info("listening to os signals")
-		return signalx.ListenContext(ctx, syscall.SIGTERM, syscall.SIGINT)
+		err := signalx.ListenContext(ctx, syscall.SIGTERM, syscall.SIGINT)
+		if errors.Is(err, signalx.ErrSignal) {
+			// Load balancers need a few probes to notice we're not ready. Servers keep serving meanwhile.
+			logger.Info("draining", slog.String("signal", err.Error()), slog.Duration("for", cfg.ShutdownDrain))
+			healthSvc.Drain()
+			select {
+			case <-ctx.Done():
+			case <-time.After(cfg.ShutdownDrain):
+			}
+		}
+		return err
 	})
 
-	if err := eg.Wait(); err != nil {
+	err = eg.Wait()
+	stopAudit()
+	<-auditDone
+	flushTraces()
+	if err != nil {
 		if errors.Is(err, signalx.ErrSignal) {
 			logger.Info("signal received", slog.String("signal", err.Error()))
 		} else {
@@ -90,37 +386,109 @@ func main() {
 	}
 }
 
-func runDynamo(endpoint string, cfg aws.Config) *dynamodb.Client {
-	if endpoint == "" {
-		return dynamodb.NewFromConfig(cfg)
-	}
-
-	return dynamodb.NewFromConfig(cfg, func(o *dynamodb.Options) {
-		o.BaseEndpoint = aws.String(endpoint)
-		o.Credentials = credentials.NewStaticCredentialsProvider("dummy", "dummy", "")
+// runDynamo creates the client. Breaker may be nil, e.g. for commands.
+func runDynamo(cfg Config, awsCfg aws.Config, breaker *storage.Breaker) *dynamodb.Client {
+	return dynamodb.NewFromConfig(awsCfg, storage.WithResilience(cfg.ResilienceConfig(), breaker), func(o *dynamodb.Options) {
+		o.APIOptions = append(o.APIOptions, storage.InstrumentMetrics())
+		if cfg.DynamoEndpoint != "" {
+			o.BaseEndpoint = aws.String(cfg.DynamoEndpoint)
+			o.Credentials = credentials.NewStaticCredentialsProvider("dummy", "dummy", "")
+		}
 	})
 }
 
-func pingTable(ctx context.Context, dyn *dynamodb.Client, table string, timeout time.Duration) error {
-	ctx, cancel := context.WithTimeout(ctx, timeout)
-	defer cancel()
-
-	for {
-		_, err := dyn.DescribeTable(ctx, &dynamodb.DescribeTableInput{
-			TableName: aws.String(table),
+// changesHandler serves delta sync. Only DynamoDB needs a separate table for the change log, without it the endpoint
+// is 501 rather than failing every call.
+func changesHandler(cfg Config, svc *medication.Service) http.Handler {
+	if cfg.StorageBackend == "dynamodb" && cfg.OutboxTable == "" {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			httpx.Error(w, r, "delta sync is not enabled", http.StatusNotImplemented)
 		})
-		if err == nil {
-			return nil
+	}
+	return httpmedication.Changes(svc)
+}
+
+// openAuditSink returns the sink of MED_AUDIT_SINK and a function that closes it.
+func openAuditSink(cfg Config, store audit.Storage) (audit.Sink, func(), error) {
+	switch cfg.AuditSink {
+	case "dynamodb":
+		return audit.NewDynamoSink(store, cfg.AuditRetention), func() {}, nil
+	case "file":
+		fileSink, err := audit.NewFileSink(cfg.AuditFile)
+		if err != nil {
+			return nil, nil, err
 		}
+		return fileSink, func() { _ = fileSink.Close() }, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown audit sink: %s", cfg.AuditSink)
+	}
+}
+
+// checkSchema verifies or applies the schema depending on MED_SCHEMA_ON_STARTUP. Drift is logged and doesn't stop
+// the service, as most of it (e.g. PITR) doesn't affect serving.
+func checkSchema(ctx context.Context, cfg Config, dyn *dynamodb.Client) error {
+	s := storage.NewSchema(dyn, storage.Tables(cfg.StorageConfig(), cfg.SchemaPITR))
+	var drift []storage.Drift
+	var err error
+	switch cfg.SchemaOnStartup {
+	case "none":
+		return nil
+	case "verify":
+		drift, err = s.Diff(ctx)
+	case "apply":
+		drift, err = s.Apply(ctx)
+	default:
+		return fmt.Errorf("unknown schema on startup mode: %s", cfg.SchemaOnStartup)
+	}
+	if err != nil {
+		return err
+	}
+	for _, d := range drift {
+		logx.Logger(ctx).Warn("dynamodb schema drift",
+			slog.String("table", d.Table),
+			slog.String("field", d.Field),
+			slog.String("expected", d.Expected),
+			slog.String("actual", d.Actual),
+			slog.Bool("fixable", d.Fixable()))
+	}
+	return nil
+}
 
-		logx.Logger(ctx).Error("describe table error",
-			slog.String("table", table),
-			slog.Any("error", err))
+// reloadCatalogue re-reads the form catalogue, so that forms can be added by changing the file (e.g. k8s config map).
+// Broken catalogue is logged and ignored, the previous one stays in use.
+func reloadCatalogue(ctx context.Context, path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 
+	for {
 		select {
 		case <-ctx.Done():
-			return ctx.Err()
-		case <-time.After(time.Second):
+			return
+		case <-ticker.C:
+		}
+
+		if err := reloadCatalogueOnce(ctx, path); err != nil {
+			logx.Logger(ctx).Error("reloading form catalogue", slog.Any("error", err))
 		}
 	}
 }
+
+// reloadCatalogueOnce replaces the current catalogue with the file unless it's broken or drops a form. It also loads
+// the file at startup, when the current catalogue is the embedded one.
+func reloadCatalogueOnce(ctx context.Context, path string) error {
+	catalogue, err := model.LoadCatalogue(path)
+	if err != nil {
+		return err
+	}
+	prev := model.CurrentCatalogue()
+	if err := catalogue.CheckKeeps(prev); err != nil {
+		return err
+	}
+	if prev.Version != catalogue.Version {
+		logx.Logger(ctx).Info("form catalogue updated",
+			slog.String("from", prev.Version),
+			slog.String("to", catalogue.Version))
+	}
+	model.SetCatalogue(catalogue)
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/chestnut42/test-medication/internal/model"
+)
+
+func TestReloadCatalogueOnce(t *testing.T) {
+	prev := model.CurrentCatalogue()
+	defer model.SetCatalogue(prev)
+
+	initial, err := model.ParseCatalogue([]byte(`{"version":"1","forms":[
+		{"code":"spray","display":{"en":"Spray"},"units":["puff"]},
+		{"code":"tablet","display":{"en":"Tablet"},"units":["mg"]}]}`))
+	if err != nil {
+		t.Fatalf("ParseCatalogue() error = %v", err)
+	}
+
+	tests := []struct {
+		name        string
+		data        string
+		wantErr     bool
+		wantVersion string
+	}{
+		{
+			name:        "form added",
+			data:        `{"version":"2","forms":[{"code":"spray","display":{"en":"Spray"},"units":["puff"]},{"code":"tablet","display":{"en":"Tablet"},"units":["mg"]},{"code":"gum","display":{"en":"Gum"},"units":["mg"]}]}`,
+			wantVersion: "2",
+		},
+		{
+			name:        "form dropped",
+			data:        `{"version":"2","forms":[{"code":"tablet","display":{"en":"Tablet"},"units":["mg"]}]}`,
+			wantErr:     true,
+			wantVersion: "1",
+		},
+		{
+			name:        "broken",
+			data:        `{"version":"2","forms":`,
+			wantErr:     true,
+			wantVersion: "1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			model.SetCatalogue(initial)
+			path := filepath.Join(t.TempDir(), "forms.json")
+			if err := os.WriteFile(path, []byte(tt.data), 0o600); err != nil {
+				t.Fatalf("failed to write catalogue: %v", err)
+			}
+
+			err := reloadCatalogueOnce(t.Context(), path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error: %v, expected error: %v", err, tt.wantErr)
+			}
+			if got := model.CurrentCatalogue().Version; got != tt.wantVersion {
+				t.Fatalf("got catalogue version: %s, expected: %s", got, tt.wantVersion)
+			}
+		})
+	}
+}
+
+func TestReloadCatalogueOnceStartup(t *testing.T) {
+	embedded := model.CurrentCatalogue()
+	defer model.SetCatalogue(embedded)
+
+	path := filepath.Join(t.TempDir(), "forms.json")
+	data := `{"version":"custom","forms":[{"code":"tablet","display":{"en":"Tablet"},"units":["mg"]}]}`
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatalf("failed to write catalogue: %v", err)
+	}
+
+	if err := reloadCatalogueOnce(t.Context(), path); err == nil {
+		t.Fatal("a file that drops embedded forms is accepted")
+	}
+	if got := model.CurrentCatalogue(); got != embedded {
+		t.Fatalf("got catalogue version: %s, expected the embedded one", got.Version)
+	}
+}
+
+func TestChangesHandlerDisabled(t *testing.T) {
+	h := changesHandler(Config{StorageBackend: "dynamodb"}, nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/medication:changes", nil))
+	if rec.Code != http.StatusNotImplemented {
+		t.Fatalf("got code: %d, expected: %d", rec.Code, http.StatusNotImplemented)
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/chestnut42/test-medication/internal/medication"
+	"github.com/chestnut42/test-medication/internal/model"
+	"github.com/chestnut42/test-medication/internal/storage"
+	"github.com/chestnut42/test-medication/internal/tenant"
+)
+
+type restoreHistory interface {
+	MedicationAt(ctx context.Context, identity model.Identity, at time.Time) (storage.HistoryEntry, error)
+}
+
+type restoreService interface {
+	GetMedication(ctx context.Context, identity model.Identity) (model.Medication, error)
+	RestoreMedication(ctx context.Context, identity model.Identity, version string, data model.MedicationData) (model.Medication, error)
+}
+
+type auditWriter interface {
+	Write(ctx context.Context, records []model.AuditRecord) error
+}
+
+type restoreOptions struct {
+	identity model.Identity
+	at       time.Time
+	dryRun   bool
+	operator string // Who runs the restore, for the audit record
+}
+
+// restore brings a single medication back to its state at the given time, e.g. after a client has overwritten it
+// by mistake. The state comes from the history table, it's written as a new version with the current version as
+// the condition, so a concurrent change fails the restore rather than being lost. Deleted medications can't be
+// restored this way. Replicas with the medication cache see the restored version once their entries expire.
+// History is only kept by the DynamoDB backend.
+func restore(ctx context.Context, cfg Config, args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	var opts restoreOptions
+	var at string
+	flags.StringVar(&opts.identity.Tenant, "tenant", model.DefaultTenant, "tenant of the medication")
+	flags.StringVar(&opts.identity.Owner, "owner", "", "owner of the medication")
+	flags.StringVar(&opts.identity.Id, "id", "", "id of the medication")
+	flags.StringVar(&at, "at", "", "RFC 3339 time to restore the state at, e.g. 2026-01-02T15:04:05Z")
+	flags.BoolVar(&opts.dryRun, "dry-run", false, "print the difference without writing anything")
+	flags.StringVar(&opts.operator, "operator", cfg.Operator, "who runs the restore, recorded in the audit (MED_OPERATOR)")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if opts.identity.Owner == "" || opts.identity.Id == "" || at == "" || opts.operator == "" {
+		return errors.New("usage: restore -owner <owner> -id <id> -at <time> -operator <name> [-tenant <tenant>] [-dry-run]")
+	}
+	if cfg.StorageBackend != "dynamodb" {
+		return fmt.Errorf("restore is only supported by the dynamodb storage backend, got %s", cfg.StorageBackend)
+	}
+	var err error
+	if opts.at, err = time.Parse(time.RFC3339Nano, at); err != nil {
+		return fmt.Errorf("parsing -at: %w", err)
+	}
+	if cfg.HistoryTable == "" {
+		return errors.New("MED_HISTORY_TABLE is not set")
+	}
+
+	store, err := openDynamoStore(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	sink, closeAudit, err := openAuditSink(cfg, store)
+	if err != nil {
+		return err
+	}
+	defer closeAudit()
+	tenantSvc := tenant.NewService(tenant.Config{CacheTTL: cfg.TenantCacheTTL}, store)
+	medSvc := medication.NewService(store, tenantSvc)
+
+	return restoreMedication(ctx, opts, store, medSvc, sink, os.Stdout)
+}
+
+func restoreMedication(ctx context.Context, opts restoreOptions, history restoreHistory, svc restoreService,
+	sink auditWriter, out io.Writer) error {
+
+	past, err := history.MedicationAt(ctx, opts.identity, opts.at)
+	if err != nil {
+		return fmt.Errorf("reading history: %w", err)
+	}
+	if past.Deleted {
+		return fmt.Errorf("medication %v was deleted at %s", opts.identity, past.Time.Format(time.RFC3339))
+	}
+	current, err := svc.GetMedication(storage.WithConsistentRead(ctx), opts.identity)
+	if err != nil {
+		return fmt.Errorf("reading current state: %w", err)
+	}
+
+	changes := current.MedicationData.Diff(past.Medication.MedicationData)
+	_, _ = fmt.Fprintf(out, "medication %s/%s/%s: version %s, restoring version %s written at %s\n",
+		opts.identity.Tenant, opts.identity.Owner, opts.identity.Id,
+		current.Version, past.Medication.Version, past.Time.Format(time.RFC3339Nano))
+	for _, c := range changes {
+		_, _ = fmt.Fprintf(out, "  %s: %q -> %q\n", c.Field, c.From, c.To)
+	}
+	if len(changes) == 0 {
+		_, _ = fmt.Fprintln(out, "nothing to restore, the current state is the same")
+		return nil
+	}
+	if opts.dryRun {
+		return nil
+	}
+
+	restored, err := svc.RestoreMedication(ctx, opts.identity, current.Version, past.Medication.MedicationData)
+	record := model.AuditRecord{
+		Time:         time.Now(),
+		RequestId:    uuid.NewString(),
+		Tenant:       opts.identity.Tenant,
+		Owner:        opts.identity.Owner,
+		Operator:     opts.operator,
+		MedicationId: opts.identity.Id,
+		Action:       "medication.restore",
+		Status:       restoreStatus(err),
+	}
+	if auditErr := sink.Write(ctx, []model.AuditRecord{record}); auditErr != nil {
+		err = errors.Join(err, fmt.Errorf("writing audit record %s: %w", record.RequestId, auditErr))
+	}
+	if err != nil {
+		return err
+	}
+	_, _ = fmt.Fprintf(out, "restored as version %s\n", restored.Version)
+	return nil
+}
+
+// restoreStatus is the status code the same failure gets from the API, audit records are keyed by it.
+func restoreStatus(err error) int {
+	switch {
+	case err == nil:
+		return http.StatusOK
+	case errors.Is(err, medication.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, medication.ErrVersionConflict):
+		return http.StatusConflict
+	case errors.Is(err, medication.ErrBadInput):
+		return http.StatusBadRequest
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chestnut42/test-medication/internal/medication"
+	"github.com/chestnut42/test-medication/internal/model"
+	"github.com/chestnut42/test-medication/internal/storage"
+)
+
+type fakeRestore struct {
+	past       storage.HistoryEntry
+	current    model.Medication
+	restoreErr error
+
+	restored []model.MedicationData
+	audit    []model.AuditRecord
+}
+
+func (f *fakeRestore) MedicationAt(_ context.Context, identity model.Identity, _ time.Time) (storage.HistoryEntry, error) {
+	if f.past.Medication.Identity != identity {
+		return storage.HistoryEntry{}, storage.ErrNotFound
+	}
+	return f.past, nil
+}
+
+func (f *fakeRestore) GetMedication(ctx context.Context, _ model.Identity) (model.Medication, error) {
+	if !storage.IsConsistentRead(ctx) {
+		return model.Medication{}, errors.New("current state must be read consistently")
+	}
+	return f.current, nil
+}
+
+func (f *fakeRestore) RestoreMedication(_ context.Context, identity model.Identity, version string, data model.MedicationData) (model.Medication, error) {
+	if f.restoreErr != nil {
+		return model.Medication{}, f.restoreErr
+	}
+	if version != f.current.Version {
+		return model.Medication{}, medication.ErrVersionConflict
+	}
+	f.restored = append(f.restored, data)
+	return model.Medication{Identity: identity, MedicationData: data, Version: "v3"}, nil
+}
+
+func (f *fakeRestore) Write(_ context.Context, records []model.AuditRecord) error {
+	f.audit = append(f.audit, records...)
+	return nil
+}
+
+func TestRestoreMedication(t *testing.T) {
+	identity := model.Identity{Id: "id", Owner: "owner", Tenant: "acme"}
+	past := model.Medication{
+		Identity:       identity,
+		MedicationData: model.MedicationData{Name: "Paracetamol", Dosage: "500mg", Form: model.FormTablet},
+		Version:        "v1",
+	}
+	current := past
+	current.Name = "Ibuprofen"
+	current.Version = "v2"
+
+	tests := []struct {
+		name       string
+		opts       restoreOptions
+		past       storage.HistoryEntry
+		current    model.Medication
+		restoreErr error
+		wantErr    bool
+		wantOutput []string
+		wantStatus int // Of the audit record, zero means no record
+	}{
+		{
+			name:       "restored",
+			opts:       restoreOptions{identity: identity, operator: "jane"},
+			past:       storage.HistoryEntry{Medication: past},
+			current:    current,
+			wantOutput: []string{`Name: "Ibuprofen" -> "Paracetamol"`, "restored as version v3"},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "dry run",
+			opts:       restoreOptions{identity: identity, dryRun: true},
+			past:       storage.HistoryEntry{Medication: past},
+			current:    current,
+			wantOutput: []string{`Name: "Ibuprofen" -> "Paracetamol"`},
+		},
+		{
+			name:       "same state",
+			opts:       restoreOptions{identity: identity},
+			past:       storage.HistoryEntry{Medication: current},
+			current:    current,
+			wantOutput: []string{"nothing to restore"},
+		},
+		{
+			name:    "no history",
+			opts:    restoreOptions{identity: model.Identity{Id: "other", Owner: "owner", Tenant: "acme"}},
+			past:    storage.HistoryEntry{Medication: past},
+			current: current,
+			wantErr: true,
+		},
+		{
+			name:    "deleted at the time",
+			opts:    restoreOptions{identity: identity},
+			past:    storage.HistoryEntry{Medication: past, Deleted: true},
+			current: current,
+			wantErr: true,
+		},
+		{
+			name:       "changed concurrently",
+			opts:       restoreOptions{identity: identity, operator: "jane"},
+			past:       storage.HistoryEntry{Medication: past},
+			current:    current,
+			restoreErr: fmt.Errorf("medication: %w", medication.ErrVersionConflict),
+			wantErr:    true,
+			wantStatus: http.StatusConflict,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeRestore{past: tt.past, current: tt.current, restoreErr: tt.restoreErr}
+			out := &bytes.Buffer{}
+			err := restoreMedication(t.Context(), tt.opts, f, f, f, out)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("restoreMedication() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			for _, line := range tt.wantOutput {
+				if !strings.Contains(out.String(), line) {
+					t.Errorf("output %q doesn't contain %q", out.String(), line)
+				}
+			}
+			if tt.wantStatus == 0 {
+				if len(f.audit) != 0 {
+					t.Fatalf("got audit records %+v, expected none", f.audit)
+				}
+				return
+			}
+			if len(f.audit) != 1 {
+				t.Fatalf("got %d audit records, expected 1", len(f.audit))
+			}
+			if r := f.audit[0]; r.Action != "medication.restore" || r.Status != tt.wantStatus || r.MedicationId != identity.Id ||
+				r.Operator != "jane" {
+				t.Errorf("got audit record %+v, expected medication.restore of %s by jane with status %d", r, identity.Id, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestRestoreArgs(t *testing.T) {
+	args := []string{"-owner", "owner", "-id", "id", "-at", "2026-01-02T15:04:05Z"}
+	tests := []struct {
+		name    string
+		cfg     Config
+		args    []string
+		wantErr string
+	}{
+		{
+			name:    "no operator",
+			cfg:     Config{StorageBackend: "dynamodb"},
+			args:    args,
+			wantErr: "usage: restore",
+		},
+		{
+			name:    "not dynamodb",
+			cfg:     Config{StorageBackend: "postgres", Operator: "jane"},
+			args:    args,
+			wantErr: "only supported by the dynamodb storage backend",
+		},
+		{
+			name:    "operator flag",
+			cfg:     Config{StorageBackend: "bolt"},
+			args:    append([]string{"-operator", "jane"}, args...),
+			wantErr: "only supported by the dynamodb storage backend",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := restore(t.Context(), tt.cfg, tt.args)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("got error: %v, expected <%s>", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,161 @@
+package apikey
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chestnut42/test-medication/internal/model"
+	"github.com/chestnut42/test-medication/internal/storage"
+)
+
+// Key format is <tenant>.<id>.<secret>. Tenant and id locate the stored key, secret is compared with the stored hash.
+// Only the hash is stored, so a lost key can't be recovered and must be re-issued.
+
+var (
+	ErrUnauthenticated = errors.New("unauthenticated")
+	ErrNotFound        = errors.New("not found")
+	ErrBadInput        = errors.New("bad request")
+)
+
+type Storage interface {
+	CreateAPIKey(ctx context.Context, key model.APIKey) error
+	GetAPIKey(ctx context.Context, tenant string, id string) (model.APIKey, error)
+	ListAPIKeys(ctx context.Context, tenant string) ([]model.APIKey, error)
+	RevokeAPIKey(ctx context.Context, tenant string, id string) error
+}
+
+type Config struct {
+	CacheTTL time.Duration
+}
+
+type cacheEntry struct {
+	key     model.APIKey
+	expires time.Time
+}
+
+type Service struct {
+	cfg   Config
+	store Storage
+
+	mu    sync.Mutex
+	cache map[string]cacheEntry // tenant/id -> key
+	now   func() time.Time
+}
+
+func NewService(cfg Config, store Storage) *Service {
+	return &Service{
+		cfg:   cfg,
+		store: store,
+		cache: make(map[string]cacheEntry),
+		now:   time.Now,
+	}
+}
+
+// Create issues a new key. The returned string is the only place the secret appears.
+func (s *Service) Create(ctx context.Context, tenant string, owner string, name string) (string, model.APIKey, error) {
+	if !model.ValidTenant(tenant) {
+		return "", model.APIKey{}, fmt.Errorf("<%s> is not a valid tenant: %w", tenant, ErrBadInput)
+	}
+
+	idBytes := make([]byte, 8)
+	secretBytes := make([]byte, 32)
+	// crypto/rand.Read never returns an error
+	_, _ = rand.Read(idBytes)
+	_, _ = rand.Read(secretBytes)
+	id := hex.EncodeToString(idBytes)
+	secret := base64.RawURLEncoding.EncodeToString(secretBytes)
+
+	key := model.APIKey{
+		Id:         id,
+		Tenant:     tenant,
+		Owner:      owner,
+		Name:       name,
+		SecretHash: hashSecret(secret),
+		CreatedAt:  s.now().UTC(),
+	}
+	if err := s.store.CreateAPIKey(ctx, key); err != nil {
+		return "", model.APIKey{}, fmt.Errorf("creating api key: %w", err)
+	}
+	return tenant + "." + id + "." + secret, key, nil
+}
+
+func (s *Service) List(ctx context.Context, tenant string) ([]model.APIKey, error) {
+	keys, err := s.store.ListAPIKeys(ctx, tenant)
+	if err != nil {
+		return nil, fmt.Errorf("listing api keys: %w", err)
+	}
+	return keys, nil
+}
+
+// Revoke takes effect immediately on this replica and after the cache TTL on others.
+func (s *Service) Revoke(ctx context.Context, tenant string, id string) error {
+	if err := s.store.RevokeAPIKey(ctx, tenant, id); err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return fmt.Errorf("api key %s/%s: %w", tenant, id, ErrNotFound)
+		}
+		return fmt.Errorf("revoking api key: %w", err)
+	}
+
+	s.mu.Lock()
+	delete(s.cache, tenant+"/"+id)
+	s.mu.Unlock()
+	return nil
+}
+
+// Authenticate returns the key if the raw key is valid and not revoked.
+func (s *Service) Authenticate(ctx context.Context, rawKey string) (model.APIKey, error) {
+	tenant, rest, _ := strings.Cut(rawKey, ".")
+	id, secret, ok := strings.Cut(rest, ".")
+	if !ok || !model.ValidTenant(tenant) || id == "" || secret == "" {
+		return model.APIKey{}, fmt.Errorf("malformed api key: %w", ErrUnauthenticated)
+	}
+
+	key, err := s.get(ctx, tenant, id)
+	if err != nil {
+		return model.APIKey{}, err
+	}
+	if subtle.ConstantTimeCompare([]byte(key.SecretHash), []byte(hashSecret(secret))) != 1 {
+		return model.APIKey{}, fmt.Errorf("api key %s/%s secret mismatch: %w", tenant, id, ErrUnauthenticated)
+	}
+	if key.Revoked {
+		return model.APIKey{}, fmt.Errorf("api key %s/%s is revoked: %w", tenant, id, ErrUnauthenticated)
+	}
+	return key, nil
+}
+
+func (s *Service) get(ctx context.Context, tenant string, id string) (model.APIKey, error) {
+	cacheKey := tenant + "/" + id
+	s.mu.Lock()
+	entry, ok := s.cache[cacheKey]
+	s.mu.Unlock()
+	if ok && s.now().Before(entry.expires) {
+		return entry.key, nil
+	}
+
+	key, err := s.store.GetAPIKey(ctx, tenant, id)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return model.APIKey{}, fmt.Errorf("api key %s/%s: %w", tenant, id, ErrUnauthenticated)
+		}
+		return model.APIKey{}, fmt.Errorf("getting api key: %w", err)
+	}
+
+	s.mu.Lock()
+	s.cache[cacheKey] = cacheEntry{key: key, expires: s.now().Add(s.cfg.CacheTTL)}
+	s.mu.Unlock()
+	return key, nil
+}
+
+func hashSecret(secret string) string {
+	h := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(h[:])
+}
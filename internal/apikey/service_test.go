@@ -0,0 +1,101 @@
+package apikey
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chestnut42/test-medication/internal/model"
+	"github.com/chestnut42/test-medication/internal/storage"
+)
+
+type memoryStore struct {
+	keys map[string]model.APIKey
+	gets int
+}
+
+func (m *memoryStore) CreateAPIKey(_ context.Context, key model.APIKey) error {
+	m.keys[key.Tenant+"/"+key.Id] = key
+	return nil
+}
+
+func (m *memoryStore) GetAPIKey(_ context.Context, tenant string, id string) (model.APIKey, error) {
+	m.gets++
+	key, ok := m.keys[tenant+"/"+id]
+	if !ok {
+		return model.APIKey{}, fmt.Errorf("%s/%s: %w", tenant, id, storage.ErrNotFound)
+	}
+	return key, nil
+}
+
+func (m *memoryStore) ListAPIKeys(context.Context, string) ([]model.APIKey, error) {
+	return nil, nil
+}
+
+func (m *memoryStore) RevokeAPIKey(_ context.Context, tenant string, id string) error {
+	key, ok := m.keys[tenant+"/"+id]
+	if !ok {
+		return fmt.Errorf("%s/%s: %w", tenant, id, storage.ErrNotFound)
+	}
+	key.Revoked = true
+	m.keys[tenant+"/"+id] = key
+	return nil
+}
+
+func TestAuthenticate(t *testing.T) {
+	ctx := context.Background()
+	store := &memoryStore{keys: map[string]model.APIKey{}}
+	svc := NewService(Config{CacheTTL: time.Minute}, store)
+
+	raw, created, err := svc.Create(ctx, "acme", "project1", "backend")
+	if err != nil {
+		t.Fatalf("failed to create key: %v", err)
+	}
+	if strings.Contains(created.SecretHash, strings.Split(raw, ".")[2]) {
+		t.Fatalf("secret must not be stored")
+	}
+
+	got, err := svc.Authenticate(ctx, raw)
+	if err != nil {
+		t.Fatalf("failed to authenticate: %v", err)
+	}
+	if got.Tenant != "acme" || got.Owner != "project1" || got.Id != created.Id {
+		t.Fatalf("unexpected key: %v", got)
+	}
+
+	// Cached
+	if _, err := svc.Authenticate(ctx, raw); err != nil {
+		t.Fatalf("failed to authenticate: %v", err)
+	}
+	if store.gets != 1 {
+		t.Fatalf("store was called %d times, expected 1", store.gets)
+	}
+
+	for _, bad := range []string{
+		"",
+		"acme",
+		"acme." + created.Id,
+		"acme." + created.Id + ".wrong",
+		"other." + created.Id + "." + strings.Split(raw, ".")[2],
+		"acme.unknown.secret",
+		"ACME." + created.Id + ".secret",
+	} {
+		if _, err := svc.Authenticate(ctx, bad); !errors.Is(err, ErrUnauthenticated) {
+			t.Fatalf("key <%s> must be rejected, got: %v", bad, err)
+		}
+	}
+
+	// Revoked key is rejected immediately
+	if err := svc.Revoke(ctx, "acme", created.Id); err != nil {
+		t.Fatalf("failed to revoke: %v", err)
+	}
+	if _, err := svc.Authenticate(ctx, raw); !errors.Is(err, ErrUnauthenticated) {
+		t.Fatalf("revoked key must be rejected, got: %v", err)
+	}
+	if err := svc.Revoke(ctx, "acme", "unknown"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected not found, got: %v", err)
+	}
+}
@@ -0,0 +1,55 @@
+package audit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/chestnut42/test-medication/internal/model"
+	"github.com/chestnut42/test-medication/internal/storage"
+)
+
+type Storage interface {
+	WriteAudit(ctx context.Context, records []model.AuditRecord, retention time.Duration) error
+	QueryAudit(ctx context.Context, query storage.AuditQuery) (storage.AuditResult, error)
+}
+
+// DynamoSink keeps records in a DynamoDB table. Records expire after the retention by the table TTL.
+type DynamoSink struct {
+	store     Storage
+	retention time.Duration
+}
+
+func NewDynamoSink(store Storage, retention time.Duration) *DynamoSink {
+	return &DynamoSink{
+		store:     store,
+		retention: retention,
+	}
+}
+
+func (d *DynamoSink) Write(ctx context.Context, records []model.AuditRecord) error {
+	return d.store.WriteAudit(ctx, records, d.retention)
+}
+
+func (d *DynamoSink) Query(ctx context.Context, query Query) (Result, error) {
+	res, err := d.store.QueryAudit(ctx, storage.AuditQuery{
+		Tenant:       query.Tenant,
+		Owner:        query.Owner,
+		MedicationId: query.MedicationId,
+		From:         query.From,
+		To:           query.To,
+		Cursor:       query.Cursor,
+		Limit:        query.Limit,
+	})
+	if err != nil {
+		if errors.Is(err, storage.ErrBadCursor) {
+			return Result{}, fmt.Errorf("%w: %w", ErrBadCursor, err)
+		}
+		return Result{}, err
+	}
+	return Result{
+		Records: res.Records,
+		Cursor:  res.Cursor,
+	}, nil
+}
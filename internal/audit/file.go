@@ -0,0 +1,121 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+
+	"github.com/chestnut42/test-medication/internal/model"
+)
+
+// FileSink appends records to a file as JSON lines, to be shipped by a log collector. The file is only appended to,
+// rotation and retention are up to the collector. Query reads the whole file, it's meant for small deployments and
+// local development.
+type FileSink struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func NewFileSink(path string) (*FileSink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("opening audit file: %w", err)
+	}
+	return &FileSink{file: f}, nil
+}
+
+func (f *FileSink) Close() error {
+	return f.file.Close()
+}
+
+// Write syncs the file, so that a written batch survives a crash.
+func (f *FileSink) Write(_ context.Context, records []model.AuditRecord) error {
+	var buf []byte
+	for _, r := range records {
+		line, err := json.Marshal(r)
+		if err != nil {
+			return fmt.Errorf("marshaling record: %w", err)
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, err := f.file.Write(buf); err != nil {
+		return fmt.Errorf("writing audit file: %w", err)
+	}
+	if err := f.file.Sync(); err != nil {
+		return fmt.Errorf("syncing audit file: %w", err)
+	}
+	return nil
+}
+
+// Query scans the file. Cursor is the number of matching records already returned.
+func (f *FileSink) Query(_ context.Context, query Query) (Result, error) {
+	skip := 0
+	if query.Cursor != "" {
+		var err error
+		if skip, err = strconv.Atoi(query.Cursor); err != nil || skip < 0 {
+			return Result{}, fmt.Errorf("cursor is malformed: %w", ErrBadCursor)
+		}
+	}
+
+	r, err := os.Open(f.file.Name())
+	if err != nil {
+		return Result{}, fmt.Errorf("opening audit file: %w", err)
+	}
+	defer r.Close()
+
+	var matched []model.AuditRecord
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var record model.AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			// A torn line after a crash, the rest of the file is fine
+			continue
+		}
+		if matches(record, query) {
+			matched = append(matched, record)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return Result{}, fmt.Errorf("reading audit file: %w", err)
+	}
+
+	// Appends from concurrent batches may be slightly out of order
+	slices.SortStableFunc(matched, func(a, b model.AuditRecord) int {
+		return b.Time.Compare(a.Time)
+	})
+
+	var res Result
+	if skip < len(matched) {
+		end := min(skip+int(query.Limit), len(matched))
+		res.Records = matched[skip:end]
+		if end < len(matched) {
+			res.Cursor = strconv.Itoa(end)
+		}
+	}
+	return res, nil
+}
+
+func matches(r model.AuditRecord, q Query) bool {
+	if r.Tenant != q.Tenant || r.Owner != q.Owner {
+		return false
+	}
+	if q.MedicationId != "" && r.MedicationId != q.MedicationId {
+		return false
+	}
+	if !q.From.IsZero() && r.Time.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && !r.Time.Before(q.To) {
+		return false
+	}
+	return true
+}
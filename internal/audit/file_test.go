@@ -0,0 +1,107 @@
+package audit
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/chestnut42/test-medication/internal/model"
+)
+
+func TestFileSink(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	sink, err := NewFileSink(path)
+	if err != nil {
+		t.Fatalf("failed to open sink: %v", err)
+	}
+	defer sink.Close()
+
+	base := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	var records []model.AuditRecord
+	for i := 0; i < 5; i++ {
+		records = append(records, model.AuditRecord{
+			Time:         base.Add(time.Duration(i) * time.Minute),
+			Tenant:       "acme",
+			Owner:        "owner",
+			MedicationId: []string{"a", "b"}[i%2],
+			Action:       "medication.get",
+			Status:       200,
+		})
+	}
+	records = append(records, model.AuditRecord{Time: base, Tenant: "acme", Owner: "other"})
+	if err := sink.Write(ctx, records[:3]); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	if err := sink.Write(ctx, records[3:]); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	for _, tt := range []struct {
+		name  string
+		query Query
+		want  []time.Time
+	}{
+		{
+			name:  "owner",
+			query: Query{Tenant: "acme", Owner: "owner", Limit: 10},
+			want:  []time.Time{records[4].Time, records[3].Time, records[2].Time, records[1].Time, records[0].Time},
+		},
+		{
+			name:  "medication",
+			query: Query{Tenant: "acme", Owner: "owner", MedicationId: "b", Limit: 10},
+			want:  []time.Time{records[3].Time, records[1].Time},
+		},
+		{
+			name:  "time range",
+			query: Query{Tenant: "acme", Owner: "owner", From: records[1].Time, To: records[3].Time, Limit: 10},
+			want:  []time.Time{records[2].Time, records[1].Time},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := sink.Query(ctx, tt.query)
+			if err != nil {
+				t.Fatalf("failed to query: %v", err)
+			}
+			if len(res.Records) != len(tt.want) {
+				t.Fatalf("got %d records, expected %d", len(res.Records), len(tt.want))
+			}
+			for i := range tt.want {
+				if !res.Records[i].Time.Equal(tt.want[i]) {
+					t.Fatalf("record %d has time %v, expected %v", i, res.Records[i].Time, tt.want[i])
+				}
+			}
+		})
+	}
+
+	t.Run("pages", func(t *testing.T) {
+		query := Query{Tenant: "acme", Owner: "owner", Limit: 2}
+		total := 0
+		for pages := 0; ; pages++ {
+			if pages > 5 {
+				t.Fatal("too many pages")
+			}
+			res, err := sink.Query(ctx, query)
+			if err != nil {
+				t.Fatalf("failed to query: %v", err)
+			}
+			total += len(res.Records)
+			if res.Cursor == "" {
+				break
+			}
+			query.Cursor = res.Cursor
+		}
+		if total != 5 {
+			t.Fatalf("got %d records, expected 5", total)
+		}
+	})
+
+	t.Run("bad cursor", func(t *testing.T) {
+		_, err := sink.Query(ctx, Query{Tenant: "acme", Owner: "owner", Cursor: "nope", Limit: 2})
+		if !errors.Is(err, ErrBadCursor) {
+			t.Fatalf("expected bad cursor, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,221 @@
+package audit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+
+	"github.com/chestnut42/test-medication/internal/model"
+	"github.com/chestnut42/test-medication/internal/utils/logx"
+	"github.com/chestnut42/test-medication/internal/utils/metrics"
+)
+
+// Audit records are written asynchronously, so that a slow or unavailable sink doesn't slow down or fail requests.
+// Records are buffered in memory and written in batches, failed batches are retried. A record that can't be written
+// (the buffer is full, retries are exhausted, or the process is stopping) is logged at error level with all its fields
+// and counted in audit_lost_records_total. Logs are shipped separately, so that is the last resort copy and an alert
+// on the metric tells that the sink must be reconciled with the logs.
+
+var (
+	ErrBadInput  = errors.New("bad request")
+	ErrBadCursor = errors.New("bad cursor")
+)
+
+type Sink interface {
+	Write(ctx context.Context, records []model.AuditRecord) error
+	Query(ctx context.Context, query Query) (Result, error)
+}
+
+type Query struct {
+	Tenant       string
+	Owner        string
+	MedicationId string    // Optional
+	From         time.Time // Inclusive, optional
+	To           time.Time // Exclusive, optional
+	Cursor       string
+	Limit        int32
+}
+
+// Result holds records the newest first.
+type Result struct {
+	Records []model.AuditRecord
+	Cursor  string // Empty if there are no more pages
+}
+
+const (
+	DefaultQueryLimit = 100
+	MaxQueryLimit     = 1000
+)
+
+type Config struct {
+	BufferSize    int           // Records waiting to be written. Records are lost when it's full
+	BatchSize     int           // Max records per write
+	FlushInterval time.Duration // Max time a record waits for a batch to fill up
+	MaxAttempts   int           // Per batch
+	RetryBackoff  time.Duration // Doubled after every attempt
+	StopTimeout   time.Duration // For writing what's buffered on shutdown
+}
+
+type Service struct {
+	cfg     Config
+	sink    Sink
+	records chan model.AuditRecord
+
+	lost    metric.Int64Counter
+	written metric.Int64Counter
+}
+
+func NewService(cfg Config, sink Sink) *Service {
+	meter := metrics.Meter("github.com/chestnut42/test-medication/internal/audit")
+	// Instruments never fail with a valid name
+	lost, _ := meter.Int64Counter("audit.lost_records",
+		metric.WithDescription("Audit records that couldn't be written to the sink and were only logged, by reason"))
+	written, _ := meter.Int64Counter("audit.written_records",
+		metric.WithDescription("Audit records written to the sink"))
+	return &Service{
+		cfg:     cfg,
+		sink:    sink,
+		records: make(chan model.AuditRecord, cfg.BufferSize),
+		lost:    lost,
+		written: written,
+	}
+}
+
+// Record queues the record for writing. It never blocks.
+func (s *Service) Record(ctx context.Context, record model.AuditRecord) {
+	select {
+	case s.records <- record:
+	default:
+		s.loseRecords(ctx, "buffer_full", []model.AuditRecord{record}, nil)
+	}
+}
+
+// Run writes queued records until ctx is done, then writes what's left in the buffer within StopTimeout.
+// Records passed to Record after Run has returned are lost.
+func (s *Service) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	// A batch that is being written is not abandoned when ctx is done, retries are bounded anyway
+	writeCtx := context.WithoutCancel(ctx)
+	batch := make([]model.AuditRecord, 0, s.cfg.BatchSize)
+	flush := func() {
+		if len(batch) > 0 {
+			s.write(writeCtx, batch)
+			batch = batch[:0]
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			s.stop(ctx, batch)
+			return
+		case r := <-s.records:
+			batch = append(batch, r)
+			if len(batch) >= s.cfg.BatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+func (s *Service) stop(ctx context.Context, batch []model.AuditRecord) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), s.cfg.StopTimeout)
+	defer cancel()
+
+	for {
+		select {
+		case r := <-s.records:
+			batch = append(batch, r)
+			if len(batch) < s.cfg.BatchSize {
+				continue
+			}
+		default:
+		}
+		if len(batch) == 0 {
+			return
+		}
+		s.write(ctx, batch)
+		batch = batch[:0]
+	}
+}
+
+// write makes MaxAttempts to write the batch. Requests keep adding records to the buffer meanwhile.
+func (s *Service) write(ctx context.Context, batch []model.AuditRecord) {
+	backoff := s.cfg.RetryBackoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		if err = s.sink.Write(ctx, batch); err == nil {
+			s.written.Add(ctx, int64(len(batch)))
+			return
+		}
+		if attempt >= s.cfg.MaxAttempts {
+			break
+		}
+		logx.Logger(ctx).Warn("writing audit records",
+			slog.Int("attempt", attempt),
+			slog.Int("records", len(batch)),
+			slog.Any("error", err))
+
+		select {
+		case <-ctx.Done():
+			// Only happens on shutdown, when StopTimeout is over
+			s.loseRecords(ctx, "stopped", batch, ctx.Err())
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+	s.loseRecords(ctx, "write_failed", batch, err)
+}
+
+func (s *Service) loseRecords(ctx context.Context, reason string, records []model.AuditRecord, err error) {
+	logger := logx.Logger(ctx)
+	for _, r := range records {
+		logger.Error("audit record lost",
+			slog.String("reason", reason),
+			slog.Any("error", err),
+			slog.Group("audit",
+				slog.Time("time", r.Time),
+				slog.String("request_id", r.RequestId),
+				slog.String("tenant", r.Tenant),
+				slog.String("owner", r.Owner),
+				slog.String("key_id", r.KeyId),
+				slog.String("medication_id", r.MedicationId),
+				slog.String("action", r.Action),
+				slog.Int("status", r.Status),
+				slog.String("source_ip", r.SourceIP),
+				slog.String("forwarded_for", r.ForwardedFor)))
+	}
+	s.lost.Add(ctx, int64(len(records)), metric.WithAttributes(attribute.String("reason", reason)))
+}
+
+func (s *Service) Query(ctx context.Context, query Query) (Result, error) {
+	if query.Tenant == "" || query.Owner == "" {
+		return Result{}, fmt.Errorf("tenant and owner are required: %w", ErrBadInput)
+	}
+	if !query.To.IsZero() && query.To.Before(query.From) {
+		return Result{}, fmt.Errorf("to is before from: %w", ErrBadInput)
+	}
+	if query.Limit <= 0 {
+		query.Limit = DefaultQueryLimit
+	}
+	query.Limit = min(query.Limit, MaxQueryLimit)
+
+	res, err := s.sink.Query(ctx, query)
+	if err != nil {
+		if errors.Is(err, ErrBadCursor) {
+			return Result{}, fmt.Errorf("querying audit: %w: %w", ErrBadInput, err)
+		}
+		return Result{}, fmt.Errorf("querying audit: %w", err)
+	}
+	return res, nil
+}
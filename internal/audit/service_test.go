@@ -0,0 +1,141 @@
+package audit
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chestnut42/test-medication/internal/model"
+)
+
+type fakeSink struct {
+	mu       sync.Mutex
+	written  []model.AuditRecord
+	failures int // Number of writes to fail before succeeding
+}
+
+func (f *fakeSink) Write(_ context.Context, records []model.AuditRecord) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failures > 0 {
+		f.failures--
+		return errors.New("sink is down")
+	}
+	f.written = append(f.written, records...)
+	return nil
+}
+
+func (f *fakeSink) Query(context.Context, Query) (Result, error) {
+	return Result{}, nil
+}
+
+func (f *fakeSink) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.written)
+}
+
+var testConfig = Config{
+	BufferSize:    10,
+	BatchSize:     3,
+	FlushInterval: 10 * time.Millisecond,
+	MaxAttempts:   3,
+	RetryBackoff:  time.Millisecond,
+	StopTimeout:   time.Second,
+}
+
+func runService(t *testing.T, svc *Service) (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		svc.Run(ctx)
+		close(done)
+	}()
+	return func() {
+		cancel()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("service didn't stop")
+		}
+	}
+}
+
+func TestServiceWrites(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		failures int
+		want     int
+	}{
+		{name: "ok", failures: 0, want: 5},
+		{name: "retried", failures: 2, want: 5},
+		{name: "retries exhausted", failures: 3, want: 2}, // The first batch is lost
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			sink := &fakeSink{failures: tt.failures}
+			svc := NewService(testConfig, sink)
+			for i := 0; i < 5; i++ {
+				svc.Record(context.Background(), model.AuditRecord{Action: "medication.get"})
+			}
+			stop := runService(t, svc)
+			stop()
+
+			if got := sink.count(); got != tt.want {
+				t.Fatalf("got %d records written, expected %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServiceFlushes(t *testing.T) {
+	sink := &fakeSink{}
+	svc := NewService(testConfig, sink)
+	stop := runService(t, svc)
+	defer stop()
+
+	svc.Record(context.Background(), model.AuditRecord{Action: "medication.get"})
+	deadline := time.Now().Add(5 * time.Second)
+	for sink.count() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("incomplete batch is not flushed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestServiceNeverBlocks(t *testing.T) {
+	sink := &fakeSink{}
+	svc := NewService(testConfig, sink)
+
+	// Not running, so the buffer fills up
+	for i := 0; i < testConfig.BufferSize*2; i++ {
+		svc.Record(context.Background(), model.AuditRecord{Action: "medication.get"})
+	}
+	stop := runService(t, svc)
+	stop()
+
+	if got := sink.count(); got != testConfig.BufferSize {
+		t.Fatalf("got %d records written, expected %d", got, testConfig.BufferSize)
+	}
+}
+
+func TestServiceQuery(t *testing.T) {
+	svc := NewService(testConfig, &fakeSink{})
+	for _, tt := range []struct {
+		name  string
+		query Query
+	}{
+		{name: "no owner", query: Query{Tenant: "acme"}},
+		{name: "no tenant", query: Query{Owner: "owner"}},
+		{name: "to before from", query: Query{Tenant: "acme", Owner: "owner",
+			From: time.Unix(100, 0), To: time.Unix(50, 0)}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := svc.Query(context.Background(), tt.query); !errors.Is(err, ErrBadInput) {
+				t.Fatalf("expected bad input, got %v", err)
+			}
+		})
+	}
+}
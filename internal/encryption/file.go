@@ -0,0 +1,69 @@
+package encryption
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// FileProvider keeps master keys in a local JSON file:
+//
+//	{"current": "2025-01", "keys": {"2024-06": "<base64>", "2025-01": "<base64>"}}
+//
+// Keys are 32 random bytes (openssl rand -base64 32). Master keys are rotated by adding a new key and making it
+// current. The old one must be kept until the re-wrap job has run. The file is read once on startup.
+//
+// It's meant for development and tests. In production master keys must never leave a KMS.
+type FileProvider struct {
+	current string
+	keys    map[string][]byte
+}
+
+type keyFile struct {
+	Current string            `json:"current"`
+	Keys    map[string][]byte `json:"keys"` // base64 in JSON
+}
+
+func NewFileProvider(path string) (*FileProvider, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading key file: %w", err)
+	}
+	var f keyFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("parsing key file: %w", err)
+	}
+	if _, ok := f.Keys[f.Current]; !ok {
+		return nil, fmt.Errorf("current key %s is not in the key file", f.Current)
+	}
+	for id, key := range f.Keys {
+		if len(key) != keySize {
+			return nil, fmt.Errorf("key %s must be %d bytes, got %d", id, keySize, len(key))
+		}
+	}
+	return &FileProvider{
+		current: f.Current,
+		keys:    f.Keys,
+	}, nil
+}
+
+func (p *FileProvider) CurrentKeyId() string {
+	return p.current
+}
+
+func (p *FileProvider) Encrypt(_ context.Context, keyId string, plaintext []byte) ([]byte, error) {
+	key, ok := p.keys[keyId]
+	if !ok {
+		return nil, fmt.Errorf("master key %s: %w", keyId, ErrUnknownKey)
+	}
+	return seal(key, plaintext, []byte(keyId))
+}
+
+func (p *FileProvider) Decrypt(_ context.Context, keyId string, ciphertext []byte) ([]byte, error) {
+	key, ok := p.keys[keyId]
+	if !ok {
+		return nil, fmt.Errorf("master key %s: %w", keyId, ErrUnknownKey)
+	}
+	return open(key, ciphertext, []byte(keyId))
+}
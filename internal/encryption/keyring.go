@@ -0,0 +1,243 @@
+package encryption
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/chestnut42/test-medication/internal/model"
+	"github.com/chestnut42/test-medication/internal/storage"
+)
+
+// Envelope encryption: medication fields are encrypted with a per-tenant data key, data keys are encrypted (wrapped)
+// with a master key of the KeyProvider and stored next to tenant settings. Plaintext data keys are cached in memory,
+// so the provider is only called when a key is loaded.
+//
+// There are two kinds of rotation:
+//   - Data key rotation (Rotate) creates a new current key for the tenant. Medications are re-encrypted with it
+//     when they are written or read, and by the re-wrap job.
+//   - Master key rotation is done in the provider. The re-wrap job re-wraps data keys with the new master key,
+//     after that the old master key can be disabled.
+
+var ErrUnknownKey = errors.New("unknown key")
+
+// KeyProvider is a KMS: it encrypts and decrypts small payloads with master keys that never leave it.
+type KeyProvider interface {
+	CurrentKeyId() string
+	Encrypt(ctx context.Context, keyId string, plaintext []byte) ([]byte, error)
+	Decrypt(ctx context.Context, keyId string, ciphertext []byte) ([]byte, error)
+}
+
+type Storage interface {
+	CreateDataKey(ctx context.Context, key model.DataKey) error
+	ListDataKeys(ctx context.Context, tenant string) ([]model.DataKey, error)
+	ScanDataKeys(ctx context.Context, fn func(model.DataKey) error) error
+	RewrapDataKey(ctx context.Context, key model.DataKey, oldMasterKeyId string) error
+}
+
+type Config struct {
+	CacheTTL time.Duration // How long it takes for a rotation to reach other replicas
+}
+
+type tenantKeys struct {
+	current string
+	keys    map[string][]byte // id -> plaintext data key
+	expires time.Time
+}
+
+type Keyring struct {
+	cfg      Config
+	provider KeyProvider
+	store    Storage
+
+	mu    sync.Mutex
+	cache map[string]tenantKeys // tenant -> keys
+	now   func() time.Time
+}
+
+func NewKeyring(cfg Config, provider KeyProvider, store Storage) *Keyring {
+	return &Keyring{
+		cfg:      cfg,
+		provider: provider,
+		store:    store,
+		cache:    make(map[string]tenantKeys),
+		now:      time.Now,
+	}
+}
+
+// Encrypt encrypts with the current data key of the tenant. The first key of a tenant is created on demand.
+func (k *Keyring) Encrypt(ctx context.Context, tenant string, plaintext []byte, aad []byte) (string, []byte, error) {
+	keys, err := k.keys(ctx, tenant)
+	if err != nil {
+		return "", nil, err
+	}
+	ciphertext, err := seal(keys.keys[keys.current], plaintext, aad)
+	if err != nil {
+		return "", nil, err
+	}
+	return keys.current, ciphertext, nil
+}
+
+func (k *Keyring) Decrypt(ctx context.Context, tenant string, keyId string, ciphertext []byte, aad []byte) ([]byte, error) {
+	keys, err := k.keys(ctx, tenant)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := keys.keys[keyId]
+	if !ok {
+		// The key may have been created by another replica
+		k.invalidate(tenant)
+		if keys, err = k.keys(ctx, tenant); err != nil {
+			return nil, err
+		}
+		if key, ok = keys.keys[keyId]; !ok {
+			return nil, fmt.Errorf("data key %s/%s: %w", tenant, keyId, ErrUnknownKey)
+		}
+	}
+	return open(key, ciphertext, aad)
+}
+
+func (k *Keyring) CurrentKeyId(ctx context.Context, tenant string) (string, error) {
+	keys, err := k.keys(ctx, tenant)
+	if err != nil {
+		return "", err
+	}
+	return keys.current, nil
+}
+
+// Rotate creates a new current data key for the tenant.
+func (k *Keyring) Rotate(ctx context.Context, tenant string) (model.DataKey, error) {
+	key, err := k.createKey(ctx, tenant)
+	if err != nil {
+		return model.DataKey{}, err
+	}
+	k.invalidate(tenant)
+	return key, nil
+}
+
+// List returns data keys of the tenant, the current one first.
+func (k *Keyring) List(ctx context.Context, tenant string) ([]model.DataKey, error) {
+	keys, err := k.store.ListDataKeys(ctx, tenant)
+	if err != nil {
+		return nil, fmt.Errorf("listing data keys: %w", err)
+	}
+	sortNewestFirst(keys)
+	return keys, nil
+}
+
+// Rewrap re-wraps data keys of all tenants that are not wrapped by the current master key.
+// Returns the number of re-wrapped keys.
+func (k *Keyring) Rewrap(ctx context.Context) (int, error) {
+	current := k.provider.CurrentKeyId()
+	count := 0
+	err := k.store.ScanDataKeys(ctx, func(key model.DataKey) error {
+		if key.MasterKeyId == current {
+			return nil
+		}
+		plaintext, err := k.provider.Decrypt(ctx, key.MasterKeyId, key.WrappedKey)
+		if err != nil {
+			return fmt.Errorf("unwrapping data key %s/%s: %w", key.Tenant, key.Id, err)
+		}
+		oldMasterKeyId := key.MasterKeyId
+		key.MasterKeyId = current
+		if key.WrappedKey, err = k.provider.Encrypt(ctx, current, plaintext); err != nil {
+			return fmt.Errorf("wrapping data key %s/%s: %w", key.Tenant, key.Id, err)
+		}
+		if err := k.store.RewrapDataKey(ctx, key, oldMasterKeyId); err != nil {
+			if errors.Is(err, storage.ErrVersionMismatch) {
+				return nil // Re-wrapped by another replica
+			}
+			return fmt.Errorf("storing data key %s/%s: %w", key.Tenant, key.Id, err)
+		}
+		count++
+		return nil
+	})
+	return count, err
+}
+
+func (k *Keyring) keys(ctx context.Context, tenant string) (tenantKeys, error) {
+	now := k.now()
+	k.mu.Lock()
+	keys, ok := k.cache[tenant]
+	k.mu.Unlock()
+	if ok && now.Before(keys.expires) {
+		return keys, nil
+	}
+
+	stored, err := k.store.ListDataKeys(ctx, tenant)
+	if err != nil {
+		return tenantKeys{}, fmt.Errorf("listing data keys: %w", err)
+	}
+	if len(stored) == 0 {
+		key, err := k.createKey(ctx, tenant)
+		if err != nil {
+			return tenantKeys{}, err
+		}
+		stored = []model.DataKey{key}
+	}
+	sortNewestFirst(stored)
+
+	keys = tenantKeys{
+		current: stored[0].Id,
+		keys:    make(map[string][]byte, len(stored)),
+		expires: now.Add(k.cfg.CacheTTL),
+	}
+	for _, key := range stored {
+		plaintext, err := k.provider.Decrypt(ctx, key.MasterKeyId, key.WrappedKey)
+		if err != nil {
+			return tenantKeys{}, fmt.Errorf("unwrapping data key %s/%s: %w", tenant, key.Id, err)
+		}
+		keys.keys[key.Id] = plaintext
+	}
+
+	k.mu.Lock()
+	k.cache[tenant] = keys
+	k.mu.Unlock()
+	return keys, nil
+}
+
+func (k *Keyring) createKey(ctx context.Context, tenant string) (model.DataKey, error) {
+	plaintext, err := newKey()
+	if err != nil {
+		return model.DataKey{}, err
+	}
+	masterKeyId := k.provider.CurrentKeyId()
+	wrapped, err := k.provider.Encrypt(ctx, masterKeyId, plaintext)
+	if err != nil {
+		return model.DataKey{}, fmt.Errorf("wrapping data key: %w", err)
+	}
+
+	key := model.DataKey{
+		Tenant:      tenant,
+		Id:          uuid.NewString(),
+		MasterKeyId: masterKeyId,
+		WrappedKey:  wrapped,
+		CreatedAt:   k.now().UTC(),
+	}
+	if err := k.store.CreateDataKey(ctx, key); err != nil {
+		return model.DataKey{}, fmt.Errorf("storing data key: %w", err)
+	}
+	return key, nil
+}
+
+func (k *Keyring) invalidate(tenant string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	delete(k.cache, tenant)
+}
+
+// sortNewestFirst breaks ties by id, so that all replicas agree on the current key.
+func sortNewestFirst(keys []model.DataKey) {
+	slices.SortFunc(keys, func(a, b model.DataKey) int {
+		if c := b.CreatedAt.Compare(a.CreatedAt); c != 0 {
+			return c
+		}
+		return strings.Compare(b.Id, a.Id)
+	})
+}
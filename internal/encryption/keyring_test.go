@@ -0,0 +1,236 @@
+package encryption
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chestnut42/test-medication/internal/model"
+	"github.com/chestnut42/test-medication/internal/storage"
+)
+
+type fakeStorage struct {
+	mu   sync.Mutex
+	keys map[string]model.DataKey // tenant/id -> key
+}
+
+func newFakeStorage() *fakeStorage {
+	return &fakeStorage{keys: make(map[string]model.DataKey)}
+}
+
+func (f *fakeStorage) CreateDataKey(_ context.Context, key model.DataKey) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.keys[key.Tenant+"/"+key.Id]; ok {
+		return storage.ErrAlreadyExists
+	}
+	f.keys[key.Tenant+"/"+key.Id] = key
+	return nil
+}
+
+func (f *fakeStorage) ListDataKeys(_ context.Context, tenant string) ([]model.DataKey, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var keys []model.DataKey
+	for _, key := range f.keys {
+		if key.Tenant == tenant {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func (f *fakeStorage) ScanDataKeys(_ context.Context, fn func(model.DataKey) error) error {
+	f.mu.Lock()
+	keys := make([]model.DataKey, 0, len(f.keys))
+	for _, key := range f.keys {
+		keys = append(keys, key)
+	}
+	f.mu.Unlock()
+	for _, key := range keys {
+		if err := fn(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *fakeStorage) RewrapDataKey(_ context.Context, key model.DataKey, oldMasterKeyId string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	stored := f.keys[key.Tenant+"/"+key.Id]
+	if stored.MasterKeyId != oldMasterKeyId {
+		return storage.ErrVersionMismatch
+	}
+	f.keys[key.Tenant+"/"+key.Id] = key
+	return nil
+}
+
+func writeKeyFile(t *testing.T, current string, ids ...string) string {
+	t.Helper()
+	f := keyFile{Current: current, Keys: make(map[string][]byte)}
+	for _, id := range ids {
+		f.Keys[id] = bytes.Repeat([]byte(id[:1]), keySize)
+	}
+	data, err := json.Marshal(f)
+	if err != nil {
+		t.Fatalf("failed to marshal key file: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "keys.json")
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("failed to write key file: %v", err)
+	}
+	return path
+}
+
+func newProvider(t *testing.T, current string, ids ...string) *FileProvider {
+	t.Helper()
+	p, err := NewFileProvider(writeKeyFile(t, current, ids...))
+	if err != nil {
+		t.Fatalf("failed to create provider: %v", err)
+	}
+	return p
+}
+
+func TestFileProvider(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		content string
+	}{
+		{name: "missing current", content: `{"current":"b","keys":{}}`},
+		{name: "short key", content: `{"current":"a","keys":{"a":"AAAA"}}`},
+		{name: "not json", content: `current=a`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "keys.json")
+			if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+				t.Fatalf("failed to write key file: %v", err)
+			}
+			if _, err := NewFileProvider(path); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+
+	t.Run("round trip", func(t *testing.T) {
+		ctx := context.Background()
+		p := newProvider(t, "a", "a", "b")
+		ciphertext, err := p.Encrypt(ctx, "a", []byte("secret"))
+		if err != nil {
+			t.Fatalf("failed to encrypt: %v", err)
+		}
+		if _, err := p.Decrypt(ctx, "b", ciphertext); err == nil {
+			t.Fatal("decrypted with another key")
+		}
+		plaintext, err := p.Decrypt(ctx, "a", ciphertext)
+		if err != nil {
+			t.Fatalf("failed to decrypt: %v", err)
+		}
+		if string(plaintext) != "secret" {
+			t.Fatalf("got %s, expected secret", plaintext)
+		}
+		if _, err := p.Decrypt(ctx, "c", ciphertext); !errors.Is(err, ErrUnknownKey) {
+			t.Fatalf("expected unknown key, got %v", err)
+		}
+	})
+}
+
+func TestKeyring(t *testing.T) {
+	ctx := context.Background()
+	store := newFakeStorage()
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	newKeyring := func(provider KeyProvider) *Keyring {
+		k := NewKeyring(Config{CacheTTL: time.Minute}, provider, store)
+		k.now = func() time.Time { return now }
+		return k
+	}
+	keyring := newKeyring(newProvider(t, "a", "a"))
+
+	keyId, ciphertext, err := keyring.Encrypt(ctx, "acme", []byte("paracetamol"), []byte("aad"))
+	if err != nil {
+		t.Fatalf("failed to encrypt: %v", err)
+	}
+	if bytes.Contains(ciphertext, []byte("paracetamol")) {
+		t.Fatal("ciphertext contains plaintext")
+	}
+
+	t.Run("aad must match", func(t *testing.T) {
+		if _, err := keyring.Decrypt(ctx, "acme", keyId, ciphertext, []byte("other")); err == nil {
+			t.Fatal("decrypted with wrong aad")
+		}
+	})
+
+	t.Run("tenants have own keys", func(t *testing.T) {
+		otherId, err := keyring.CurrentKeyId(ctx, "other")
+		if err != nil {
+			t.Fatalf("failed to get key: %v", err)
+		}
+		if otherId == keyId {
+			t.Fatal("tenants share a data key")
+		}
+		if _, err := keyring.Decrypt(ctx, "other", keyId, ciphertext, []byte("aad")); !errors.Is(err, ErrUnknownKey) {
+			t.Fatalf("expected unknown key, got %v", err)
+		}
+	})
+
+	t.Run("rotate", func(t *testing.T) {
+		now = now.Add(time.Hour)
+		rotated, err := keyring.Rotate(ctx, "acme")
+		if err != nil {
+			t.Fatalf("failed to rotate: %v", err)
+		}
+		current, err := keyring.CurrentKeyId(ctx, "acme")
+		if err != nil {
+			t.Fatalf("failed to get key: %v", err)
+		}
+		if current != rotated.Id || current == keyId {
+			t.Fatalf("current key is %s, expected %s", current, rotated.Id)
+		}
+
+		// Another replica learns about the new key without waiting for the cache
+		other := newKeyring(newProvider(t, "a", "a"))
+		newKeyId, newCiphertext, err := other.Encrypt(ctx, "acme", []byte("ibuprofen"), nil)
+		if err != nil {
+			t.Fatalf("failed to encrypt: %v", err)
+		}
+		if newKeyId != rotated.Id {
+			t.Fatalf("encrypted with %s, expected %s", newKeyId, rotated.Id)
+		}
+		if _, err := keyring.Decrypt(ctx, "acme", newKeyId, newCiphertext, nil); err != nil {
+			t.Fatalf("failed to decrypt with the new key: %v", err)
+		}
+		if _, err := keyring.Decrypt(ctx, "acme", keyId, ciphertext, []byte("aad")); err != nil {
+			t.Fatalf("failed to decrypt with the old key: %v", err)
+		}
+	})
+
+	t.Run("rewrap", func(t *testing.T) {
+		count, err := newKeyring(newProvider(t, "b", "a", "b")).Rewrap(ctx)
+		if err != nil {
+			t.Fatalf("failed to rewrap: %v", err)
+		}
+		if count != 3 {
+			t.Fatalf("re-wrapped %d keys, expected 3", count)
+		}
+
+		// Master key "a" is not needed anymore
+		rewrapped := newKeyring(newProvider(t, "b", "b"))
+		plaintext, err := rewrapped.Decrypt(ctx, "acme", keyId, ciphertext, []byte("aad"))
+		if err != nil {
+			t.Fatalf("failed to decrypt: %v", err)
+		}
+		if string(plaintext) != "paracetamol" {
+			t.Fatalf("got %s, expected paracetamol", plaintext)
+		}
+
+		if count, err := rewrapped.Rewrap(ctx); err != nil || count != 0 {
+			t.Fatalf("second rewrap: %d, %v", count, err)
+		}
+	})
+}
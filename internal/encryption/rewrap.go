@@ -0,0 +1,62 @@
+package encryption
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/chestnut42/test-medication/internal/utils/logx"
+)
+
+type Medications interface {
+	ReencryptMedications(ctx context.Context) (int, error)
+}
+
+// Rewrapper finishes rotations: it re-wraps data keys with the current master key and re-encrypts medications
+// that haven't been read or written since their tenant's data key was rotated. Both scan the whole table.
+// It's safe to run on every replica, writes are conditional, but it's cheaper to run it on one.
+type Rewrapper struct {
+	keyring     *Keyring
+	medications Medications
+}
+
+func NewRewrapper(keyring *Keyring, medications Medications) *Rewrapper {
+	return &Rewrapper{
+		keyring:     keyring,
+		medications: medications,
+	}
+}
+
+func (r *Rewrapper) RunOnce(ctx context.Context) error {
+	keys, err := r.keyring.Rewrap(ctx)
+	if err != nil {
+		return fmt.Errorf("re-wrapping data keys: %w", err)
+	}
+	medications, err := r.medications.ReencryptMedications(ctx)
+	if err != nil {
+		return fmt.Errorf("re-encrypting medications: %w", err)
+	}
+	logx.Logger(ctx).Info("re-wrap finished",
+		slog.Int("data_keys", keys),
+		slog.Int("medications", medications))
+	return nil
+}
+
+// Run calls RunOnce every interval until ctx is done. Failures are logged and retried on the next run.
+func (r *Rewrapper) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := r.RunOnce(ctx); err != nil {
+			logx.Logger(ctx).Error("re-wrap", slog.Any("error", err))
+		}
+	}
+}
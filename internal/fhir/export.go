@@ -0,0 +1,84 @@
+package fhir
+
+import (
+	"github.com/chestnut42/test-medication/internal/model"
+)
+
+// Code systems of the values that are only meaningful inside this service.
+const (
+	FormSystem       = "urn:medication:form"
+	OwnerSystem      = "urn:medication:owner"
+	PrescriberSystem = "urn:medication:prescriber"
+)
+
+const containedMedicationId = "med"
+
+var statementStatuses = map[model.Status]string{
+	model.StatusActive:       "active",
+	model.StatusPaused:       "on-hold",
+	model.StatusCompleted:    "completed",
+	model.StatusDiscontinued: "stopped",
+}
+
+// StatementStatus converts status to MedicationStatement.status code.
+func StatementStatus(status model.Status) string {
+	return statementStatuses[status.OrActive()]
+}
+
+// ParseStatementStatus converts MedicationStatement.status code to status.
+func ParseStatementStatus(code string) (model.Status, bool) {
+	for status, c := range statementStatuses {
+		if c == code {
+			return status, true
+		}
+	}
+	return "", false
+}
+
+// NewMedicationStatement renders the medication as MedicationStatement.
+// Name and form are carried by a contained Medication resource as MedicationStatement has no form.
+func NewMedicationStatement(m model.Medication) MedicationStatement {
+	st := MedicationStatement{
+		ResourceType: ResourceMedicationStatement,
+		Id:           m.Id,
+		Meta:         &Meta{VersionId: m.Version},
+		Contained: []Medication{{
+			ResourceType: ResourceMedication,
+			Id:           containedMedicationId,
+			Code:         &CodeableConcept{Text: m.Name},
+			Form: &CodeableConcept{
+				Coding: []Coding{{System: FormSystem, Code: string(m.Form)}},
+				Text:   string(m.Form),
+			},
+		}},
+		Status:              StatementStatus(m.Status),
+		MedicationReference: &Reference{Reference: "#" + containedMedicationId},
+		Subject: Reference{
+			Identifier: &Identifier{System: OwnerSystem, Value: m.Owner},
+		},
+		Dosage: []Dosage{{Text: m.Dosage}},
+	}
+
+	if m.StatusReason != "" {
+		st.StatusReason = []CodeableConcept{{Text: m.StatusReason}}
+	}
+	if m.StartDate != "" || m.EndDate != "" {
+		period := &Period{Start: m.StartDate, End: m.EndDate}
+		st.EffectivePeriod = period
+		st.Dosage[0].Timing = &Timing{Repeat: &TimingRepeat{BoundsPeriod: period}}
+	}
+	if m.Prescriber != (model.Prescriber{}) {
+		st.InformationSource = &Reference{Display: m.Prescriber.Name}
+		if m.Prescriber.Id != "" {
+			st.InformationSource.Identifier = &Identifier{System: PrescriberSystem, Value: m.Prescriber.Id}
+		}
+	}
+	if m.Indication != (model.Indication{}) {
+		reason := CodeableConcept{Text: m.Indication.Text}
+		if m.Indication.Code != "" {
+			reason.Coding = []Coding{{System: m.Indication.System, Code: m.Indication.Code}}
+		}
+		st.ReasonCode = []CodeableConcept{reason}
+	}
+	return st
+}
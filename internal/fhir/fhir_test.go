@@ -0,0 +1,190 @@
+package fhir
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+
+	"github.com/chestnut42/test-medication/internal/model"
+)
+
+func TestRoundTrip(t *testing.T) {
+	med := model.Medication{
+		Identity: model.Identity{Id: "id1", Owner: "owner"},
+		MedicationData: model.MedicationData{
+			Name:   "Paracetamol",
+			Dosage: "500mg",
+			Form:   model.FormTablet,
+			Prescription: model.Prescription{
+				Prescriber:   model.Prescriber{Id: "12345", Name: "Dr. House"},
+				Indication:   model.Indication{Text: "Headache", Code: "R51", System: "http://hl7.org/fhir/sid/icd-10"},
+				StartDate:    "2025-01-01",
+				EndDate:      "2025-02-01",
+				Status:       model.StatusDiscontinued,
+				StatusReason: "side effects",
+			},
+		},
+		Version: "v1",
+	}
+
+	raw, err := json.Marshal(NewMedicationStatement(med))
+	if err != nil {
+		t.Fatalf("failed to marshal: %v", err)
+	}
+
+	imported := ImportResource(raw)
+	if imported.Failed() || len(imported.Issues) > 0 {
+		t.Fatalf("unexpected issues: %+v", imported.Issues)
+	}
+	if imported.Id != med.Id {
+		t.Fatalf("got id: %s, expected: %s", imported.Id, med.Id)
+	}
+	if imported.Data != med.MedicationData {
+		t.Fatalf("got: %+v, expected: %+v", imported.Data, med.MedicationData)
+	}
+}
+
+func TestImportResource(t *testing.T) {
+	tests := []struct {
+		name       string
+		resource   string
+		wantFailed bool
+		wantIssues []string // expressions
+		want       model.MedicationData
+	}{
+		{
+			name: "request",
+			resource: `{
+				"resourceType": "MedicationRequest",
+				"id": "r1",
+				"status": "on-hold",
+				"intent": "order",
+				"contained": [{"resourceType": "Medication", "id": "m", "code": {"text": "Ibuprofen"}, "form": {"text": "Capsule"}}],
+				"medicationReference": {"reference": "#m"},
+				"subject": {"reference": "Patient/1"},
+				"requester": {"reference": "Practitioner/7", "display": "Dr. Who"},
+				"dosageInstruction": [{"doseAndRate": [{"doseQuantity": {"value": 200, "unit": "mg"}}]}],
+				"dispenseRequest": {"validityPeriod": {"start": "2025-03-01"}}
+			}`,
+			want: model.MedicationData{
+				Name:   "Ibuprofen",
+				Dosage: "200mg",
+				Form:   model.FormCapsule,
+				Prescription: model.Prescription{
+					Prescriber: model.Prescriber{Id: "Practitioner/7", Name: "Dr. Who"},
+					StartDate:  "2025-03-01",
+					Status:     model.StatusPaused,
+				},
+			},
+		},
+		{
+			name: "unmappable fields are reported",
+			resource: `{
+				"resourceType": "MedicationStatement",
+				"id": "s1",
+				"status": "active",
+				"contained": [{"resourceType": "Medication", "id": "m", "code": {"text": "Ibuprofen"}, "form": {"text": "liquid"}}],
+				"medicationReference": {"reference": "#m"},
+				"dosage": [{"text": "5ml"}, {"text": "10ml"}],
+				"effectivePeriod": {"start": "2025-03-01T10:00:00Z"},
+				"note": [{"text": "take with food"}],
+				"category": {"text": "inpatient"}
+			}`,
+			wantIssues: []string{
+				"MedicationStatement.category",
+				"MedicationStatement.note",
+				"MedicationStatement.dosage",
+				"MedicationStatement.effectivePeriod.start",
+			},
+			want: model.MedicationData{
+				Name:         "Ibuprofen",
+				Dosage:       "5ml",
+				Form:         model.FormLiquid,
+				Prescription: model.Prescription{StartDate: "2025-03-01", Status: model.StatusActive},
+			},
+		},
+		{
+			name: "unmappable nested fields are reported",
+			resource: `{
+				"resourceType": "MedicationRequest",
+				"id": "r1",
+				"status": "active",
+				"intent": "order",
+				"contained": [{"resourceType": "Medication", "id": "m", "code": {"text": "Ibuprofen"}, "form": {"text": "tablet"}}],
+				"medicationReference": {"reference": "#m"},
+				"dosageInstruction": [{
+					"text": "200mg",
+					"timing": {"code": {"text": "BID"}, "repeat": {"boundsPeriod": {"start": "2025-03-01"}, "frequency": 2}},
+					"route": {"text": "oral"},
+					"doseAndRate": [{"doseQuantity": {"value": 200, "unit": "mg"}, "rateQuantity": {"value": 1}}]
+				}],
+				"dispenseRequest": {"validityPeriod": {"start": "2025-03-01"}, "quantity": {"value": 20}, "numberOfRepeatsAllowed": 1}
+			}`,
+			wantIssues: []string{
+				"MedicationRequest.dispenseRequest.numberOfRepeatsAllowed",
+				"MedicationRequest.dispenseRequest.quantity",
+				"MedicationRequest.dosageInstruction.doseAndRate.rateQuantity",
+				"MedicationRequest.dosageInstruction.route",
+				"MedicationRequest.dosageInstruction.timing.code",
+				"MedicationRequest.dosageInstruction.timing.repeat.frequency",
+			},
+			want: model.MedicationData{
+				Name:         "Ibuprofen",
+				Dosage:       "200mg",
+				Form:         model.FormTablet,
+				Prescription: model.Prescription{StartDate: "2025-03-01", Status: model.StatusActive},
+			},
+		},
+		{
+			name: "no form",
+			resource: `{
+				"resourceType": "MedicationStatement",
+				"id": "s1",
+				"status": "active",
+				"medicationCodeableConcept": {"text": "Ibuprofen"},
+				"dosage": [{"text": "5ml"}]
+			}`,
+			wantFailed: true,
+			wantIssues: []string{"MedicationStatement.medication"},
+		},
+		{
+			name: "unmappable status",
+			resource: `{
+				"resourceType": "MedicationStatement",
+				"id": "s1",
+				"status": "entered-in-error",
+				"contained": [{"resourceType": "Medication", "id": "m", "code": {"text": "Ibuprofen"}, "form": {"text": "liquid"}}],
+				"medicationReference": {"reference": "#m"},
+				"dosage": [{"text": "5ml"}]
+			}`,
+			wantFailed: true,
+			wantIssues: []string{"MedicationStatement.status"},
+		},
+		{
+			name:       "unsupported resource",
+			resource:   `{"resourceType": "Patient", "id": "p1"}`,
+			wantFailed: true,
+			wantIssues: []string{""},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ImportResource(json.RawMessage(tt.resource))
+			if got.Failed() != tt.wantFailed {
+				t.Fatalf("got failed: %v, expected: %v, issues: %+v", got.Failed(), tt.wantFailed, got.Issues)
+			}
+
+			var gotIssues []string
+			for _, issue := range got.Issues {
+				gotIssues = append(gotIssues, slices.Concat(issue.Expression, []string{""})[0])
+			}
+			if !slices.Equal(gotIssues, tt.wantIssues) {
+				t.Fatalf("got issues: %v, expected: %v", gotIssues, tt.wantIssues)
+			}
+			if !tt.wantFailed && got.Data != tt.want {
+				t.Fatalf("got: %+v, expected: %+v", got.Data, tt.want)
+			}
+		})
+	}
+}
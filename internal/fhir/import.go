@@ -0,0 +1,377 @@
+package fhir
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chestnut42/test-medication/internal/model"
+)
+
+const maxFieldLength = 1024
+
+var requestStatuses = map[string]model.Status{
+	"active":    model.StatusActive,
+	"on-hold":   model.StatusPaused,
+	"completed": model.StatusCompleted,
+	"stopped":   model.StatusDiscontinued,
+	"cancelled": model.StatusDiscontinued,
+}
+
+// fields describes what is mapped or deliberately ignored. Everything else is reported as not supported.
+// A nil value accepts the field as it is, otherwise it's an object (or an array of objects) with the listed fields.
+type fields map[string]fields
+
+var (
+	containedFields = fields{"resourceType": nil, "id": nil, "code": nil, "form": nil}
+	dosageFields    = fields{
+		"text": nil, "doseAndRate": {"doseQuantity": nil},
+		"timing": {"repeat": {"boundsPeriod": nil}}, // Written by export, mirrors the effective period
+	}
+
+	statementFields = fields{
+		"resourceType": nil, "id": nil, "meta": nil, "contained": containedFields, "status": nil, "statusReason": nil,
+		"medicationCodeableConcept": nil, "medicationReference": nil, "subject": nil, "effectivePeriod": nil,
+		"informationSource": nil, "reasonCode": nil, "dosage": dosageFields,
+	}
+	requestFields = fields{
+		"resourceType": nil, "id": nil, "meta": nil, "contained": containedFields, "status": nil, "statusReason": nil,
+		"intent": nil, "medicationCodeableConcept": nil, "medicationReference": nil, "subject": nil, "requester": nil,
+		"reasonCode": nil, "dosageInstruction": dosageFields, "dispenseRequest": {"validityPeriod": nil},
+	}
+)
+
+// Imported is a result of mapping a single FHIR resource.
+// Issues contain everything that couldn't be mapped. If there's at least one error issue, Data must not be used.
+type Imported struct {
+	Id     string
+	Data   model.MedicationData
+	Issues []Issue
+}
+
+func (i Imported) Failed() bool {
+	return slices.ContainsFunc(i.Issues, func(issue Issue) bool {
+		return issue.Severity == SeverityError
+	})
+}
+
+// importer accumulates issues while mapping a resource.
+type importer struct {
+	resourceType string
+	issues       []Issue
+}
+
+func (im *importer) report(severity string, code string, field string, format string, args ...any) {
+	im.issues = append(im.issues, Issue{
+		Severity:    severity,
+		Code:        code,
+		Diagnostics: fmt.Sprintf(format, args...),
+		Expression:  []string{im.resourceType + "." + field},
+	})
+}
+
+// ImportResource maps MedicationStatement or MedicationRequest to medication data.
+// Subject is ignored: the owner is determined by the transport layer.
+func ImportResource(raw json.RawMessage) Imported {
+	var header struct {
+		ResourceType string `json:"resourceType"`
+	}
+	if err := json.Unmarshal(raw, &header); err != nil {
+		return Imported{Issues: []Issue{{
+			Severity:    SeverityError,
+			Code:        IssueInvalid,
+			Diagnostics: fmt.Sprintf("resource is not a json object: %v", err),
+		}}}
+	}
+
+	switch header.ResourceType {
+	case ResourceMedicationStatement:
+		var st MedicationStatement
+		if err := json.Unmarshal(raw, &st); err != nil {
+			return invalidResource(header.ResourceType, err)
+		}
+		return importStatement(raw, st)
+	case ResourceMedicationRequest:
+		var req MedicationRequest
+		if err := json.Unmarshal(raw, &req); err != nil {
+			return invalidResource(header.ResourceType, err)
+		}
+		return importRequest(raw, req)
+	default:
+		return Imported{Issues: []Issue{{
+			Severity:    SeverityError,
+			Code:        IssueNotSupported,
+			Diagnostics: fmt.Sprintf("resource type <%s> is not supported", header.ResourceType),
+		}}}
+	}
+}
+
+func invalidResource(resourceType string, err error) Imported {
+	return Imported{Issues: []Issue{{
+		Severity:    SeverityError,
+		Code:        IssueInvalid,
+		Diagnostics: fmt.Sprintf("malformed %s: %v", resourceType, err),
+	}}}
+}
+
+func importStatement(raw json.RawMessage, st MedicationStatement) Imported {
+	im := &importer{resourceType: ResourceMedicationStatement}
+	im.checkUnknownFields(raw, statementFields)
+
+	var data model.MedicationData
+	if status, ok := ParseStatementStatus(st.Status); ok {
+		data.Status = status
+	} else {
+		im.report(SeverityError, IssueNotSupported, "status", "status <%s> can't be mapped", st.Status)
+	}
+	if len(st.StatusReason) > 0 {
+		data.StatusReason = im.conceptText(st.StatusReason[0], "statusReason")
+		if len(st.StatusReason) > 1 {
+			im.report(SeverityWarning, IssueNotSupported, "statusReason", "only the first status reason is imported")
+		}
+	}
+
+	data.Name, data.Form = im.medication(st.MedicationCodeableConcept, st.MedicationReference, st.Contained)
+	data.Dosage = im.dosage(st.Dosage, "dosage")
+	if st.EffectivePeriod != nil {
+		data.StartDate = im.date(st.EffectivePeriod.Start, "effectivePeriod.start")
+		data.EndDate = im.date(st.EffectivePeriod.End, "effectivePeriod.end")
+	}
+	if st.InformationSource != nil {
+		data.Prescriber = im.prescriber(*st.InformationSource)
+	}
+	data.Indication = im.indication(st.ReasonCode)
+
+	return im.result(st.Id, data)
+}
+
+func importRequest(raw json.RawMessage, req MedicationRequest) Imported {
+	im := &importer{resourceType: ResourceMedicationRequest}
+	im.checkUnknownFields(raw, requestFields)
+
+	var data model.MedicationData
+	if status, ok := requestStatuses[req.Status]; ok {
+		data.Status = status
+	} else {
+		im.report(SeverityError, IssueNotSupported, "status", "status <%s> can't be mapped", req.Status)
+	}
+	if req.StatusReason != nil {
+		data.StatusReason = im.conceptText(*req.StatusReason, "statusReason")
+	}
+	if req.Intent != "" && req.Intent != "order" {
+		im.report(SeverityWarning, IssueNotSupported, "intent", "intent <%s> is imported as an order", req.Intent)
+	}
+
+	data.Name, data.Form = im.medication(req.MedicationCodeableConcept, req.MedicationReference, req.Contained)
+	data.Dosage = im.dosage(req.DosageInstruction, "dosageInstruction")
+	if req.DispenseRequest != nil && req.DispenseRequest.ValidityPeriod != nil {
+		data.StartDate = im.date(req.DispenseRequest.ValidityPeriod.Start, "dispenseRequest.validityPeriod.start")
+		data.EndDate = im.date(req.DispenseRequest.ValidityPeriod.End, "dispenseRequest.validityPeriod.end")
+	}
+	if req.Requester != nil {
+		data.Prescriber = im.prescriber(*req.Requester)
+	}
+	data.Indication = im.indication(req.ReasonCode)
+
+	return im.result(req.Id, data)
+}
+
+func (im *importer) result(id string, data model.MedicationData) Imported {
+	if id == "" {
+		im.report(SeverityError, IssueRequired, "id", "id is required as it identifies the medication")
+	}
+	if len(id) >= 64 {
+		im.report(SeverityError, IssueInvalid, "id", "id must be less than 64 characters")
+	}
+	if data.Status == model.StatusDiscontinued && data.StatusReason == "" {
+		im.report(SeverityError, IssueRequired, "statusReason", "status reason is required for stopped medications")
+	}
+	for _, f := range []struct{ field, value string }{
+		{field: "medication", value: data.Name},
+		{field: "dosage", value: data.Dosage},
+		{field: "statusReason", value: data.StatusReason},
+	} {
+		if len(f.value) >= maxFieldLength {
+			im.report(SeverityError, IssueInvalid, f.field, "value must be less than %d characters", maxFieldLength)
+		}
+	}
+
+	return Imported{
+		Id:     id,
+		Data:   data,
+		Issues: im.issues,
+	}
+}
+
+func (im *importer) checkUnknownFields(raw json.RawMessage, known fields) {
+	unknown := make(map[string]struct{})
+	collectUnknownFields(raw, known, "", unknown)
+	for _, path := range slices.Sorted(maps.Keys(unknown)) {
+		im.report(SeverityWarning, IssueNotSupported, path, "field is not supported and was dropped")
+	}
+}
+
+// collectUnknownFields walks objects and arrays of objects. Same path in several array items is reported once.
+func collectUnknownFields(raw json.RawMessage, known fields, prefix string, unknown map[string]struct{}) {
+	var items []json.RawMessage
+	if err := json.Unmarshal(raw, &items); err == nil {
+		for _, item := range items {
+			collectUnknownFields(item, known, prefix, unknown)
+		}
+		return
+	}
+
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &object); err != nil {
+		return // Already reported by the caller
+	}
+	for field, value := range object {
+		nested, ok := known[field]
+		switch {
+		case !ok:
+			unknown[prefix+field] = struct{}{}
+		case nested != nil:
+			collectUnknownFields(value, nested, prefix+field+".", unknown)
+		}
+	}
+}
+
+func (im *importer) medication(concept *CodeableConcept, ref *Reference, contained []Medication) (string, model.Form) {
+	var med *Medication
+	if ref != nil {
+		if !strings.HasPrefix(ref.Reference, "#") {
+			im.report(SeverityError, IssueNotSupported, "medicationReference",
+				"only references to contained resources are supported, got <%s>", ref.Reference)
+			return "", ""
+		}
+		for i := range contained {
+			if contained[i].Id == strings.TrimPrefix(ref.Reference, "#") {
+				med = &contained[i]
+			}
+		}
+		if med == nil {
+			im.report(SeverityError, IssueNotFound, "medicationReference", "contained <%s> is not found", ref.Reference)
+			return "", ""
+		}
+		concept = med.Code
+	}
+
+	var name string
+	if concept != nil {
+		name = im.conceptText(*concept, "medication")
+	}
+	if name == "" {
+		im.report(SeverityError, IssueRequired, "medication", "medication name is required")
+	}
+
+	if med == nil || med.Form == nil {
+		im.report(SeverityError, IssueRequired, "medication", "form is required, use a contained Medication with form")
+		return name, ""
+	}
+
+	rawForm := med.Form.Text
+	for _, c := range med.Form.Coding {
+		if c.System == FormSystem {
+			rawForm = c.Code
+		}
+	}
+	if rawForm == "" && len(med.Form.Coding) > 0 {
+		rawForm = med.Form.Coding[0].Display
+	}
+	form, ok := model.ParseForm(rawForm)
+	if !ok {
+		im.report(SeverityError, IssueNotSupported, "medication", "form <%s> is not supported", rawForm)
+	}
+	return name, form
+}
+
+func (im *importer) dosage(dosages []Dosage, field string) string {
+	if len(dosages) == 0 {
+		im.report(SeverityError, IssueRequired, field, "dosage is required")
+		return ""
+	}
+	if len(dosages) > 1 {
+		im.report(SeverityWarning, IssueNotSupported, field, "only the first dosage is imported")
+	}
+
+	d := dosages[0]
+	if d.Text != "" {
+		return d.Text
+	}
+	if len(d.DoseAndRate) > 0 && d.DoseAndRate[0].DoseQuantity != nil {
+		q := d.DoseAndRate[0].DoseQuantity
+		return strconv.FormatFloat(q.Value, 'f', -1, 64) + q.Unit
+	}
+	im.report(SeverityError, IssueRequired, field, "dosage must have text or doseQuantity")
+	return ""
+}
+
+// date converts FHIR date or dateTime to a date. Time part is dropped.
+func (im *importer) date(value string, field string) string {
+	if value == "" {
+		return ""
+	}
+	if len(value) > len(time.DateOnly) {
+		im.report(SeverityInformation, IssueNotSupported, field, "time part of <%s> was dropped", value)
+		value = value[:len(time.DateOnly)]
+	}
+	if _, err := time.Parse(time.DateOnly, value); err != nil {
+		im.report(SeverityError, IssueInvalid, field, "<%s> is not a full date", value)
+		return ""
+	}
+	return value
+}
+
+func (im *importer) prescriber(ref Reference) model.Prescriber {
+	p := model.Prescriber{Name: ref.Display}
+	switch {
+	case ref.Identifier != nil:
+		p.Id = ref.Identifier.Value
+	case ref.Reference != "":
+		p.Id = ref.Reference
+	}
+	return p
+}
+
+func (im *importer) indication(reasons []CodeableConcept) model.Indication {
+	if len(reasons) == 0 {
+		return model.Indication{}
+	}
+	if len(reasons) > 1 {
+		im.report(SeverityWarning, IssueNotSupported, "reasonCode", "only the first reason is imported")
+	}
+
+	reason := reasons[0]
+	ind := model.Indication{Text: reason.Text}
+	if len(reason.Coding) > 0 {
+		ind.Code = reason.Coding[0].Code
+		ind.System = reason.Coding[0].System
+		if ind.Text == "" {
+			ind.Text = reason.Coding[0].Display
+		}
+		if len(reason.Coding) > 1 {
+			im.report(SeverityWarning, IssueNotSupported, "reasonCode.coding", "only the first coding is imported")
+		}
+	}
+	return ind
+}
+
+func (im *importer) conceptText(concept CodeableConcept, field string) string {
+	if concept.Text != "" {
+		return concept.Text
+	}
+	for _, c := range concept.Coding {
+		if c.Display != "" {
+			return c.Display
+		}
+	}
+	if len(concept.Coding) > 0 {
+		im.report(SeverityWarning, IssueNotSupported, field, "coding without text or display, code is used as text")
+		return concept.Coding[0].Code
+	}
+	return ""
+}
@@ -0,0 +1,175 @@
+package fhir
+
+import (
+	"encoding/json"
+)
+
+// Only a subset of FHIR R4 is modelled here: what's needed to represent model.Medication.
+// See https://hl7.org/fhir/R4/medicationstatement.html and https://hl7.org/fhir/R4/medicationrequest.html
+
+const (
+	ContentType = "application/fhir+json"
+
+	ResourceBundle              = "Bundle"
+	ResourceMedication          = "Medication"
+	ResourceMedicationStatement = "MedicationStatement"
+	ResourceMedicationRequest   = "MedicationRequest"
+	ResourceOperationOutcome    = "OperationOutcome"
+)
+
+type Meta struct {
+	VersionId string `json:"versionId,omitempty"`
+}
+
+type Coding struct {
+	System  string `json:"system,omitempty"`
+	Code    string `json:"code,omitempty"`
+	Display string `json:"display,omitempty"`
+}
+
+type CodeableConcept struct {
+	Coding []Coding `json:"coding,omitempty"`
+	Text   string   `json:"text,omitempty"`
+}
+
+type Reference struct {
+	Reference  string      `json:"reference,omitempty"`
+	Identifier *Identifier `json:"identifier,omitempty"`
+	Display    string      `json:"display,omitempty"`
+}
+
+type Identifier struct {
+	System string `json:"system,omitempty"`
+	Value  string `json:"value,omitempty"`
+}
+
+type Period struct {
+	Start string `json:"start,omitempty"`
+	End   string `json:"end,omitempty"`
+}
+
+type Quantity struct {
+	Value float64 `json:"value,omitempty"`
+	Unit  string  `json:"unit,omitempty"`
+}
+
+type DoseAndRate struct {
+	DoseQuantity *Quantity `json:"doseQuantity,omitempty"`
+}
+
+type TimingRepeat struct {
+	BoundsPeriod *Period `json:"boundsPeriod,omitempty"`
+}
+
+type Timing struct {
+	Repeat *TimingRepeat `json:"repeat,omitempty"`
+}
+
+type Dosage struct {
+	Text        string        `json:"text,omitempty"`
+	Timing      *Timing       `json:"timing,omitempty"`
+	DoseAndRate []DoseAndRate `json:"doseAndRate,omitempty"`
+}
+
+// Medication is only used as a contained resource to carry the form.
+type Medication struct {
+	ResourceType string           `json:"resourceType"`
+	Id           string           `json:"id,omitempty"`
+	Code         *CodeableConcept `json:"code,omitempty"`
+	Form         *CodeableConcept `json:"form,omitempty"`
+}
+
+type MedicationStatement struct {
+	ResourceType              string            `json:"resourceType"`
+	Id                        string            `json:"id,omitempty"`
+	Meta                      *Meta             `json:"meta,omitempty"`
+	Contained                 []Medication      `json:"contained,omitempty"`
+	Status                    string            `json:"status"`
+	StatusReason              []CodeableConcept `json:"statusReason,omitempty"`
+	MedicationCodeableConcept *CodeableConcept  `json:"medicationCodeableConcept,omitempty"`
+	MedicationReference       *Reference        `json:"medicationReference,omitempty"`
+	Subject                   Reference         `json:"subject"`
+	EffectivePeriod           *Period           `json:"effectivePeriod,omitempty"`
+	InformationSource         *Reference        `json:"informationSource,omitempty"`
+	ReasonCode                []CodeableConcept `json:"reasonCode,omitempty"`
+	Dosage                    []Dosage          `json:"dosage,omitempty"`
+}
+
+type DispenseRequest struct {
+	ValidityPeriod *Period `json:"validityPeriod,omitempty"`
+}
+
+type MedicationRequest struct {
+	ResourceType              string            `json:"resourceType"`
+	Id                        string            `json:"id,omitempty"`
+	Meta                      *Meta             `json:"meta,omitempty"`
+	Contained                 []Medication      `json:"contained,omitempty"`
+	Status                    string            `json:"status"`
+	StatusReason              *CodeableConcept  `json:"statusReason,omitempty"`
+	Intent                    string            `json:"intent"`
+	MedicationCodeableConcept *CodeableConcept  `json:"medicationCodeableConcept,omitempty"`
+	MedicationReference       *Reference        `json:"medicationReference,omitempty"`
+	Subject                   Reference         `json:"subject"`
+	Requester                 *Reference        `json:"requester,omitempty"`
+	ReasonCode                []CodeableConcept `json:"reasonCode,omitempty"`
+	DosageInstruction         []Dosage          `json:"dosageInstruction,omitempty"`
+	DispenseRequest           *DispenseRequest  `json:"dispenseRequest,omitempty"`
+}
+
+type BundleLink struct {
+	Relation string `json:"relation"`
+	Url      string `json:"url"`
+}
+
+type BundleEntryResponse struct {
+	Status   string            `json:"status"`
+	Location string            `json:"location,omitempty"`
+	Etag     string            `json:"etag,omitempty"`
+	Outcome  *OperationOutcome `json:"outcome,omitempty"`
+}
+
+type BundleEntry struct {
+	FullUrl  string               `json:"fullUrl,omitempty"`
+	Resource json.RawMessage      `json:"resource,omitempty"`
+	Response *BundleEntryResponse `json:"response,omitempty"`
+}
+
+type Bundle struct {
+	ResourceType string        `json:"resourceType"`
+	Type         string        `json:"type"`
+	Link         []BundleLink  `json:"link,omitempty"`
+	Entry        []BundleEntry `json:"entry"`
+}
+
+const (
+	SeverityError       = "error"
+	SeverityWarning     = "warning"
+	SeverityInformation = "information"
+
+	IssueInvalid      = "invalid"
+	IssueNotSupported = "not-supported"
+	IssueRequired     = "required"
+	IssueNotFound     = "not-found"
+	IssueConflict     = "conflict"
+	IssueException    = "exception"
+	IssueTransient    = "transient"
+)
+
+type Issue struct {
+	Severity    string   `json:"severity"`
+	Code        string   `json:"code"`
+	Diagnostics string   `json:"diagnostics,omitempty"`
+	Expression  []string `json:"expression,omitempty"`
+}
+
+type OperationOutcome struct {
+	ResourceType string  `json:"resourceType"`
+	Issue        []Issue `json:"issue"`
+}
+
+func NewOperationOutcome(issues ...Issue) *OperationOutcome {
+	return &OperationOutcome{
+		ResourceType: ResourceOperationOutcome,
+		Issue:        issues,
+	}
+}
@@ -0,0 +1,183 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/chestnut42/test-medication/internal/utils/logx"
+)
+
+// Liveness only tells the process is able to serve requests. It must not depend on anything external,
+// otherwise an outage of a dependency restarts every replica.
+//
+// Readiness runs dependency checks. Results are cached, so that frequent probes from many load balancers
+// don't turn into load on dependencies. Each check has a timeout, so that a hanging dependency doesn't hang the probe.
+
+type CheckFunc func(ctx context.Context) error
+
+type Config struct {
+	CacheTTL time.Duration
+	Timeout  time.Duration
+}
+
+type check struct {
+	name string
+	fn   CheckFunc
+
+	mu        sync.Mutex
+	err       error
+	checkedAt time.Time
+}
+
+type Service struct {
+	cfg      Config
+	checks   []*check
+	draining atomic.Bool
+
+	now func() time.Time
+}
+
+func NewService(cfg Config) *Service {
+	return &Service{
+		cfg: cfg,
+		now: time.Now,
+	}
+}
+
+// AddCheck registers a readiness check. Must be called before serving probes.
+func (s *Service) AddCheck(name string, fn CheckFunc) {
+	s.checks = append(s.checks, &check{name: name, fn: fn})
+}
+
+// Drain makes the service not ready. It's called on shutdown before the servers stop,
+// so that load balancers stop routing new requests first.
+func (s *Service) Drain() {
+	s.draining.Store(true)
+}
+
+type CheckResult struct {
+	Name      string
+	Err       error
+	CheckedAt time.Time
+}
+
+type Report struct {
+	Ready    bool
+	Draining bool
+	Checks   []CheckResult
+}
+
+// Ready runs the checks concurrently. Results younger than CacheTTL are reused.
+func (s *Service) Ready(ctx context.Context) Report {
+	report := Report{
+		Ready:    true,
+		Draining: s.draining.Load(),
+		Checks:   make([]CheckResult, len(s.checks)),
+	}
+
+	wg := &sync.WaitGroup{}
+	for i, c := range s.checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			report.Checks[i] = s.run(ctx, c)
+		}()
+	}
+	wg.Wait()
+
+	if report.Draining {
+		report.Ready = false
+	}
+	for _, c := range report.Checks {
+		if c.Err != nil {
+			report.Ready = false
+		}
+	}
+	return report
+}
+
+func (s *Service) run(ctx context.Context, c *check) CheckResult {
+	// Holding the lock while checking makes concurrent probes wait for one result instead of piling up.
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.checkedAt.IsZero() && s.now().Sub(c.checkedAt) < s.cfg.CacheTTL {
+		return CheckResult{Name: c.name, Err: c.err, CheckedAt: c.checkedAt}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.Timeout)
+	defer cancel()
+
+	err := c.fn(ctx)
+	if err != nil {
+		err = fmt.Errorf("check %s: %w", c.name, err)
+		if c.err == nil {
+			logx.Logger(ctx).Warn("readiness check failed", slog.String("check", c.name), slog.Any("error", err))
+		}
+	} else if c.err != nil {
+		logx.Logger(ctx).Info("readiness check recovered", slog.String("check", c.name))
+	}
+	c.err = err
+	c.checkedAt = s.now()
+	return CheckResult{Name: c.name, Err: c.err, CheckedAt: c.checkedAt}
+}
+
+type checkJson struct {
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checkedAt"`
+}
+
+type reportJson struct {
+	Status string               `json:"status"`
+	Checks map[string]checkJson `json:"checks"`
+}
+
+// Livez always returns 200 while the process is running.
+func Livez() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+}
+
+// Readyz returns 200 if all checks pass and the service is not draining, 503 otherwise.
+// The body lists every check.
+func Readyz(s *Service) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := s.Ready(r.Context())
+
+		out := reportJson{
+			Status: "ok",
+			Checks: make(map[string]checkJson, len(report.Checks)),
+		}
+		for _, c := range report.Checks {
+			cj := checkJson{Status: "ok", CheckedAt: c.CheckedAt}
+			if c.Err != nil {
+				cj.Status = "failed"
+				cj.Error = c.Err.Error()
+			}
+			out.Checks[c.Name] = cj
+		}
+
+		code := http.StatusOK
+		switch {
+		case report.Draining:
+			out.Status, code = "draining", http.StatusServiceUnavailable
+		case !report.Ready:
+			out.Status, code = "failed", http.StatusServiceUnavailable
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(code)
+		if err := json.NewEncoder(w).Encode(out); err != nil {
+			logx.Logger(r.Context()).Error("writing response", slog.Any("error", err))
+		}
+	})
+}
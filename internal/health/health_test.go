@@ -0,0 +1,88 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReady(t *testing.T) {
+	ctx := context.Background()
+	svc := NewService(Config{CacheTTL: time.Second, Timeout: 50 * time.Millisecond})
+	now := time.Now()
+	svc.now = func() time.Time { return now }
+
+	calls := 0
+	var dbErr error
+	svc.AddCheck("db", func(context.Context) error {
+		calls++
+		return dbErr
+	})
+	svc.AddCheck("slow", func(ctx context.Context) error {
+		<-ctx.Done() // Never answers, must be cut by the timeout
+		return ctx.Err()
+	})
+
+	report := svc.Ready(ctx)
+	if report.Ready {
+		t.Fatalf("must not be ready with a hanging check")
+	}
+	if report.Checks[0].Err != nil || !errors.Is(report.Checks[1].Err, context.DeadlineExceeded) {
+		t.Fatalf("unexpected checks: %v", report.Checks)
+	}
+
+	// Cached
+	dbErr = errors.New("boom")
+	if report := svc.Ready(ctx); report.Checks[0].Err != nil || calls != 1 {
+		t.Fatalf("cache was not used: %v, calls: %d", report.Checks, calls)
+	}
+	now = now.Add(2 * time.Second)
+	if report := svc.Ready(ctx); report.Checks[0].Err == nil || calls != 2 {
+		t.Fatalf("cache has not expired: %v, calls: %d", report.Checks, calls)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	svc := NewService(Config{CacheTTL: 0, Timeout: time.Second})
+	var dbErr error
+	svc.AddCheck("db", func(context.Context) error { return dbErr })
+
+	tests := []struct {
+		name       string
+		dbErr      error
+		drain      bool
+		wantCode   int
+		wantStatus string
+		wantCheck  string
+	}{
+		{name: "ok", wantCode: http.StatusOK, wantStatus: "ok", wantCheck: "ok"},
+		{name: "failed", dbErr: errors.New("boom"), wantCode: http.StatusServiceUnavailable, wantStatus: "failed", wantCheck: "failed"},
+		{name: "draining", drain: true, wantCode: http.StatusServiceUnavailable, wantStatus: "draining", wantCheck: "ok"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dbErr = tt.dbErr
+			if tt.drain {
+				svc.Drain()
+			}
+
+			rec := httptest.NewRecorder()
+			Readyz(svc).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			if rec.Code != tt.wantCode {
+				t.Fatalf("got code %d, want %d", rec.Code, tt.wantCode)
+			}
+
+			var out reportJson
+			if err := json.Unmarshal(rec.Body.Bytes(), &out); err != nil {
+				t.Fatalf("failed to decode body: %v", err)
+			}
+			if out.Status != tt.wantStatus || out.Checks["db"].Status != tt.wantCheck {
+				t.Fatalf("unexpected body: %s", rec.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package medication
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/chestnut42/test-medication/internal/model"
+	"github.com/chestnut42/test-medication/internal/storage"
+	"github.com/chestnut42/test-medication/internal/utils/tracing"
+)
+
+// Changes is a delta sync for offline-first clients. A client keeps the token of its last sync and gets everything
+// created, updated or deleted since then from the owner's change log (see storage.Storage). Every result has a fresh
+// token. If the log can't tell what has changed (no token yet, changes expired or wiped), the result asks for
+// a full resync: the client lists all medications and continues with the token it has got, which was issued before
+// the list, so nothing is missed. Changes may repeat what the list has returned, versions tell which is newer.
+
+type ChangesQuery struct {
+	Tenant string
+	Owner  string
+	Token  string // Empty means the client has never synced
+	Limit  int32
+}
+
+type Change struct {
+	Medication model.Medication // Only identity and version if deleted
+	Deleted    bool
+}
+
+type ChangesResult struct {
+	Changes        []Change
+	Token          string
+	HasMore        bool // More changes are available with Token
+	ResyncRequired bool // The client must list all medications, Changes are empty
+}
+
+const (
+	DefaultChangesLimit = 100
+	MaxChangesLimit     = 1000
+)
+
+// changesToken is the owner and the last change the client has got.
+type changesToken struct {
+	Tenant string `json:"t"`
+	Owner  string `json:"o"`
+	Seq    int64  `json:"s"`
+}
+
+func (s *Service) Changes(ctx context.Context, query ChangesQuery) (_ ChangesResult, err error) {
+	ctx, span := tracer.Start(ctx, "medication.Changes", trace.WithAttributes(
+		attribute.String("med.tenant", query.Tenant),
+		attribute.String("med.owner", query.Owner)))
+	defer func() { tracing.End(span, err) }()
+
+	if query.Owner == "" || query.Tenant == "" {
+		return ChangesResult{}, errors.New("owner and tenant are required")
+	}
+	limit := query.Limit
+	if limit <= 0 {
+		limit = DefaultChangesLimit
+	}
+	limit = min(limit, MaxChangesLimit)
+
+	after := int64(0)
+	resync := query.Token == ""
+	if !resync {
+		if after, err = decodeChangesToken(query); err != nil {
+			return ChangesResult{}, err
+		}
+	}
+	span.SetAttributes(attribute.Int64("med.changes.after", after))
+
+	var res storage.ChangesResult
+	if !resync {
+		res, err = s.store.ListChanges(ctx, storage.ChangesQuery{Tenant: query.Tenant, Owner: query.Owner, After: after, Limit: limit})
+		resync = errors.Is(err, storage.ErrChangesExpired)
+		if err != nil && !resync {
+			return ChangesResult{}, fmt.Errorf("listing changes: %w", err)
+		}
+	}
+	if resync {
+		span.SetAttributes(attribute.Bool("med.changes.resync", true))
+		res, err = s.store.ListChanges(ctx, storage.ChangesQuery{Tenant: query.Tenant, Owner: query.Owner})
+		if err != nil {
+			return ChangesResult{}, fmt.Errorf("getting the last change: %w", err)
+		}
+		after = res.Last
+	}
+
+	out := ChangesResult{Changes: make([]Change, 0, len(res.Changes)), ResyncRequired: resync}
+	for _, c := range res.Changes {
+		m := c.Medication
+		if !c.Deleted {
+			m.Status = m.Status.OrActive()
+		}
+		out.Changes = append(out.Changes, Change{Medication: m, Deleted: c.Deleted})
+		after = c.Seq
+	}
+	out.HasMore = after < res.Last
+	if out.Token, err = encodeChangesToken(changesToken{Tenant: query.Tenant, Owner: query.Owner, Seq: after}); err != nil {
+		return ChangesResult{}, err
+	}
+	return out, nil
+}
+
+func encodeChangesToken(t changesToken) (string, error) {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal token: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// decodeChangesToken returns the last change of the token. Tokens of other owners are ErrBadInput.
+func decodeChangesToken(query ChangesQuery) (int64, error) {
+	data, err := base64.RawURLEncoding.DecodeString(query.Token)
+	if err != nil {
+		return 0, fmt.Errorf("token is not base64: %w", ErrBadInput)
+	}
+	var t changesToken
+	if err := json.Unmarshal(data, &t); err != nil {
+		return 0, fmt.Errorf("token is not json: %w", ErrBadInput)
+	}
+	if t.Tenant != query.Tenant || t.Owner != query.Owner || t.Seq < 0 {
+		return 0, fmt.Errorf("token is not valid for the owner: %w", ErrBadInput)
+	}
+	return t.Seq, nil
+}
@@ -0,0 +1,110 @@
+package medication
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/chestnut42/test-medication/internal/model"
+	"github.com/chestnut42/test-medication/internal/storage/memory"
+)
+
+func TestChanges(t *testing.T) {
+	ctx := t.Context()
+	store := memory.New()
+	svc := NewService(store, nil)
+	query := ChangesQuery{Tenant: "acme", Owner: "owner", Limit: 2}
+
+	create := func(id string) model.Medication {
+		m := model.Medication{
+			Identity:       model.Identity{Id: id, Owner: "owner", Tenant: "acme"},
+			MedicationData: model.MedicationData{Name: "Paracetamol", Dosage: "500mg", Form: model.FormTablet},
+			Version:        "v1",
+		}
+		if err := store.CreateMedication(ctx, m); err != nil {
+			t.Fatalf("failed to create: %v", err)
+		}
+		return m
+	}
+	create("a")
+
+	// The first sync is a resync, the token is issued before the client lists medications
+	res, err := svc.Changes(ctx, query)
+	if err != nil {
+		t.Fatalf("failed to get changes: %v", err)
+	}
+	if !res.ResyncRequired || len(res.Changes) != 0 || res.HasMore || res.Token == "" {
+		t.Fatalf("got %+v, expected a resync", res)
+	}
+
+	create("b")
+	create("c")
+	if _, err := store.DeleteMedication(ctx, model.Identity{Id: "a", Owner: "owner", Tenant: "acme"}); err != nil {
+		t.Fatalf("failed to delete: %v", err)
+	}
+
+	var got []Change
+	query.Token = res.Token
+	for {
+		if res, err = svc.Changes(ctx, query); err != nil {
+			t.Fatalf("failed to get changes: %v", err)
+		}
+		if res.ResyncRequired {
+			t.Fatalf("got %+v, expected changes", res)
+		}
+		got = append(got, res.Changes...)
+		query.Token = res.Token
+		if !res.HasMore {
+			break
+		}
+	}
+	if len(got) != 3 || got[0].Medication.Id != "b" || got[1].Medication.Status != model.StatusActive ||
+		!got[2].Deleted || got[2].Medication.Id != "a" {
+		t.Fatalf("got %+v, expected b, c and a deleted", got)
+	}
+
+	// Nothing new, the same token works again
+	res, err = svc.Changes(ctx, query)
+	if err != nil || len(res.Changes) != 0 || res.Token != query.Token {
+		t.Fatalf("got %+v, %v, expected no changes", res, err)
+	}
+
+	if _, err := store.WipeTenant(ctx, "acme"); err != nil {
+		t.Fatalf("failed to wipe: %v", err)
+	}
+	res, err = svc.Changes(ctx, query)
+	if err != nil || !res.ResyncRequired || res.Token == query.Token {
+		t.Fatalf("got %+v, %v, expected a resync with a new token", res, err)
+	}
+}
+
+func TestChangesToken(t *testing.T) {
+	svc := NewService(memory.New(), nil)
+	token, err := encodeChangesToken(changesToken{Tenant: "acme", Owner: "owner", Seq: 1})
+	if err != nil {
+		t.Fatalf("failed to encode: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		query   ChangesQuery
+		wantErr error
+	}{
+		{name: "valid", query: ChangesQuery{Tenant: "acme", Owner: "owner", Token: token}},
+		{name: "other owner", query: ChangesQuery{Tenant: "acme", Owner: "other", Token: token}, wantErr: ErrBadInput},
+		{name: "other tenant", query: ChangesQuery{Tenant: "globex", Owner: "owner", Token: token}, wantErr: ErrBadInput},
+		{name: "not base64", query: ChangesQuery{Tenant: "acme", Owner: "owner", Token: "!"}, wantErr: ErrBadInput},
+		{name: "not json", query: ChangesQuery{Tenant: "acme", Owner: "owner", Token: "YWJj"}, wantErr: ErrBadInput},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res, err := svc.Changes(t.Context(), tt.query)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error: %v, expected: %v", err, tt.wantErr)
+			}
+			// A token ahead of the empty log expires
+			if err == nil && !res.ResyncRequired {
+				t.Fatalf("got %+v, expected a resync", res)
+			}
+		})
+	}
+}
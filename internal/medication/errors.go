@@ -2,10 +2,50 @@ package medication
 
 import (
 	"errors"
+	"fmt"
+
+	"github.com/chestnut42/test-medication/internal/model"
 )
 
 var (
-	ErrAlreadyExists = errors.New("conflict")
-	ErrNotFound      = errors.New("not found")
-	ErrBadInput      = errors.New("bad request")
+	ErrAlreadyExists     = errors.New("conflict")
+	ErrNotFound          = errors.New("not found")
+	ErrBadInput          = errors.New("bad request")
+	ErrVersionConflict   = errors.New("version conflict")
+	ErrInvalidTransition = errors.New("invalid status transition")
 )
+
+// FieldError is a validation error of a particular field. It wraps ErrBadInput.
+type FieldError struct {
+	Field string
+	err   error
+}
+
+func badField(field string, format string, args ...any) error {
+	return &FieldError{
+		Field: field,
+		err:   fmt.Errorf("%s: %w", fmt.Sprintf(format, args...), ErrBadInput),
+	}
+}
+
+func (e *FieldError) Error() string {
+	return e.err.Error()
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.err
+}
+
+// MovedError is returned for a medication that has been moved to another owner, see transfer. It wraps ErrNotFound.
+type MovedError struct {
+	Identity model.Identity
+	Target   model.Identity
+}
+
+func (e *MovedError) Error() string {
+	return fmt.Sprintf("medication %v has been moved to %v: %v", e.Identity, e.Target, ErrNotFound)
+}
+
+func (e *MovedError) Unwrap() error {
+	return ErrNotFound
+}
@@ -0,0 +1,76 @@
+package medication
+
+import (
+	"context"
+	"errors"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+
+	"github.com/chestnut42/test-medication/internal/model"
+	"github.com/chestnut42/test-medication/internal/utils/metrics"
+)
+
+// maxTenantLabels bounds the tenant label. There are only a few partners, so hitting it means something is off.
+const maxTenantLabels = 100
+
+const (
+	operationCreate  = "create"
+	operationUpdate  = "update"
+	operationDelete  = "delete"
+	operationRestore = "restore"
+)
+
+type serviceMetrics struct {
+	changes            metric.Int64Counter
+	versionConflicts   metric.Int64Counter
+	validationFailures metric.Int64Counter
+
+	tenants *metrics.BoundedLabel
+}
+
+func newServiceMetrics() *serviceMetrics {
+	meter := metrics.Meter("github.com/chestnut42/test-medication/internal/medication")
+	// Instruments never fail with a valid name
+	changes, _ := meter.Int64Counter("medication.changes",
+		metric.WithDescription("Medications created, updated, deleted and restored"))
+	versionConflicts, _ := meter.Int64Counter("medication.version_conflicts",
+		metric.WithDescription("Updates rejected because the medication was changed concurrently"))
+	validationFailures, _ := meter.Int64Counter("medication.validation_failures",
+		metric.WithDescription("Changes rejected by business validation, by field"))
+	return &serviceMetrics{
+		changes:            changes,
+		versionConflicts:   versionConflicts,
+		validationFailures: validationFailures,
+		tenants:            metrics.NewBoundedLabel(maxTenantLabels),
+	}
+}
+
+// record is called with the outcome of a change.
+func (m *serviceMetrics) record(ctx context.Context, operation string, tenant string, form model.Form, err error) {
+	tenantAttr := attribute.String("tenant", m.tenants.Value(tenant))
+
+	var fieldErr *FieldError
+	switch {
+	case err == nil:
+		m.changes.Add(ctx, 1, metric.WithAttributes(
+			attribute.String("operation", operation),
+			attribute.String("form", formLabel(form)),
+			tenantAttr))
+	case errors.Is(err, ErrVersionConflict):
+		m.versionConflicts.Add(ctx, 1, metric.WithAttributes(tenantAttr))
+	case errors.As(err, &fieldErr):
+		m.validationFailures.Add(ctx, 1, metric.WithAttributes(
+			attribute.String("operation", operation),
+			attribute.String("field", fieldErr.Field),
+			tenantAttr))
+	}
+}
+
+// formLabel is bounded by the catalogue.
+func formLabel(form model.Form) string {
+	if f, ok := model.CurrentCatalogue().Lookup(string(form)); ok {
+		return string(f.Code)
+	}
+	return metrics.OtherLabel
+}
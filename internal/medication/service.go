@@ -4,11 +4,19 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/chestnut42/test-medication/internal/model"
 	"github.com/chestnut42/test-medication/internal/storage"
+	"github.com/chestnut42/test-medication/internal/utils/tracing"
 )
 
 // This is a package for business logic. Given the simplicity of the task it could have been omitted.
@@ -27,37 +35,82 @@ import (
 //    the case. We should have at least {number: int, unit: string}. So that 500mg is {number: 500, unit: "mg"}.
 //    On top of it - units should be validated against form and the drug, e.g. given it's Paracetamol in Tablet
 //    the unit can't be "ml". TODO: validate and structure the dosage
-// 4. Very likely, form is a short enum. It should be confirmed, of course. But it's very likely enum, thus I'm
-//    implementing an enum here.
+// 4. Forms come from a catalogue (see model.Catalogue) that can be extended without a release. Each form lists
+//    dosage units it allows, so "5ml" tablet is rejected here. Dosage is still a free text, so the unit is only
+//    checked if the dosage looks like amount+unit.
 // 5. We have Version<>Conflict logic for updates. I'd rather have it here instead of adding complexity to storage layer.
+// 6. Prescription status is a state machine (see model.Status). Transitions are validated here as they depend on
+//    the stored state.
+// 7. Tenants can restrict allowed forms and require strict names. See model.TenantSettings.
+// 8. Offline-first clients sync with Changes, see changes.go.
 
 type Storage interface {
 	CreateMedication(ctx context.Context, medication model.Medication) error
+	GetMedication(ctx context.Context, identity model.Identity) (model.Medication, error)
+	UpdateMedication(ctx context.Context, oldVersion string, medication model.Medication) (model.Medication, error)
+	DeleteMedication(ctx context.Context, identity model.Identity) (model.Medication, error)
+	ListMedications(ctx context.Context, query storage.ListQuery) (storage.ListResult, error)
+	ListChanges(ctx context.Context, query storage.ChangesQuery) (storage.ChangesResult, error)
+}
+
+type TenantSettings interface {
+	Settings(ctx context.Context, tenant string) (model.TenantSettings, error)
+}
+
+var tracer = otel.Tracer("github.com/chestnut42/test-medication/internal/medication")
+
+func identityAttributes(identity model.Identity) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("med.tenant", identity.Tenant),
+		attribute.String("med.owner", identity.Owner),
+		attribute.String("med.id", identity.Id),
+	}
 }
 
 type NewVersionFunc func() string
 
 type Service struct {
-	store Storage
+	store   Storage
+	tenants TenantSettings
+	metrics *serviceMetrics
 
 	newVersion NewVersionFunc
 }
 
-func NewService(store Storage) *Service {
+func NewService(store Storage, tenants TenantSettings) *Service {
 	return &Service{
-		store: store,
+		store:   store,
+		tenants: tenants,
+		metrics: newServiceMetrics(),
 
 		newVersion: uuid.NewString,
 	}
 }
 
-func (s *Service) CreateMedication(ctx context.Context, identity model.Identity, data model.MedicationData) (model.Medication, error) {
-	if identity.Owner == "" {
+func (s *Service) CreateMedication(ctx context.Context, identity model.Identity, data model.MedicationData) (_ model.Medication, err error) {
+	ctx, span := tracer.Start(ctx, "medication.CreateMedication", trace.WithAttributes(identityAttributes(identity)...))
+	defer func() {
+		s.metrics.record(ctx, operationCreate, identity.Tenant, data.Form, err)
+		tracing.End(span, err)
+	}()
+
+	if identity.Owner == "" || identity.Tenant == "" {
 		// It's not a BadInput. Caller of this function must ensure the owner is determined and is not empty.
-		return model.Medication{}, errors.New("owner is required")
+		return model.Medication{}, errors.New("owner and tenant are required")
 	}
 
-	// TODO: Validate name and dosage taking form into account
+	// TODO: Validate name against the drug list
+
+	data.Status = data.Status.OrActive()
+	if err := s.validateForTenant(ctx, identity.Tenant, data); err != nil {
+		return model.Medication{}, err
+	}
+	if err := validateDosage(data); err != nil {
+		return model.Medication{}, err
+	}
+	if err := validatePrescription(data.Prescription); err != nil {
+		return model.Medication{}, err
+	}
 
 	storedMedication := model.Medication{
 		Identity:       identity,
@@ -72,3 +125,288 @@ func (s *Service) CreateMedication(ctx context.Context, identity model.Identity,
 	}
 	return storedMedication, nil
 }
+
+func (s *Service) GetMedication(ctx context.Context, identity model.Identity) (_ model.Medication, err error) {
+	ctx, span := tracer.Start(ctx, "medication.GetMedication", trace.WithAttributes(identityAttributes(identity)...))
+	defer func() { tracing.End(span, err) }()
+
+	med, err := s.store.GetMedication(ctx, identity)
+	if err != nil {
+		var moved *storage.MovedError
+		if errors.As(err, &moved) {
+			return model.Medication{}, &MovedError{Identity: identity, Target: moved.Target}
+		}
+		if errors.Is(err, storage.ErrNotFound) {
+			return model.Medication{}, fmt.Errorf("medication %v: %w", identity, ErrNotFound)
+		}
+		return model.Medication{}, fmt.Errorf("getting medication: %w", err)
+	}
+	med.Status = med.Status.OrActive()
+	return med, nil
+}
+
+// GetMedicationSeen returns the medication a client has seen with the given version. The client may be ahead
+// of an eventually consistent read (e.g. it has just changed the medication), so a different version or
+// not found is read again strongly consistently.
+func (s *Service) GetMedicationSeen(ctx context.Context, identity model.Identity, version string) (model.Medication, error) {
+	med, err := s.GetMedication(ctx, identity)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return model.Medication{}, err
+	}
+	if err == nil && med.Version == version {
+		return med, nil
+	}
+	return s.GetMedication(storage.WithConsistentRead(ctx), identity)
+}
+
+// UpdateMedication replaces medication data if the stored version is equal to the given one.
+// Empty status means the status is kept as is.
+func (s *Service) UpdateMedication(ctx context.Context, identity model.Identity, version string, data model.MedicationData) (_ model.Medication, err error) {
+	ctx, span := tracer.Start(ctx, "medication.UpdateMedication", trace.WithAttributes(identityAttributes(identity)...))
+	defer func() {
+		s.metrics.record(ctx, operationUpdate, identity.Tenant, data.Form, err)
+		tracing.End(span, err)
+	}()
+
+	// A cached version would turn into a false conflict
+	current, err := s.GetMedication(storage.WithConsistentRead(ctx), identity)
+	if err != nil {
+		return model.Medication{}, err
+	}
+	if current.Version != version {
+		return model.Medication{}, fmt.Errorf("medication %v has version %s, got %s: %w",
+			identity, current.Version, version, ErrVersionConflict)
+	}
+
+	if data.Status == "" {
+		data.Status = current.Status
+		data.StatusReason = current.StatusReason
+	}
+	if !current.Status.CanTransitionTo(data.Status) {
+		return model.Medication{}, fmt.Errorf("medication %v can't change status from %s to %s: %w",
+			identity, current.Status, data.Status, ErrInvalidTransition)
+	}
+	if err := s.validateForTenant(ctx, identity.Tenant, data); err != nil {
+		return model.Medication{}, err
+	}
+	if err := validateDosage(data); err != nil {
+		return model.Medication{}, err
+	}
+	if err := validatePrescription(data.Prescription); err != nil {
+		return model.Medication{}, err
+	}
+
+	updated, err := s.store.UpdateMedication(ctx, version, model.Medication{
+		Identity:       identity,
+		Version:        s.newVersion(),
+		MedicationData: data,
+	})
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return model.Medication{}, fmt.Errorf("medication %v: %w", identity, ErrNotFound)
+		}
+		if errors.Is(err, storage.ErrVersionMismatch) {
+			return model.Medication{}, fmt.Errorf("medication %v: %w", identity, ErrVersionConflict)
+		}
+		return model.Medication{}, fmt.Errorf("updating medication: %w", err)
+	}
+	return updated, nil
+}
+
+// RestoreMedication writes data of an earlier state as a new version, see `medication restore`. It's an update
+// that skips status transition rules, as restoring undoes a transition. The data is validated against the current
+// catalogue and tenant settings, so a state that is no longer valid can't be restored.
+func (s *Service) RestoreMedication(ctx context.Context, identity model.Identity, version string, data model.MedicationData) (_ model.Medication, err error) {
+	ctx, span := tracer.Start(ctx, "medication.RestoreMedication", trace.WithAttributes(identityAttributes(identity)...))
+	defer func() {
+		s.metrics.record(ctx, operationRestore, identity.Tenant, data.Form, err)
+		tracing.End(span, err)
+	}()
+
+	if err := s.validateForTenant(ctx, identity.Tenant, data); err != nil {
+		return model.Medication{}, err
+	}
+	if err := validateDosage(data); err != nil {
+		return model.Medication{}, err
+	}
+	if err := validatePrescription(data.Prescription); err != nil {
+		return model.Medication{}, err
+	}
+
+	restored, err := s.store.UpdateMedication(ctx, version, model.Medication{
+		Identity:       identity,
+		Version:        s.newVersion(),
+		MedicationData: data,
+	})
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return model.Medication{}, fmt.Errorf("medication %v: %w", identity, ErrNotFound)
+		}
+		if errors.Is(err, storage.ErrVersionMismatch) {
+			return model.Medication{}, fmt.Errorf("medication %v: %w", identity, ErrVersionConflict)
+		}
+		return model.Medication{}, fmt.Errorf("restoring medication: %w", err)
+	}
+	return restored, nil
+}
+
+func (s *Service) DeleteMedication(ctx context.Context, identity model.Identity) (err error) {
+	ctx, span := tracer.Start(ctx, "medication.DeleteMedication", trace.WithAttributes(identityAttributes(identity)...))
+	var deleted model.Medication
+	defer func() {
+		s.metrics.record(ctx, operationDelete, identity.Tenant, deleted.Form, err)
+		tracing.End(span, err)
+	}()
+
+	deleted, err = s.store.DeleteMedication(ctx, identity)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			return fmt.Errorf("medication %v: %w", identity, ErrNotFound)
+		}
+		return fmt.Errorf("deleting medication: %w", err)
+	}
+	return nil
+}
+
+type ListQuery struct {
+	Tenant       string
+	Owner        string
+	Statuses     []model.Status // Empty means DefaultListStatuses
+	Form         model.Form     // Empty means any form
+	UpdatedSince time.Time      // Zero means any time
+	Name         string         // See model.MatchName, empty means any name
+	Cursor       string
+	Limit        int32
+}
+
+type ListResult struct {
+	Medications []model.Medication
+	Cursor      string
+}
+
+// DefaultListStatuses doesn't include discontinued medications. They must be requested explicitly.
+var DefaultListStatuses = []model.Status{model.StatusActive, model.StatusPaused, model.StatusCompleted}
+
+const (
+	DefaultListLimit = 50
+	MaxListLimit     = 500
+)
+
+func (s *Service) ListMedications(ctx context.Context, query ListQuery) (_ ListResult, err error) {
+	ctx, span := tracer.Start(ctx, "medication.ListMedications", trace.WithAttributes(
+		attribute.String("med.tenant", query.Tenant),
+		attribute.String("med.owner", query.Owner)))
+	defer func() { tracing.End(span, err) }()
+
+	if query.Owner == "" || query.Tenant == "" {
+		return ListResult{}, errors.New("owner and tenant are required")
+	}
+
+	statuses := query.Statuses
+	if len(statuses) == 0 {
+		statuses = DefaultListStatuses
+	}
+	limit := query.Limit
+	if limit <= 0 {
+		limit = DefaultListLimit
+	}
+	limit = min(limit, MaxListLimit)
+
+	res, err := s.store.ListMedications(ctx, storage.ListQuery{
+		Tenant:       query.Tenant,
+		Owner:        query.Owner,
+		Statuses:     statuses,
+		Form:         query.Form,
+		UpdatedSince: query.UpdatedSince,
+		Name:         query.Name,
+		Cursor:       query.Cursor,
+		Limit:        limit,
+	})
+	if err != nil {
+		if errors.Is(err, storage.ErrBadCursor) {
+			return ListResult{}, fmt.Errorf("listing medications: %w: %w", ErrBadInput, err)
+		}
+		return ListResult{}, fmt.Errorf("listing medications: %w", err)
+	}
+
+	for i := range res.Medications {
+		res.Medications[i].Status = res.Medications[i].Status.OrActive()
+	}
+	return ListResult{
+		Medications: res.Medications,
+		Cursor:      res.Cursor,
+	}, nil
+}
+
+// maxFieldLength limits free text fields of a prescription.
+const maxFieldLength = 1024
+
+// strictNameRegexp allows letters, digits and a few punctuation marks used in drug names, e.g. "Co-codamol 30/500".
+var strictNameRegexp = regexp.MustCompile(`^\p{L}[\p{L}\p{N}\-(),./+ ]*$`)
+
+func (s *Service) validateForTenant(ctx context.Context, tenant string, data model.MedicationData) error {
+	settings, err := s.tenants.Settings(ctx, tenant)
+	if err != nil {
+		return fmt.Errorf("getting tenant settings: %w", err)
+	}
+
+	if len(settings.AllowedForms) > 0 && !slices.Contains(settings.AllowedForms, data.Form) {
+		return badField("form", "form %s is not allowed for tenant %s", data.Form, tenant)
+	}
+	if settings.StrictNameValidation {
+		if !strictNameRegexp.MatchString(data.Name) || strings.TrimSpace(data.Name) != data.Name ||
+			strings.Contains(data.Name, "  ") {
+			return badField("name", "name <%s> doesn't pass strict validation", data.Name)
+		}
+	}
+	return nil
+}
+
+func validateDosage(data model.MedicationData) error {
+	form, ok := model.CurrentCatalogue().Lookup(string(data.Form))
+	if !ok {
+		return badField("form", "form %s is not in the catalogue", data.Form)
+	}
+	if unit, ok := model.DosageUnit(data.Dosage); ok && !form.AllowsUnit(unit) {
+		return badField("dosage", "unit %s is not allowed for %s, allowed units: %v", unit, form.Code, form.Units)
+	}
+	return nil
+}
+
+func validatePrescription(p model.Prescription) error {
+	for _, f := range []struct{ field, value string }{
+		{field: "prescriber.id", value: p.Prescriber.Id},
+		{field: "prescriber.name", value: p.Prescriber.Name},
+		{field: "indication.text", value: p.Indication.Text},
+		{field: "indication.code", value: p.Indication.Code},
+		{field: "indication.system", value: p.Indication.System},
+		{field: "statusReason", value: p.StatusReason},
+	} {
+		if len(f.value) >= maxFieldLength {
+			return badField(f.field, "%s must be less than %d characters", f.field, maxFieldLength)
+		}
+	}
+	if p.Indication.Code != "" && p.Indication.System == "" {
+		return badField("indication.system", "indication.system is required for indication.code")
+	}
+	for _, f := range []struct{ field, value string }{
+		{field: "startDate", value: p.StartDate},
+		{field: "endDate", value: p.EndDate},
+	} {
+		if f.value == "" {
+			continue
+		}
+		if _, err := time.Parse(time.DateOnly, f.value); err != nil {
+			return badField(f.field, "%s must be a date in YYYY-MM-DD format", f.field)
+		}
+	}
+
+	if p.Status == model.StatusDiscontinued && p.StatusReason == "" {
+		return badField("statusReason", "discontinued medication requires a reason")
+	}
+	// Dates are YYYY-MM-DD, so they can be compared as strings
+	if p.StartDate != "" && p.EndDate != "" && p.EndDate < p.StartDate {
+		return badField("endDate", "end date %s is before start date %s", p.EndDate, p.StartDate)
+	}
+	return nil
+}
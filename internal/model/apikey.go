@@ -0,0 +1,18 @@
+package model
+
+import (
+	"time"
+)
+
+// APIKey authenticates a partner backend. A key belongs to a tenant.
+// If Owner is set, the key can only act on behalf of that owner (B2B project).
+// Otherwise, the owner is taken from the request (B2C behind a gateway that authorises users).
+type APIKey struct {
+	Id         string
+	Tenant     string
+	Owner      string
+	Name       string
+	SecretHash string // Hex encoded SHA-256 of the secret. The secret itself is never stored
+	CreatedAt  time.Time
+	Revoked    bool
+}
@@ -0,0 +1,20 @@
+package model
+
+import (
+	"time"
+)
+
+// AuditRecord is a single access to patient data. JSON is the format of the audit file.
+type AuditRecord struct {
+	Time         time.Time `json:"time"`
+	RequestId    string    `json:"requestId"`
+	Tenant       string    `json:"tenant"`
+	Owner        string    `json:"owner"`
+	KeyId        string    `json:"keyId,omitempty"`        // API key the request was made with, empty if authenticated by headers
+	Operator     string    `json:"operator,omitempty"`     // Who ran an admin command, e.g. medication.restore
+	MedicationId string    `json:"medicationId,omitempty"` // Empty for calls that touched no medication, e.g. an empty list
+	Action       string    `json:"action"`                 // e.g. medication.get, fhir.import
+	Status       int       `json:"status"`                 // HTTP status code of the response
+	SourceIP     string    `json:"sourceIp"`
+	ForwardedFor string    `json:"forwardedFor,omitempty"` // As sent by the client or the load balancer, not verified
+}
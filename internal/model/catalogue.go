@@ -0,0 +1,155 @@
+package model
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync/atomic"
+)
+
+// DefaultLanguage is used when a display name is not available in the requested language.
+const DefaultLanguage = "en"
+
+//go:embed forms.json
+var defaultCatalogueData []byte
+
+var currentCatalogue atomic.Pointer[Catalogue]
+
+func init() {
+	c, err := ParseCatalogue(defaultCatalogueData)
+	if err != nil {
+		panic(fmt.Sprintf("default form catalogue is invalid: %v", err))
+	}
+	SetCatalogue(c)
+}
+
+// FormDefinition describes a single form of the catalogue.
+// Units are lower case dosage units allowed for the form.
+type FormDefinition struct {
+	Code    Form              `json:"code"`
+	Aliases []string          `json:"aliases"`
+	Display map[string]string `json:"display"` // Language -> display name
+	Units   []string          `json:"units"`
+}
+
+// Catalogue is a versioned list of known forms. It's loaded from a file, so adding a form doesn't require a release.
+// Forms must never be removed from the catalogue as stored medications keep referencing them.
+type Catalogue struct {
+	Version string           `json:"version"`
+	Forms   []FormDefinition `json:"forms"`
+
+	index map[string]int // Normalised code or alias -> index in Forms
+}
+
+func ParseCatalogue(data []byte) (*Catalogue, error) {
+	var c Catalogue
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("unable to parse catalogue: %w", err)
+	}
+	if c.Version == "" {
+		return nil, errors.New("catalogue version must not be empty")
+	}
+
+	c.index = make(map[string]int)
+	for i, f := range c.Forms {
+		if f.Code == "" || string(f.Code) != normaliseForm(string(f.Code)) {
+			return nil, fmt.Errorf("form code <%s> must be non-empty, lower case and trimmed", f.Code)
+		}
+		if f.Display[DefaultLanguage] == "" {
+			return nil, fmt.Errorf("form <%s> must have display name in %s", f.Code, DefaultLanguage)
+		}
+		if len(f.Units) == 0 {
+			return nil, fmt.Errorf("form <%s> must have at least one unit", f.Code)
+		}
+		for _, u := range f.Units {
+			if u != strings.ToLower(u) {
+				return nil, fmt.Errorf("form <%s> unit <%s> must be lower case", f.Code, u)
+			}
+		}
+
+		for _, name := range append([]string{string(f.Code)}, f.Aliases...) {
+			key := normaliseForm(name)
+			if prev, ok := c.index[key]; ok {
+				return nil, fmt.Errorf("<%s> is used by both <%s> and <%s>", name, c.Forms[prev].Code, f.Code)
+			}
+			c.index[key] = i
+		}
+	}
+	return &c, nil
+}
+
+func LoadCatalogue(path string) (*Catalogue, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read catalogue: %w", err)
+	}
+	return ParseCatalogue(data)
+}
+
+// SetCatalogue replaces the catalogue used by ParseForm. Safe for concurrent use.
+func SetCatalogue(c *Catalogue) {
+	currentCatalogue.Store(c)
+}
+
+func CurrentCatalogue() *Catalogue {
+	return currentCatalogue.Load()
+}
+
+// CheckKeeps returns an error if a form of prev is missing in the catalogue, see Catalogue on why forms can't be removed.
+func (c *Catalogue) CheckKeeps(prev *Catalogue) error {
+	var missing []string
+	for _, f := range prev.Forms {
+		if _, ok := c.index[string(f.Code)]; !ok {
+			missing = append(missing, string(f.Code))
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("catalogue %s drops forms of %s: %s", c.Version, prev.Version, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// Lookup finds a form by its code or alias. Case and surrounding whitespace are ignored.
+func (c *Catalogue) Lookup(form string) (FormDefinition, bool) {
+	i, ok := c.index[normaliseForm(form)]
+	if !ok {
+		return FormDefinition{}, false
+	}
+	return c.Forms[i], true
+}
+
+// DisplayName returns a localised form name falling back to DefaultLanguage and then to the code.
+func (f FormDefinition) DisplayName(lang string) string {
+	if name, ok := f.Display[strings.ToLower(lang)]; ok {
+		return name
+	}
+	if name, ok := f.Display[DefaultLanguage]; ok {
+		return name
+	}
+	return string(f.Code)
+}
+
+func (f FormDefinition) AllowsUnit(unit string) bool {
+	return slices.Contains(f.Units, strings.ToLower(unit))
+}
+
+var dosageRegexp = regexp.MustCompile(`^\s*\d+(?:[.,]\d+)?\s*(\S+)\s*$`)
+
+// DosageUnit extracts a unit from dosages like "500mg" or "2.5 ml".
+// Dosage is a free text for now, so false is returned if the dosage doesn't follow the amount+unit pattern.
+func DosageUnit(dosage string) (string, bool) {
+	m := dosageRegexp.FindStringSubmatch(dosage)
+	if m == nil {
+		return "", false
+	}
+	return m[1], true
+}
+
+func normaliseForm(form string) string {
+	return strings.ToLower(strings.TrimSpace(form))
+}
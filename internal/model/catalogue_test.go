@@ -0,0 +1,159 @@
+package model
+
+import (
+	"testing"
+)
+
+func TestDefaultCatalogue(t *testing.T) {
+	c := CurrentCatalogue()
+
+	tests := []struct {
+		input  string
+		want   Form
+		wantOk bool
+	}{
+		{input: "patch", want: "patch", wantOk: true},
+		{input: " Transdermal Patch", want: "patch", wantOk: true}, // alias
+		{input: "TAB", want: FormTablet, wantOk: true},
+		{input: "eye drops", want: "drops", wantOk: true},
+		{input: "Plasma"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, gotOk := c.Lookup(tt.input)
+			if got.Code != tt.want || gotOk != tt.wantOk {
+				t.Errorf("Lookup() got = %v, %v, want %v, %v", got.Code, gotOk, tt.want, tt.wantOk)
+			}
+		})
+	}
+
+	tablet, _ := c.Lookup("tablet")
+	if got := tablet.DisplayName("de"); got != "Tablette" {
+		t.Errorf("DisplayName(de) = %s", got)
+	}
+	if got := tablet.DisplayName("xx"); got != "Tablet" {
+		t.Errorf("DisplayName(xx) = %s", got)
+	}
+	if !tablet.AllowsUnit("MG") || tablet.AllowsUnit("ml") {
+		t.Errorf("unexpected units: %v", tablet.Units)
+	}
+}
+
+func TestDefaultCatalogueUnits(t *testing.T) {
+	tests := []struct {
+		form   string
+		dosage string
+		want   bool
+	}{
+		{form: "tablet", dosage: "500mg", want: true},
+		{form: "tablet", dosage: "1 tablet", want: true},
+		{form: "tablet", dosage: "2 tabs", want: true},
+		{form: "tablet", dosage: "2 capsules"},
+		{form: "capsule", dosage: "1 capsule", want: true},
+		{form: "capsule", dosage: "2 Caps", want: true},
+		{form: "patch", dosage: "1 patch", want: true},
+		{form: "suppository", dosage: "1 suppository", want: true},
+		{form: "liquid", dosage: "1 tablet"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.form+" "+tt.dosage, func(t *testing.T) {
+			form, ok := CurrentCatalogue().Lookup(tt.form)
+			if !ok {
+				t.Fatalf("form %s is not found", tt.form)
+			}
+			unit, ok := DosageUnit(tt.dosage)
+			if !ok {
+				t.Fatalf("dosage %s has no unit", tt.dosage)
+			}
+			if got := form.AllowsUnit(unit); got != tt.want {
+				t.Errorf("AllowsUnit(%s) = %v, want %v", unit, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseCatalogue(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr bool
+	}{
+		{
+			name: "ok",
+			data: `{"version":"1","forms":[{"code":"spray","aliases":["nasal spray"],"display":{"en":"Spray"},"units":["puff"]}]}`,
+		},
+		{
+			name:    "no version",
+			data:    `{"forms":[{"code":"spray","display":{"en":"Spray"},"units":["puff"]}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "duplicate alias",
+			data:    `{"version":"1","forms":[{"code":"spray","display":{"en":"Spray"},"units":["puff"]},{"code":"mist","aliases":["Spray"],"display":{"en":"Mist"},"units":["puff"]}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "upper case code",
+			data:    `{"version":"1","forms":[{"code":"Spray","display":{"en":"Spray"},"units":["puff"]}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "no units",
+			data:    `{"version":"1","forms":[{"code":"spray","display":{"en":"Spray"}}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "no english name",
+			data:    `{"version":"1","forms":[{"code":"spray","display":{"de":"Spray"},"units":["puff"]}]}`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseCatalogue([]byte(tt.data))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseCatalogue() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSetCatalogue(t *testing.T) {
+	prev := CurrentCatalogue()
+	defer SetCatalogue(prev)
+
+	c, err := ParseCatalogue([]byte(`{"version":"2","forms":[{"code":"spray","display":{"en":"Spray"},"units":["puff"]}]}`))
+	if err != nil {
+		t.Fatalf("ParseCatalogue() error = %v", err)
+	}
+	SetCatalogue(c)
+
+	if got, ok := ParseForm(" SPRAY"); got != "spray" || !ok {
+		t.Errorf("ParseForm() got = %v, %v", got, ok)
+	}
+	if _, ok := ParseForm("tablet"); ok {
+		t.Errorf("ParseForm() found a form missing in the catalogue")
+	}
+}
+
+func TestDosageUnit(t *testing.T) {
+	tests := []struct {
+		input  string
+		want   string
+		wantOk bool
+	}{
+		{input: "500mg", want: "mg", wantOk: true},
+		{input: " 2.5 ml ", want: "ml", wantOk: true},
+		{input: "2,5mg/ml", want: "mg/ml", wantOk: true},
+		{input: "one tablet twice a day"},
+		{input: "500 mg twice a day"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, gotOk := DosageUnit(tt.input)
+			if got != tt.want || gotOk != tt.wantOk {
+				t.Errorf("DosageUnit() got = %v, %v, want %v, %v", got, gotOk, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
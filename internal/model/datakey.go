@@ -0,0 +1,15 @@
+package model
+
+import (
+	"time"
+)
+
+// DataKey encrypts sensitive medication fields of a tenant. It's stored wrapped (encrypted) by a master key of
+// the key provider, the plaintext key only lives in memory. The newest key of a tenant is the current one.
+type DataKey struct {
+	Tenant      string
+	Id          string
+	MasterKeyId string
+	WrappedKey  []byte
+	CreatedAt   time.Time
+}
@@ -1,9 +1,5 @@
 package model
 
-import (
-	"strings"
-)
-
 // Medication struct.
 // TODO: typically there are two layers of model objects: storage and business.
 // i.e. storage services return storage objects ->
@@ -18,33 +14,95 @@ type Medication struct {
 	Version string
 }
 
+// Identity of a medication. Owner is a user (B2C) or a project (B2B) within the tenant.
+// The same id can be used by different owners, and the same owner can exist in different tenants.
 type Identity struct {
-	Id    string
-	Owner string
+	Id     string
+	Owner  string
+	Tenant string
 }
 
 type MedicationData struct {
 	Name   string
 	Dosage string // It shall likely be a struct. See internal/medication/service.go for details
 	Form   Form   // It's important to save the string to DB. Validation happens on API/Business layer
+	Prescription
+}
+
+// Prescription holds who prescribed the medication, why and for how long.
+// All fields are optional except Status. Objects created before Status was introduced have it empty,
+// see Status.OrActive.
+type Prescription struct {
+	Prescriber   Prescriber
+	Indication   Indication
+	StartDate    string // YYYY-MM-DD
+	EndDate      string // YYYY-MM-DD
+	Status       Status
+	StatusReason string // Required for StatusDiscontinued
+}
+
+type Prescriber struct {
+	Id   string // License number, NPI or any other id the partner uses
+	Name string
+}
+
+// Indication is a free text or a coded reason for the prescription.
+// System is a code system the Code belongs to, e.g. http://hl7.org/fhir/sid/icd-10
+type Indication struct {
+	Text   string
+	Code   string
+	System string
 }
 
 type Form string
 
+// Well-known forms. The full list comes from the catalogue, see catalogue.go
 const (
 	FormTablet  Form = "tablet"
 	FormCapsule Form = "capsule"
 	FormLiquid  Form = "liquid"
 )
 
+// ParseForm looks the form up in the current catalogue by its code or alias.
 func ParseForm(form string) (Form, bool) {
-	for _, f := range []Form{FormTablet, FormCapsule, FormLiquid} {
-		if string(f) == form {
-			return f, true
-		}
-		if strings.EqualFold(strings.TrimSpace(form), string(f)) {
-			return f, true
+	def, ok := CurrentCatalogue().Lookup(form)
+	if !ok {
+		return "", false
+	}
+	return def.Code, true
+}
+
+// Change is a field that differs between two states of a medication.
+type Change struct {
+	Field string
+	From  string
+	To    string
+}
+
+// Diff lists fields that change from d to other, in the order of declaration.
+func (d MedicationData) Diff(other MedicationData) []Change {
+	fields := []struct {
+		name     string
+		from, to string
+	}{
+		{"Name", d.Name, other.Name},
+		{"Dosage", d.Dosage, other.Dosage},
+		{"Form", string(d.Form), string(other.Form)},
+		{"Prescriber.Id", d.Prescriber.Id, other.Prescriber.Id},
+		{"Prescriber.Name", d.Prescriber.Name, other.Prescriber.Name},
+		{"Indication.Text", d.Indication.Text, other.Indication.Text},
+		{"Indication.Code", d.Indication.Code, other.Indication.Code},
+		{"Indication.System", d.Indication.System, other.Indication.System},
+		{"StartDate", d.StartDate, other.StartDate},
+		{"EndDate", d.EndDate, other.EndDate},
+		{"Status", string(d.Status), string(other.Status)},
+		{"StatusReason", d.StatusReason, other.StatusReason},
+	}
+	var changes []Change
+	for _, f := range fields {
+		if f.from != f.to {
+			changes = append(changes, Change{Field: f.name, From: f.from, To: f.to})
 		}
 	}
-	return "", false
+	return changes
 }
@@ -1,6 +1,7 @@
 package model
 
 import (
+	"slices"
 	"testing"
 )
 
@@ -30,3 +31,52 @@ func TestParseForm(t *testing.T) {
 		})
 	}
 }
+
+func TestMedicationDataDiff(t *testing.T) {
+	base := MedicationData{
+		Name:   "Paracetamol",
+		Dosage: "500mg",
+		Form:   FormTablet,
+		Prescription: Prescription{
+			Prescriber: Prescriber{Id: "123", Name: "Dr. House"},
+			Status:     StatusActive,
+		},
+	}
+
+	tests := []struct {
+		name   string
+		change func(d *MedicationData)
+		want   []Change
+	}{
+		{name: "same", change: func(d *MedicationData) {}},
+		{
+			name:   "nested",
+			change: func(d *MedicationData) { d.Prescriber.Name = "Dr. Wilson" },
+			want:   []Change{{Field: "Prescriber.Name", From: "Dr. House", To: "Dr. Wilson"}},
+		},
+		{
+			name: "several",
+			change: func(d *MedicationData) {
+				d.Status = StatusDiscontinued
+				d.StatusReason = "side effects"
+				d.Name = "Ibuprofen"
+			},
+			want: []Change{
+				{Field: "Name", From: "Paracetamol", To: "Ibuprofen"},
+				{Field: "Status", From: "active", To: "discontinued"},
+				{Field: "StatusReason", From: "", To: "side effects"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			other := base
+			tt.change(&other)
+			got := base.Diff(other)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("Diff() got = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+package model
+
+import (
+	"strings"
+	"unicode"
+)
+
+// MinNameQuery is the shortest name query, in letters and digits. Shorter ones match nearly everything.
+const MinNameQuery = 2
+
+// NameQueryWords splits a name query into lowercase words of letters and digits. "Co-codamol 30/500" is
+// "co", "codamol", "30" and "500".
+func NameQueryWords(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// MatchName reports whether every word of the query is a prefix of some word of the name, so "para 500" matches
+// "Paracetamol 500mg". Query words of 4 or more letters also match with a single typo, e.g. "parcet".
+func MatchName(name string, query string) bool {
+	nameWords := NameQueryWords(name)
+	for _, q := range NameQueryWords(query) {
+		matched := false
+		for _, w := range nameWords {
+			if matchWord(w, q) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+func matchWord(word string, query string) bool {
+	if strings.HasPrefix(word, query) {
+		return true
+	}
+	w, q := []rune(word), []rune(query)
+	if len(q) < 4 {
+		return false
+	}
+	// The typo can make the matching prefix one letter shorter or longer
+	for n := len(q) - 1; n <= len(q)+1 && n <= len(w); n++ {
+		if withinOneEdit(w[:n], q) {
+			return true
+		}
+	}
+	return false
+}
+
+// withinOneEdit reports whether a and b differ by at most one inserted, deleted or replaced letter.
+func withinOneEdit(a []rune, b []rune) bool {
+	if len(a) > len(b) {
+		a, b = b, a
+	}
+	if len(b)-len(a) > 1 {
+		return false
+	}
+	i := 0
+	for i < len(a) && a[i] == b[i] {
+		i++
+	}
+	if len(a) == len(b) {
+		return string(a[i+min(1, len(a)-i):]) == string(b[i+min(1, len(b)-i):])
+	}
+	return string(a[i:]) == string(b[i+1:])
+}
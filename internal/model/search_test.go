@@ -0,0 +1,56 @@
+package model
+
+import "testing"
+
+func TestMatchName(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  bool
+	}{
+		{name: "Paracetamol", query: "para", want: true},
+		{name: "Paracetamol", query: "PARA", want: true},
+		{name: "Paracetamol 500mg", query: "para 500", want: true},
+		{name: "Paracetamol 500mg", query: "500 para", want: true},
+		{name: "Co-codamol 30/500", query: "codamol", want: true},
+		{name: "Co-codamol 30/500", query: "co-cod", want: true},
+		{name: "Paracetamol", query: "parcet", want: true},   // Deleted letter
+		{name: "Paracetamol", query: "parra", want: true},    // Inserted letter
+		{name: "Paracetamol", query: "porace", want: true},   // Replaced letter
+		{name: "Paracetamol", query: "cetamol", want: false}, // Not a word prefix
+		{name: "Paracetamol", query: "pra", want: false},     // Too short for a typo
+		{name: "Paracetamol", query: "ibuprofen"},
+		{name: "Paracetamol", query: "para ibu"},
+		{name: "Ibuprofen", query: "ibuprfoen"}, // Two typos
+		{name: "Ибупрофен", query: "ибу", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name+"/"+tt.query, func(t *testing.T) {
+			if got := MatchName(tt.name, tt.query); got != tt.want {
+				t.Errorf("MatchName(%q, %q) = %v, want %v", tt.name, tt.query, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithinOneEdit(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{a: "", b: "", want: true},
+		{a: "a", b: "", want: true},
+		{a: "abc", b: "abc", want: true},
+		{a: "abc", b: "abd", want: true},
+		{a: "abc", b: "ac", want: true},
+		{a: "abc", b: "xabc", want: true},
+		{a: "abc", b: "cba"},
+		{a: "abc", b: "a"},
+	}
+	for _, tt := range tests {
+		if got := withinOneEdit([]rune(tt.a), []rune(tt.b)); got != tt.want {
+			t.Errorf("withinOneEdit(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
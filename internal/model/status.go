@@ -0,0 +1,54 @@
+package model
+
+import (
+	"slices"
+	"strings"
+)
+
+// Status is a lifecycle state of a prescription.
+//
+//	active <-> paused
+//	active, paused -> completed
+//	active, paused -> discontinued
+//
+// Completed and discontinued are final. Staying in the same state is always allowed.
+type Status string
+
+const (
+	StatusActive       Status = "active"
+	StatusPaused       Status = "paused"
+	StatusCompleted    Status = "completed"
+	StatusDiscontinued Status = "discontinued"
+)
+
+var AllStatuses = []Status{StatusActive, StatusPaused, StatusCompleted, StatusDiscontinued}
+
+var statusTransitions = map[Status][]Status{
+	StatusActive: {StatusPaused, StatusCompleted, StatusDiscontinued},
+	StatusPaused: {StatusActive, StatusCompleted, StatusDiscontinued},
+}
+
+func ParseStatus(status string) (Status, bool) {
+	for _, s := range AllStatuses {
+		if strings.EqualFold(strings.TrimSpace(status), string(s)) {
+			return s, true
+		}
+	}
+	return "", false
+}
+
+// OrActive returns StatusActive for the objects stored without status.
+func (s Status) OrActive() Status {
+	if s == "" {
+		return StatusActive
+	}
+	return s
+}
+
+func (s Status) CanTransitionTo(next Status) bool {
+	from, to := s.OrActive(), next.OrActive()
+	if from == to {
+		return true
+	}
+	return slices.Contains(statusTransitions[from], to)
+}
@@ -0,0 +1,61 @@
+package model
+
+import (
+	"testing"
+)
+
+func TestParseStatus(t *testing.T) {
+	tests := []struct {
+		input  string
+		want   Status
+		wantOk bool
+	}{
+		{input: ""},
+		{input: "stopped"},
+		{input: "active", want: StatusActive, wantOk: true},
+		{input: " Paused ", want: StatusPaused, wantOk: true},
+		{input: "COMPLETED", want: StatusCompleted, wantOk: true},
+		{input: "discontinued", want: StatusDiscontinued, wantOk: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			got, gotOk := ParseStatus(tt.input)
+			if got != tt.want {
+				t.Errorf("ParseStatus() got = %v, want %v", got, tt.want)
+			}
+			if gotOk != tt.wantOk {
+				t.Errorf("ParseStatus() gotOk = %v, want %v", gotOk, tt.wantOk)
+			}
+		})
+	}
+}
+
+func TestStatusCanTransitionTo(t *testing.T) {
+	tests := []struct {
+		from Status
+		to   Status
+		want bool
+	}{
+		{from: StatusActive, to: StatusActive, want: true},
+		{from: StatusActive, to: StatusPaused, want: true},
+		{from: StatusActive, to: StatusCompleted, want: true},
+		{from: StatusActive, to: StatusDiscontinued, want: true},
+		{from: StatusPaused, to: StatusActive, want: true},
+		{from: StatusPaused, to: StatusDiscontinued, want: true},
+		{from: StatusCompleted, to: StatusActive, want: false},
+		{from: StatusCompleted, to: StatusCompleted, want: true},
+		{from: StatusDiscontinued, to: StatusActive, want: false},
+		{from: StatusDiscontinued, to: StatusPaused, want: false},
+		{from: "", to: StatusPaused, want: true}, // legacy objects are active
+		{from: "", to: StatusActive, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.from)+"->"+string(tt.to), func(t *testing.T) {
+			if got := tt.from.CanTransitionTo(tt.to); got != tt.want {
+				t.Errorf("CanTransitionTo() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,36 @@
+package model
+
+import (
+	"regexp"
+)
+
+// DefaultTenant is used for requests that don't specify a tenant.
+const DefaultTenant = "default"
+
+var tenantRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// ValidTenant checks the tenant id. Tenant ids are parts of storage keys, thus they are restricted to
+// lower case letters, digits and dashes.
+func ValidTenant(tenant string) bool {
+	return tenantRegexp.MatchString(tenant)
+}
+
+// TenantSettings are per-tenant configuration. Zero value means no restrictions.
+type TenantSettings struct {
+	Tenant               string
+	AllowedForms         []Form // Empty means all catalogue forms are allowed
+	StrictNameValidation bool
+	Webhook              Webhook
+	RateLimit            RateLimit
+}
+
+type Webhook struct {
+	URL    string
+	Secret string
+}
+
+// RateLimit is a token bucket configuration. Zero RequestsPerSecond means the service default is used.
+type RateLimit struct {
+	RequestsPerSecond float64
+	Burst             int
+}
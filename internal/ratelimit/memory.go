@@ -0,0 +1,53 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/chestnut42/test-medication/internal/model"
+)
+
+const sweepInterval = time.Minute
+
+// Memory keeps buckets in-process. Every replica limits independently, so the effective limit is multiplied
+// by the number of replicas. Use Shared where that matters.
+type Memory struct {
+	mu        sync.Mutex
+	buckets   map[string]Bucket
+	lastSweep time.Time
+
+	now func() time.Time
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		buckets: make(map[string]Bucket),
+		now:     time.Now,
+	}
+}
+
+func (m *Memory) Take(_ context.Context, key string, cost int, limit model.RateLimit) (Result, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	if now.Sub(m.lastSweep) > sweepInterval {
+		m.sweep(now, limit)
+		m.lastSweep = now
+	}
+
+	bucket, res := take(m.buckets[key], now, cost, limit)
+	m.buckets[key] = bucket
+	return res, nil
+}
+
+// sweep forgets buckets that had enough time to refill, they are equal to missing ones.
+// Limits differ per tenant, so the current one is only an estimate. Forgetting a bucket a bit early is harmless.
+func (m *Memory) sweep(now time.Time, limit model.RateLimit) {
+	for key, b := range m.buckets {
+		if _, res := take(b, now, 0, limit); res.Reset == 0 {
+			delete(m.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/chestnut42/test-medication/internal/model"
+)
+
+// Token bucket: a bucket holds up to Burst tokens and is refilled with RequestsPerSecond tokens per second.
+// A request takes as many tokens as it costs, so that expensive requests (list, export) drain the bucket faster.
+
+type Limiter interface {
+	Take(ctx context.Context, key string, cost int, limit model.RateLimit) (Result, error)
+}
+
+type Result struct {
+	Allowed    bool
+	Remaining  int           // Tokens left after the request
+	Reset      time.Duration // Time until the bucket is full again
+	RetryAfter time.Duration // Time until the request can be afforded. Zero if allowed
+}
+
+// Bucket is the state of a single bucket. It's exported for shared (storage backed) limiters.
+type Bucket struct {
+	Tokens    float64
+	UpdatedAt time.Time
+}
+
+// take refills the bucket up to now and takes cost tokens if there are enough.
+// Zero bucket is a full one.
+func take(b Bucket, now time.Time, cost int, limit model.RateLimit) (Bucket, Result) {
+	burst := float64(limit.Burst)
+	tokens := burst
+	if !b.UpdatedAt.IsZero() {
+		elapsed := max(0, now.Sub(b.UpdatedAt).Seconds())
+		tokens = min(burst, b.Tokens+elapsed*limit.RequestsPerSecond)
+	}
+
+	res := Result{Allowed: tokens >= float64(cost)}
+	if res.Allowed {
+		tokens -= float64(cost)
+	} else {
+		res.RetryAfter = secondsToDuration((float64(cost) - tokens) / limit.RequestsPerSecond)
+	}
+	res.Remaining = int(math.Floor(tokens))
+	res.Reset = secondsToDuration((burst - tokens) / limit.RequestsPerSecond)
+	return Bucket{Tokens: tokens, UpdatedAt: now}, res
+}
+
+func secondsToDuration(s float64) time.Duration {
+	return time.Duration(math.Ceil(s * float64(time.Second)))
+}
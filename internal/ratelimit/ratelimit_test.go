@@ -0,0 +1,118 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/chestnut42/test-medication/internal/model"
+	"github.com/chestnut42/test-medication/internal/storage"
+)
+
+func TestMemory(t *testing.T) {
+	ctx := context.Background()
+	limit := model.RateLimit{RequestsPerSecond: 1, Burst: 5}
+	m := NewMemory()
+	now := time.Now()
+	m.now = func() time.Time { return now }
+
+	tests := []struct {
+		name          string
+		advance       time.Duration
+		cost          int
+		wantAllowed   bool
+		wantRemaining int
+		wantReset     time.Duration
+		wantRetry     time.Duration
+	}{
+		{name: "full bucket", cost: 1, wantAllowed: true, wantRemaining: 4, wantReset: time.Second},
+		{name: "expensive", cost: 3, wantAllowed: true, wantRemaining: 1, wantReset: 4 * time.Second},
+		{name: "can't afford", cost: 3, wantAllowed: false, wantRemaining: 1, wantReset: 4 * time.Second, wantRetry: 2 * time.Second},
+		{name: "refilled", advance: 2 * time.Second, cost: 3, wantAllowed: true, wantRemaining: 0, wantReset: 5 * time.Second},
+		{name: "never over burst", advance: time.Hour, cost: 0, wantAllowed: true, wantRemaining: 5, wantReset: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now = now.Add(tt.advance)
+			res, err := m.Take(ctx, "k", tt.cost, limit)
+			if err != nil {
+				t.Fatalf("failed to take: %v", err)
+			}
+			want := Result{Allowed: tt.wantAllowed, Remaining: tt.wantRemaining, Reset: tt.wantReset, RetryAfter: tt.wantRetry}
+			if res != want {
+				t.Fatalf("got %+v, want %+v", res, want)
+			}
+		})
+	}
+
+	// Other keys have own buckets
+	if res, _ := m.Take(ctx, "other", 5, limit); !res.Allowed {
+		t.Fatalf("other key must not be limited")
+	}
+}
+
+type memoryStore struct {
+	buckets  map[string]storage.RateBucket
+	conflict int   // Number of puts to fail as if another replica wrote first
+	err      error // Returned by gets as if storage was unavailable
+}
+
+func (m *memoryStore) GetRateBucket(_ context.Context, key string) (storage.RateBucket, error) {
+	if m.err != nil {
+		return storage.RateBucket{}, m.err
+	}
+	return m.buckets[key], nil
+}
+
+func (m *memoryStore) PutRateBucket(_ context.Context, key string, prev time.Time, bucket storage.RateBucket) error {
+	if m.conflict > 0 || !m.buckets[key].UpdatedAt.Equal(prev) {
+		m.conflict--
+		return fmt.Errorf("%s: %w", key, storage.ErrVersionMismatch)
+	}
+	m.buckets[key] = bucket
+	return nil
+}
+
+func TestShared(t *testing.T) {
+	ctx := context.Background()
+	limit := model.RateLimit{RequestsPerSecond: 1, Burst: 2}
+	store := &memoryStore{buckets: map[string]storage.RateBucket{}}
+	s := NewShared(store)
+	now := time.Now()
+	s.now = func() time.Time { return now }
+
+	store.conflict = 1 // Retried
+	for i, wantAllowed := range []bool{true, true, false} {
+		res, err := s.Take(ctx, "k", 1, limit)
+		if err != nil {
+			t.Fatalf("failed to take: %v", err)
+		}
+		if res.Allowed != wantAllowed {
+			t.Fatalf("request %d: allowed %v, want %v", i, res.Allowed, wantAllowed)
+		}
+	}
+	if b := store.buckets["k"]; !b.ExpiresAt.Equal(now.Add(2 * time.Second)) {
+		t.Fatalf("unexpected expiration: %v", b.ExpiresAt.Sub(now))
+	}
+
+	// Contention is a rejection, not an error: errors let requests through
+	now = now.Add(time.Hour)
+	store.conflict = maxSharedAttempts
+	res, err := s.Take(ctx, "k", 1, limit)
+	if err != nil {
+		t.Fatalf("failed to take: %v", err)
+	}
+	if res.Allowed || res.RetryAfter != contendedRetryAfter {
+		t.Fatalf("got %+v, expected a rejection", res)
+	}
+	if _, err := s.Take(ctx, "k", 1, limit); err != nil {
+		t.Fatalf("failed to take: %v", err)
+	}
+
+	store.err = errors.New("boom")
+	if _, err := s.Take(ctx, "k", 1, limit); err == nil {
+		t.Fatalf("expected storage error")
+	}
+}
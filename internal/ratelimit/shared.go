@@ -0,0 +1,69 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/chestnut42/test-medication/internal/model"
+	"github.com/chestnut42/test-medication/internal/storage"
+)
+
+const (
+	maxSharedAttempts = 3
+	// contendedRetryAfter is suggested to a request rejected because of contention while the bucket had tokens
+	contendedRetryAfter = time.Second
+)
+
+type Storage interface {
+	// GetRateBucket returns zero bucket if there's none.
+	GetRateBucket(ctx context.Context, key string) (storage.RateBucket, error)
+	// PutRateBucket fails with storage.ErrVersionMismatch if the bucket was changed since it was read.
+	PutRateBucket(ctx context.Context, key string, prev time.Time, bucket storage.RateBucket) error
+}
+
+// Shared keeps buckets in storage, so that all replicas share the same limit. It costs a read and a conditional
+// write per request, so it's meant for deployments where limits must be exact.
+type Shared struct {
+	store Storage
+	now   func() time.Time
+}
+
+func NewShared(store Storage) *Shared {
+	return &Shared{
+		store: store,
+		now:   time.Now,
+	}
+}
+
+// Take fails only if storage fails. A bucket that is still contended after maxSharedAttempts is hit by more
+// concurrent requests than it can serialise, so the request is rejected as if the bucket was empty.
+func (s *Shared) Take(ctx context.Context, key string, cost int, limit model.RateLimit) (Result, error) {
+	var res Result
+	for attempt := 0; attempt < maxSharedAttempts; attempt++ {
+		stored, err := s.store.GetRateBucket(ctx, key)
+		if err != nil {
+			return Result{}, fmt.Errorf("getting bucket: %w", err)
+		}
+
+		var bucket Bucket
+		bucket, res = take(Bucket{Tokens: stored.Tokens, UpdatedAt: stored.UpdatedAt}, s.now(), cost, limit)
+		err = s.store.PutRateBucket(ctx, key, stored.UpdatedAt, storage.RateBucket{
+			Tokens:    bucket.Tokens,
+			UpdatedAt: bucket.UpdatedAt,
+			ExpiresAt: bucket.UpdatedAt.Add(res.Reset),
+		})
+		if err == nil {
+			return res, nil
+		}
+		if !errors.Is(err, storage.ErrVersionMismatch) {
+			return Result{}, fmt.Errorf("putting bucket: %w", err)
+		}
+		// Another replica took tokens meanwhile, retry with the fresh state
+	}
+	if res.Allowed {
+		res = Result{Remaining: 0, Reset: res.Reset, RetryAfter: contendedRetryAfter}
+	}
+	return res, nil
+}
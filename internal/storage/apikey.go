@@ -0,0 +1,143 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"github.com/chestnut42/test-medication/internal/model"
+)
+
+const apiKeySortKeyPrefix = "apikey#"
+
+// API keys live next to tenant settings, so that all keys of a tenant can be queried.
+type wrappedAPIKey struct {
+	PartitionKey string `dynamodbav:"PK"`
+	SortKey      string `dynamodbav:"SK"`
+	model.APIKey
+}
+
+func getAPIKeyKey(tenant string, id string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"PK": &types.AttributeValueMemberS{Value: getTenantSettingsPartition(tenant)},
+		"SK": &types.AttributeValueMemberS{Value: apiKeySortKeyPrefix + id},
+	}
+}
+
+func (s *Service) CreateAPIKey(ctx context.Context, key model.APIKey) error {
+	item, err := attributevalue.MarshalMap(wrappedAPIKey{
+		PartitionKey: getTenantSettingsPartition(key.Tenant),
+		SortKey:      apiKeySortKeyPrefix + key.Id,
+		APIKey:       key,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal item: %w", err)
+	}
+
+	expr, err := expression.NewBuilder().
+		WithCondition(expression.Name("PK").AttributeNotExists()).
+		Build()
+	if err != nil {
+		return fmt.Errorf("failed to build expression: %w", err)
+	}
+
+	if _, err := s.database.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:                 aws.String(s.cfg.MedicationTable),
+		Item:                      item,
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	}); err != nil {
+		var cfe *types.ConditionalCheckFailedException
+		if errors.As(err, &cfe) {
+			return fmt.Errorf("api key %s already exists: %w", key.Id, ErrAlreadyExists)
+		}
+		return fmt.Errorf("failed to put item: %w", err)
+	}
+	return nil
+}
+
+func (s *Service) GetAPIKey(ctx context.Context, tenant string, id string) (model.APIKey, error) {
+	resp, err := s.database.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.cfg.MedicationTable),
+		Key:       getAPIKeyKey(tenant, id),
+	})
+	if err != nil {
+		return model.APIKey{}, fmt.Errorf("failed to get item: %w", err)
+	}
+	if resp.Item == nil {
+		return model.APIKey{}, fmt.Errorf("api key not found: %s/%s, %w", tenant, id, ErrNotFound)
+	}
+
+	var item wrappedAPIKey
+	if err = attributevalue.UnmarshalMap(resp.Item, &item); err != nil {
+		return model.APIKey{}, fmt.Errorf("failed to unmarshal item: %w", err)
+	}
+	return item.APIKey, nil
+}
+
+func (s *Service) ListAPIKeys(ctx context.Context, tenant string) ([]model.APIKey, error) {
+	expr, err := expression.NewBuilder().
+		WithKeyCondition(expression.Key("PK").Equal(expression.Value(getTenantSettingsPartition(tenant))).
+			And(expression.Key("SK").BeginsWith(apiKeySortKeyPrefix))).
+		Build()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build expression: %w", err)
+	}
+
+	keys := make([]model.APIKey, 0)
+	paginator := dynamodb.NewQueryPaginator(s.database, &dynamodb.QueryInput{
+		TableName:                 aws.String(s.cfg.MedicationTable),
+		KeyConditionExpression:    expr.KeyCondition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query items: %w", err)
+		}
+
+		var items []wrappedAPIKey
+		if err := attributevalue.UnmarshalListOfMaps(page.Items, &items); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal items: %w", err)
+		}
+		for _, item := range items {
+			keys = append(keys, item.APIKey)
+		}
+	}
+	return keys, nil
+}
+
+// RevokeAPIKey marks the key as revoked. Revoked keys are kept for the audit purposes.
+func (s *Service) RevokeAPIKey(ctx context.Context, tenant string, id string) error {
+	expr, err := expression.NewBuilder().
+		WithCondition(expression.Name("PK").AttributeExists()).
+		WithUpdate(expression.Set(expression.Name("Revoked"), expression.Value(true))).
+		Build()
+	if err != nil {
+		return fmt.Errorf("failed to build expression: %w", err)
+	}
+
+	if _, err := s.database.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(s.cfg.MedicationTable),
+		Key:                       getAPIKeyKey(tenant, id),
+		ConditionExpression:       expr.Condition(),
+		UpdateExpression:          expr.Update(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	}); err != nil {
+		var cfe *types.ConditionalCheckFailedException
+		if errors.As(err, &cfe) {
+			return fmt.Errorf("api key not found: %s/%s, %w", tenant, id, ErrNotFound)
+		}
+		return fmt.Errorf("failed to update item: %w", err)
+	}
+	return nil
+}
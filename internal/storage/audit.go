@@ -0,0 +1,140 @@
+package storage
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/google/uuid"
+
+	"github.com/chestnut42/test-medication/internal/model"
+)
+
+// Audit records of an owner share a partition and are sorted by time. Sort key is a fixed width timestamp,
+// so that it's ordered as a string, plus a random suffix, so that records of the same nanosecond don't collide.
+const (
+	auditPartitionPrefix = "#audit#"
+	auditTimeLayout      = "2006-01-02T15:04:05.000000000Z"
+)
+
+type wrappedAuditRecord struct {
+	PartitionKey string `dynamodbav:"PK"`
+	SortKey      string `dynamodbav:"SK"`
+	ExpiresAt    int64  `dynamodbav:"ExpiresAt"` // Unix seconds for DynamoDB TTL
+	model.AuditRecord
+}
+
+func getAuditPartition(tenant string, owner string) string {
+	return auditPartitionPrefix + getListKey(tenant, owner)
+}
+
+// WriteAudit appends the records. Records are never updated, the condition makes sure of it.
+func (s *Service) WriteAudit(ctx context.Context, records []model.AuditRecord, retention time.Duration) error {
+	requests := make([]types.WriteRequest, 0, len(records))
+	for _, r := range records {
+		item, err := attributevalue.MarshalMap(wrappedAuditRecord{
+			PartitionKey: getAuditPartition(r.Tenant, r.Owner),
+			SortKey:      r.Time.UTC().Format(auditTimeLayout) + "#" + uuid.NewString(),
+			ExpiresAt:    r.Time.Add(retention).Unix(),
+			AuditRecord:  r,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to marshal item: %w", err)
+		}
+		requests = append(requests, types.WriteRequest{PutRequest: &types.PutRequest{Item: item}})
+	}
+
+	for start := 0; start < len(requests); start += maxBatchWrite {
+		chunk := requests[start:min(start+maxBatchWrite, len(requests))]
+		if err := s.batchWriteTable(ctx, s.cfg.AuditTable, chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type AuditQuery struct {
+	Tenant       string
+	Owner        string
+	MedicationId string    // Optional
+	From         time.Time // Inclusive, zero means from the beginning
+	To           time.Time // Exclusive, zero means up to now
+	Cursor       string
+	Limit        int32
+}
+
+type AuditResult struct {
+	Records []model.AuditRecord
+	Cursor  string // Empty if there are no more pages
+}
+
+// QueryAudit returns records of the owner, the newest first.
+func (s *Service) QueryAudit(ctx context.Context, query AuditQuery) (AuditResult, error) {
+	partition := getAuditPartition(query.Tenant, query.Owner)
+	from := query.From.UTC().Format(auditTimeLayout)
+	to := "~" // Greater than any timestamp
+	if !query.To.IsZero() {
+		to = query.To.UTC().Format(auditTimeLayout)
+	}
+
+	var startKey map[string]types.AttributeValue
+	if query.Cursor != "" {
+		sk, err := base64.RawURLEncoding.DecodeString(query.Cursor)
+		if err != nil || !strings.Contains(string(sk), "#") {
+			return AuditResult{}, fmt.Errorf("cursor is malformed: %w", ErrBadCursor)
+		}
+		startKey = map[string]types.AttributeValue{
+			"PK": &types.AttributeValueMemberS{Value: partition},
+			"SK": &types.AttributeValueMemberS{Value: string(sk)},
+		}
+	}
+
+	builder := expression.NewBuilder().WithKeyCondition(
+		expression.Key("PK").Equal(expression.Value(partition)).
+			And(expression.Key("SK").Between(expression.Value(from), expression.Value(to))))
+	if query.MedicationId != "" {
+		builder = builder.WithFilter(expression.Name("MedicationId").Equal(expression.Value(query.MedicationId)))
+	}
+	expr, err := builder.Build()
+	if err != nil {
+		return AuditResult{}, fmt.Errorf("failed to build expression: %w", err)
+	}
+
+	var limit *int32
+	if query.Limit > 0 {
+		limit = aws.Int32(query.Limit)
+	}
+	resp, err := s.database.Query(ctx, &dynamodb.QueryInput{
+		TableName:                 aws.String(s.cfg.AuditTable),
+		KeyConditionExpression:    expr.KeyCondition(),
+		FilterExpression:          expr.Filter(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ExclusiveStartKey:         startKey,
+		Limit:                     limit,
+		ScanIndexForward:          aws.Bool(false),
+	})
+	if err != nil {
+		return AuditResult{}, fmt.Errorf("failed to query items: %w", err)
+	}
+
+	var items []wrappedAuditRecord
+	if err := attributevalue.UnmarshalListOfMaps(resp.Items, &items); err != nil {
+		return AuditResult{}, fmt.Errorf("failed to unmarshal items: %w", err)
+	}
+	result := AuditResult{Records: make([]model.AuditRecord, 0, len(items))}
+	for _, item := range items {
+		result.Records = append(result.Records, item.AuditRecord)
+	}
+	if sk, ok := resp.LastEvaluatedKey["SK"].(*types.AttributeValueMemberS); ok {
+		result.Cursor = base64.RawURLEncoding.EncodeToString([]byte(sk.Value))
+	}
+	return result, nil
+}
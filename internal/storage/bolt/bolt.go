@@ -0,0 +1,600 @@
+package bolt
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	bbolt "go.etcd.io/bbolt"
+
+	"github.com/chestnut42/test-medication/internal/model"
+	"github.com/chestnut42/test-medication/internal/storage"
+)
+
+// Keys are parts joined with a zero byte, which never occurs in tenants, owners or ids coming from HTTP.
+// A key prefix selects a tenant or an owner, and keys sort the same way DynamoDB sort keys do.
+const sep = "\x00"
+
+var (
+	bucketMedications = []byte("medications") // tenant, owner, id -> storedMedication
+	bucketSettings    = []byte("settings")    // tenant -> model.TenantSettings
+	bucketAPIKeys     = []byte("apikeys")     // tenant, id -> model.APIKey
+	bucketRateBuckets = []byte("ratebuckets") // key -> storage.RateBucket
+	bucketAudit       = []byte("audit")       // tenant, owner, time, sequence -> model.AuditRecord
+	bucketChanges     = []byte("changes")     // tenant, owner, sequence -> storage.Change
+	bucketCounters    = []byte("counters")    // tenant, owner -> last change sequence
+)
+
+type storedMedication struct {
+	model.Medication
+	Deleted   bool
+	MovedTo   *model.Identity `json:",omitempty"`
+	UpdatedAt time.Time       `json:",omitzero"` // Zero for medications written before it was added
+}
+
+// Storage keeps data in a single bbolt file with the same semantics as DynamoDB storage. It's meant for local
+// development: the file can only be opened by one process, so it can't be shared by replicas.
+type Storage struct {
+	db *bbolt.DB
+}
+
+var _ storage.Storage = (*Storage)(nil)
+
+func Open(path string) (*Storage, error) {
+	db, err := bbolt.Open(path, 0o600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("opening bolt file: %w", err)
+	}
+	if err := db.Update(func(tx *bbolt.Tx) error {
+		for _, name := range [][]byte{bucketMedications, bucketSettings, bucketAPIKeys, bucketRateBuckets, bucketAudit, bucketChanges, bucketCounters} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("creating buckets: %w", err)
+	}
+	return &Storage{db: db}, nil
+}
+
+func (s *Storage) Close() error {
+	return s.db.Close()
+}
+
+func key(parts ...string) []byte {
+	return []byte(strings.Join(parts, sep))
+}
+
+func prefix(parts ...string) []byte {
+	return key(append(parts, "")...)
+}
+
+func medicationKey(identity model.Identity) []byte {
+	return key(identity.Tenant, identity.Owner, identity.Id)
+}
+
+func get[T any](b *bbolt.Bucket, k []byte) (T, bool, error) {
+	var v T
+	data := b.Get(k)
+	if data == nil {
+		return v, false, nil
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return v, false, fmt.Errorf("failed to unmarshal %s: %w", k, err)
+	}
+	return v, true, nil
+}
+
+func put(b *bbolt.Bucket, k []byte, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s: %w", k, err)
+	}
+	return b.Put(k, data)
+}
+
+func (s *Storage) Ping(context.Context) error {
+	return s.db.View(func(*bbolt.Tx) error { return nil })
+}
+
+func (s *Storage) CreateMedication(_ context.Context, m model.Medication) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(bucketMedications)
+		k := medicationKey(m.Identity)
+		if b.Get(k) != nil {
+			return fmt.Errorf("medication %s already exists: %w", m.Id, storage.ErrAlreadyExists)
+		}
+		if err := put(b, k, storedMedication{Medication: m, UpdatedAt: time.Now()}); err != nil {
+			return err
+		}
+		return appendChange(tx, m, false)
+	})
+}
+
+func (s *Storage) GetMedication(_ context.Context, identity model.Identity) (model.Medication, error) {
+	var stored storedMedication
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		var ok bool
+		var err error
+		stored, ok, err = get[storedMedication](tx.Bucket(bucketMedications), medicationKey(identity))
+		if err != nil {
+			return err
+		}
+		if ok && stored.MovedTo != nil {
+			return &storage.MovedError{Identity: identity, Target: *stored.MovedTo}
+		}
+		if !ok || stored.Deleted {
+			return fmt.Errorf("medication not found: %v, %w", identity, storage.ErrNotFound)
+		}
+		return nil
+	})
+	return stored.Medication, err
+}
+
+func (s *Storage) UpdateMedication(_ context.Context, oldVersion string, m model.Medication) (model.Medication, error) {
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(bucketMedications)
+		k := medicationKey(m.Identity)
+		stored, ok, err := get[storedMedication](b, k)
+		if err != nil {
+			return err
+		}
+		if !ok || stored.Deleted {
+			return fmt.Errorf("medication not found: %v, %w", m.Identity, storage.ErrNotFound)
+		}
+		if stored.Version != oldVersion {
+			return fmt.Errorf("medication %v has version %s: %w", m.Identity, stored.Version, storage.ErrVersionMismatch)
+		}
+		if err := put(b, k, storedMedication{Medication: m, UpdatedAt: time.Now()}); err != nil {
+			return err
+		}
+		return appendChange(tx, m, false)
+	})
+	if err != nil {
+		return model.Medication{}, err
+	}
+	return m, nil
+}
+
+func (s *Storage) DeleteMedication(_ context.Context, identity model.Identity) (model.Medication, error) {
+	var stored storedMedication
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(bucketMedications)
+		k := medicationKey(identity)
+		var ok bool
+		var err error
+		if stored, ok, err = get[storedMedication](b, k); err != nil {
+			return err
+		}
+		if !ok || stored.Deleted {
+			return fmt.Errorf("medication not found: %v, %w", identity, storage.ErrNotFound)
+		}
+		stored.Deleted = true
+		if err := put(b, k, stored); err != nil {
+			return err
+		}
+		return appendChange(tx, stored.Medication, true)
+	})
+	if err != nil {
+		return model.Medication{}, err
+	}
+	return stored.Medication, nil
+}
+
+func (s *Storage) MoveMedication(_ context.Context, source model.Identity, target model.Identity, collision storage.Collision) (model.Medication, error) {
+	var moved model.Medication
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(bucketMedications)
+		stored, ok, err := get[storedMedication](b, medicationKey(source))
+		if err != nil {
+			return err
+		}
+		if !ok || stored.Deleted {
+			return fmt.Errorf("medication not found: %v, %w", source, storage.ErrNotFound)
+		}
+		existing, exists, err := get[storedMedication](b, medicationKey(target))
+		if err != nil {
+			return err
+		}
+
+		moved = stored.Medication
+		moved.Identity = target
+		switch {
+		case exists && collision == storage.CollisionKeepTarget:
+			moved = existing.Medication
+		case exists && collision != storage.CollisionKeepSource:
+			return fmt.Errorf("medication %v already exists: %w", target, storage.ErrAlreadyExists)
+		default:
+			if err := put(b, medicationKey(target), storedMedication{Medication: moved, UpdatedAt: time.Now()}); err != nil {
+				return err
+			}
+			if err := appendChange(tx, moved, false); err != nil {
+				return err
+			}
+		}
+		stored.Deleted = true
+		stored.MovedTo = &target
+		if err := put(b, medicationKey(source), stored); err != nil {
+			return err
+		}
+		return appendChange(tx, stored.Medication, true)
+	})
+	if err != nil {
+		return model.Medication{}, err
+	}
+	return moved, nil
+}
+
+// appendChange adds the change to the owner's log in the write transaction. Deleted changes only keep
+// the identity and the version.
+func appendChange(tx *bbolt.Tx, m model.Medication, deleted bool) error {
+	counters := tx.Bucket(bucketCounters)
+	ck := key(m.Tenant, m.Owner)
+	last, _, err := get[int64](counters, ck)
+	if err != nil {
+		return err
+	}
+	last++
+	if err := put(counters, ck, last); err != nil {
+		return err
+	}
+
+	c := storage.Change{Seq: last, Medication: m, Deleted: deleted}
+	if deleted {
+		c.Medication = model.Medication{Identity: m.Identity, Version: m.Version}
+	}
+	return put(tx.Bucket(bucketChanges), changeKey(m.Tenant, m.Owner, last), c)
+}
+
+func changeKey(tenant string, owner string, seq int64) []byte {
+	return binary.BigEndian.AppendUint64(prefix(tenant, owner), uint64(seq))
+}
+
+// ListChanges never expires changes unless the tenant is wiped.
+func (s *Storage) ListChanges(_ context.Context, query storage.ChangesQuery) (storage.ChangesResult, error) {
+	result := storage.ChangesResult{Changes: []storage.Change{}}
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		var err error
+		if result.Last, _, err = get[int64](tx.Bucket(bucketCounters), key(query.Tenant, query.Owner)); err != nil {
+			return err
+		}
+		if query.After > result.Last {
+			return fmt.Errorf("change %d is ahead of the log at %d: %w", query.After, result.Last, storage.ErrChangesExpired)
+		}
+		if query.Limit <= 0 || query.After == result.Last {
+			return nil
+		}
+
+		// Wiping leaves a gap
+		b := tx.Bucket(bucketChanges)
+		for seq := query.After + 1; seq <= min(result.Last, query.After+int64(query.Limit)); seq++ {
+			c, ok, err := get[storage.Change](b, changeKey(query.Tenant, query.Owner, seq))
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return fmt.Errorf("change %d of %s is not kept: %w", seq, query.Owner, storage.ErrChangesExpired)
+			}
+			result.Changes = append(result.Changes, c)
+		}
+		return nil
+	})
+	if err != nil {
+		return storage.ChangesResult{}, err
+	}
+	return result, nil
+}
+
+// ListMedications cursor is the last returned key. It starts with the owner prefix, which is checked.
+func (s *Storage) ListMedications(_ context.Context, query storage.ListQuery) (storage.ListResult, error) {
+	ownerPrefix := prefix(query.Tenant, query.Owner)
+	var after []byte
+	if query.Cursor != "" {
+		var err error
+		if after, err = base64.RawURLEncoding.DecodeString(query.Cursor); err != nil {
+			return storage.ListResult{}, fmt.Errorf("cursor is not base64: %w", storage.ErrBadCursor)
+		}
+		// The id must not contain the separator, otherwise it belongs to a deeper owner
+		if id, ok := bytes.CutPrefix(after, ownerPrefix); !ok || bytes.Contains(id, []byte(sep)) {
+			return storage.ListResult{}, fmt.Errorf("cursor keys mismatch: %w", storage.ErrBadCursor)
+		}
+	}
+
+	result := storage.ListResult{Medications: []model.Medication{}}
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		c := tx.Bucket(bucketMedications).Cursor()
+		k, v := c.Seek(ownerPrefix)
+		if after != nil {
+			if k, v = c.Seek(after); bytes.Equal(k, after) {
+				k, v = c.Next()
+			}
+		}
+		for ; k != nil && bytes.HasPrefix(k, ownerPrefix); k, v = c.Next() {
+			if bytes.Contains(k[len(ownerPrefix):], []byte(sep)) {
+				continue // An owner that starts with this owner and a separator, can't come from HTTP
+			}
+			if query.Limit > 0 && len(result.Medications) == int(query.Limit) {
+				result.Cursor = base64.RawURLEncoding.EncodeToString(medicationKey(result.Medications[len(result.Medications)-1].Identity))
+				return nil
+			}
+			var stored storedMedication
+			if err := json.Unmarshal(v, &stored); err != nil {
+				return fmt.Errorf("failed to unmarshal %s: %w", k, err)
+			}
+			if !stored.Deleted && matches(stored, query) {
+				result.Medications = append(result.Medications, stored.Medication)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return storage.ListResult{}, err
+	}
+	return result, nil
+}
+
+// matches treats an empty status as active, see model.Status.OrActive.
+func matches(m storedMedication, query storage.ListQuery) bool {
+	return (len(query.Statuses) == 0 || slices.Contains(query.Statuses, m.Status.OrActive())) &&
+		(query.Form == "" || m.Form == query.Form) &&
+		(query.UpdatedSince.IsZero() || !m.UpdatedAt.Before(query.UpdatedSince)) &&
+		(query.Name == "" || model.MatchName(m.Name, query.Name))
+}
+
+func (s *Storage) GetTenantSettings(_ context.Context, tenant string) (model.TenantSettings, error) {
+	var settings model.TenantSettings
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		var ok bool
+		var err error
+		if settings, ok, err = get[model.TenantSettings](tx.Bucket(bucketSettings), key(tenant)); err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("tenant settings not found: %s, %w", tenant, storage.ErrNotFound)
+		}
+		return nil
+	})
+	return settings, err
+}
+
+func (s *Storage) PutTenantSettings(_ context.Context, settings model.TenantSettings) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		return put(tx.Bucket(bucketSettings), key(settings.Tenant), settings)
+	})
+}
+
+// ExportTenant calls fn within a read transaction, fn must not write to the storage.
+func (s *Storage) ExportTenant(_ context.Context, tenant string, fn func(storage.ExportedMedication) error) error {
+	return s.db.View(func(tx *bbolt.Tx) error {
+		c := tx.Bucket(bucketMedications).Cursor()
+		p := prefix(tenant)
+		for k, v := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, v = c.Next() {
+			var stored storedMedication
+			if err := json.Unmarshal(v, &stored); err != nil {
+				return fmt.Errorf("failed to unmarshal %s: %w", k, err)
+			}
+			if err := fn(storage.ExportedMedication{Medication: stored.Medication, Deleted: stored.Deleted}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *Storage) WipeTenant(_ context.Context, tenant string) (int, error) {
+	deleted := 0
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		c := tx.Bucket(bucketMedications).Cursor()
+		p := prefix(tenant)
+		for k, _ := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, _ = c.Seek(p) {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+			deleted++
+		}
+
+		changes := tx.Bucket(bucketChanges).Cursor()
+		for k, _ := changes.Seek(p); k != nil && bytes.HasPrefix(k, p); k, _ = changes.Seek(p) {
+			if err := changes.Delete(); err != nil {
+				return err
+			}
+		}
+		// Counters are moved one past the last change, so that every token issued before expires
+		counters := tx.Bucket(bucketCounters)
+		var keys [][]byte
+		cc := counters.Cursor()
+		for k, _ := cc.Seek(p); k != nil && bytes.HasPrefix(k, p); k, _ = cc.Next() {
+			keys = append(keys, slices.Clone(k))
+		}
+		for _, k := range keys {
+			last, _, err := get[int64](counters, k)
+			if err != nil {
+				return err
+			}
+			if err := put(counters, k, last+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return deleted, nil
+}
+
+func (s *Storage) CreateAPIKey(_ context.Context, apiKey model.APIKey) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(bucketAPIKeys)
+		k := key(apiKey.Tenant, apiKey.Id)
+		if b.Get(k) != nil {
+			return fmt.Errorf("api key %s already exists: %w", apiKey.Id, storage.ErrAlreadyExists)
+		}
+		return put(b, k, apiKey)
+	})
+}
+
+func (s *Storage) GetAPIKey(_ context.Context, tenant string, id string) (model.APIKey, error) {
+	var apiKey model.APIKey
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		var ok bool
+		var err error
+		if apiKey, ok, err = get[model.APIKey](tx.Bucket(bucketAPIKeys), key(tenant, id)); err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("api key not found: %s/%s, %w", tenant, id, storage.ErrNotFound)
+		}
+		return nil
+	})
+	return apiKey, err
+}
+
+func (s *Storage) ListAPIKeys(_ context.Context, tenant string) ([]model.APIKey, error) {
+	keys := make([]model.APIKey, 0)
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		c := tx.Bucket(bucketAPIKeys).Cursor()
+		p := prefix(tenant)
+		for k, v := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, v = c.Next() {
+			var apiKey model.APIKey
+			if err := json.Unmarshal(v, &apiKey); err != nil {
+				return fmt.Errorf("failed to unmarshal %s: %w", k, err)
+			}
+			keys = append(keys, apiKey)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (s *Storage) RevokeAPIKey(_ context.Context, tenant string, id string) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(bucketAPIKeys)
+		k := key(tenant, id)
+		apiKey, ok, err := get[model.APIKey](b, k)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("api key not found: %s/%s, %w", tenant, id, storage.ErrNotFound)
+		}
+		apiKey.Revoked = true
+		return put(b, k, apiKey)
+	})
+}
+
+func (s *Storage) GetRateBucket(_ context.Context, bucketKey string) (storage.RateBucket, error) {
+	var bucket storage.RateBucket
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		var err error
+		bucket, _, err = get[storage.RateBucket](tx.Bucket(bucketRateBuckets), key(bucketKey))
+		return err
+	})
+	return bucket, err
+}
+
+func (s *Storage) PutRateBucket(_ context.Context, bucketKey string, prev time.Time, bucket storage.RateBucket) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(bucketRateBuckets)
+		stored, _, err := get[storage.RateBucket](b, key(bucketKey))
+		if err != nil {
+			return err
+		}
+		if !stored.UpdatedAt.Equal(prev) {
+			return fmt.Errorf("rate bucket %s was changed: %w", bucketKey, storage.ErrVersionMismatch)
+		}
+		return put(b, key(bucketKey), bucket)
+	})
+}
+
+// auditSuffixSize is the length of unix nanoseconds and the sequence after the owner prefix.
+const auditSuffixSize = 16
+
+// WriteAudit keeps records forever, retention is ignored.
+func (s *Storage) WriteAudit(_ context.Context, records []model.AuditRecord, _ time.Duration) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(bucketAudit)
+		for _, r := range records {
+			seq, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+			k := binary.BigEndian.AppendUint64(prefix(r.Tenant, r.Owner), uint64(r.Time.UnixNano()))
+			k = binary.BigEndian.AppendUint64(k, seq)
+			if err := put(b, k, r); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// QueryAudit iterates the owner's records backwards. Cursor is the time and the sequence of the last returned one.
+func (s *Storage) QueryAudit(_ context.Context, query storage.AuditQuery) (storage.AuditResult, error) {
+	ownerPrefix := prefix(query.Tenant, query.Owner)
+	upper := binary.BigEndian.AppendUint64(slices.Clone(ownerPrefix), ^uint64(0)) // Exclusive
+	if !query.To.IsZero() {
+		upper = binary.BigEndian.AppendUint64(slices.Clone(ownerPrefix), uint64(query.To.UnixNano()))
+	}
+	if query.Cursor != "" {
+		suffix, err := base64.RawURLEncoding.DecodeString(query.Cursor)
+		if err != nil || len(suffix) != auditSuffixSize {
+			return storage.AuditResult{}, fmt.Errorf("cursor is malformed: %w", storage.ErrBadCursor)
+		}
+		upper = append(slices.Clone(ownerPrefix), suffix...)
+	}
+	var lower []byte
+	if !query.From.IsZero() {
+		lower = binary.BigEndian.AppendUint64(slices.Clone(ownerPrefix), uint64(query.From.UnixNano()))
+	}
+
+	result := storage.AuditResult{Records: []model.AuditRecord{}}
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		c := tx.Bucket(bucketAudit).Cursor()
+		// Seek finds the first key >= upper, the one before it is the first to return
+		k, v := c.Seek(upper)
+		if k == nil {
+			k, v = c.Last()
+		} else {
+			k, v = c.Prev()
+		}
+		var last []byte // Suffix of the last examined record
+		for ; k != nil && bytes.HasPrefix(k, ownerPrefix); k, v = c.Prev() {
+			if len(k) != len(ownerPrefix)+auditSuffixSize {
+				continue // An owner that starts with this owner and a separator, can't come from HTTP
+			}
+			if lower != nil && bytes.Compare(k, lower) < 0 {
+				break
+			}
+			if query.Limit > 0 && len(result.Records) == int(query.Limit) {
+				result.Cursor = base64.RawURLEncoding.EncodeToString(last)
+				return nil
+			}
+			last = slices.Clone(k[len(ownerPrefix):])
+
+			var r model.AuditRecord
+			if err := json.Unmarshal(v, &r); err != nil {
+				return fmt.Errorf("failed to unmarshal %s: %w", k, err)
+			}
+			if query.MedicationId == "" || r.MedicationId == query.MedicationId {
+				result.Records = append(result.Records, r)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return storage.AuditResult{}, err
+	}
+	return result, nil
+}
@@ -0,0 +1,24 @@
+package bolt
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/chestnut42/test-medication/internal/storage"
+	"github.com/chestnut42/test-medication/internal/storage/storagetest"
+)
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		s, err := Open(filepath.Join(t.TempDir(), "medication.db"))
+		if err != nil {
+			t.Fatalf("failed to open storage: %v", err)
+		}
+		t.Cleanup(func() {
+			if err := s.Close(); err != nil {
+				t.Errorf("failed to close storage: %v", err)
+			}
+		})
+		return s
+	})
+}
@@ -0,0 +1,327 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"golang.org/x/sync/singleflight"
+
+	"github.com/chestnut42/test-medication/internal/model"
+	"github.com/chestnut42/test-medication/internal/storage"
+	"github.com/chestnut42/test-medication/internal/utils/logx"
+	"github.com/chestnut42/test-medication/internal/utils/metrics"
+)
+
+// Storage is a read-through cache of GetMedication in front of another storage. Everything else is passed through.
+//
+// Lookups go to the in-process LRU, then to the shared cache (if any), then to the storage. Concurrent misses
+// of the same medication are collapsed into one storage read. Not found is cached too, for NegativeTTL.
+//
+// Changes made through this Storage replace the entry: update stores the new version, delete stores not found.
+// A read that started before a change never overwrites the entry the change has written. Changes made by other
+// replicas are seen once the local entry expires, thus TTL is the maximum staleness. The shared cache is updated
+// by every replica, so it's stale only if a replica has failed to write to it.
+//
+// Reads with storage.WithConsistentRead skip the cache and refresh it.
+
+// Shared is a cache shared by replicas, e.g. Redis or Memcached. Errors are logged and treated as misses.
+type Shared interface {
+	Get(ctx context.Context, key string) (Entry, bool, error)
+	Set(ctx context.Context, key string, entry Entry, ttl time.Duration) error
+	Delete(ctx context.Context, key string) error
+}
+
+// Entry is a cached result of GetMedication.
+type Entry struct {
+	Medication model.Medication
+	NotFound   bool
+	MovedTo    *model.Identity // Set if not found because the medication has been moved
+}
+
+// newEntry caches the result of GetMedication. Errors other than not found must not be cached.
+func newEntry(m model.Medication, err error) Entry {
+	e := Entry{Medication: m, NotFound: err != nil}
+	var moved *storage.MovedError
+	if errors.As(err, &moved) {
+		e.MovedTo = &moved.Target
+	}
+	return e
+}
+
+type Config struct {
+	Size        int // Entries of the in-process cache
+	TTL         time.Duration
+	NegativeTTL time.Duration
+}
+
+type Storage struct {
+	storage.Storage
+
+	cfg    Config
+	shared Shared // Optional
+
+	mu    sync.Mutex
+	local *lru
+	seq   uint64 // Number of changes made, see entry.mutation
+
+	group   singleflight.Group
+	metrics *cacheMetrics
+	now     func() time.Time
+}
+
+var _ storage.Storage = (*Storage)(nil)
+
+// New wraps the storage. Shared may be nil.
+func New(cfg Config, store storage.Storage, shared Shared) *Storage {
+	return &Storage{
+		Storage: store,
+		cfg:     cfg,
+		shared:  shared,
+		local:   newLRU(cfg.Size),
+		metrics: newCacheMetrics(),
+		now:     time.Now,
+	}
+}
+
+func sharedKey(identity model.Identity) string {
+	return strings.Join([]string{"medication", identity.Tenant, identity.Owner, identity.Id}, "#")
+}
+
+func (s *Storage) GetMedication(ctx context.Context, identity model.Identity) (model.Medication, error) {
+	if storage.IsConsistentRead(ctx) {
+		s.metrics.bypasses.Add(ctx, 1)
+		s.mu.Lock()
+		start := s.seq
+		s.mu.Unlock()
+		m, err := s.Storage.GetMedication(ctx, identity)
+		s.fill(ctx, identity, start, m, err)
+		return m, err
+	}
+
+	s.mu.Lock()
+	e, ok := s.local.get(identity)
+	if ok && !s.now().Before(e.expires) {
+		s.local.remove(identity)
+		ok = false
+	}
+	if ok && e.invalid {
+		ok = false
+	}
+	s.mu.Unlock()
+	if ok {
+		s.metrics.hit(ctx, "local")
+		return result(identity, e.value)
+	}
+	s.metrics.miss(ctx, "local")
+
+	// The read is shared by callers, so it must not be canceled by the first one
+	ch := s.group.DoChan(sharedKey(identity), func() (any, error) {
+		return s.load(context.WithoutCancel(ctx), identity)
+	})
+	select {
+	case <-ctx.Done():
+		return model.Medication{}, ctx.Err()
+	case res := <-ch:
+		if res.Err != nil {
+			return model.Medication{}, res.Err
+		}
+		return result(identity, res.Val.(Entry))
+	}
+}
+
+func result(identity model.Identity, e Entry) (model.Medication, error) {
+	if e.MovedTo != nil {
+		return model.Medication{}, &storage.MovedError{Identity: identity, Target: *e.MovedTo}
+	}
+	if e.NotFound {
+		return model.Medication{}, fmt.Errorf("medication not found: %v, %w", identity, storage.ErrNotFound)
+	}
+	return e.Medication, nil
+}
+
+// load reads the medication from the shared cache or the storage and caches it.
+// Errors other than not found are not cached.
+func (s *Storage) load(ctx context.Context, identity model.Identity) (Entry, error) {
+	s.mu.Lock()
+	start := s.seq
+	s.mu.Unlock()
+
+	if s.shared != nil {
+		e, ok, err := s.shared.Get(ctx, sharedKey(identity))
+		if err != nil {
+			logx.Logger(ctx).Warn("getting medication from shared cache", slog.Any("error", err))
+		}
+		if ok {
+			s.metrics.hit(ctx, "shared")
+			s.putLocal(identity, start, e)
+			return e, nil
+		}
+		s.metrics.miss(ctx, "shared")
+	}
+
+	m, err := s.Storage.GetMedication(ctx, identity)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return Entry{}, err
+	}
+	s.fill(ctx, identity, start, m, err)
+	return newEntry(m, err), nil
+}
+
+// fill caches a result of the storage read that has started when the change sequence was at start.
+func (s *Storage) fill(ctx context.Context, identity model.Identity, start uint64, m model.Medication, err error) {
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return
+	}
+	e := newEntry(m, err)
+	if s.putLocal(identity, start, e) {
+		s.setShared(ctx, identity, e)
+	}
+}
+
+// putLocal stores the entry unless a change has written the entry after start. Returns false in that case.
+func (s *Storage) putLocal(identity model.Identity, start uint64, e Entry) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if current, ok := s.local.peek(identity); ok && current.mutation > start {
+		return false
+	}
+	s.local.put(&entry{key: identity, value: e, expires: s.now().Add(s.ttl(e))})
+	return true
+}
+
+// changed stores the entry written by a change.
+func (s *Storage) changed(ctx context.Context, identity model.Identity, e Entry) {
+	s.mu.Lock()
+	s.seq++
+	s.local.put(&entry{key: identity, value: e, expires: s.now().Add(s.ttl(e)), mutation: s.seq})
+	s.mu.Unlock()
+	s.setShared(ctx, identity, e)
+}
+
+// invalidate drops the entry, e.g. when it's known to be stale. It leaves a tombstone rather than removing the entry,
+// so that a read that has started before doesn't write the stale value back.
+func (s *Storage) invalidate(ctx context.Context, identity model.Identity) {
+	s.mu.Lock()
+	s.seq++
+	s.local.put(&entry{key: identity, expires: s.now().Add(s.cfg.TTL), mutation: s.seq, invalid: true})
+	s.mu.Unlock()
+	if s.shared != nil {
+		if err := s.shared.Delete(ctx, sharedKey(identity)); err != nil {
+			logx.Logger(ctx).Warn("deleting medication from shared cache", slog.Any("error", err))
+		}
+	}
+}
+
+func (s *Storage) setShared(ctx context.Context, identity model.Identity, e Entry) {
+	if s.shared == nil {
+		return
+	}
+	if err := s.shared.Set(ctx, sharedKey(identity), e, s.ttl(e)); err != nil {
+		logx.Logger(ctx).Warn("setting medication to shared cache", slog.Any("error", err))
+	}
+}
+
+func (s *Storage) ttl(e Entry) time.Duration {
+	if e.NotFound {
+		return s.cfg.NegativeTTL
+	}
+	return s.cfg.TTL
+}
+
+func (s *Storage) CreateMedication(ctx context.Context, medication model.Medication) error {
+	if err := s.Storage.CreateMedication(ctx, medication); err != nil {
+		return err
+	}
+	s.changed(ctx, medication.Identity, Entry{Medication: medication})
+	return nil
+}
+
+func (s *Storage) UpdateMedication(ctx context.Context, oldVersion string, medication model.Medication) (model.Medication, error) {
+	updated, err := s.Storage.UpdateMedication(ctx, oldVersion, medication)
+	if err != nil {
+		if errors.Is(err, storage.ErrVersionMismatch) || errors.Is(err, storage.ErrNotFound) {
+			// The cached version is likely the one that has been rejected
+			s.invalidate(ctx, medication.Identity)
+		}
+		return model.Medication{}, err
+	}
+	s.changed(ctx, updated.Identity, Entry{Medication: updated})
+	return updated, nil
+}
+
+func (s *Storage) DeleteMedication(ctx context.Context, identity model.Identity) (model.Medication, error) {
+	deleted, err := s.Storage.DeleteMedication(ctx, identity)
+	if err != nil {
+		return model.Medication{}, err
+	}
+	s.changed(ctx, identity, Entry{NotFound: true})
+	return deleted, nil
+}
+
+func (s *Storage) MoveMedication(ctx context.Context, source model.Identity, target model.Identity, collision storage.Collision) (model.Medication, error) {
+	moved, err := s.Storage.MoveMedication(ctx, source, target, collision)
+	if err != nil {
+		if errors.Is(err, storage.ErrVersionMismatch) {
+			s.invalidate(ctx, source)
+			s.invalidate(ctx, target)
+		}
+		return model.Medication{}, err
+	}
+	s.changed(ctx, source, Entry{NotFound: true, MovedTo: &target})
+	if collision == storage.CollisionKeepTarget {
+		// The kept target may be a tombstone
+		s.invalidate(ctx, target)
+	} else {
+		s.changed(ctx, target, Entry{Medication: moved})
+	}
+	return moved, nil
+}
+
+// WipeTenant drops local entries of the tenant. Shared entries expire with TTL.
+func (s *Storage) WipeTenant(ctx context.Context, tenant string) (int, error) {
+	n, err := s.Storage.WipeTenant(ctx, tenant)
+	s.mu.Lock()
+	s.seq++
+	s.local.removeFunc(func(key model.Identity) bool {
+		return key.Tenant == tenant
+	})
+	s.mu.Unlock()
+	return n, err
+}
+
+type cacheMetrics struct {
+	hits     metric.Int64Counter
+	misses   metric.Int64Counter
+	bypasses metric.Int64Counter
+}
+
+func newCacheMetrics() *cacheMetrics {
+	meter := metrics.Meter("github.com/chestnut42/test-medication/internal/storage/cache")
+	// Instruments never fail with a valid name
+	hits, _ := meter.Int64Counter("medication.cache.hits",
+		metric.WithDescription("GetMedication served from a cache, not found included, by layer"))
+	misses, _ := meter.Int64Counter("medication.cache.misses",
+		metric.WithDescription("GetMedication cache misses, by layer"))
+	bypasses, _ := meter.Int64Counter("medication.cache.bypasses",
+		metric.WithDescription("Consistent reads that skipped the cache"))
+	return &cacheMetrics{
+		hits:     hits,
+		misses:   misses,
+		bypasses: bypasses,
+	}
+}
+
+func (m *cacheMetrics) hit(ctx context.Context, layer string) {
+	m.hits.Add(ctx, 1, metric.WithAttributes(attribute.String("layer", layer)))
+}
+
+func (m *cacheMetrics) miss(ctx context.Context, layer string) {
+	m.misses.Add(ctx, 1, metric.WithAttributes(attribute.String("layer", layer)))
+}
@@ -0,0 +1,342 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/chestnut42/test-medication/internal/model"
+	"github.com/chestnut42/test-medication/internal/storage"
+	"github.com/chestnut42/test-medication/internal/storage/memory"
+	"github.com/chestnut42/test-medication/internal/storage/storagetest"
+)
+
+var testConfig = Config{Size: 100, TTL: time.Minute, NegativeTTL: 10 * time.Second}
+
+func TestConformance(t *testing.T) {
+	t.Run("local", func(t *testing.T) {
+		storagetest.Run(t, func(t *testing.T) storage.Storage {
+			return New(testConfig, memory.New(), nil)
+		})
+	})
+	t.Run("shared", func(t *testing.T) {
+		storagetest.Run(t, func(t *testing.T) storage.Storage {
+			return New(testConfig, memory.New(), newFakeShared())
+		})
+	})
+}
+
+// countingStorage counts reads. If block is set, reads wait for it to be closed before they return, so that their
+// result is older than changes made meanwhile.
+type countingStorage struct {
+	storage.Storage
+	reads atomic.Int64
+	block chan struct{}
+}
+
+func (c *countingStorage) GetMedication(ctx context.Context, identity model.Identity) (model.Medication, error) {
+	m, err := c.Storage.GetMedication(ctx, identity)
+	c.reads.Add(1)
+	if c.block != nil {
+		<-c.block
+	}
+	return m, err
+}
+
+type fakeShared struct {
+	mu      sync.Mutex
+	entries map[string]Entry
+}
+
+func newFakeShared() *fakeShared {
+	return &fakeShared{entries: make(map[string]Entry)}
+}
+
+func (f *fakeShared) Get(_ context.Context, key string) (Entry, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	e, ok := f.entries[key]
+	return e, ok, nil
+}
+
+func (f *fakeShared) Set(_ context.Context, key string, entry Entry, _ time.Duration) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.entries[key] = entry
+	return nil
+}
+
+func (f *fakeShared) Delete(_ context.Context, key string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.entries, key)
+	return nil
+}
+
+func newMedication(id string) model.Medication {
+	return model.Medication{
+		Identity:       model.Identity{Id: id, Owner: "owner", Tenant: "acme"},
+		MedicationData: model.MedicationData{Name: "Paracetamol", Dosage: "500mg", Form: model.FormTablet},
+		Version:        "v1",
+	}
+}
+
+func TestCache(t *testing.T) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, ctx context.Context, backend *countingStorage, cache *Storage, now *time.Time)
+	}{
+		{name: "hit", test: testCacheHit},
+		{name: "negative", test: testCacheNegative},
+		{name: "changes", test: testCacheChanges},
+		{name: "consistent read", test: testCacheConsistentRead},
+		{name: "concurrent misses", test: testCacheConcurrentMisses},
+		{name: "read racing a change", test: testCacheReadRacingChange},
+		{name: "read racing an invalidation", test: testCacheReadRacingInvalidation},
+		{name: "eviction", test: testCacheEviction},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			now := time.Unix(0, 0)
+			backend := &countingStorage{Storage: memory.New()}
+			cache := New(testConfig, backend, nil)
+			cache.now = func() time.Time { return now }
+			test.test(t, t.Context(), backend, cache, &now)
+		})
+	}
+}
+
+func expectReads(t *testing.T, backend *countingStorage, expected int64) {
+	t.Helper()
+	if got := backend.reads.Load(); got != expected {
+		t.Fatalf("got %d storage reads, expected %d", got, expected)
+	}
+}
+
+func testCacheHit(t *testing.T, ctx context.Context, backend *countingStorage, cache *Storage, now *time.Time) {
+	m := newMedication("hit")
+	if err := backend.Storage.CreateMedication(ctx, m); err != nil {
+		t.Fatalf("failed to create: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		got, err := cache.GetMedication(ctx, m.Identity)
+		if err != nil {
+			t.Fatalf("failed to get: %v", err)
+		}
+		if got != m {
+			t.Fatalf("got %+v, expected %+v", got, m)
+		}
+	}
+	expectReads(t, backend, 1)
+
+	*now = now.Add(testConfig.TTL)
+	if _, err := cache.GetMedication(ctx, m.Identity); err != nil {
+		t.Fatalf("failed to get: %v", err)
+	}
+	expectReads(t, backend, 2)
+}
+
+func testCacheNegative(t *testing.T, ctx context.Context, backend *countingStorage, cache *Storage, now *time.Time) {
+	m := newMedication("negative")
+	for i := 0; i < 2; i++ {
+		if _, err := cache.GetMedication(ctx, m.Identity); !errors.Is(err, storage.ErrNotFound) {
+			t.Fatalf("got %v, expected %v", err, storage.ErrNotFound)
+		}
+	}
+	expectReads(t, backend, 1)
+
+	// Created by another replica, visible once the negative entry expires
+	if err := backend.Storage.CreateMedication(ctx, m); err != nil {
+		t.Fatalf("failed to create: %v", err)
+	}
+	*now = now.Add(testConfig.NegativeTTL)
+	if _, err := cache.GetMedication(ctx, m.Identity); err != nil {
+		t.Fatalf("failed to get: %v", err)
+	}
+	expectReads(t, backend, 2)
+}
+
+func testCacheChanges(t *testing.T, ctx context.Context, backend *countingStorage, cache *Storage, now *time.Time) {
+	m := newMedication("changes")
+	if _, err := cache.GetMedication(ctx, m.Identity); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("got %v, expected %v", err, storage.ErrNotFound)
+	}
+	if err := cache.CreateMedication(ctx, m); err != nil {
+		t.Fatalf("failed to create: %v", err)
+	}
+	if got, err := cache.GetMedication(ctx, m.Identity); err != nil || got != m {
+		t.Fatalf("got %+v, %v, expected %+v", got, err, m)
+	}
+
+	updated := m
+	updated.Version = "v2"
+	updated.Name = "Ibuprofen"
+	if _, err := cache.UpdateMedication(ctx, m.Version, updated); err != nil {
+		t.Fatalf("failed to update: %v", err)
+	}
+	if got, err := cache.GetMedication(ctx, m.Identity); err != nil || got != updated {
+		t.Fatalf("got %+v, %v, expected %+v", got, err, updated)
+	}
+
+	// Updated by another replica: the stale entry is dropped by the rejected update
+	changed := updated
+	changed.Version = "v3"
+	if _, err := backend.Storage.UpdateMedication(ctx, updated.Version, changed); err != nil {
+		t.Fatalf("failed to update: %v", err)
+	}
+	if _, err := cache.UpdateMedication(ctx, updated.Version, updated); !errors.Is(err, storage.ErrVersionMismatch) {
+		t.Fatalf("got %v, expected %v", err, storage.ErrVersionMismatch)
+	}
+	if got, err := cache.GetMedication(ctx, m.Identity); err != nil || got != changed {
+		t.Fatalf("got %+v, %v, expected %+v", got, err, changed)
+	}
+
+	if _, err := cache.DeleteMedication(ctx, m.Identity); err != nil {
+		t.Fatalf("failed to delete: %v", err)
+	}
+	if _, err := cache.GetMedication(ctx, m.Identity); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("got %v, expected %v", err, storage.ErrNotFound)
+	}
+	expectReads(t, backend, 2)
+}
+
+func testCacheConsistentRead(t *testing.T, ctx context.Context, backend *countingStorage, cache *Storage, now *time.Time) {
+	m := newMedication("consistent")
+	if err := cache.CreateMedication(ctx, m); err != nil {
+		t.Fatalf("failed to create: %v", err)
+	}
+	changed := m
+	changed.Version = "v2"
+	if _, err := backend.Storage.UpdateMedication(ctx, m.Version, changed); err != nil {
+		t.Fatalf("failed to update: %v", err)
+	}
+
+	if got, _ := cache.GetMedication(ctx, m.Identity); got != m {
+		t.Fatalf("got %+v, expected the cached %+v", got, m)
+	}
+	if got, _ := cache.GetMedication(storage.WithConsistentRead(ctx), m.Identity); got != changed {
+		t.Fatalf("got %+v, expected %+v", got, changed)
+	}
+	// And the cache is refreshed
+	if got, _ := cache.GetMedication(ctx, m.Identity); got != changed {
+		t.Fatalf("got %+v, expected %+v", got, changed)
+	}
+	expectReads(t, backend, 1)
+}
+
+func testCacheConcurrentMisses(t *testing.T, ctx context.Context, backend *countingStorage, cache *Storage, now *time.Time) {
+	m := newMedication("concurrent")
+	if err := backend.Storage.CreateMedication(ctx, m); err != nil {
+		t.Fatalf("failed to create: %v", err)
+	}
+	backend.block = make(chan struct{})
+
+	const callers = 10
+	wg := &sync.WaitGroup{}
+	errs := make(chan error, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := cache.GetMedication(ctx, m.Identity)
+			errs <- err
+		}()
+	}
+	// Callers are blocked on the first read, let it go once it has started
+	for backend.reads.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(backend.block)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("failed to get: %v", err)
+		}
+	}
+	expectReads(t, backend, 1)
+}
+
+func testCacheReadRacingChange(t *testing.T, ctx context.Context, backend *countingStorage, cache *Storage, now *time.Time) {
+	m := newMedication("race")
+	if err := backend.Storage.CreateMedication(ctx, m); err != nil {
+		t.Fatalf("failed to create: %v", err)
+	}
+	backend.block = make(chan struct{})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = cache.GetMedication(ctx, m.Identity)
+	}()
+	for backend.reads.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The read has started before the update, its result is older
+	updated := m
+	updated.Version = "v2"
+	if _, err := cache.UpdateMedication(ctx, m.Version, updated); err != nil {
+		t.Fatalf("failed to update: %v", err)
+	}
+	close(backend.block)
+	<-done
+
+	if got, _ := cache.GetMedication(ctx, m.Identity); got != updated {
+		t.Fatalf("got %+v, expected %+v", got, updated)
+	}
+}
+
+func testCacheReadRacingInvalidation(t *testing.T, ctx context.Context, backend *countingStorage, cache *Storage, now *time.Time) {
+	m := newMedication("race")
+	if err := backend.Storage.CreateMedication(ctx, m); err != nil {
+		t.Fatalf("failed to create: %v", err)
+	}
+	backend.block = make(chan struct{})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = cache.GetMedication(ctx, m.Identity)
+	}()
+	for backend.reads.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Updated by another replica while the read is in flight, the rejected update invalidates the entry
+	changed := m
+	changed.Version = "v2"
+	if _, err := backend.Storage.UpdateMedication(ctx, m.Version, changed); err != nil {
+		t.Fatalf("failed to update: %v", err)
+	}
+	if _, err := cache.UpdateMedication(ctx, m.Version, m); !errors.Is(err, storage.ErrVersionMismatch) {
+		t.Fatalf("got %v, expected %v", err, storage.ErrVersionMismatch)
+	}
+	close(backend.block)
+	<-done
+
+	backend.block = nil
+	if got, err := cache.GetMedication(ctx, m.Identity); err != nil || got != changed {
+		t.Fatalf("got %+v, %v, expected %+v", got, err, changed)
+	}
+	expectReads(t, backend, 2)
+}
+
+func testCacheEviction(t *testing.T, ctx context.Context, backend *countingStorage, cache *Storage, now *time.Time) {
+	cache.local = newLRU(2)
+	ids := []string{"a", "b", "a", "c", "a", "b"} // b is the least recently used when c is added
+	for _, id := range ids {
+		_, _ = cache.GetMedication(ctx, newMedication(id).Identity)
+	}
+	// a, b, c and b again
+	expectReads(t, backend, 4)
+	if cache.local.len() != 2 {
+		t.Fatalf("got %d entries, expected 2", cache.local.len())
+	}
+}
@@ -0,0 +1,84 @@
+package cache
+
+import (
+	"container/list"
+	"time"
+
+	"github.com/chestnut42/test-medication/internal/model"
+)
+
+type entry struct {
+	key      model.Identity
+	value    Entry
+	expires  time.Time
+	mutation uint64 // Sequence number of the mutation that wrote the entry, zero for fills
+	invalid  bool   // Tombstone of invalidate, it's a miss
+}
+
+// lru is a size bounded map that evicts the least recently used entry. It's not safe for concurrent use.
+type lru struct {
+	size  int
+	order *list.List // Front is the most recently used
+	items map[model.Identity]*list.Element
+}
+
+func newLRU(size int) *lru {
+	return &lru{
+		size:  size,
+		order: list.New(),
+		items: make(map[model.Identity]*list.Element),
+	}
+}
+
+func (l *lru) get(key model.Identity) (*entry, bool) {
+	el, ok := l.items[key]
+	if !ok {
+		return nil, false
+	}
+	l.order.MoveToFront(el)
+	return el.Value.(*entry), true
+}
+
+// peek doesn't make the entry recently used.
+func (l *lru) peek(key model.Identity) (*entry, bool) {
+	el, ok := l.items[key]
+	if !ok {
+		return nil, false
+	}
+	return el.Value.(*entry), true
+}
+
+func (l *lru) put(e *entry) {
+	if el, ok := l.items[e.key]; ok {
+		el.Value = e
+		l.order.MoveToFront(el)
+		return
+	}
+	l.items[e.key] = l.order.PushFront(e)
+	for l.order.Len() > l.size {
+		oldest := l.order.Back()
+		l.order.Remove(oldest)
+		delete(l.items, oldest.Value.(*entry).key)
+	}
+}
+
+func (l *lru) remove(key model.Identity) {
+	if el, ok := l.items[key]; ok {
+		l.order.Remove(el)
+		delete(l.items, key)
+	}
+}
+
+// removeFunc removes every entry the function returns true for.
+func (l *lru) removeFunc(fn func(key model.Identity) bool) {
+	for key, el := range l.items {
+		if fn(key) {
+			l.order.Remove(el)
+			delete(l.items, key)
+		}
+	}
+}
+
+func (l *lru) len() int {
+	return l.order.Len()
+}
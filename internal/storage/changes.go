@@ -0,0 +1,428 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/chestnut42/test-medication/internal/model"
+	"github.com/chestnut42/test-medication/internal/utils/tracing"
+)
+
+// The outbox table is the change log of every owner, so that clients can catch up with what they have missed.
+// A create, update, delete or move appends a change in the same transaction as the medication write. Changes of
+// an owner are numbered 1, 2, 3... by a counter item: the counter is read before the write and the transaction is
+// conditional on it, so a number is never skipped or reused and the order is the commit order. Concurrent writes
+// of the same owner are retried. Changes expire after Config.ChangeRetention, the counter never does.
+
+// ErrChangesExpired means changes after the requested one are no longer kept, or the log has been reset by
+// wiping the tenant. The client has to start over.
+var ErrChangesExpired = errors.New("changes expired")
+
+// Change is a medication as it was written. Deleted changes only have the identity and the version.
+type Change struct {
+	Seq        int64
+	Medication model.Medication
+	Deleted    bool
+}
+
+type ChangesQuery struct {
+	Tenant string
+	Owner  string
+	After  int64 // Changes after this one are returned, zero means from the beginning
+	Limit  int32 // Zero returns no changes, only Last
+}
+
+type ChangesResult struct {
+	Changes []Change
+	Last    int64 // The last change of the owner when the query started
+}
+
+const (
+	// changeCounterSortKey sorts before sequence numbers, so a query of changes never returns it
+	changeCounterSortKey = "#seq"
+
+	maxChangeAttempts = 5
+)
+
+// changeItemV1 is the layout of a change. The medication item is nested into it as it was written, so its
+// encrypted fields are still bound to the medication's partition key.
+type changeItemV1 struct {
+	PartitionKey string `dynamodbav:"PK"` // List key of the owner
+	SortKey      string `dynamodbav:"SK"` // Zero padded Seq
+	Seq          int64
+	Id           string
+	Version      string
+	Deleted      bool  `dynamodbav:",omitempty"`
+	ExpiresAt    int64 `dynamodbav:",omitempty"`
+}
+
+const changeItemAttribute = "Item"
+
+// change is a change to be appended to the owner's log. Item is the written medication item, nil for deletes.
+type change struct {
+	identity model.Identity
+	version  string
+	item     map[string]types.AttributeValue
+}
+
+func getChangeSortKey(seq int64) string {
+	return fmt.Sprintf("%020d", seq)
+}
+
+func getChangeCounterKey(tenant string, owner string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"PK": &types.AttributeValueMemberS{Value: getListKey(tenant, owner)},
+		"SK": &types.AttributeValueMemberS{Value: changeCounterSortKey},
+	}
+}
+
+// transact writes the items in one transaction that appends the changes to the change log, if it's configured.
+// Conflicts on change counters are retried, any other error is returned as it is.
+func (s *Service) transact(ctx context.Context, span trace.Span, writes []types.TransactWriteItem, changes ...change) error {
+	for attempt := 1; ; attempt++ {
+		items := writes
+		if s.cfg.OutboxTable != "" && len(changes) > 0 {
+			appended, err := s.changeWrites(ctx, changes)
+			if err != nil {
+				return err
+			}
+			items = append(slices.Clip(writes), appended...)
+		}
+
+		out, err := s.database.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+			TransactItems:          items,
+			ReturnConsumedCapacity: types.ReturnConsumedCapacityTotal,
+		})
+		if err != nil {
+			if attempt < maxChangeAttempts && changeConflict(err, len(writes)) {
+				continue
+			}
+			return err
+		}
+		units := 0.0
+		for _, c := range out.ConsumedCapacity {
+			units += consumedUnits(&c)
+		}
+		recordCapacity(span, &types.ConsumedCapacity{CapacityUnits: aws.Float64(units)})
+		return nil
+	}
+}
+
+// deleteWithChange flags the medication as deleted and appends the change in one transaction. A transaction
+// can't return the old item, so it's read first and the transaction is conditional on it.
+func (s *Service) deleteWithChange(ctx context.Context, span trace.Span, identity model.Identity) (wrappedMedication, error) {
+	for attempt := 1; ; attempt++ {
+		item, ok, err := s.getItem(ctx, identity)
+		if err != nil {
+			return wrappedMedication{}, err
+		}
+		if !ok || item.Deleted {
+			return wrappedMedication{}, fmt.Errorf("medication not found: %v, %w", identity, ErrNotFound)
+		}
+
+		expr, err := expression.NewBuilder().
+			WithCondition(unchangedCondition(item)).
+			WithUpdate(expression.Set(expression.Name("Deleted"), expression.Value(true))).
+			Build()
+		if err != nil {
+			return wrappedMedication{}, fmt.Errorf("failed to build expression: %w", err)
+		}
+		err = s.transact(ctx, span, []types.TransactWriteItem{{
+			Update: &types.Update{
+				TableName:                 aws.String(s.cfg.MedicationTable),
+				Key:                       getKey(identity),
+				ConditionExpression:       expr.Condition(),
+				UpdateExpression:          expr.Update(),
+				ExpressionAttributeNames:  expr.Names(),
+				ExpressionAttributeValues: expr.Values(),
+			},
+		}}, change{identity: identity, version: item.Version})
+		if err != nil {
+			// Changed since it has been read, it's read again
+			var tce *types.TransactionCanceledException
+			if errors.As(err, &tce) && attempt < maxChangeAttempts && len(tce.CancellationReasons) > 0 &&
+				aws.ToString(tce.CancellationReasons[0].Code) == "ConditionalCheckFailed" {
+				continue
+			}
+			return wrappedMedication{}, fmt.Errorf("failed to transact items: %w", err)
+		}
+		item.Deleted = true
+		return item, nil
+	}
+}
+
+// changeConflict reports whether the transaction has been cancelled by concurrent writes only, e.g. another
+// change of the same owner has taken the number.
+func changeConflict(err error, writes int) bool {
+	var tce *types.TransactionCanceledException
+	if !errors.As(err, &tce) {
+		return false
+	}
+	conflict := false
+	for i, reason := range tce.CancellationReasons {
+		switch code := aws.ToString(reason.Code); {
+		case code == "" || code == "None":
+		case code == "TransactionConflict", i >= writes && code == "ConditionalCheckFailed":
+			conflict = true
+		default:
+			return false
+		}
+	}
+	return conflict
+}
+
+// changeWrites numbers the changes and returns the writes that append them. A transaction can't write
+// the same item twice, so the counter of an owner is updated once.
+func (s *Service) changeWrites(ctx context.Context, changes []change) ([]types.TransactWriteItem, error) {
+	type counter struct {
+		identity model.Identity
+		last     int64
+		next     int64
+	}
+	var counters []*counter
+	now := time.Now()
+
+	var writes []types.TransactWriteItem
+	for _, c := range changes {
+		i := slices.IndexFunc(counters, func(cnt *counter) bool {
+			return cnt.identity.Tenant == c.identity.Tenant && cnt.identity.Owner == c.identity.Owner
+		})
+		if i < 0 {
+			last, err := s.lastChange(ctx, c.identity.Tenant, c.identity.Owner)
+			if err != nil {
+				return nil, err
+			}
+			counters = append(counters, &counter{identity: c.identity, last: last, next: last})
+			i = len(counters) - 1
+		}
+		counters[i].next++
+
+		item, err := s.encodeChange(c, counters[i].next, now)
+		if err != nil {
+			return nil, err
+		}
+		writes = append(writes, types.TransactWriteItem{
+			Put: &types.Put{TableName: aws.String(s.cfg.OutboxTable), Item: item},
+		})
+	}
+
+	for _, cnt := range counters {
+		cond := expression.Name("Seq").Equal(expression.Value(cnt.last))
+		if cnt.last == 0 {
+			cond = expression.Name("Seq").AttributeNotExists()
+		}
+		expr, err := expression.NewBuilder().
+			WithCondition(cond).
+			WithUpdate(expression.Set(expression.Name("Seq"), expression.Value(cnt.next))).
+			Build()
+		if err != nil {
+			return nil, fmt.Errorf("failed to build expression: %w", err)
+		}
+		writes = append(writes, types.TransactWriteItem{
+			Update: &types.Update{
+				TableName:                 aws.String(s.cfg.OutboxTable),
+				Key:                       getChangeCounterKey(cnt.identity.Tenant, cnt.identity.Owner),
+				ConditionExpression:       expr.Condition(),
+				UpdateExpression:          expr.Update(),
+				ExpressionAttributeNames:  expr.Names(),
+				ExpressionAttributeValues: expr.Values(),
+			},
+		})
+	}
+	return writes, nil
+}
+
+func (s *Service) encodeChange(c change, seq int64, now time.Time) (map[string]types.AttributeValue, error) {
+	item := changeItemV1{
+		PartitionKey: getListKey(c.identity.Tenant, c.identity.Owner),
+		SortKey:      getChangeSortKey(seq),
+		Seq:          seq,
+		Id:           c.identity.Id,
+		Version:      c.version,
+		Deleted:      c.item == nil,
+	}
+	if s.cfg.ChangeRetention > 0 {
+		item.ExpiresAt = now.Add(s.cfg.ChangeRetention).Unix()
+	}
+	av, err := attributevalue.MarshalMap(item)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal change: %w", err)
+	}
+	if c.item != nil {
+		av[changeItemAttribute] = &types.AttributeValueMemberM{Value: c.item}
+	}
+	return av, nil
+}
+
+// lastChange is a consistent read of the owner's counter, zero if the owner has no changes.
+func (s *Service) lastChange(ctx context.Context, tenant string, owner string) (int64, error) {
+	resp, err := s.database.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(s.cfg.OutboxTable),
+		Key:            getChangeCounterKey(tenant, owner),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to get change counter: %w", err)
+	}
+	var counter struct{ Seq int64 }
+	if err := attributevalue.UnmarshalMap(resp.Item, &counter); err != nil {
+		return 0, fmt.Errorf("failed to unmarshal change counter: %w", err)
+	}
+	return counter.Seq, nil
+}
+
+// ListChanges returns changes of the owner after query.After in order. ErrChangesExpired is returned if some of
+// them are no longer kept or the requested change is ahead of the log.
+func (s *Service) ListChanges(ctx context.Context, query ChangesQuery) (_ ChangesResult, err error) {
+	ctx, span := tracer.Start(ctx, "storage.ListChanges", trace.WithAttributes(
+		attribute.String("med.tenant", query.Tenant),
+		attribute.String("med.owner", query.Owner)))
+	defer func() { tracing.End(span, err) }()
+
+	if s.cfg.OutboxTable == "" {
+		return ChangesResult{}, errors.New("outbox table is not configured")
+	}
+
+	// The counter is read first: every change up to it has been committed, so it's found below unless expired
+	last, err := s.lastChange(ctx, query.Tenant, query.Owner)
+	if err != nil {
+		return ChangesResult{}, err
+	}
+	if query.After > last {
+		return ChangesResult{}, fmt.Errorf("change %d is ahead of the log at %d: %w", query.After, last, ErrChangesExpired)
+	}
+	result := ChangesResult{Changes: []Change{}, Last: last}
+	if query.Limit <= 0 || query.After == last {
+		return result, nil
+	}
+
+	expr, err := expression.NewBuilder().WithKeyCondition(
+		expression.Key("PK").Equal(expression.Value(getListKey(query.Tenant, query.Owner))).
+			And(expression.Key("SK").GreaterThan(expression.Value(getChangeSortKey(query.After))))).
+		Build()
+	if err != nil {
+		return ChangesResult{}, fmt.Errorf("failed to build expression: %w", err)
+	}
+	resp, err := s.database.Query(ctx, &dynamodb.QueryInput{
+		TableName:                 aws.String(s.cfg.OutboxTable),
+		KeyConditionExpression:    expr.KeyCondition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		Limit:                     aws.Int32(query.Limit),
+		ConsistentRead:            aws.Bool(true),
+		ReturnConsumedCapacity:    types.ReturnConsumedCapacityTotal,
+	})
+	if err != nil {
+		return ChangesResult{}, fmt.Errorf("failed to query changes: %w", err)
+	}
+	recordCapacity(span, resp.ConsumedCapacity)
+
+	for i, av := range resp.Items {
+		c, err := s.decodeChange(ctx, query, av)
+		if err != nil {
+			return ChangesResult{}, err
+		}
+		// Expired changes leave a gap
+		if expected := query.After + int64(i) + 1; c.Seq != expected {
+			return ChangesResult{}, fmt.Errorf("change %d of %s is not kept: %w", expected, query.Owner, ErrChangesExpired)
+		}
+		result.Changes = append(result.Changes, c)
+	}
+	if len(result.Changes) == 0 {
+		return ChangesResult{}, fmt.Errorf("changes after %d of %s are not kept: %w", query.After, query.Owner, ErrChangesExpired)
+	}
+	return result, nil
+}
+
+// wipeChanges deletes changes of the tenant. Counters are kept and moved one past the last change instead: that
+// change never exists, so every token issued before is expired while new ones are issued after it.
+func (s *Service) wipeChanges(ctx context.Context, tenant string) error {
+	if s.cfg.OutboxTable == "" {
+		return nil
+	}
+	expr, err := expression.NewBuilder().
+		WithFilter(expression.Name("PK").BeginsWith(getTenantPrefix(tenant))).
+		WithProjection(expression.NamesList(expression.Name("PK"), expression.Name("SK"))).
+		Build()
+	if err != nil {
+		return fmt.Errorf("failed to build expression: %w", err)
+	}
+	reset, err := expression.NewBuilder().
+		WithUpdate(expression.Add(expression.Name("Seq"), expression.Value(1))).
+		Build()
+	if err != nil {
+		return fmt.Errorf("failed to build expression: %w", err)
+	}
+
+	paginator := dynamodb.NewScanPaginator(s.database, &dynamodb.ScanInput{
+		TableName:                 aws.String(s.cfg.OutboxTable),
+		FilterExpression:          expr.Filter(),
+		ProjectionExpression:      expr.Projection(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to scan changes: %w", err)
+		}
+
+		requests := make([]types.WriteRequest, 0, len(page.Items))
+		for _, key := range page.Items {
+			if sk, ok := key["SK"].(*types.AttributeValueMemberS); ok && sk.Value == changeCounterSortKey {
+				if _, err := s.database.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+					TableName:                 aws.String(s.cfg.OutboxTable),
+					Key:                       key,
+					UpdateExpression:          reset.Update(),
+					ExpressionAttributeNames:  reset.Names(),
+					ExpressionAttributeValues: reset.Values(),
+				}); err != nil {
+					return fmt.Errorf("failed to reset change counter: %w", err)
+				}
+				continue
+			}
+			requests = append(requests, types.WriteRequest{DeleteRequest: &types.DeleteRequest{Key: key}})
+		}
+		for start := 0; start < len(requests); start += maxBatchWrite {
+			chunk := requests[start:min(start+maxBatchWrite, len(requests))]
+			if err := s.batchWriteTable(ctx, s.cfg.OutboxTable, chunk); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Service) decodeChange(ctx context.Context, query ChangesQuery, av map[string]types.AttributeValue) (Change, error) {
+	var item changeItemV1
+	if err := attributevalue.UnmarshalMap(av, &item); err != nil {
+		return Change{}, fmt.Errorf("failed to unmarshal change: %w", err)
+	}
+	c := Change{
+		Seq: item.Seq,
+		Medication: model.Medication{
+			Identity: model.Identity{Id: item.Id, Owner: query.Owner, Tenant: query.Tenant},
+			Version:  item.Version,
+		},
+		Deleted: item.Deleted,
+	}
+	if nested, ok := av[changeItemAttribute].(*types.AttributeValueMemberM); ok {
+		m, err := s.unmarshalMedication(ctx, nested.Value)
+		if err != nil {
+			return Change{}, err
+		}
+		c.Medication = m.Medication
+	}
+	return c, nil
+}
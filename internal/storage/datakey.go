@@ -0,0 +1,158 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"github.com/chestnut42/test-medication/internal/model"
+)
+
+const dataKeySortKeyPrefix = "datakey#"
+
+// Data keys live next to tenant settings. They are never deleted: old keys are needed to read items
+// that haven't been re-encrypted yet, and backups.
+type wrappedDataKey struct {
+	PartitionKey string `dynamodbav:"PK"`
+	SortKey      string `dynamodbav:"SK"`
+	model.DataKey
+}
+
+func (s *Service) CreateDataKey(ctx context.Context, key model.DataKey) error {
+	item, err := attributevalue.MarshalMap(wrappedDataKey{
+		PartitionKey: getTenantSettingsPartition(key.Tenant),
+		SortKey:      dataKeySortKeyPrefix + key.Id,
+		DataKey:      key,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal item: %w", err)
+	}
+
+	expr, err := expression.NewBuilder().
+		WithCondition(expression.Name("PK").AttributeNotExists()).
+		Build()
+	if err != nil {
+		return fmt.Errorf("failed to build expression: %w", err)
+	}
+
+	if _, err := s.database.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:                 aws.String(s.cfg.MedicationTable),
+		Item:                      item,
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	}); err != nil {
+		var cfe *types.ConditionalCheckFailedException
+		if errors.As(err, &cfe) {
+			return fmt.Errorf("data key %s already exists: %w", key.Id, ErrAlreadyExists)
+		}
+		return fmt.Errorf("failed to put item: %w", err)
+	}
+	return nil
+}
+
+func (s *Service) ListDataKeys(ctx context.Context, tenant string) ([]model.DataKey, error) {
+	expr, err := expression.NewBuilder().
+		WithKeyCondition(expression.Key("PK").Equal(expression.Value(getTenantSettingsPartition(tenant))).
+			And(expression.Key("SK").BeginsWith(dataKeySortKeyPrefix))).
+		Build()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build expression: %w", err)
+	}
+
+	var keys []model.DataKey
+	paginator := dynamodb.NewQueryPaginator(s.database, &dynamodb.QueryInput{
+		TableName:                 aws.String(s.cfg.MedicationTable),
+		KeyConditionExpression:    expr.KeyCondition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ConsistentRead:            aws.Bool(true),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to query items: %w", err)
+		}
+		var items []wrappedDataKey
+		if err := attributevalue.UnmarshalListOfMaps(page.Items, &items); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal items: %w", err)
+		}
+		for _, item := range items {
+			keys = append(keys, item.DataKey)
+		}
+	}
+	return keys, nil
+}
+
+// ScanDataKeys calls fn for data keys of all tenants. It scans the whole table.
+func (s *Service) ScanDataKeys(ctx context.Context, fn func(model.DataKey) error) error {
+	expr, err := expression.NewBuilder().
+		WithFilter(expression.Name("PK").BeginsWith(getTenantSettingsPartition("")).
+			And(expression.Name("SK").BeginsWith(dataKeySortKeyPrefix))).
+		Build()
+	if err != nil {
+		return fmt.Errorf("failed to build expression: %w", err)
+	}
+
+	paginator := dynamodb.NewScanPaginator(s.database, &dynamodb.ScanInput{
+		TableName:                 aws.String(s.cfg.MedicationTable),
+		FilterExpression:          expr.Filter(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to scan: %w", err)
+		}
+		var items []wrappedDataKey
+		if err := attributevalue.UnmarshalListOfMaps(page.Items, &items); err != nil {
+			return fmt.Errorf("failed to unmarshal items: %w", err)
+		}
+		for _, item := range items {
+			if err := fn(item.DataKey); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// RewrapDataKey replaces the wrapped key if it's still wrapped by oldMasterKeyId.
+// ErrVersionMismatch means it has been re-wrapped concurrently.
+func (s *Service) RewrapDataKey(ctx context.Context, key model.DataKey, oldMasterKeyId string) error {
+	expr, err := expression.NewBuilder().
+		WithCondition(expression.Name("MasterKeyId").Equal(expression.Value(oldMasterKeyId))).
+		WithUpdate(expression.
+			Set(expression.Name("MasterKeyId"), expression.Value(key.MasterKeyId)).
+			Set(expression.Name("WrappedKey"), expression.Value(key.WrappedKey))).
+		Build()
+	if err != nil {
+		return fmt.Errorf("failed to build expression: %w", err)
+	}
+
+	if _, err := s.database.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(s.cfg.MedicationTable),
+		Key: map[string]types.AttributeValue{
+			"PK": &types.AttributeValueMemberS{Value: getTenantSettingsPartition(key.Tenant)},
+			"SK": &types.AttributeValueMemberS{Value: dataKeySortKeyPrefix + key.Id},
+		},
+		ConditionExpression:       expr.Condition(),
+		UpdateExpression:          expr.Update(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	}); err != nil {
+		var cfe *types.ConditionalCheckFailedException
+		if errors.As(err, &cfe) {
+			return fmt.Errorf("data key %s/%s is not wrapped by %s: %w", key.Tenant, key.Id, oldMasterKeyId, ErrVersionMismatch)
+		}
+		return fmt.Errorf("failed to update item: %w", err)
+	}
+	return nil
+}
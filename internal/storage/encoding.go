@@ -0,0 +1,236 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"github.com/chestnut42/test-medication/internal/model"
+	"github.com/chestnut42/test-medication/internal/utils/logx"
+)
+
+// Medication items carry the version of their layout in the Schema attribute. The layout is declared by
+// a storage struct per version, so a change of the model doesn't change what is stored.
+//
+// To change the layout: add medicationItemV<N+1>, make it current and keep the decoder of version N.
+// The decoder upgrades old items to the current model on read. Items are written in the current layout by
+// every full write (create, update, re-encryption, migrations). Deletes only flag the item unless
+// Config.UpgradeOnWrite is set. Old items can also be rewritten at once with a migration (see migration.go).
+// An optional attribute that older releases can ignore (e.g. MovedTo) is added to the current layout instead,
+// so that a rollout doesn't make new items unreadable for replicas that are not updated yet.
+
+const (
+	schemaAttribute = "Schema"
+
+	// currentMedicationSchema is the version new items are written with.
+	currentMedicationSchema = 1
+)
+
+var ErrUnknownSchema = errors.New("unknown item schema")
+
+// medicationDecoders upgrade items of every known version to the current model.
+var medicationDecoders = map[int]func(av map[string]types.AttributeValue) (wrappedMedication, error){
+	0: decodeMedicationV1, // Written before the schema attribute, the layout is the same as version 1
+	1: decodeMedicationV1,
+}
+
+// medicationItemV1 is the layout model.Medication had when it was embedded into the item.
+type medicationItemV1 struct {
+	PartitionKey string           `dynamodbav:"PK"`
+	SortKey      string           `dynamodbav:"SK"`
+	ListKey      string           `dynamodbav:"LK"`
+	Deleted      bool             `dynamodbav:",omitempty"`
+	Encrypted    *encryptedFields `dynamodbav:"Enc,omitempty"` // Sensitive fields, see encryption.go
+	MovedTo      *identityV1      `dynamodbav:",omitempty"`    // Set on redirect tombstones, see move.go
+	UpdatedAt    int64            `dynamodbav:",omitempty"`    // Unix milliseconds, filtered by ListMedications
+	Schema       int
+
+	Id     string
+	Owner  string
+	Tenant string
+
+	Name         string
+	Dosage       string
+	Form         string
+	Prescriber   prescriberV1
+	Indication   indicationV1
+	StartDate    string
+	EndDate      string
+	Status       string
+	StatusReason string
+
+	Version string
+}
+
+type identityV1 struct {
+	Id     string
+	Owner  string
+	Tenant string
+}
+
+type prescriberV1 struct {
+	Id   string
+	Name string
+}
+
+type indicationV1 struct {
+	Text   string
+	Code   string
+	System string
+}
+
+func encodeMedication(item wrappedMedication) (map[string]types.AttributeValue, error) {
+	av, err := attributevalue.MarshalMap(medicationItemV1{
+		PartitionKey: item.PartitionKey,
+		SortKey:      item.SortKey,
+		ListKey:      item.ListKey,
+		Deleted:      item.Deleted,
+		Encrypted:    item.Encrypted,
+		MovedTo:      encodeIdentity(item.MovedTo),
+		UpdatedAt:    encodeTime(item.UpdatedAt),
+		Schema:       currentMedicationSchema,
+		Id:           item.Id,
+		Owner:        item.Owner,
+		Tenant:       item.Tenant,
+		Name:         item.Name,
+		Dosage:       item.Dosage,
+		Form:         string(item.Form),
+		Prescriber:   prescriberV1{Id: item.Prescriber.Id, Name: item.Prescriber.Name},
+		Indication: indicationV1{
+			Text:   item.Indication.Text,
+			Code:   item.Indication.Code,
+			System: item.Indication.System,
+		},
+		StartDate:    item.StartDate,
+		EndDate:      item.EndDate,
+		Status:       string(item.Status),
+		StatusReason: item.StatusReason,
+		Version:      item.Version,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal item: %w", err)
+	}
+	return av, nil
+}
+
+// decodeMedication decodes an item of any known version. Schema of the result keeps the version
+// the item is stored with.
+func decodeMedication(av map[string]types.AttributeValue) (wrappedMedication, error) {
+	version, err := medicationSchema(av)
+	if err != nil {
+		return wrappedMedication{}, err
+	}
+	decode, ok := medicationDecoders[version]
+	if !ok {
+		// Most likely written by a newer release
+		return wrappedMedication{}, fmt.Errorf("medication item has schema %d: %w", version, ErrUnknownSchema)
+	}
+	item, err := decode(av)
+	if err != nil {
+		return wrappedMedication{}, fmt.Errorf("failed to decode medication item of schema %d: %w", version, err)
+	}
+	item.Schema = version
+	return item, nil
+}
+
+func medicationSchema(av map[string]types.AttributeValue) (int, error) {
+	attr, ok := av[schemaAttribute]
+	if !ok {
+		return 0, nil
+	}
+	var version int
+	if err := attributevalue.Unmarshal(attr, &version); err != nil {
+		return 0, fmt.Errorf("failed to unmarshal schema: %w", err)
+	}
+	return version, nil
+}
+
+func decodeMedicationV1(av map[string]types.AttributeValue) (wrappedMedication, error) {
+	var item medicationItemV1
+	if err := attributevalue.UnmarshalMap(av, &item); err != nil {
+		return wrappedMedication{}, fmt.Errorf("failed to unmarshal item: %w", err)
+	}
+	return wrappedMedication{
+		PartitionKey: item.PartitionKey,
+		SortKey:      item.SortKey,
+		ListKey:      item.ListKey,
+		Deleted:      item.Deleted,
+		Encrypted:    item.Encrypted,
+		MovedTo:      decodeIdentity(item.MovedTo),
+		UpdatedAt:    decodeTime(item.UpdatedAt),
+		Medication: model.Medication{
+			Identity: model.Identity{Id: item.Id, Owner: item.Owner, Tenant: item.Tenant},
+			MedicationData: model.MedicationData{
+				Name:   item.Name,
+				Dosage: item.Dosage,
+				Form:   model.Form(item.Form),
+				Prescription: model.Prescription{
+					Prescriber: model.Prescriber{Id: item.Prescriber.Id, Name: item.Prescriber.Name},
+					Indication: model.Indication{
+						Text:   item.Indication.Text,
+						Code:   item.Indication.Code,
+						System: item.Indication.System,
+					},
+					StartDate:    item.StartDate,
+					EndDate:      item.EndDate,
+					Status:       model.Status(item.Status),
+					StatusReason: item.StatusReason,
+				},
+			},
+			Version: item.Version,
+		},
+	}, nil
+}
+
+func encodeIdentity(identity *model.Identity) *identityV1 {
+	if identity == nil {
+		return nil
+	}
+	return &identityV1{Id: identity.Id, Owner: identity.Owner, Tenant: identity.Tenant}
+}
+
+func decodeIdentity(identity *identityV1) *model.Identity {
+	if identity == nil {
+		return nil
+	}
+	return &model.Identity{Id: identity.Id, Owner: identity.Owner, Tenant: identity.Tenant}
+}
+
+func encodeTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixMilli()
+}
+
+func decodeTime(ms int64) time.Time {
+	if ms == 0 {
+		return time.Time{}
+	}
+	return time.UnixMilli(ms)
+}
+
+// outdated reports whether the item is stored with an older schema than the current one.
+func (w wrappedMedication) outdated() bool {
+	return w.Schema < currentMedicationSchema
+}
+
+// upgradeOnWrite rewrites an outdated item that has just been changed in place (e.g. flagged as deleted)
+// in the current layout. It's best effort, the write has already succeeded.
+func (s *Service) upgradeOnWrite(ctx context.Context, item wrappedMedication) {
+	if !s.cfg.UpgradeOnWrite || !item.outdated() {
+		return
+	}
+	// reencrypt writes the current layout with the current data key unless the item has been changed meanwhile
+	if _, err := s.reencrypt(ctx, item); err != nil {
+		logx.Logger(ctx).Warn("upgrading medication on write",
+			slog.String("id", item.Id),
+			slog.Int("schema", item.Schema),
+			slog.Any("error", err))
+	}
+}
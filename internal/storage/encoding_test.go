@@ -0,0 +1,94 @@
+package storage
+
+import (
+	"errors"
+	"maps"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"github.com/chestnut42/test-medication/internal/model"
+)
+
+func TestEncoding(t *testing.T) {
+	medication := model.Medication{
+		Identity: model.Identity{Id: "id", Owner: "owner", Tenant: "acme"},
+		MedicationData: model.MedicationData{
+			Name:   "Paracetamol",
+			Dosage: "500mg",
+			Form:   model.FormTablet,
+			Prescription: model.Prescription{
+				Prescriber:   model.Prescriber{Id: "npi", Name: "Dr. Who"},
+				Indication:   model.Indication{Text: "Headache", Code: "R51", System: "http://hl7.org/fhir/sid/icd-10"},
+				StartDate:    "2024-01-01",
+				EndDate:      "2024-02-01",
+				Status:       model.StatusActive,
+				StatusReason: "reason",
+			},
+		},
+		Version: "v1",
+	}
+	item := wrapMedication(medication)
+	item.Deleted = true
+	item.Encrypted = &encryptedFields{KeyId: "key", Data: []byte("data")}
+
+	encoded, err := encodeMedication(item)
+	if err != nil {
+		t.Fatalf("failed to encode: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		av       func() map[string]types.AttributeValue
+		schema   int
+		outdated bool
+		err      error
+	}{
+		{
+			name:   "current",
+			av:     func() map[string]types.AttributeValue { return encoded },
+			schema: currentMedicationSchema,
+		},
+		{
+			name: "without schema",
+			av: func() map[string]types.AttributeValue {
+				av := maps.Clone(encoded)
+				delete(av, schemaAttribute)
+				return av
+			},
+			schema:   0,
+			outdated: true,
+		},
+		{
+			name: "newer schema",
+			av: func() map[string]types.AttributeValue {
+				av := maps.Clone(encoded)
+				av[schemaAttribute] = &types.AttributeValueMemberN{Value: "1000"}
+				return av
+			},
+			err: ErrUnknownSchema,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := decodeMedication(test.av())
+			if !errors.Is(err, test.err) {
+				t.Fatalf("got error %v, expected %v", err, test.err)
+			}
+			if test.err != nil {
+				return
+			}
+			if got.Schema != test.schema {
+				t.Fatalf("got schema %d, expected %d", got.Schema, test.schema)
+			}
+			if got.outdated() != test.outdated {
+				t.Fatalf("got outdated %v, expected %v", got.outdated(), test.outdated)
+			}
+			if got.Medication != medication || got.PartitionKey != item.PartitionKey || got.SortKey != item.SortKey ||
+				got.ListKey != item.ListKey || !got.Deleted || got.Encrypted == nil || got.Encrypted.KeyId != "key" {
+				t.Fatalf("got %+v, expected %+v", got, item)
+			}
+		})
+	}
+}
@@ -0,0 +1,240 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"github.com/chestnut42/test-medication/internal/model"
+	"github.com/chestnut42/test-medication/internal/utils/logx"
+)
+
+// Sensitive medication fields are encrypted with a per-tenant data key (see internal/encryption) and stored as
+// a single binary attribute. Fields used in conditions and filters (status, form, version) stay in plaintext.
+// Ciphertext is bound to the partition key, so it can't be copied to another medication.
+//
+// Items written before encryption was enabled, or with a data key that is not current anymore, are re-encrypted
+// when they are written, when they are read by GetMedication, and by ReencryptMedications.
+
+// Cipher encrypts data with the current data key of the tenant.
+type Cipher interface {
+	Encrypt(ctx context.Context, tenant string, plaintext []byte, aad []byte) (keyId string, ciphertext []byte, err error)
+	Decrypt(ctx context.Context, tenant string, keyId string, ciphertext []byte, aad []byte) ([]byte, error)
+	CurrentKeyId(ctx context.Context, tenant string) (string, error)
+}
+
+type encryptedFields struct {
+	KeyId string `dynamodbav:"K"`
+	Data  []byte `dynamodbav:"C"`
+}
+
+type sensitiveFields struct {
+	Name         string
+	Dosage       string
+	Indication   model.Indication
+	StatusReason string
+}
+
+// sensitiveAttributes are plaintext attributes of sensitiveFields. They are removed from encrypted items.
+var sensitiveAttributes = []string{"Name", "Dosage", "Indication", "StatusReason"}
+
+// WithCipher returns a copy of the service that encrypts sensitive fields. Without a cipher items are written
+// in plaintext and encrypted items can't be read.
+func (s *Service) WithCipher(cipher Cipher) *Service {
+	c := *s
+	c.cipher = cipher
+	return &c
+}
+
+func (s *Service) marshalMedication(ctx context.Context, item wrappedMedication) (map[string]types.AttributeValue, error) {
+	item.Encrypted = nil
+	av, err := encodeMedication(item)
+	if err != nil {
+		return nil, err
+	}
+	if s.cipher == nil {
+		return av, nil
+	}
+
+	plaintext, err := json.Marshal(sensitiveFields{
+		Name:         item.Name,
+		Dosage:       item.Dosage,
+		Indication:   item.Indication,
+		StatusReason: item.StatusReason,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal sensitive fields: %w", err)
+	}
+	keyId, ciphertext, err := s.cipher.Encrypt(ctx, item.Tenant, plaintext, []byte(item.PartitionKey))
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt: %w", err)
+	}
+
+	for _, name := range sensitiveAttributes {
+		delete(av, name)
+	}
+	if av["Enc"], err = attributevalue.Marshal(encryptedFields{KeyId: keyId, Data: ciphertext}); err != nil {
+		return nil, fmt.Errorf("failed to marshal encrypted fields: %w", err)
+	}
+	return av, nil
+}
+
+func (s *Service) unmarshalMedication(ctx context.Context, av map[string]types.AttributeValue) (wrappedMedication, error) {
+	item, err := decodeMedication(av)
+	if err != nil {
+		return wrappedMedication{}, err
+	}
+	if item.Encrypted == nil {
+		return item, nil
+	}
+	if s.cipher == nil {
+		return wrappedMedication{}, fmt.Errorf("medication %v is encrypted, but encryption is not configured", item.Identity)
+	}
+
+	plaintext, err := s.cipher.Decrypt(ctx, item.Tenant, item.Encrypted.KeyId, item.Encrypted.Data, []byte(item.PartitionKey))
+	if err != nil {
+		return wrappedMedication{}, fmt.Errorf("failed to decrypt medication %v: %w", item.Identity, err)
+	}
+	var fields sensitiveFields
+	if err := json.Unmarshal(plaintext, &fields); err != nil {
+		return wrappedMedication{}, fmt.Errorf("failed to unmarshal sensitive fields: %w", err)
+	}
+	item.Name = fields.Name
+	item.Dosage = fields.Dosage
+	item.Indication = fields.Indication
+	item.StatusReason = fields.StatusReason
+	return item, nil
+}
+
+func (s *Service) unmarshalMedications(ctx context.Context, avs []map[string]types.AttributeValue) ([]wrappedMedication, error) {
+	items := make([]wrappedMedication, 0, len(avs))
+	for _, av := range avs {
+		item, err := s.unmarshalMedication(ctx, av)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// stale reports whether the item must be re-encrypted with the current data key.
+func (s *Service) stale(ctx context.Context, item wrappedMedication) (bool, error) {
+	if s.cipher == nil {
+		return false, nil
+	}
+	if item.Encrypted == nil {
+		return true, nil
+	}
+	current, err := s.cipher.CurrentKeyId(ctx, item.Tenant)
+	if err != nil {
+		return false, fmt.Errorf("failed to get current data key: %w", err)
+	}
+	return item.Encrypted.KeyId != current, nil
+}
+
+// reencrypt writes the item back with the current data key unless it has been changed (or deleted) meanwhile.
+// Returns false in that case: the concurrent write has used the current key anyway.
+func (s *Service) reencrypt(ctx context.Context, item wrappedMedication) (bool, error) {
+	// Keys are recomputed the same way an update does it
+	rewritten := wrapMedication(item.Medication)
+	rewritten.Deleted = item.Deleted
+	rewritten.MovedTo = item.MovedTo
+	rewritten.UpdatedAt = item.UpdatedAt
+	av, err := s.marshalMedication(ctx, rewritten)
+	if err != nil {
+		return false, err
+	}
+
+	expr, err := expression.NewBuilder().WithCondition(unchangedCondition(item)).Build()
+	if err != nil {
+		return false, fmt.Errorf("failed to build expression: %w", err)
+	}
+
+	if _, err := s.database.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:                 aws.String(s.cfg.MedicationTable),
+		Item:                      av,
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	}); err != nil {
+		var cfe *types.ConditionalCheckFailedException
+		if errors.As(err, &cfe) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to put item: %w", err)
+	}
+	return true, nil
+}
+
+// reencryptOnRead is best effort, the read must not fail because of it.
+func (s *Service) reencryptOnRead(ctx context.Context, item wrappedMedication) {
+	stale, err := s.stale(ctx, item)
+	if err == nil && stale {
+		_, err = s.reencrypt(ctx, item)
+	}
+	if err != nil {
+		logx.Logger(ctx).Warn("re-encrypting medication on read",
+			slog.String("id", item.Id),
+			slog.Any("error", err))
+	}
+}
+
+// ReencryptMedications re-encrypts medications of all tenants, including deleted ones, that are not encrypted
+// with the current data key of their tenant. It scans the whole table and returns the number of re-encrypted items.
+func (s *Service) ReencryptMedications(ctx context.Context) (int, error) {
+	if s.cipher == nil {
+		return 0, errors.New("encryption is not configured")
+	}
+
+	// Everything but medications has a partition key starting with "#"
+	expr, err := expression.NewBuilder().
+		WithFilter(expression.Not(expression.Name("PK").BeginsWith("#"))).
+		Build()
+	if err != nil {
+		return 0, fmt.Errorf("failed to build expression: %w", err)
+	}
+
+	count := 0
+	paginator := dynamodb.NewScanPaginator(s.database, &dynamodb.ScanInput{
+		TableName:                 aws.String(s.cfg.MedicationTable),
+		FilterExpression:          expr.Filter(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return count, fmt.Errorf("failed to scan: %w", err)
+		}
+		items, err := s.unmarshalMedications(ctx, page.Items)
+		if err != nil {
+			return count, err
+		}
+		for _, item := range items {
+			stale, err := s.stale(ctx, item)
+			if err != nil {
+				return count, err
+			}
+			if !stale {
+				continue
+			}
+			done, err := s.reencrypt(ctx, item)
+			if err != nil {
+				return count, err
+			}
+			if done {
+				count++
+			}
+		}
+	}
+	return count, nil
+}
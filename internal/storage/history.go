@@ -0,0 +1,172 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/chestnut42/test-medication/internal/model"
+	"github.com/chestnut42/test-medication/internal/utils/logx"
+	"github.com/chestnut42/test-medication/internal/utils/tracing"
+)
+
+// History keeps every state of a medication, so that a single medication can be restored to any point in time
+// without restoring the whole table. A history item is the medication item as it was written: the partition key
+// is the same (it's the aad of encrypted fields too), the sort key is a fixed width timestamp of the write plus
+// the version.
+//
+// Creates and updates write history in the same transaction as the medication. A delete adds the tombstone
+// after the medication is flagged, a failure there is only logged: the medication item keeps the data anyway.
+
+// HistoryEntry is a state of a medication since Time.
+type HistoryEntry struct {
+	Medication model.Medication
+	Deleted    bool
+	Time       time.Time
+}
+
+func getHistorySortKey(at time.Time, version string) string {
+	return at.UTC().Format(auditTimeLayout) + "#" + version
+}
+
+// historyItem turns a marshaled medication into a history item. Items expire after the retention, if it's set.
+func (s *Service) historyItem(item map[string]types.AttributeValue, version string, at time.Time) map[string]types.AttributeValue {
+	h := maps.Clone(item)
+	h["SK"] = &types.AttributeValueMemberS{Value: getHistorySortKey(at, version)}
+	delete(h, "LK")
+	if s.cfg.HistoryRetention > 0 {
+		h[ExpiresAtAttribute] = &types.AttributeValueMemberN{Value: fmt.Sprint(at.Add(s.cfg.HistoryRetention).Unix())}
+	}
+	return h
+}
+
+// putMedication puts the medication item. With the history or outbox table configured it's a transaction that adds
+// the history item and the change as well. A failed condition is *types.ConditionalCheckFailedException either way,
+// with the old item if the input asks for it.
+func (s *Service) putMedication(ctx context.Context, span trace.Span, input *dynamodb.PutItemInput, medication model.Medication) error {
+	if s.cfg.HistoryTable == "" && s.cfg.OutboxTable == "" {
+		out, err := s.database.PutItem(ctx, input)
+		if err != nil {
+			return err
+		}
+		recordCapacity(span, out.ConsumedCapacity)
+		return nil
+	}
+
+	writes := []types.TransactWriteItem{{
+		Put: &types.Put{
+			TableName:                           input.TableName,
+			Item:                                input.Item,
+			ConditionExpression:                 input.ConditionExpression,
+			ExpressionAttributeNames:            input.ExpressionAttributeNames,
+			ExpressionAttributeValues:           input.ExpressionAttributeValues,
+			ReturnValuesOnConditionCheckFailure: input.ReturnValuesOnConditionCheckFailure,
+		},
+	}}
+	if s.cfg.HistoryTable != "" {
+		writes = append(writes, types.TransactWriteItem{
+			Put: &types.Put{
+				TableName: aws.String(s.cfg.HistoryTable),
+				Item:      s.historyItem(input.Item, medication.Version, time.Now()),
+			},
+		})
+	}
+	err := s.transact(ctx, span, writes, change{identity: medication.Identity, version: medication.Version, item: input.Item})
+	if err != nil {
+		var tce *types.TransactionCanceledException
+		if errors.As(err, &tce) && len(tce.CancellationReasons) > 0 &&
+			aws.ToString(tce.CancellationReasons[0].Code) == "ConditionalCheckFailed" {
+			return &types.ConditionalCheckFailedException{
+				Message: tce.Message,
+				Item:    tce.CancellationReasons[0].Item,
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// addTombstone writes the deleted medication to history.
+func (s *Service) addTombstone(ctx context.Context, item wrappedMedication) {
+	if s.cfg.HistoryTable == "" {
+		return
+	}
+	av, err := s.marshalMedication(ctx, item)
+	if err == nil {
+		_, err = s.database.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName: aws.String(s.cfg.HistoryTable),
+			Item:      s.historyItem(av, item.Version, time.Now()),
+		})
+	}
+	if err != nil {
+		logx.Logger(ctx).Warn("adding medication tombstone to history",
+			slog.String("id", item.Id), slog.Any("error", err))
+	}
+}
+
+// MedicationAt returns the state of the medication at the time, i.e. the last one written before or at it.
+// ErrNotFound means the medication didn't exist or its history had expired.
+func (s *Service) MedicationAt(ctx context.Context, identity model.Identity, at time.Time) (_ HistoryEntry, err error) {
+	ctx, span := tracer.Start(ctx, "storage.MedicationAt", identityAttributes(identity))
+	defer func() { tracing.End(span, err) }()
+
+	if s.cfg.HistoryTable == "" {
+		return HistoryEntry{}, errors.New("history table is not configured")
+	}
+
+	// "~" is greater than "#", so states written at exactly that time are included
+	expr, err := expression.NewBuilder().WithKeyCondition(
+		expression.Key("PK").Equal(expression.Value(getPartition(identity))).
+			And(expression.Key("SK").LessThanEqual(expression.Value(at.UTC().Format(auditTimeLayout) + "~")))).
+		Build()
+	if err != nil {
+		return HistoryEntry{}, fmt.Errorf("failed to build expression: %w", err)
+	}
+	resp, err := s.database.Query(ctx, &dynamodb.QueryInput{
+		TableName:                 aws.String(s.cfg.HistoryTable),
+		KeyConditionExpression:    expr.KeyCondition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ScanIndexForward:          aws.Bool(false),
+		Limit:                     aws.Int32(1),
+		ConsistentRead:            aws.Bool(true),
+		ReturnConsumedCapacity:    types.ReturnConsumedCapacityTotal,
+	})
+	if err != nil {
+		return HistoryEntry{}, fmt.Errorf("failed to query items: %w", err)
+	}
+	recordCapacity(span, resp.ConsumedCapacity)
+	if len(resp.Items) == 0 {
+		return HistoryEntry{}, fmt.Errorf("no history of medication %v at %s: %w", identity, at, ErrNotFound)
+	}
+
+	item, err := s.unmarshalMedication(ctx, resp.Items[0])
+	if err != nil {
+		return HistoryEntry{}, err
+	}
+	var sk string
+	if err := attributevalue.Unmarshal(resp.Items[0]["SK"], &sk); err != nil {
+		return HistoryEntry{}, fmt.Errorf("failed to unmarshal sort key: %w", err)
+	}
+	written, _, _ := strings.Cut(sk, "#")
+	writtenAt, err := time.Parse(auditTimeLayout, written)
+	if err != nil {
+		return HistoryEntry{}, fmt.Errorf("malformed history sort key %s: %w", sk, err)
+	}
+	return HistoryEntry{
+		Medication: item.Medication,
+		Deleted:    item.Deleted,
+		Time:       writtenAt,
+	}, nil
+}
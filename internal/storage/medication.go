@@ -2,29 +2,58 @@ package storage
 
 import (
 	"context"
+	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"slices"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/chestnut42/test-medication/internal/model"
+	"github.com/chestnut42/test-medication/internal/utils/tracing"
 )
 
 // wrappedMedication is an internal equivalent of Medication.
 // The purpose is to abstract away partition and sort keys as they
 // tend to have implementation dependent format.
+// It's not marshaled directly, the stored layout is versioned, see encoding.go.
 type wrappedMedication struct {
-	PartitionKey string `dynamodbav:"PK"`
-	SortKey      string `dynamodbav:"SK"`
+	PartitionKey string
+	SortKey      string
+	ListKey      string
+	Deleted      bool
+	Encrypted    *encryptedFields // Sensitive fields, see encryption.go
+	MovedTo      *model.Identity  // Where a deleted medication has been moved to, see move.go
+	UpdatedAt    time.Time        // Of the last create or update, zero for items written before it was added
+	Schema       int              // Version the item is stored with, zero for new items
 	model.Medication
 }
 
+func wrapMedication(m model.Medication) wrappedMedication {
+	return wrappedMedication{
+		PartitionKey: getPartition(m.Identity),
+		SortKey:      getSortKey(m.Identity),
+		ListKey:      getListKey(m.Tenant, m.Owner),
+		Medication:   m,
+	}
+}
+
+// getPartition starts with the tenant, so that all tenant's data can be found by the key prefix.
 func getPartition(m model.Identity) string {
-	return m.Owner + "#" + m.Id // We can just concatenate here as it never leaves the implementation
+	return getTenantPrefix(m.Tenant) + m.Owner + "#" + m.Id // We can just concatenate here as it never leaves the implementation
+}
+
+// getTenantPrefix relies on tenant ids never containing "#", see model.ValidTenant
+func getTenantPrefix(tenant string) string {
+	return tenant + "#"
 }
 
 // TODO: figure out sort key. Very likely these medications are going to be queried by client/person or
@@ -37,16 +66,28 @@ func getSortKey(m model.Identity) string {
 	return m.Id
 }
 
-func (s *Service) CreateMedication(ctx context.Context, medication model.Medication) error {
-	wrapped := wrappedMedication{
-		PartitionKey: getPartition(medication.Identity),
-		SortKey:      getSortKey(medication.Identity),
-		Medication:   medication,
+// getListKey is a hash key of ListIndex. Objects created before ListIndex was introduced don't have it
+// and therefore aren't listed.
+func getListKey(tenant string, owner string) string {
+	return getTenantPrefix(tenant) + owner
+}
+
+func getKey(identity model.Identity) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"PK": &types.AttributeValueMemberS{Value: getPartition(identity)},
+		"SK": &types.AttributeValueMemberS{Value: getSortKey(identity)},
 	}
+}
 
-	item, err := attributevalue.MarshalMap(wrapped)
+func (s *Service) CreateMedication(ctx context.Context, medication model.Medication) (err error) {
+	ctx, span := tracer.Start(ctx, "storage.CreateMedication", identityAttributes(medication.Identity))
+	defer func() { tracing.End(span, err) }()
+
+	wrapped := wrapMedication(medication)
+	wrapped.UpdatedAt = time.Now()
+	item, err := s.marshalMedication(ctx, wrapped)
 	if err != nil {
-		return fmt.Errorf("failed to marshal item: %w", err)
+		return err
 	}
 
 	cond := expression.Name("PK").AttributeNotExists().
@@ -59,13 +100,14 @@ func (s *Service) CreateMedication(ctx context.Context, medication model.Medicat
 		return fmt.Errorf("failed to build expression: %w", err)
 	}
 
-	if _, err = s.database.PutItem(ctx, &dynamodb.PutItemInput{
+	if err := s.putMedication(ctx, span, &dynamodb.PutItemInput{
 		TableName:                 aws.String(s.cfg.MedicationTable),
 		Item:                      item,
 		ConditionExpression:       expr.Condition(),
 		ExpressionAttributeNames:  expr.Names(),
 		ExpressionAttributeValues: expr.Values(),
-	}); err != nil {
+		ReturnConsumedCapacity:    types.ReturnConsumedCapacityTotal,
+	}, medication); err != nil {
 		var cfe *types.ConditionalCheckFailedException
 		if errors.As(err, &cfe) {
 			return fmt.Errorf("medication %s already exists: %w", medication.Id, ErrAlreadyExists)
@@ -75,13 +117,18 @@ func (s *Service) CreateMedication(ctx context.Context, medication model.Medicat
 	return nil
 }
 
-func (s *Service) GetMedication(ctx context.Context, identity model.Identity) (model.Medication, error) {
+func (s *Service) GetMedication(ctx context.Context, identity model.Identity) (_ model.Medication, err error) {
+	ctx, span := tracer.Start(ctx, "storage.GetMedication", identityAttributes(identity))
+	defer func() { tracing.End(span, err) }()
+
+	// A consistent read costs twice as much, so it's only done when asked for
+	consistent := IsConsistentRead(ctx)
+	span.SetAttributes(attribute.Bool("med.consistent_read", consistent))
 	resp, err := s.database.GetItem(ctx, &dynamodb.GetItemInput{
-		TableName: aws.String(s.cfg.MedicationTable),
-		Key: map[string]types.AttributeValue{
-			"PK": &types.AttributeValueMemberS{Value: getPartition(identity)},
-			"SK": &types.AttributeValueMemberS{Value: getSortKey(identity)},
-		},
+		TableName:              aws.String(s.cfg.MedicationTable),
+		Key:                    getKey(identity),
+		ConsistentRead:         aws.Bool(consistent),
+		ReturnConsumedCapacity: types.ReturnConsumedCapacityTotal,
 	})
 	if err != nil {
 		var nfe *types.ResourceNotFoundException
@@ -90,35 +137,284 @@ func (s *Service) GetMedication(ctx context.Context, identity model.Identity) (m
 		}
 		return model.Medication{}, fmt.Errorf("failed to get item: %w", err)
 	}
+	recordCapacity(span, resp.ConsumedCapacity)
 	if resp.Item == nil {
 		return model.Medication{}, fmt.Errorf("medication not found: %v, %w", identity, ErrNotFound)
 	}
 
-	// TODO: also return NotFound if the object is marked as DELETED
+	item, err := s.unmarshalMedication(ctx, resp.Item)
+	if err != nil {
+		return model.Medication{}, err
+	}
+	if item.MovedTo != nil {
+		return model.Medication{}, &MovedError{Identity: identity, Target: *item.MovedTo}
+	}
+	if item.Deleted {
+		return model.Medication{}, fmt.Errorf("medication deleted: %v, %w", identity, ErrNotFound)
+	}
+	s.reencryptOnRead(ctx, item)
+	return item.Medication, nil
+}
+
+// UpdateMedication overwrites the whole object if the stored version is equal to oldVersion.
+// Once the logic become more sophisticate we can move to UpdateItem certain fields.
+//
+// Each updated snapshot is saved to the history table if it's configured, see history.go.
+func (s *Service) UpdateMedication(ctx context.Context, oldVersion string, medication model.Medication) (_ model.Medication, err error) {
+	ctx, span := tracer.Start(ctx, "storage.UpdateMedication", identityAttributes(medication.Identity))
+	defer func() { tracing.End(span, err) }()
+
+	wrapped := wrapMedication(medication)
+	wrapped.UpdatedAt = time.Now()
+	item, err := s.marshalMedication(ctx, wrapped)
+	if err != nil {
+		return model.Medication{}, err
+	}
+
+	cond := expression.Name("PK").AttributeExists().
+		And(expression.Name("Deleted").AttributeNotExists()).
+		And(expression.Name("Version").Equal(expression.Value(oldVersion)))
 
-	var item wrappedMedication
-	if err = attributevalue.UnmarshalMap(resp.Item, &item); err != nil {
-		return model.Medication{}, fmt.Errorf("failed to unmarshal item: %w", err)
+	expr, err := expression.NewBuilder().
+		WithCondition(cond).
+		Build()
+	if err != nil {
+		return model.Medication{}, fmt.Errorf("failed to build expression: %w", err)
+	}
+
+	if err := s.putMedication(ctx, span, &dynamodb.PutItemInput{
+		TableName:                           aws.String(s.cfg.MedicationTable),
+		Item:                                item,
+		ConditionExpression:                 expr.Condition(),
+		ExpressionAttributeNames:            expr.Names(),
+		ExpressionAttributeValues:           expr.Values(),
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+		ReturnConsumedCapacity:              types.ReturnConsumedCapacityTotal,
+	}, medication); err != nil {
+		var cfe *types.ConditionalCheckFailedException
+		if errors.As(err, &cfe) {
+			return model.Medication{}, conditionFailedError(medication.Identity, cfe.Item)
+		}
+		return model.Medication{}, fmt.Errorf("failed to put item: %w", err)
 	}
+	return medication, nil
+}
+
+// DeleteMedication leaves a tombstone: the object is marked as deleted and is not returned anymore.
+// The id can't be reused by the owner afterward as ids work as deduplication keys.
+//
+// Unless we must conform some GDPR and must delete the data, we should keep it.
+// The deleted medication is returned.
+func (s *Service) DeleteMedication(ctx context.Context, identity model.Identity) (_ model.Medication, err error) {
+	ctx, span := tracer.Start(ctx, "storage.DeleteMedication", identityAttributes(identity))
+	defer func() { tracing.End(span, err) }()
+
+	flag := s.flagDeleted
+	if s.cfg.OutboxTable != "" {
+		flag = s.deleteWithChange
+	}
+	item, err := flag(ctx, span, identity)
+	if err != nil {
+		return model.Medication{}, err
+	}
+	s.upgradeOnWrite(ctx, item)
+	s.addTombstone(ctx, item)
 	return item.Medication, nil
 }
 
-func (s *Service) UpdateMedication(ctx context.Context, oldVersion string, medication model.Medication) (model.Medication, error) {
-	// TODO: implement me
-	// The operation must succeed ONLY if the old version is equal to one in DB
-	// Roughly we can just PutItem with a condition to overwrite the whole object conditionally.
-	// Once the logic become more sophisticate we can move to UpdateItem certain fields
-	//
-	// Ideally we should save each updated snapshot in a logging table. It will cost money, but saves a ton of time
-	// on issue resolution. If money isn't a concern here (95% it is not) we should do so.
-	return model.Medication{}, errors.New("not implemented")
-}
-
-func (s *Service) DeleteMedication(ctx context.Context, identity model.Identity) error {
-	// TODO: implement me
-	// Ideally we should just mark the object as DELETED and leave it as is. Unless:
-	// a) We must conform some GDPR and must delete the data
-	// b) The caller wants to create new object with the same id -> we can save deleted object in log table and delete from the
-	// main table.
-	return errors.New("not implemented")
+// flagDeleted flags the medication as deleted and returns it as it was before.
+func (s *Service) flagDeleted(ctx context.Context, span trace.Span, identity model.Identity) (wrappedMedication, error) {
+	cond := expression.Name("PK").AttributeExists().
+		And(expression.Name("Deleted").AttributeNotExists())
+
+	expr, err := expression.NewBuilder().
+		WithCondition(cond).
+		WithUpdate(expression.Set(expression.Name("Deleted"), expression.Value(true))).
+		Build()
+	if err != nil {
+		return wrappedMedication{}, fmt.Errorf("failed to build expression: %w", err)
+	}
+
+	out, err := s.database.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(s.cfg.MedicationTable),
+		Key:                       getKey(identity),
+		ConditionExpression:       expr.Condition(),
+		UpdateExpression:          expr.Update(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ReturnValues:              types.ReturnValueAllOld,
+		ReturnConsumedCapacity:    types.ReturnConsumedCapacityTotal,
+	})
+	if err != nil {
+		var cfe *types.ConditionalCheckFailedException
+		if errors.As(err, &cfe) {
+			return wrappedMedication{}, fmt.Errorf("medication not found: %v, %w", identity, ErrNotFound)
+		}
+		return wrappedMedication{}, fmt.Errorf("failed to update item: %w", err)
+	}
+	recordCapacity(span, out.ConsumedCapacity)
+
+	item, err := s.unmarshalMedication(ctx, out.Attributes)
+	if err != nil {
+		return wrappedMedication{}, err
+	}
+	item.Deleted = true
+	return item, nil
+}
+
+type ListQuery struct {
+	Tenant       string
+	Owner        string
+	Statuses     []model.Status // Empty means any status
+	Form         model.Form     // Empty means any form
+	UpdatedSince time.Time      // Zero means any time. Items written before UpdatedAt was added never match
+	Name         string         // Matched with model.MatchName, empty means any name
+	Cursor       string         // Empty means the first page
+	Limit        int32
+}
+
+type ListResult struct {
+	Medications []model.Medication
+	Cursor      string // Empty if there are no more pages
+}
+
+// ListMedications returns medications of the owner ordered by id.
+// Statuses, form and time are applied as a filter, the name is matched after decryption. So a page can contain
+// fewer items than the limit (even zero) while the cursor is still not empty.
+func (s *Service) ListMedications(ctx context.Context, query ListQuery) (_ ListResult, err error) {
+	ctx, span := tracer.Start(ctx, "storage.ListMedications", trace.WithAttributes(
+		attribute.String("med.tenant", query.Tenant),
+		attribute.String("med.owner", query.Owner)))
+	defer func() { tracing.End(span, err) }()
+
+	startKey, err := decodeCursor(query.Cursor, getListKey(query.Tenant, query.Owner))
+	if err != nil {
+		return ListResult{}, err
+	}
+
+	filter := expression.Name("Deleted").AttributeNotExists()
+	if len(query.Statuses) > 0 {
+		operands := make([]expression.OperandBuilder, 0, len(query.Statuses))
+		for _, st := range query.Statuses {
+			operands = append(operands, expression.Value(st))
+		}
+		statusCond := expression.Name("Status").In(operands[0], operands[1:]...)
+		if slices.Contains(query.Statuses, model.StatusActive) {
+			statusCond = statusCond.Or(expression.Name("Status").AttributeNotExists())
+		}
+		filter = filter.And(statusCond)
+	}
+	if query.Form != "" {
+		filter = filter.And(expression.Name("Form").Equal(expression.Value(query.Form)))
+	}
+	if !query.UpdatedSince.IsZero() {
+		filter = filter.And(expression.Name("UpdatedAt").GreaterThanEqual(expression.Value(query.UpdatedSince.UnixMilli())))
+	}
+
+	var limit *int32
+	if query.Limit > 0 {
+		limit = aws.Int32(query.Limit)
+	}
+
+	expr, err := expression.NewBuilder().
+		WithKeyCondition(expression.Key("LK").Equal(expression.Value(getListKey(query.Tenant, query.Owner)))).
+		WithFilter(filter).
+		Build()
+	if err != nil {
+		return ListResult{}, fmt.Errorf("failed to build expression: %w", err)
+	}
+
+	resp, err := s.database.Query(ctx, &dynamodb.QueryInput{
+		TableName:                 aws.String(s.cfg.MedicationTable),
+		IndexName:                 aws.String(ListIndex),
+		KeyConditionExpression:    expr.KeyCondition(),
+		FilterExpression:          expr.Filter(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ExclusiveStartKey:         startKey,
+		Limit:                     limit,
+		ReturnConsumedCapacity:    types.ReturnConsumedCapacityTotal,
+	})
+	if err != nil {
+		return ListResult{}, fmt.Errorf("failed to query items: %w", err)
+	}
+	recordCapacity(span, resp.ConsumedCapacity)
+	span.SetAttributes(attribute.Int("aws.dynamodb.count", int(resp.Count)),
+		attribute.Int("aws.dynamodb.scanned_count", int(resp.ScannedCount)))
+
+	items, err := s.unmarshalMedications(ctx, resp.Items)
+	if err != nil {
+		return ListResult{}, err
+	}
+
+	result := ListResult{
+		Medications: make([]model.Medication, 0, len(items)),
+	}
+	for _, item := range items {
+		if query.Name != "" && !model.MatchName(item.Name, query.Name) {
+			continue
+		}
+		result.Medications = append(result.Medications, item.Medication)
+	}
+	if result.Cursor, err = encodeCursor(resp.LastEvaluatedKey); err != nil {
+		return ListResult{}, err
+	}
+	return result, nil
+}
+
+func conditionFailedError(identity model.Identity, old map[string]types.AttributeValue) error {
+	if old == nil {
+		return fmt.Errorf("medication not found: %v, %w", identity, ErrNotFound)
+	}
+
+	item, err := decodeMedication(old)
+	if err != nil {
+		return fmt.Errorf("failed to decode old item: %w", err)
+	}
+	if item.Deleted {
+		return fmt.Errorf("medication deleted: %v, %w", identity, ErrNotFound)
+	}
+	return fmt.Errorf("medication %v has version %s: %w", identity, item.Version, ErrVersionMismatch)
+}
+
+// Cursor is an opaque LastEvaluatedKey. It's checked to belong to the same list key,
+// so that one owner can't iterate over other owner's medications.
+func encodeCursor(key map[string]types.AttributeValue) (string, error) {
+	if len(key) == 0 {
+		return "", nil
+	}
+
+	var raw map[string]string
+	if err := attributevalue.UnmarshalMap(key, &raw); err != nil {
+		return "", fmt.Errorf("failed to unmarshal last evaluated key: %w", err)
+	}
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal cursor: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+func decodeCursor(cursor string, listKey string) (map[string]types.AttributeValue, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, fmt.Errorf("cursor is not base64: %w", ErrBadCursor)
+	}
+	var raw map[string]string
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("cursor is not json: %w", ErrBadCursor)
+	}
+	if len(raw) != 3 || raw["PK"] == "" || raw["SK"] == "" || raw["LK"] != listKey {
+		return nil, fmt.Errorf("cursor keys mismatch: %w", ErrBadCursor)
+	}
+
+	key, err := attributevalue.MarshalMap(raw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal cursor: %w", err)
+	}
+	return key, nil
 }
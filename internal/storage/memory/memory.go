@@ -0,0 +1,440 @@
+package memory
+
+import (
+	"cmp"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/chestnut42/test-medication/internal/model"
+	"github.com/chestnut42/test-medication/internal/storage"
+)
+
+type medication struct {
+	model.Medication
+	deleted   bool
+	movedTo   *model.Identity
+	updatedAt time.Time
+}
+
+type ownerId struct {
+	tenant string
+	owner  string
+}
+
+// changeLog keeps changes of an owner forever. Last is kept when changes are wiped.
+type changeLog struct {
+	last    int64
+	changes []storage.Change
+}
+
+type apiKeyId struct {
+	tenant string
+	id     string
+}
+
+// Storage keeps everything in the process memory with the same semantics as DynamoDB storage.
+// It's meant for tests and local development: data is lost on restart and every replica has its own.
+type Storage struct {
+	mu          sync.Mutex
+	medications map[model.Identity]medication
+	settings    map[string]model.TenantSettings
+	apiKeys     map[apiKeyId]model.APIKey
+	buckets     map[string]storage.RateBucket
+	audit       []model.AuditRecord
+	changes     map[ownerId]*changeLog
+}
+
+var _ storage.Storage = (*Storage)(nil)
+
+func New() *Storage {
+	return &Storage{
+		medications: make(map[model.Identity]medication),
+		settings:    make(map[string]model.TenantSettings),
+		apiKeys:     make(map[apiKeyId]model.APIKey),
+		buckets:     make(map[string]storage.RateBucket),
+		changes:     make(map[ownerId]*changeLog),
+	}
+}
+
+func (s *Storage) Ping(context.Context) error {
+	return nil
+}
+
+func (s *Storage) CreateMedication(_ context.Context, m model.Medication) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.medications[m.Identity]; ok {
+		return fmt.Errorf("medication %s already exists: %w", m.Id, storage.ErrAlreadyExists)
+	}
+	s.medications[m.Identity] = medication{Medication: m, updatedAt: time.Now()}
+	s.appendChange(m, false)
+	return nil
+}
+
+func (s *Storage) GetMedication(_ context.Context, identity model.Identity) (model.Medication, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.medications[identity]
+	if ok && stored.movedTo != nil {
+		return model.Medication{}, &storage.MovedError{Identity: identity, Target: *stored.movedTo}
+	}
+	if !ok || stored.deleted {
+		return model.Medication{}, fmt.Errorf("medication not found: %v, %w", identity, storage.ErrNotFound)
+	}
+	return stored.Medication, nil
+}
+
+func (s *Storage) UpdateMedication(_ context.Context, oldVersion string, m model.Medication) (model.Medication, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.medications[m.Identity]
+	if !ok || stored.deleted {
+		return model.Medication{}, fmt.Errorf("medication not found: %v, %w", m.Identity, storage.ErrNotFound)
+	}
+	if stored.Version != oldVersion {
+		return model.Medication{}, fmt.Errorf("medication %v has version %s: %w", m.Identity, stored.Version, storage.ErrVersionMismatch)
+	}
+	s.medications[m.Identity] = medication{Medication: m, updatedAt: time.Now()}
+	s.appendChange(m, false)
+	return m, nil
+}
+
+func (s *Storage) DeleteMedication(_ context.Context, identity model.Identity) (model.Medication, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.medications[identity]
+	if !ok || stored.deleted {
+		return model.Medication{}, fmt.Errorf("medication not found: %v, %w", identity, storage.ErrNotFound)
+	}
+	stored.deleted = true
+	s.medications[identity] = stored
+	s.appendChange(stored.Medication, true)
+	return stored.Medication, nil
+}
+
+func (s *Storage) MoveMedication(_ context.Context, source model.Identity, target model.Identity, collision storage.Collision) (model.Medication, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.medications[source]
+	if !ok || stored.deleted {
+		return model.Medication{}, fmt.Errorf("medication not found: %v, %w", source, storage.ErrNotFound)
+	}
+	moved := stored.Medication
+	moved.Identity = target
+	if existing, ok := s.medications[target]; ok {
+		switch collision {
+		case storage.CollisionKeepTarget:
+			moved = existing.Medication
+		case storage.CollisionKeepSource:
+			s.medications[target] = medication{Medication: moved, updatedAt: time.Now()}
+			s.appendChange(moved, false)
+		default:
+			return model.Medication{}, fmt.Errorf("medication %v already exists: %w", target, storage.ErrAlreadyExists)
+		}
+	} else {
+		s.medications[target] = medication{Medication: moved, updatedAt: time.Now()}
+		s.appendChange(moved, false)
+	}
+	stored.deleted = true
+	stored.movedTo = &target
+	s.medications[source] = stored
+	s.appendChange(stored.Medication, true)
+	return moved, nil
+}
+
+// appendChange must be called with the lock held.
+func (s *Storage) appendChange(m model.Medication, deleted bool) {
+	id := ownerId{tenant: m.Tenant, owner: m.Owner}
+	log, ok := s.changes[id]
+	if !ok {
+		log = &changeLog{}
+		s.changes[id] = log
+	}
+	log.last++
+	c := storage.Change{Seq: log.last, Medication: m, Deleted: deleted}
+	if deleted {
+		c.Medication = model.Medication{Identity: m.Identity, Version: m.Version}
+	}
+	log.changes = append(log.changes, c)
+}
+
+// ListChanges never expires changes unless the tenant is wiped.
+func (s *Storage) ListChanges(_ context.Context, query storage.ChangesQuery) (storage.ChangesResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	log, ok := s.changes[ownerId{tenant: query.Tenant, owner: query.Owner}]
+	if !ok {
+		log = &changeLog{}
+	}
+	if query.After > log.last {
+		return storage.ChangesResult{}, fmt.Errorf("change %d is ahead of the log at %d: %w", query.After, log.last, storage.ErrChangesExpired)
+	}
+	result := storage.ChangesResult{Changes: []storage.Change{}, Last: log.last}
+	if query.Limit <= 0 || query.After == log.last {
+		return result, nil
+	}
+	// Changes are kept from first on
+	first := log.last - int64(len(log.changes)) + 1
+	if query.After+1 < first {
+		return storage.ChangesResult{}, fmt.Errorf("change %d of %s is not kept: %w", query.After+1, query.Owner, storage.ErrChangesExpired)
+	}
+	start := query.After + 1 - first
+	end := min(start+int64(query.Limit), int64(len(log.changes)))
+	result.Changes = append(result.Changes, log.changes[start:end]...)
+	return result, nil
+}
+
+// listCursor is the owner and the last returned id.
+type listCursor struct {
+	Tenant string `json:"t"`
+	Owner  string `json:"o"`
+	Id     string `json:"i"`
+}
+
+func (s *Storage) ListMedications(_ context.Context, query storage.ListQuery) (storage.ListResult, error) {
+	after := ""
+	if query.Cursor != "" {
+		data, err := base64.RawURLEncoding.DecodeString(query.Cursor)
+		if err != nil {
+			return storage.ListResult{}, fmt.Errorf("cursor is not base64: %w", storage.ErrBadCursor)
+		}
+		var c listCursor
+		if err := json.Unmarshal(data, &c); err != nil {
+			return storage.ListResult{}, fmt.Errorf("cursor is not json: %w", storage.ErrBadCursor)
+		}
+		if c.Tenant != query.Tenant || c.Owner != query.Owner {
+			return storage.ListResult{}, fmt.Errorf("cursor keys mismatch: %w", storage.ErrBadCursor)
+		}
+		after = c.Id
+	}
+
+	s.mu.Lock()
+	var matched []model.Medication
+	for identity, m := range s.medications {
+		if identity.Tenant == query.Tenant && identity.Owner == query.Owner && identity.Id > after &&
+			!m.deleted && matches(m, query) {
+			matched = append(matched, m.Medication)
+		}
+	}
+	s.mu.Unlock()
+	slices.SortFunc(matched, func(a, b model.Medication) int {
+		return cmp.Compare(a.Id, b.Id)
+	})
+
+	result := storage.ListResult{Medications: matched}
+	if query.Limit > 0 && len(matched) > int(query.Limit) {
+		result.Medications = matched[:query.Limit]
+		data, err := json.Marshal(listCursor{
+			Tenant: query.Tenant,
+			Owner:  query.Owner,
+			Id:     result.Medications[len(result.Medications)-1].Id,
+		})
+		if err != nil {
+			return storage.ListResult{}, fmt.Errorf("failed to marshal cursor: %w", err)
+		}
+		result.Cursor = base64.RawURLEncoding.EncodeToString(data)
+	}
+	if result.Medications == nil {
+		result.Medications = []model.Medication{}
+	}
+	return result, nil
+}
+
+// matches treats an empty status as active, see model.Status.OrActive.
+func matches(m medication, query storage.ListQuery) bool {
+	return (len(query.Statuses) == 0 || slices.Contains(query.Statuses, m.Status.OrActive())) &&
+		(query.Form == "" || m.Form == query.Form) &&
+		(query.UpdatedSince.IsZero() || !m.updatedAt.Before(query.UpdatedSince)) &&
+		(query.Name == "" || model.MatchName(m.Name, query.Name))
+}
+
+func (s *Storage) GetTenantSettings(_ context.Context, tenant string) (model.TenantSettings, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	settings, ok := s.settings[tenant]
+	if !ok {
+		return model.TenantSettings{}, fmt.Errorf("tenant settings not found: %s, %w", tenant, storage.ErrNotFound)
+	}
+	settings.AllowedForms = slices.Clone(settings.AllowedForms)
+	return settings, nil
+}
+
+func (s *Storage) PutTenantSettings(_ context.Context, settings model.TenantSettings) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	settings.AllowedForms = slices.Clone(settings.AllowedForms)
+	s.settings[settings.Tenant] = settings
+	return nil
+}
+
+// ExportTenant calls fn outside the lock, so fn may use the storage.
+func (s *Storage) ExportTenant(_ context.Context, tenant string, fn func(storage.ExportedMedication) error) error {
+	s.mu.Lock()
+	var exported []storage.ExportedMedication
+	for identity, m := range s.medications {
+		if identity.Tenant == tenant {
+			exported = append(exported, storage.ExportedMedication{Medication: m.Medication, Deleted: m.deleted})
+		}
+	}
+	s.mu.Unlock()
+
+	for _, m := range exported {
+		if err := fn(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Storage) WipeTenant(_ context.Context, tenant string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	deleted := 0
+	for identity := range s.medications {
+		if identity.Tenant == tenant {
+			delete(s.medications, identity)
+			deleted++
+		}
+	}
+	// The log is moved one past the last change, so that every token issued before expires
+	for id, log := range s.changes {
+		if id.tenant == tenant {
+			log.last++
+			log.changes = nil
+		}
+	}
+	return deleted, nil
+}
+
+func (s *Storage) CreateAPIKey(_ context.Context, key model.APIKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	id := apiKeyId{tenant: key.Tenant, id: key.Id}
+	if _, ok := s.apiKeys[id]; ok {
+		return fmt.Errorf("api key %s already exists: %w", key.Id, storage.ErrAlreadyExists)
+	}
+	s.apiKeys[id] = key
+	return nil
+}
+
+func (s *Storage) GetAPIKey(_ context.Context, tenant string, id string) (model.APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, ok := s.apiKeys[apiKeyId{tenant: tenant, id: id}]
+	if !ok {
+		return model.APIKey{}, fmt.Errorf("api key not found: %s/%s, %w", tenant, id, storage.ErrNotFound)
+	}
+	return key, nil
+}
+
+func (s *Storage) ListAPIKeys(_ context.Context, tenant string) ([]model.APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make([]model.APIKey, 0)
+	for id, key := range s.apiKeys {
+		if id.tenant == tenant {
+			keys = append(keys, key)
+		}
+	}
+	slices.SortFunc(keys, func(a, b model.APIKey) int {
+		return cmp.Compare(a.Id, b.Id)
+	})
+	return keys, nil
+}
+
+func (s *Storage) RevokeAPIKey(_ context.Context, tenant string, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, ok := s.apiKeys[apiKeyId{tenant: tenant, id: id}]
+	if !ok {
+		return fmt.Errorf("api key not found: %s/%s, %w", tenant, id, storage.ErrNotFound)
+	}
+	key.Revoked = true
+	s.apiKeys[apiKeyId{tenant: tenant, id: id}] = key
+	return nil
+}
+
+func (s *Storage) GetRateBucket(_ context.Context, key string) (storage.RateBucket, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.buckets[key], nil
+}
+
+func (s *Storage) PutRateBucket(_ context.Context, key string, prev time.Time, bucket storage.RateBucket) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if stored := s.buckets[key]; !stored.UpdatedAt.Equal(prev) {
+		return fmt.Errorf("rate bucket %s was changed: %w", key, storage.ErrVersionMismatch)
+	}
+	s.buckets[key] = bucket
+	return nil
+}
+
+// WriteAudit keeps records forever, retention is ignored.
+func (s *Storage) WriteAudit(_ context.Context, records []model.AuditRecord, _ time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.audit = append(s.audit, records...)
+	return nil
+}
+
+// QueryAudit cursor is the number of matching records already returned.
+func (s *Storage) QueryAudit(_ context.Context, query storage.AuditQuery) (storage.AuditResult, error) {
+	skip := 0
+	if query.Cursor != "" {
+		var err error
+		if skip, err = strconv.Atoi(query.Cursor); err != nil || skip < 0 {
+			return storage.AuditResult{}, fmt.Errorf("cursor is malformed: %w", storage.ErrBadCursor)
+		}
+	}
+
+	s.mu.Lock()
+	var matched []model.AuditRecord
+	for _, r := range s.audit {
+		if r.Tenant == query.Tenant && r.Owner == query.Owner &&
+			(query.MedicationId == "" || r.MedicationId == query.MedicationId) &&
+			!r.Time.Before(query.From) && (query.To.IsZero() || r.Time.Before(query.To)) {
+			matched = append(matched, r)
+		}
+	}
+	s.mu.Unlock()
+	slices.Reverse(matched)
+	slices.SortStableFunc(matched, func(a, b model.AuditRecord) int {
+		return b.Time.Compare(a.Time)
+	})
+
+	result := storage.AuditResult{Records: []model.AuditRecord{}}
+	if skip < len(matched) {
+		end := len(matched)
+		if query.Limit > 0 {
+			end = min(skip+int(query.Limit), end)
+		}
+		result.Records = matched[skip:end]
+		if end < len(matched) {
+			result.Cursor = strconv.Itoa(end)
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	awsmiddleware "github.com/aws/aws-sdk-go-v2/aws/middleware"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/smithy-go"
+	"github.com/aws/smithy-go/middleware"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+
+	"github.com/chestnut42/test-medication/internal/utils/metrics"
+)
+
+// Labels are DynamoDB operation names and outcomes only, so cardinality is bounded by the API.
+
+type dynamoMetrics struct {
+	duration  metric.Float64Histogram
+	throttles metric.Int64Counter
+	capacity  metric.Float64Counter
+}
+
+func newDynamoMetrics() *dynamoMetrics {
+	meter := metrics.Meter("github.com/chestnut42/test-medication/internal/storage")
+	// Instruments never fail with a valid name
+	duration, _ := meter.Float64Histogram("dynamodb.call.duration",
+		metric.WithUnit("ms"),
+		metric.WithDescription("DynamoDB call latency including SDK retries"))
+	throttles, _ := meter.Int64Counter("dynamodb.throttles",
+		metric.WithDescription("DynamoDB attempts rejected by throttling, retried ones included"))
+	capacity, _ := meter.Float64Counter("dynamodb.consumed_capacity",
+		metric.WithDescription("Consumed capacity units of calls that requested it"))
+	return &dynamoMetrics{
+		duration:  duration,
+		throttles: throttles,
+		capacity:  capacity,
+	}
+}
+
+// InstrumentMetrics returns a DynamoDB client API option, e.g. for dynamodb.Options.APIOptions.
+// API options are applied to every call, so instruments are created once here.
+func InstrumentMetrics() func(stack *middleware.Stack) error {
+	m := newDynamoMetrics()
+	return func(stack *middleware.Stack) error {
+		if err := stack.Initialize.Add(middleware.InitializeMiddlewareFunc("MedMetricsCall", m.call), middleware.Before); err != nil {
+			return err
+		}
+		// After retry middleware, so that every attempt is seen
+		return stack.Finalize.Insert(middleware.FinalizeMiddlewareFunc("MedMetricsAttempt", m.attempt), "Retry", middleware.After)
+	}
+}
+
+func (m *dynamoMetrics) call(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+	start := time.Now()
+	out, md, err := next.HandleInitialize(ctx, in)
+
+	operation := attribute.String("operation", awsmiddleware.GetOperationName(ctx))
+	outcome := "ok"
+	if err != nil {
+		outcome = "error"
+	}
+	m.duration.Record(ctx, float64(time.Since(start))/float64(time.Millisecond),
+		metric.WithAttributes(operation, attribute.String("outcome", outcome)))
+	if units := consumedCapacity(out.Result); units > 0 {
+		m.capacity.Add(ctx, units, metric.WithAttributes(operation))
+	}
+	return out, md, err
+}
+
+func (m *dynamoMetrics) attempt(ctx context.Context, in middleware.FinalizeInput, next middleware.FinalizeHandler) (middleware.FinalizeOutput, middleware.Metadata, error) {
+	out, md, err := next.HandleFinalize(ctx, in)
+	if isThrottling(err) {
+		m.throttles.Add(ctx, 1, metric.WithAttributes(
+			attribute.String("operation", awsmiddleware.GetOperationName(ctx))))
+	}
+	return out, md, err
+}
+
+func isThrottling(err error) bool {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	switch apiErr.ErrorCode() {
+	case "ProvisionedThroughputExceededException", "ThrottlingException", "RequestLimitExceeded":
+		return true
+	default:
+		return false
+	}
+}
+
+func consumedCapacity(result any) float64 {
+	var ccs []types.ConsumedCapacity
+	switch r := result.(type) {
+	case *dynamodb.GetItemOutput:
+		ccs = optional(r.ConsumedCapacity)
+	case *dynamodb.PutItemOutput:
+		ccs = optional(r.ConsumedCapacity)
+	case *dynamodb.UpdateItemOutput:
+		ccs = optional(r.ConsumedCapacity)
+	case *dynamodb.DeleteItemOutput:
+		ccs = optional(r.ConsumedCapacity)
+	case *dynamodb.QueryOutput:
+		ccs = optional(r.ConsumedCapacity)
+	case *dynamodb.ScanOutput:
+		ccs = optional(r.ConsumedCapacity)
+	case *dynamodb.BatchWriteItemOutput:
+		ccs = r.ConsumedCapacity
+	case *dynamodb.TransactWriteItemsOutput:
+		ccs = r.ConsumedCapacity
+	}
+
+	total := 0.0
+	for _, cc := range ccs {
+		if cc.CapacityUnits != nil {
+			total += *cc.CapacityUnits
+		}
+	}
+	return total
+}
+
+func optional(cc *types.ConsumedCapacity) []types.ConsumedCapacity {
+	if cc == nil {
+		return nil
+	}
+	return []types.ConsumedCapacity{*cc}
+}
@@ -0,0 +1,114 @@
+package storage
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/smithy-go/middleware"
+
+	"github.com/chestnut42/test-medication/internal/model"
+	"github.com/chestnut42/test-medication/internal/utils/metrics"
+)
+
+func TestConsumedCapacity(t *testing.T) {
+	tests := []struct {
+		name   string
+		result any
+		want   float64
+	}{
+		{name: "get", result: &dynamodb.GetItemOutput{ConsumedCapacity: &types.ConsumedCapacity{CapacityUnits: aws.Float64(0.5)}}, want: 0.5},
+		{name: "not requested", result: &dynamodb.PutItemOutput{}, want: 0},
+		{name: "batch", result: &dynamodb.BatchWriteItemOutput{ConsumedCapacity: []types.ConsumedCapacity{
+			{CapacityUnits: aws.Float64(2)}, {CapacityUnits: aws.Float64(3)},
+		}}, want: 5},
+		{name: "transaction", result: &dynamodb.TransactWriteItemsOutput{ConsumedCapacity: []types.ConsumedCapacity{
+			{TableName: aws.String("medications"), CapacityUnits: aws.Float64(2)},
+			{TableName: aws.String("history"), CapacityUnits: aws.Float64(1)},
+		}}, want: 3},
+		{name: "unknown", result: &dynamodb.DescribeTableOutput{}, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := consumedCapacity(tt.result); got != tt.want {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsThrottling(t *testing.T) {
+	throttled := fmt.Errorf("operation error: %w", &types.ProvisionedThroughputExceededException{})
+	if !isThrottling(throttled) {
+		t.Fatalf("throughput exceeded must be throttling")
+	}
+	if isThrottling(&types.ConditionalCheckFailedException{}) || isThrottling(errors.New("boom")) || isThrottling(nil) {
+		t.Fatalf("unexpected throttling")
+	}
+}
+
+// dynamoStub answers every DynamoDB call with the same body, so that the client's middleware runs without DynamoDB.
+type dynamoStub string
+
+func (d dynamoStub) Do(r *http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/x-amz-json-1.0"}},
+		Body:       io.NopCloser(strings.NewReader(string(d))),
+		Request:    r,
+	}, nil
+}
+
+// consumedCapacityMetric reads dynamodb.consumed_capacity of the operation as exported to Prometheus.
+func consumedCapacityMetric(t *testing.T, operation string) float64 {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	metrics.NewHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	scanner := bufio.NewScanner(rec.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "dynamodb_consumed_capacity_total{") ||
+			!strings.Contains(line, `operation="`+operation+`"`) {
+			continue
+		}
+		value, err := strconv.ParseFloat(line[strings.LastIndex(line, " ")+1:], 64)
+		if err != nil {
+			t.Fatalf("failed to parse %q: %v", line, err)
+		}
+		return value
+	}
+	return 0
+}
+
+func TestConsumedCapacityMetricWithHistory(t *testing.T) {
+	client := dynamodb.New(dynamodb.Options{
+		Region:      "localhost",
+		Credentials: credentials.NewStaticCredentialsProvider("dummy", "dummy", ""),
+		HTTPClient:  dynamoStub(`{"ConsumedCapacity":[{"TableName":"medications","CapacityUnits":2},{"TableName":"history","CapacityUnits":1}]}`),
+		APIOptions:  []func(*middleware.Stack) error{InstrumentMetrics()},
+	})
+	service := NewService(Config{MedicationTable: "medications", HistoryTable: "history"}, client)
+
+	before := consumedCapacityMetric(t, "TransactWriteItems")
+	if err := service.CreateMedication(t.Context(), model.Medication{
+		Identity:       model.Identity{Id: "id", Owner: "owner", Tenant: "acme"},
+		MedicationData: model.MedicationData{Name: "Paracetamol", Dosage: "500mg", Form: model.FormTablet},
+		Version:        "v1",
+	}); err != nil {
+		t.Fatalf("failed to create: %v", err)
+	}
+	if got := consumedCapacityMetric(t, "TransactWriteItems") - before; got != 3 {
+		t.Fatalf("got %v consumed capacity units, expected 3", got)
+	}
+}
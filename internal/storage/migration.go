@@ -0,0 +1,585 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/google/uuid"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/time/rate"
+
+	"github.com/chestnut42/test-medication/internal/utils/logx"
+)
+
+// Migration rewrites medication items of the table while the service keeps running.
+//
+// Transform returns the new item and whether it differs from the given one. It must be idempotent: an item it has
+// already transformed comes back unchanged. It's called for deleted items too. Changing PK or SK re-keys the item:
+// the new item is created and the old one is deleted in one transaction.
+type Migration struct {
+	Id          string // Never changes once released, it's the key of the control item
+	Description string
+	Transform   func(item wrappedMedication) (wrappedMedication, bool, error)
+}
+
+// migrations are run in this order. Released migrations must never be changed or removed, as new ones may rely
+// on the items being migrated. The service code must handle both old and new items until a migration is done
+// everywhere.
+var migrations = []Migration{{
+	Id:          "0001-fill-list-key",
+	Description: "Set LK of medications created before ListIndex, so that they are listed",
+	Transform:   fillListKey,
+}}
+
+func fillListKey(item wrappedMedication) (wrappedMedication, bool, error) {
+	if item.ListKey != "" {
+		return item, false, nil
+	}
+	item.ListKey = getListKey(item.Tenant, item.Owner)
+	return item, true, nil
+}
+
+var ErrMigrationRunning = errors.New("migration is running")
+
+const (
+	migrationPartition = "#migration" // Control items, SK is the migration id or id#segment#n for a checkpoint
+
+	MigrationPending = "pending"
+	MigrationRunning = "running" // Or interrupted, it's resumed by the next run
+	MigrationDone    = "done"
+
+	// migrationLeaseTimeout is how long a run that stopped updating its heartbeat is considered alive.
+	// A run updates it after every page.
+	migrationLeaseTimeout = time.Minute
+	// migrationWriteAttempts bounds retries of an item that is changed concurrently by the service.
+	migrationWriteAttempts = 3
+)
+
+type MigrationOptions struct {
+	DryRun            bool    // Transform items and count changes without writing anything
+	Segments          int     // Parallel scan segments. A resumed migration keeps the number it was started with
+	PageSize          int32   // Items per scan request
+	CapacityPerSecond float64 // Read and write capacity units a second for all segments. 0 means unlimited
+}
+
+// MigrationState is the progress of a migration. Counters of a running migration are as of the last checkpoint.
+type MigrationState struct {
+	Id          string
+	Description string
+	Status      string
+	Scanned     int64
+	Changed     int64
+	StartedAt   time.Time
+	FinishedAt  time.Time
+}
+
+type migrationControl struct {
+	PartitionKey string `dynamodbav:"PK"`
+	SortKey      string `dynamodbav:"SK"`
+	Status       string
+	Segments     int
+	RunId        string
+	Heartbeat    int64 // Unix seconds
+	Scanned      int64
+	Changed      int64
+	StartedAt    int64 // Unix seconds
+	FinishedAt   int64 `dynamodbav:",omitempty"`
+}
+
+type migrationCheckpoint struct {
+	PartitionKey string                          `dynamodbav:"PK"`
+	SortKey      string                          `dynamodbav:"SK"`
+	StartKey     map[string]types.AttributeValue `dynamodbav:",omitempty"` // ExclusiveStartKey of the next page
+	Done         bool
+}
+
+func migrationKey(sortKey string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"PK": &types.AttributeValueMemberS{Value: migrationPartition},
+		"SK": &types.AttributeValueMemberS{Value: sortKey},
+	}
+}
+
+func checkpointSortKey(id string, segment int) string {
+	return id + "#segment#" + strconv.Itoa(segment)
+}
+
+// MigrationStatus returns the state of every known migration in the order they are run.
+func (s *Service) MigrationStatus(ctx context.Context) ([]MigrationState, error) {
+	states := make([]MigrationState, 0, len(migrations))
+	for _, m := range migrations {
+		control, ok, err := s.getMigrationControl(ctx, m.Id)
+		if err != nil {
+			return nil, err
+		}
+		state := MigrationState{Id: m.Id, Description: m.Description, Status: MigrationPending}
+		if ok {
+			state.Status = control.Status
+			state.Scanned = control.Scanned
+			state.Changed = control.Changed
+			state.StartedAt = time.Unix(control.StartedAt, 0).UTC()
+			if control.FinishedAt != 0 {
+				state.FinishedAt = time.Unix(control.FinishedAt, 0).UTC()
+			}
+		}
+		states = append(states, state)
+	}
+	return states, nil
+}
+
+// RunMigrations runs pending migrations one by one and resumes interrupted ones. It fails with ErrMigrationRunning
+// if another process runs a migration. A dry run scans everything from scratch and returns what would be changed.
+func (s *Service) RunMigrations(ctx context.Context, opts MigrationOptions) ([]MigrationState, error) {
+	return s.runMigrations(ctx, migrations, opts)
+}
+
+func (s *Service) runMigrations(ctx context.Context, list []Migration, opts MigrationOptions) ([]MigrationState, error) {
+	opts.Segments = max(opts.Segments, 1)
+	if opts.PageSize <= 0 {
+		opts.PageSize = 100
+	}
+
+	var results []MigrationState
+	for _, m := range list {
+		state, err := s.runMigration(ctx, m, opts)
+		if err != nil {
+			return results, fmt.Errorf("migration %s: %w", m.Id, err)
+		}
+		results = append(results, state)
+	}
+	return results, nil
+}
+
+func (s *Service) getMigrationControl(ctx context.Context, id string) (migrationControl, bool, error) {
+	resp, err := s.database.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(s.cfg.MedicationTable),
+		Key:            migrationKey(id),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return migrationControl{}, false, fmt.Errorf("failed to get item: %w", err)
+	}
+	if resp.Item == nil {
+		return migrationControl{}, false, nil
+	}
+	var control migrationControl
+	if err := attributevalue.UnmarshalMap(resp.Item, &control); err != nil {
+		return migrationControl{}, false, fmt.Errorf("failed to unmarshal migration: %w", err)
+	}
+	return control, true, nil
+}
+
+// migrationRun is a run of a single migration.
+type migrationRun struct {
+	s         *Service
+	migration Migration
+	opts      MigrationOptions
+	runId     string
+	segments  int
+	limiter   *rate.Limiter // Nil means unlimited
+
+	scanned atomic.Int64
+	changed atomic.Int64
+}
+
+func (s *Service) runMigration(ctx context.Context, m Migration, opts MigrationOptions) (MigrationState, error) {
+	logger := logx.Logger(ctx).With(slog.String("migration", m.Id), slog.Bool("dry_run", opts.DryRun))
+	state := MigrationState{Id: m.Id, Description: m.Description}
+
+	run := &migrationRun{
+		s:         s,
+		migration: m,
+		opts:      opts,
+		runId:     uuid.NewString(),
+		segments:  opts.Segments,
+	}
+	if opts.CapacityPerSecond > 0 {
+		run.limiter = rate.NewLimiter(rate.Limit(opts.CapacityPerSecond), int(math.Ceil(opts.CapacityPerSecond)))
+	}
+
+	if !opts.DryRun {
+		control, ok, err := s.getMigrationControl(ctx, m.Id)
+		if err != nil {
+			return state, err
+		}
+		if ok && control.Status == MigrationDone {
+			state.Status = MigrationDone
+			state.Scanned, state.Changed = control.Scanned, control.Changed
+			return state, nil
+		}
+		if run.segments, err = run.acquire(ctx); err != nil {
+			return state, err
+		}
+		if ok {
+			logger.Info("resuming migration", slog.Int("segments", run.segments))
+		}
+	}
+
+	logger.Info("running migration", slog.Int("segments", run.segments))
+	eg, egCtx := errgroup.WithContext(ctx)
+	for segment := range run.segments {
+		eg.Go(func() error { return run.runSegment(egCtx, segment) })
+	}
+	if err := eg.Wait(); err != nil {
+		return state, err
+	}
+
+	state.Status = MigrationDone
+	state.Scanned, state.Changed = run.scanned.Load(), run.changed.Load()
+	if !opts.DryRun {
+		if err := run.finish(ctx); err != nil {
+			return state, err
+		}
+	}
+	logger.Info("migration finished", slog.Int64("scanned", state.Scanned), slog.Int64("changed", state.Changed))
+	return state, nil
+}
+
+// acquire takes the lease of the migration, creating the control item for a new one. Returns the number of segments.
+func (r *migrationRun) acquire(ctx context.Context) (int, error) {
+	now := time.Now()
+	update := expression.
+		Set(expression.Name("Status"), expression.Value(MigrationRunning)).
+		Set(expression.Name("RunId"), expression.Value(r.runId)).
+		Set(expression.Name("Heartbeat"), expression.Value(now.Unix())).
+		Set(expression.Name("Segments"), expression.IfNotExists(expression.Name("Segments"), expression.Value(r.segments))).
+		Set(expression.Name("StartedAt"), expression.IfNotExists(expression.Name("StartedAt"), expression.Value(now.Unix()))).
+		Set(expression.Name("Scanned"), expression.IfNotExists(expression.Name("Scanned"), expression.Value(0))).
+		Set(expression.Name("Changed"), expression.IfNotExists(expression.Name("Changed"), expression.Value(0)))
+	cond := expression.Name("PK").AttributeNotExists().Or(expression.And(
+		expression.Name("Status").NotEqual(expression.Value(MigrationDone)),
+		expression.Name("Heartbeat").LessThan(expression.Value(now.Add(-migrationLeaseTimeout).Unix()))))
+	expr, err := expression.NewBuilder().WithUpdate(update).WithCondition(cond).Build()
+	if err != nil {
+		return 0, fmt.Errorf("failed to build expression: %w", err)
+	}
+
+	resp, err := r.s.database.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(r.s.cfg.MedicationTable),
+		Key:                       migrationKey(r.migration.Id),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ReturnValues:              types.ReturnValueAllNew,
+	})
+	if err != nil {
+		var cfe *types.ConditionalCheckFailedException
+		if errors.As(err, &cfe) {
+			return 0, ErrMigrationRunning
+		}
+		return 0, fmt.Errorf("failed to update item: %w", err)
+	}
+	var control migrationControl
+	if err := attributevalue.UnmarshalMap(resp.Attributes, &control); err != nil {
+		return 0, fmt.Errorf("failed to unmarshal migration: %w", err)
+	}
+	return control.Segments, nil
+}
+
+// checkpoint records the progress of a segment and renews the lease. Counters are increments since the last one.
+func (r *migrationRun) checkpoint(ctx context.Context, segment int, startKey map[string]types.AttributeValue, scanned int64, changed int64) error {
+	av, err := attributevalue.MarshalMap(migrationCheckpoint{
+		PartitionKey: migrationPartition,
+		SortKey:      checkpointSortKey(r.migration.Id, segment),
+		StartKey:     startKey,
+		Done:         startKey == nil,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal checkpoint: %w", err)
+	}
+	expr, err := expression.NewBuilder().
+		WithUpdate(expression.
+			Set(expression.Name("Heartbeat"), expression.Value(time.Now().Unix())).
+			Add(expression.Name("Scanned"), expression.Value(scanned)).
+			Add(expression.Name("Changed"), expression.Value(changed))).
+		WithCondition(expression.Name("RunId").Equal(expression.Value(r.runId))).
+		Build()
+	if err != nil {
+		return fmt.Errorf("failed to build expression: %w", err)
+	}
+
+	// Both or none, so that a resumed run doesn't count a page twice
+	if _, err := r.s.database.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{{
+			Put: &types.Put{
+				TableName: aws.String(r.s.cfg.MedicationTable),
+				Item:      av,
+			},
+		}, {
+			Update: &types.Update{
+				TableName:                 aws.String(r.s.cfg.MedicationTable),
+				Key:                       migrationKey(r.migration.Id),
+				UpdateExpression:          expr.Update(),
+				ConditionExpression:       expr.Condition(),
+				ExpressionAttributeNames:  expr.Names(),
+				ExpressionAttributeValues: expr.Values(),
+			},
+		}},
+	}); err != nil {
+		var tce *types.TransactionCanceledException
+		if errors.As(err, &tce) {
+			return fmt.Errorf("lost the lease to another run: %w", ErrMigrationRunning)
+		}
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+	return nil
+}
+
+func (r *migrationRun) finish(ctx context.Context) error {
+	expr, err := expression.NewBuilder().
+		WithUpdate(expression.
+			Set(expression.Name("Status"), expression.Value(MigrationDone)).
+			Set(expression.Name("FinishedAt"), expression.Value(time.Now().Unix()))).
+		WithCondition(expression.Name("RunId").Equal(expression.Value(r.runId))).
+		Build()
+	if err != nil {
+		return fmt.Errorf("failed to build expression: %w", err)
+	}
+	if _, err := r.s.database.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(r.s.cfg.MedicationTable),
+		Key:                       migrationKey(r.migration.Id),
+		UpdateExpression:          expr.Update(),
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	}); err != nil {
+		return fmt.Errorf("failed to update item: %w", err)
+	}
+	return nil
+}
+
+func (r *migrationRun) runSegment(ctx context.Context, segment int) error {
+	var startKey map[string]types.AttributeValue
+	if !r.opts.DryRun {
+		resp, err := r.s.database.GetItem(ctx, &dynamodb.GetItemInput{
+			TableName:      aws.String(r.s.cfg.MedicationTable),
+			Key:            migrationKey(checkpointSortKey(r.migration.Id, segment)),
+			ConsistentRead: aws.Bool(true),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to get checkpoint: %w", err)
+		}
+		var cp migrationCheckpoint
+		if err := attributevalue.UnmarshalMap(resp.Item, &cp); err != nil {
+			return fmt.Errorf("failed to unmarshal checkpoint: %w", err)
+		}
+		if cp.Done {
+			return nil
+		}
+		startKey = cp.StartKey
+	}
+
+	// Everything but medications has a partition key starting with "#"
+	expr, err := expression.NewBuilder().
+		WithFilter(expression.Not(expression.Name("PK").BeginsWith("#"))).
+		Build()
+	if err != nil {
+		return fmt.Errorf("failed to build expression: %w", err)
+	}
+
+	for {
+		page, err := r.s.database.Scan(ctx, &dynamodb.ScanInput{
+			TableName:                 aws.String(r.s.cfg.MedicationTable),
+			Segment:                   aws.Int32(int32(segment)),
+			TotalSegments:             aws.Int32(int32(r.segments)),
+			ExclusiveStartKey:         startKey,
+			Limit:                     aws.Int32(r.opts.PageSize),
+			FilterExpression:          expr.Filter(),
+			ExpressionAttributeNames:  expr.Names(),
+			ExpressionAttributeValues: expr.Values(),
+			ReturnConsumedCapacity:    types.ReturnConsumedCapacityTotal,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to scan: %w", err)
+		}
+		consumed := 0.0
+		if page.ConsumedCapacity != nil {
+			consumed = aws.ToFloat64(page.ConsumedCapacity.CapacityUnits)
+		}
+
+		var changed int64
+		for _, av := range page.Items {
+			done, units, err := r.migrateItem(ctx, av)
+			if err != nil {
+				return err
+			}
+			consumed += units
+			if done {
+				changed++
+			}
+		}
+		r.scanned.Add(int64(len(page.Items)))
+		r.changed.Add(changed)
+
+		startKey = page.LastEvaluatedKey
+		if !r.opts.DryRun {
+			if err := r.checkpoint(ctx, segment, startKey, int64(len(page.Items)), changed); err != nil {
+				return err
+			}
+			consumed += 4 // A transaction of two small writes
+		}
+		if err := r.throttle(ctx, consumed); err != nil {
+			return err
+		}
+		if startKey == nil {
+			return nil
+		}
+	}
+}
+
+// throttle waits until the consumed capacity fits into the limit. Capacity is only known after a request,
+// so a big page is paid for by waiting before the next one.
+func (r *migrationRun) throttle(ctx context.Context, consumed float64) error {
+	if r.limiter == nil {
+		return nil
+	}
+	for units := int(math.Ceil(consumed)); units > 0; units -= r.limiter.Burst() {
+		if err := r.limiter.WaitN(ctx, min(units, r.limiter.Burst())); err != nil {
+			return fmt.Errorf("waiting for capacity: %w", err)
+		}
+	}
+	return nil
+}
+
+// migrateItem transforms and writes an item. An item changed by the service meanwhile is read again and transformed
+// once more. Returns whether the item has been changed (would be in a dry run) and the write capacity it consumed.
+func (r *migrationRun) migrateItem(ctx context.Context, av map[string]types.AttributeValue) (bool, float64, error) {
+	consumed := 0.0
+	for range migrationWriteAttempts {
+		item, err := r.s.unmarshalMedication(ctx, av)
+		if err != nil {
+			return false, consumed, err
+		}
+		transformed, changed, err := r.migration.Transform(item)
+		if err != nil {
+			return false, consumed, fmt.Errorf("transforming medication %s: %w", item.Id, err)
+		}
+		if !changed || r.opts.DryRun {
+			return changed, consumed, nil
+		}
+
+		units, err := r.s.writeMigrated(ctx, item, transformed)
+		consumed += units
+		if err == nil {
+			return true, consumed, nil
+		}
+		if !errors.Is(err, ErrVersionMismatch) {
+			return false, consumed, err
+		}
+
+		resp, err := r.s.database.GetItem(ctx, &dynamodb.GetItemInput{
+			TableName:      aws.String(r.s.cfg.MedicationTable),
+			Key:            map[string]types.AttributeValue{"PK": av["PK"], "SK": av["SK"]},
+			ConsistentRead: aws.Bool(true),
+		})
+		if err != nil {
+			return false, consumed, fmt.Errorf("failed to get item: %w", err)
+		}
+		consumed += 1
+		if resp.Item == nil {
+			return false, consumed, nil // Re-keyed or wiped meanwhile
+		}
+		av = resp.Item
+	}
+	return false, consumed, fmt.Errorf("medication is changed concurrently: %w", ErrVersionMismatch)
+}
+
+// unchangedCondition holds if the item has the same version and deleted state as the given one.
+func unchangedCondition(item wrappedMedication) expression.ConditionBuilder {
+	deleted := expression.Name("Deleted").AttributeNotExists()
+	if item.Deleted {
+		deleted = expression.Name("Deleted").AttributeExists()
+	}
+	return expression.Name("Version").Equal(expression.Value(item.Version)).And(deleted)
+}
+
+// writeMigrated replaces the old item with the new one unless the old one has been changed meanwhile
+// (ErrVersionMismatch). Returns consumed write capacity.
+func (s *Service) writeMigrated(ctx context.Context, old wrappedMedication, item wrappedMedication) (float64, error) {
+	av, err := s.marshalMedication(ctx, item)
+	if err != nil {
+		return 0, err
+	}
+	expr, err := expression.NewBuilder().WithCondition(unchangedCondition(old)).Build()
+	if err != nil {
+		return 0, fmt.Errorf("failed to build expression: %w", err)
+	}
+
+	if old.PartitionKey == item.PartitionKey && old.SortKey == item.SortKey {
+		resp, err := s.database.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName:                 aws.String(s.cfg.MedicationTable),
+			Item:                      av,
+			ConditionExpression:       expr.Condition(),
+			ExpressionAttributeNames:  expr.Names(),
+			ExpressionAttributeValues: expr.Values(),
+			ReturnConsumedCapacity:    types.ReturnConsumedCapacityTotal,
+		})
+		if err != nil {
+			var cfe *types.ConditionalCheckFailedException
+			if errors.As(err, &cfe) {
+				return 1, fmt.Errorf("medication %s: %w", old.Id, ErrVersionMismatch)
+			}
+			return 0, fmt.Errorf("failed to put item: %w", err)
+		}
+		return consumedUnits(resp.ConsumedCapacity), nil
+	}
+
+	notExists, err := expression.NewBuilder().WithCondition(expression.Name("PK").AttributeNotExists()).Build()
+	if err != nil {
+		return 0, fmt.Errorf("failed to build expression: %w", err)
+	}
+	resp, err := s.database.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{{
+			Put: &types.Put{
+				TableName:                 aws.String(s.cfg.MedicationTable),
+				Item:                      av,
+				ConditionExpression:       notExists.Condition(),
+				ExpressionAttributeNames:  notExists.Names(),
+				ExpressionAttributeValues: notExists.Values(),
+			},
+		}, {
+			Delete: &types.Delete{
+				TableName: aws.String(s.cfg.MedicationTable),
+				Key: map[string]types.AttributeValue{
+					"PK": &types.AttributeValueMemberS{Value: old.PartitionKey},
+					"SK": &types.AttributeValueMemberS{Value: old.SortKey},
+				},
+				ConditionExpression:       expr.Condition(),
+				ExpressionAttributeNames:  expr.Names(),
+				ExpressionAttributeValues: expr.Values(),
+			},
+		}},
+		ReturnConsumedCapacity: types.ReturnConsumedCapacityTotal,
+	})
+	if err != nil {
+		var tce *types.TransactionCanceledException
+		if errors.As(err, &tce) {
+			return 4, fmt.Errorf("medication %s: %w", old.Id, ErrVersionMismatch)
+		}
+		return 0, fmt.Errorf("failed to transact items: %w", err)
+	}
+	units := 0.0
+	for _, c := range resp.ConsumedCapacity {
+		units += consumedUnits(&c)
+	}
+	return units, nil
+}
+
+func consumedUnits(c *types.ConsumedCapacity) float64 {
+	if c == nil {
+		return 0
+	}
+	return aws.ToFloat64(c.CapacityUnits)
+}
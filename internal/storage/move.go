@@ -0,0 +1,246 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"go.opentelemetry.io/otel/attribute"
+
+	"github.com/chestnut42/test-medication/internal/model"
+	"github.com/chestnut42/test-medication/internal/utils/tracing"
+)
+
+// Collision is what MoveMedication does when the target id is already used by the target owner,
+// a deleted medication included.
+type Collision string
+
+const (
+	CollisionFail       Collision = "fail"        // ErrAlreadyExists, nothing is changed
+	CollisionKeepTarget Collision = "keep-target" // The target is kept as it is, the source is redirected to it
+	CollisionKeepSource Collision = "keep-source" // The target is overwritten with the source
+)
+
+// MovedError is returned for a medication that has been moved to another owner. It's ErrNotFound as well.
+type MovedError struct {
+	Identity model.Identity
+	Target   model.Identity
+}
+
+func (e *MovedError) Error() string {
+	return fmt.Sprintf("medication %v has been moved to %v", e.Identity, e.Target)
+}
+
+func (e *MovedError) Unwrap() error {
+	return ErrNotFound
+}
+
+// MoveMedication moves the medication in one transaction: the target gets the source's data and version, the source
+// becomes a redirect tombstone pointing to the target. The history of the source is copied to the target before.
+// Both items are read first and the transaction is conditional on them, a concurrent change is ErrVersionMismatch.
+// The source owner gets a deleted change, the target owner gets the moved medication unless the target is kept.
+func (s *Service) MoveMedication(ctx context.Context, source model.Identity, target model.Identity, collision Collision) (_ model.Medication, err error) {
+	ctx, span := tracer.Start(ctx, "storage.MoveMedication", identityAttributes(source))
+	defer func() { tracing.End(span, err) }()
+	span.SetAttributes(
+		attribute.String("med.target.tenant", target.Tenant),
+		attribute.String("med.target.owner", target.Owner),
+		attribute.String("med.target.id", target.Id),
+		attribute.String("med.collision", string(collision)))
+
+	src, ok, err := s.getItem(ctx, source)
+	if err != nil {
+		return model.Medication{}, err
+	}
+	if !ok || src.Deleted {
+		return model.Medication{}, fmt.Errorf("medication not found: %v, %w", source, ErrNotFound)
+	}
+	dst, exists, err := s.getItem(ctx, target)
+	if err != nil {
+		return model.Medication{}, err
+	}
+	if exists && collision != CollisionKeepTarget && collision != CollisionKeepSource {
+		return model.Medication{}, fmt.Errorf("medication %v already exists: %w", target, ErrAlreadyExists)
+	}
+
+	moved := src.Medication
+	moved.Identity = target
+	if err := s.copyHistory(ctx, source, target); err != nil {
+		return model.Medication{}, err
+	}
+
+	tombstone := src
+	tombstone.Deleted = true
+	tombstone.MovedTo = &target
+	tombstoneAv, err := s.marshalMedication(ctx, tombstone)
+	if err != nil {
+		return model.Medication{}, err
+	}
+	srcExpr, err := expression.NewBuilder().WithCondition(unchangedCondition(src)).Build()
+	if err != nil {
+		return model.Medication{}, fmt.Errorf("failed to build expression: %w", err)
+	}
+	transact := []types.TransactWriteItem{{
+		Put: &types.Put{
+			TableName:                 aws.String(s.cfg.MedicationTable),
+			Item:                      tombstoneAv,
+			ConditionExpression:       srcExpr.Condition(),
+			ExpressionAttributeNames:  srcExpr.Names(),
+			ExpressionAttributeValues: srcExpr.Values(),
+		},
+	}}
+
+	dstCond := expression.Name("PK").AttributeNotExists()
+	if exists {
+		dstCond = unchangedCondition(dst)
+	}
+	dstExpr, err := expression.NewBuilder().WithCondition(dstCond).Build()
+	if err != nil {
+		return model.Medication{}, fmt.Errorf("failed to build expression: %w", err)
+	}
+	var movedAv map[string]types.AttributeValue
+	if exists && collision == CollisionKeepTarget {
+		moved = dst.Medication
+		transact = append(transact, types.TransactWriteItem{
+			ConditionCheck: &types.ConditionCheck{
+				TableName:                 aws.String(s.cfg.MedicationTable),
+				Key:                       getKey(target),
+				ConditionExpression:       dstExpr.Condition(),
+				ExpressionAttributeNames:  dstExpr.Names(),
+				ExpressionAttributeValues: dstExpr.Values(),
+			},
+		})
+	} else {
+		wrapped := wrapMedication(moved)
+		wrapped.UpdatedAt = time.Now()
+		if movedAv, err = s.marshalMedication(ctx, wrapped); err != nil {
+			return model.Medication{}, err
+		}
+		transact = append(transact, types.TransactWriteItem{
+			Put: &types.Put{
+				TableName:                 aws.String(s.cfg.MedicationTable),
+				Item:                      movedAv,
+				ConditionExpression:       dstExpr.Condition(),
+				ExpressionAttributeNames:  dstExpr.Names(),
+				ExpressionAttributeValues: dstExpr.Values(),
+			},
+		})
+	}
+
+	if s.cfg.HistoryTable != "" {
+		now := time.Now()
+		transact = append(transact, types.TransactWriteItem{
+			Put: &types.Put{
+				TableName: aws.String(s.cfg.HistoryTable),
+				Item:      s.historyItem(tombstoneAv, src.Version, now),
+			},
+		})
+		if movedAv != nil {
+			transact = append(transact, types.TransactWriteItem{
+				Put: &types.Put{
+					TableName: aws.String(s.cfg.HistoryTable),
+					Item:      s.historyItem(movedAv, moved.Version, now),
+				},
+			})
+		}
+	}
+
+	changes := []change{{identity: source, version: src.Version}}
+	if movedAv != nil {
+		changes = append(changes, change{identity: target, version: moved.Version, item: movedAv})
+	}
+	if err := s.transact(ctx, span, transact, changes...); err != nil {
+		var tce *types.TransactionCanceledException
+		if errors.As(err, &tce) {
+			return model.Medication{}, fmt.Errorf("medication %v or %v has been changed: %w", source, target, ErrVersionMismatch)
+		}
+		return model.Medication{}, fmt.Errorf("failed to transact items: %w", err)
+	}
+	return moved, nil
+}
+
+// getItem is a consistent read of the medication item, tombstones included.
+func (s *Service) getItem(ctx context.Context, identity model.Identity) (wrappedMedication, bool, error) {
+	resp, err := s.database.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(s.cfg.MedicationTable),
+		Key:            getKey(identity),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return wrappedMedication{}, false, fmt.Errorf("failed to get item: %w", err)
+	}
+	if resp.Item == nil {
+		return wrappedMedication{}, false, nil
+	}
+	item, err := s.unmarshalMedication(ctx, resp.Item)
+	if err != nil {
+		return wrappedMedication{}, false, err
+	}
+	return item, true, nil
+}
+
+// copyHistory copies history items of the source to the target. Items are re-encrypted, as the partition key
+// is the aad and the tenant may differ. Sort keys are kept, so copying again overwrites the same items.
+func (s *Service) copyHistory(ctx context.Context, source model.Identity, target model.Identity) error {
+	if s.cfg.HistoryTable == "" {
+		return nil
+	}
+	expr, err := expression.NewBuilder().
+		WithKeyCondition(expression.Key("PK").Equal(expression.Value(getPartition(source)))).
+		Build()
+	if err != nil {
+		return fmt.Errorf("failed to build expression: %w", err)
+	}
+
+	var startKey map[string]types.AttributeValue
+	for {
+		resp, err := s.database.Query(ctx, &dynamodb.QueryInput{
+			TableName:                 aws.String(s.cfg.HistoryTable),
+			KeyConditionExpression:    expr.KeyCondition(),
+			ExpressionAttributeNames:  expr.Names(),
+			ExpressionAttributeValues: expr.Values(),
+			ExclusiveStartKey:         startKey,
+			ConsistentRead:            aws.Bool(true),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to query history: %w", err)
+		}
+
+		requests := make([]types.WriteRequest, 0, len(resp.Items))
+		for _, av := range resp.Items {
+			item, err := s.unmarshalMedication(ctx, av)
+			if err != nil {
+				return err
+			}
+			item.Medication.Identity = target
+			item.PartitionKey = getPartition(target)
+			copied, err := s.marshalMedication(ctx, item)
+			if err != nil {
+				return err
+			}
+			// Keys and TTL of the history item are kept as they are
+			copied["SK"] = av["SK"]
+			delete(copied, "LK")
+			if expiresAt, ok := av[ExpiresAtAttribute]; ok {
+				copied[ExpiresAtAttribute] = expiresAt
+			}
+			requests = append(requests, types.WriteRequest{PutRequest: &types.PutRequest{Item: copied}})
+		}
+		for start := 0; start < len(requests); start += maxBatchWrite {
+			chunk := requests[start:min(start+maxBatchWrite, len(requests))]
+			if err := s.batchWriteTable(ctx, s.cfg.HistoryTable, chunk); err != nil {
+				return err
+			}
+		}
+
+		if len(resp.LastEvaluatedKey) == 0 {
+			return nil
+		}
+		startKey = resp.LastEvaluatedKey
+	}
+}
@@ -0,0 +1,42 @@
+-- Text keys use the C collation, so that lists are ordered by bytes the same way DynamoDB sort keys are.
+
+CREATE TABLE medications (
+    tenant  text COLLATE "C" NOT NULL,
+    owner   text COLLATE "C" NOT NULL,
+    id      text COLLATE "C" NOT NULL,
+    version text    NOT NULL,
+    status  text    NOT NULL, -- Copy of data.Status for list filters, empty for medications created before statuses
+    deleted boolean NOT NULL DEFAULT false,
+    data    jsonb   NOT NULL, -- model.MedicationData
+    PRIMARY KEY (tenant, owner, id)
+);
+
+CREATE TABLE tenant_settings (
+    tenant   text COLLATE "C" PRIMARY KEY,
+    settings jsonb NOT NULL -- model.TenantSettings
+);
+
+CREATE TABLE api_keys (
+    tenant text COLLATE "C" NOT NULL,
+    id     text COLLATE "C" NOT NULL,
+    data   jsonb NOT NULL, -- model.APIKey
+    PRIMARY KEY (tenant, id)
+);
+
+CREATE TABLE rate_buckets (
+    key        text PRIMARY KEY,
+    tokens     double precision NOT NULL,
+    updated_at bigint           NOT NULL, -- Unix nanoseconds, compared exactly on update
+    expires_at timestamptz      NOT NULL  -- The bucket is full by then, so it can be deleted
+);
+
+CREATE TABLE audit (
+    seq        bigserial PRIMARY KEY,
+    tenant     text COLLATE "C" NOT NULL,
+    owner      text COLLATE "C" NOT NULL,
+    time       bigint NOT NULL, -- Unix nanoseconds of record.Time
+    expires_at timestamptz,     -- Null means forever
+    record     jsonb  NOT NULL  -- model.AuditRecord
+);
+
+CREATE INDEX audit_owner_time ON audit (tenant, owner, time DESC, seq DESC);
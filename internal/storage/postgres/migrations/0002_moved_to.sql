@@ -0,0 +1,3 @@
+-- Target of a medication moved to another owner, model.Identity. Only set on tombstones.
+
+ALTER TABLE medications ADD COLUMN moved_to jsonb;
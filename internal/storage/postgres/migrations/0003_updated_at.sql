@@ -0,0 +1,3 @@
+-- Time of the last create or update, filtered by lists. Null for medications written before it was added.
+
+ALTER TABLE medications ADD COLUMN updated_at timestamptz;
@@ -0,0 +1,20 @@
+-- Change logs of owners, see storage.Storage. The counter row is updated in the write transaction, so its lock
+-- orders concurrent writes of the same owner and sequences have no gaps.
+
+CREATE TABLE change_counters (
+    tenant text COLLATE "C" NOT NULL,
+    owner  text COLLATE "C" NOT NULL,
+    last   bigint NOT NULL, -- Sequence of the last change, kept when the tenant is wiped
+    PRIMARY KEY (tenant, owner)
+);
+
+CREATE TABLE changes (
+    tenant  text COLLATE "C" NOT NULL,
+    owner   text COLLATE "C" NOT NULL,
+    seq     bigint  NOT NULL,
+    id      text    NOT NULL,
+    version text    NOT NULL,
+    deleted boolean NOT NULL,
+    data    jsonb, -- model.MedicationData, null for deleted medications
+    PRIMARY KEY (tenant, owner, seq)
+);
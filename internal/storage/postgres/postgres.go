@@ -0,0 +1,645 @@
+package postgres
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/chestnut42/test-medication/internal/model"
+	"github.com/chestnut42/test-medication/internal/storage"
+)
+
+// Storage keeps data in PostgreSQL for on-prem deployments where DynamoDB isn't available. The schema is created
+// by Migrate, see migrations.
+type Storage struct {
+	pool *pgxpool.Pool
+}
+
+var _ storage.Storage = (*Storage)(nil)
+
+// Open connects to the database. Dsn is a URL or a key=value string, see pgxpool.ParseConfig.
+func Open(ctx context.Context, dsn string) (*Storage, error) {
+	pool, err := pgxpool.New(ctx, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to postgres: %w", err)
+	}
+	return &Storage{pool: pool}, nil
+}
+
+func (s *Storage) Close() {
+	s.pool.Close()
+}
+
+func (s *Storage) Ping(ctx context.Context) error {
+	if err := s.pool.Ping(ctx); err != nil {
+		return fmt.Errorf("failed to ping: %w", err)
+	}
+	return nil
+}
+
+// inTx runs fn in a transaction, which is committed if fn succeeds.
+func (s *Storage) inTx(ctx context.Context, fn func(tx pgx.Tx) error) error {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("beginning transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("committing transaction: %w", err)
+	}
+	return nil
+}
+
+func (s *Storage) CreateMedication(ctx context.Context, m model.Medication) error {
+	data, err := json.Marshal(m.MedicationData)
+	if err != nil {
+		return fmt.Errorf("failed to marshal medication: %w", err)
+	}
+	return s.inTx(ctx, func(tx pgx.Tx) error {
+		// Tombstones keep the key, so a deleted id can't be reused
+		tag, err := tx.Exec(ctx, `INSERT INTO medications (tenant, owner, id, version, status, data, updated_at)
+			VALUES ($1, $2, $3, $4, $5, $6, now()) ON CONFLICT DO NOTHING`,
+			m.Tenant, m.Owner, m.Id, m.Version, m.Status, data)
+		if err != nil {
+			return fmt.Errorf("failed to insert medication: %w", err)
+		}
+		if tag.RowsAffected() == 0 {
+			return fmt.Errorf("medication %s already exists: %w", m.Id, storage.ErrAlreadyExists)
+		}
+		return appendChange(ctx, tx, m, false)
+	})
+}
+
+// appendChange adds the change to the owner's log. It must run in the transaction of the write.
+func appendChange(ctx context.Context, tx pgx.Tx, m model.Medication, deleted bool) error {
+	var seq int64
+	if err := tx.QueryRow(ctx, `INSERT INTO change_counters (tenant, owner, last) VALUES ($1, $2, 1)
+		ON CONFLICT (tenant, owner) DO UPDATE SET last = change_counters.last + 1 RETURNING last`,
+		m.Tenant, m.Owner).Scan(&seq); err != nil {
+		return fmt.Errorf("failed to update change counter: %w", err)
+	}
+	var data []byte
+	if !deleted {
+		var err error
+		if data, err = json.Marshal(m.MedicationData); err != nil {
+			return fmt.Errorf("failed to marshal medication: %w", err)
+		}
+	}
+	if _, err := tx.Exec(ctx, `INSERT INTO changes (tenant, owner, seq, id, version, deleted, data)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)`,
+		m.Tenant, m.Owner, seq, m.Id, m.Version, deleted, data); err != nil {
+		return fmt.Errorf("failed to insert change: %w", err)
+	}
+	return nil
+}
+
+// ListChanges never expires changes unless the tenant is wiped. The counter is read first: changes up to it
+// have been committed, so a missing one has been wiped.
+func (s *Storage) ListChanges(ctx context.Context, query storage.ChangesQuery) (storage.ChangesResult, error) {
+	result := storage.ChangesResult{Changes: []storage.Change{}}
+	if err := s.pool.QueryRow(ctx, `SELECT coalesce(max(last), 0) FROM change_counters WHERE tenant = $1 AND owner = $2`,
+		query.Tenant, query.Owner).Scan(&result.Last); err != nil {
+		return storage.ChangesResult{}, fmt.Errorf("failed to get change counter: %w", err)
+	}
+	if query.After > result.Last {
+		return storage.ChangesResult{}, fmt.Errorf("change %d is ahead of the log at %d: %w", query.After, result.Last, storage.ErrChangesExpired)
+	}
+	if query.Limit <= 0 || query.After == result.Last {
+		return result, nil
+	}
+
+	rows, err := s.pool.Query(ctx, `SELECT seq, id, version, deleted, data FROM changes
+		WHERE tenant = $1 AND owner = $2 AND seq > $3 AND seq <= $4 ORDER BY seq LIMIT $5`,
+		query.Tenant, query.Owner, query.After, result.Last, query.Limit)
+	if err != nil {
+		return storage.ChangesResult{}, fmt.Errorf("failed to list changes: %w", err)
+	}
+	changes, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (storage.Change, error) {
+		c := storage.Change{Medication: model.Medication{Identity: model.Identity{Tenant: query.Tenant, Owner: query.Owner}}}
+		var data []byte
+		if err := row.Scan(&c.Seq, &c.Medication.Id, &c.Medication.Version, &c.Deleted, &data); err != nil {
+			return storage.Change{}, err
+		}
+		if data != nil {
+			if err := json.Unmarshal(data, &c.Medication.MedicationData); err != nil {
+				return storage.Change{}, fmt.Errorf("failed to unmarshal change %d: %w", c.Seq, err)
+			}
+		}
+		return c, nil
+	})
+	if err != nil {
+		return storage.ChangesResult{}, fmt.Errorf("failed to read changes: %w", err)
+	}
+	for i, c := range changes {
+		if expected := query.After + int64(i) + 1; c.Seq != expected {
+			return storage.ChangesResult{}, fmt.Errorf("change %d of %s is not kept: %w", expected, query.Owner, storage.ErrChangesExpired)
+		}
+	}
+	if len(changes) == 0 {
+		return storage.ChangesResult{}, fmt.Errorf("changes after %d of %s are not kept: %w", query.After, query.Owner, storage.ErrChangesExpired)
+	}
+	result.Changes = changes
+	return result, nil
+}
+
+type queryer interface {
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+type storedMedication struct {
+	model.Medication
+	deleted bool
+	movedTo *model.Identity
+}
+
+// getMedication returns tombstones too. Rows are locked if the query runs in a transaction.
+func getMedication(ctx context.Context, q queryer, identity model.Identity, lock bool) (storedMedication, error) {
+	sql := `SELECT version, deleted, moved_to, data FROM medications WHERE tenant = $1 AND owner = $2 AND id = $3`
+	if lock {
+		sql += " FOR UPDATE"
+	}
+	stored := storedMedication{Medication: model.Medication{Identity: identity}}
+	var movedTo, data []byte
+	if err := q.QueryRow(ctx, sql, identity.Tenant, identity.Owner, identity.Id).Scan(&stored.Version, &stored.deleted, &movedTo, &data); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return storedMedication{}, fmt.Errorf("medication not found: %v, %w", identity, storage.ErrNotFound)
+		}
+		return storedMedication{}, fmt.Errorf("failed to get medication: %w", err)
+	}
+	if err := json.Unmarshal(data, &stored.MedicationData); err != nil {
+		return storedMedication{}, fmt.Errorf("failed to unmarshal medication: %w", err)
+	}
+	if movedTo != nil {
+		if err := json.Unmarshal(movedTo, &stored.movedTo); err != nil {
+			return storedMedication{}, fmt.Errorf("failed to unmarshal moved to: %w", err)
+		}
+	}
+	return stored, nil
+}
+
+func (s *Storage) GetMedication(ctx context.Context, identity model.Identity) (model.Medication, error) {
+	stored, err := getMedication(ctx, s.pool, identity, false)
+	if err != nil {
+		return model.Medication{}, err
+	}
+	if stored.movedTo != nil {
+		return model.Medication{}, &storage.MovedError{Identity: identity, Target: *stored.movedTo}
+	}
+	if stored.deleted {
+		return model.Medication{}, fmt.Errorf("medication not found: %v, %w", identity, storage.ErrNotFound)
+	}
+	return stored.Medication, nil
+}
+
+func (s *Storage) UpdateMedication(ctx context.Context, oldVersion string, m model.Medication) (model.Medication, error) {
+	data, err := json.Marshal(m.MedicationData)
+	if err != nil {
+		return model.Medication{}, fmt.Errorf("failed to marshal medication: %w", err)
+	}
+	err = s.inTx(ctx, func(tx pgx.Tx) error {
+		stored, err := getMedication(ctx, tx, m.Identity, true)
+		if err != nil {
+			return err
+		}
+		if stored.deleted {
+			return fmt.Errorf("medication not found: %v, %w", m.Identity, storage.ErrNotFound)
+		}
+		if stored.Version != oldVersion {
+			return fmt.Errorf("medication %v has version %s: %w", m.Identity, stored.Version, storage.ErrVersionMismatch)
+		}
+		if _, err := tx.Exec(ctx, `UPDATE medications SET version = $4, status = $5, data = $6, updated_at = now()
+			WHERE tenant = $1 AND owner = $2 AND id = $3`,
+			m.Tenant, m.Owner, m.Id, m.Version, m.Status, data); err != nil {
+			return fmt.Errorf("failed to update medication: %w", err)
+		}
+		return appendChange(ctx, tx, m, false)
+	})
+	if err != nil {
+		return model.Medication{}, err
+	}
+	return m, nil
+}
+
+func (s *Storage) DeleteMedication(ctx context.Context, identity model.Identity) (model.Medication, error) {
+	var stored storedMedication
+	err := s.inTx(ctx, func(tx pgx.Tx) error {
+		var err error
+		if stored, err = getMedication(ctx, tx, identity, true); err != nil {
+			return err
+		}
+		if stored.deleted {
+			return fmt.Errorf("medication not found: %v, %w", identity, storage.ErrNotFound)
+		}
+		if _, err := tx.Exec(ctx, `UPDATE medications SET deleted = true WHERE tenant = $1 AND owner = $2 AND id = $3`,
+			identity.Tenant, identity.Owner, identity.Id); err != nil {
+			return fmt.Errorf("failed to delete medication: %w", err)
+		}
+		return appendChange(ctx, tx, stored.Medication, true)
+	})
+	if err != nil {
+		return model.Medication{}, err
+	}
+	return stored.Medication, nil
+}
+
+// MoveMedication locks the source and then the target. Concurrent moves in opposite directions
+// may deadlock, Postgres aborts one of them.
+func (s *Storage) MoveMedication(ctx context.Context, source model.Identity, target model.Identity, collision storage.Collision) (model.Medication, error) {
+	var moved model.Medication
+	err := s.inTx(ctx, func(tx pgx.Tx) error {
+		stored, err := getMedication(ctx, tx, source, true)
+		if err != nil {
+			return err
+		}
+		if stored.deleted {
+			return fmt.Errorf("medication not found: %v, %w", source, storage.ErrNotFound)
+		}
+		existing, err := getMedication(ctx, tx, target, true)
+		exists := err == nil
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return err
+		}
+
+		moved = stored.Medication
+		moved.Identity = target
+		switch {
+		case exists && collision == storage.CollisionKeepTarget:
+			moved = existing.Medication
+		case exists && collision != storage.CollisionKeepSource:
+			return fmt.Errorf("medication %v already exists: %w", target, storage.ErrAlreadyExists)
+		default:
+			data, err := json.Marshal(moved.MedicationData)
+			if err != nil {
+				return fmt.Errorf("failed to marshal medication: %w", err)
+			}
+			if _, err := tx.Exec(ctx, `INSERT INTO medications (tenant, owner, id, version, status, data, updated_at)
+				VALUES ($1, $2, $3, $4, $5, $6, now()) ON CONFLICT (tenant, owner, id) DO UPDATE
+				SET version = excluded.version, status = excluded.status, data = excluded.data,
+					updated_at = excluded.updated_at, deleted = false, moved_to = NULL`,
+				target.Tenant, target.Owner, target.Id, moved.Version, moved.Status, data); err != nil {
+				return fmt.Errorf("failed to insert medication: %w", err)
+			}
+			if err := appendChange(ctx, tx, moved, false); err != nil {
+				return err
+			}
+		}
+
+		movedTo, err := json.Marshal(target)
+		if err != nil {
+			return fmt.Errorf("failed to marshal moved to: %w", err)
+		}
+		if _, err := tx.Exec(ctx, `UPDATE medications SET deleted = true, moved_to = $4
+			WHERE tenant = $1 AND owner = $2 AND id = $3`,
+			source.Tenant, source.Owner, source.Id, movedTo); err != nil {
+			return fmt.Errorf("failed to delete medication: %w", err)
+		}
+		return appendChange(ctx, tx, stored.Medication, true)
+	})
+	if err != nil {
+		return model.Medication{}, err
+	}
+	return moved, nil
+}
+
+// listCursor is the owner and the last returned id.
+type listCursor struct {
+	Tenant string `json:"t"`
+	Owner  string `json:"o"`
+	Id     string `json:"i"`
+}
+
+func (s *Storage) ListMedications(ctx context.Context, query storage.ListQuery) (storage.ListResult, error) {
+	after := ""
+	if query.Cursor != "" {
+		data, err := base64.RawURLEncoding.DecodeString(query.Cursor)
+		if err != nil {
+			return storage.ListResult{}, fmt.Errorf("cursor is not base64: %w", storage.ErrBadCursor)
+		}
+		var c listCursor
+		if err := json.Unmarshal(data, &c); err != nil {
+			return storage.ListResult{}, fmt.Errorf("cursor is not json: %w", storage.ErrBadCursor)
+		}
+		if c.Tenant != query.Tenant || c.Owner != query.Owner {
+			return storage.ListResult{}, fmt.Errorf("cursor keys mismatch: %w", storage.ErrBadCursor)
+		}
+		after = c.Id
+	}
+
+	statuses := make([]string, 0, len(query.Statuses))
+	for _, status := range query.Statuses {
+		statuses = append(statuses, string(status))
+	}
+	limit := int64(-1) // LIMIT NULL is no limit
+	if query.Limit > 0 {
+		limit = int64(query.Limit) + 1 // One more to know if there's a next page
+	}
+	var updatedSince *time.Time
+	if !query.UpdatedSince.IsZero() {
+		updatedSince = &query.UpdatedSince
+	}
+	// Empty status is active, see model.Status.OrActive
+	rows, err := s.pool.Query(ctx, `SELECT id, version, data FROM medications
+		WHERE tenant = $1 AND owner = $2 AND id > $3 AND NOT deleted
+			AND (cardinality($4::text[]) = 0 OR coalesce(nullif(status, ''), $5) = ANY($4))
+			AND ($7::text = '' OR data->>'Form' = $7)
+			AND ($8::timestamptz IS NULL OR updated_at >= $8)
+		ORDER BY id LIMIT nullif($6::bigint, -1)`,
+		query.Tenant, query.Owner, after, statuses, string(model.StatusActive), limit, string(query.Form), updatedSince)
+	if err != nil {
+		return storage.ListResult{}, fmt.Errorf("failed to list medications: %w", err)
+	}
+	meds, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (model.Medication, error) {
+		m := model.Medication{Identity: model.Identity{Tenant: query.Tenant, Owner: query.Owner}}
+		var data []byte
+		if err := row.Scan(&m.Id, &m.Version, &data); err != nil {
+			return model.Medication{}, err
+		}
+		if err := json.Unmarshal(data, &m.MedicationData); err != nil {
+			return model.Medication{}, fmt.Errorf("failed to unmarshal medication %s: %w", m.Id, err)
+		}
+		return m, nil
+	})
+	if err != nil {
+		return storage.ListResult{}, fmt.Errorf("failed to read medications: %w", err)
+	}
+	if meds == nil {
+		meds = []model.Medication{}
+	}
+
+	result := storage.ListResult{Medications: meds}
+	if query.Limit > 0 && len(meds) > int(query.Limit) {
+		result.Medications = meds[:query.Limit]
+		data, err := json.Marshal(listCursor{
+			Tenant: query.Tenant,
+			Owner:  query.Owner,
+			Id:     result.Medications[len(result.Medications)-1].Id,
+		})
+		if err != nil {
+			return storage.ListResult{}, fmt.Errorf("failed to marshal cursor: %w", err)
+		}
+		result.Cursor = base64.RawURLEncoding.EncodeToString(data)
+	}
+	// Names are matched after the page is cut, the same way DynamoDB storage does it
+	if query.Name != "" {
+		result.Medications = slices.DeleteFunc(result.Medications, func(m model.Medication) bool {
+			return !model.MatchName(m.Name, query.Name)
+		})
+	}
+	return result, nil
+}
+
+func (s *Storage) GetTenantSettings(ctx context.Context, tenant string) (model.TenantSettings, error) {
+	var data []byte
+	if err := s.pool.QueryRow(ctx, `SELECT settings FROM tenant_settings WHERE tenant = $1`, tenant).Scan(&data); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return model.TenantSettings{}, fmt.Errorf("tenant settings not found: %s, %w", tenant, storage.ErrNotFound)
+		}
+		return model.TenantSettings{}, fmt.Errorf("failed to get tenant settings: %w", err)
+	}
+	var settings model.TenantSettings
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return model.TenantSettings{}, fmt.Errorf("failed to unmarshal tenant settings: %w", err)
+	}
+	return settings, nil
+}
+
+func (s *Storage) PutTenantSettings(ctx context.Context, settings model.TenantSettings) error {
+	data, err := json.Marshal(settings)
+	if err != nil {
+		return fmt.Errorf("failed to marshal tenant settings: %w", err)
+	}
+	if _, err := s.pool.Exec(ctx, `INSERT INTO tenant_settings (tenant, settings) VALUES ($1, $2)
+		ON CONFLICT (tenant) DO UPDATE SET settings = excluded.settings`, settings.Tenant, data); err != nil {
+		return fmt.Errorf("failed to put tenant settings: %w", err)
+	}
+	return nil
+}
+
+func (s *Storage) ExportTenant(ctx context.Context, tenant string, fn func(storage.ExportedMedication) error) error {
+	rows, err := s.pool.Query(ctx, `SELECT owner, id, version, deleted, data FROM medications
+		WHERE tenant = $1 ORDER BY owner, id`, tenant)
+	if err != nil {
+		return fmt.Errorf("failed to export medications: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		e := storage.ExportedMedication{Medication: model.Medication{Identity: model.Identity{Tenant: tenant}}}
+		var data []byte
+		if err := rows.Scan(&e.Owner, &e.Id, &e.Version, &e.Deleted, &data); err != nil {
+			return fmt.Errorf("failed to scan medication: %w", err)
+		}
+		if err := json.Unmarshal(data, &e.MedicationData); err != nil {
+			return fmt.Errorf("failed to unmarshal medication %s: %w", e.Id, err)
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to export medications: %w", err)
+	}
+	return nil
+}
+
+// WipeTenant moves change counters one past the last change, so that every token issued before expires.
+func (s *Storage) WipeTenant(ctx context.Context, tenant string) (int, error) {
+	deleted := 0
+	err := s.inTx(ctx, func(tx pgx.Tx) error {
+		tag, err := tx.Exec(ctx, `DELETE FROM medications WHERE tenant = $1`, tenant)
+		if err != nil {
+			return fmt.Errorf("failed to wipe medications: %w", err)
+		}
+		deleted = int(tag.RowsAffected())
+		if _, err := tx.Exec(ctx, `DELETE FROM changes WHERE tenant = $1`, tenant); err != nil {
+			return fmt.Errorf("failed to wipe changes: %w", err)
+		}
+		if _, err := tx.Exec(ctx, `UPDATE change_counters SET last = last + 1 WHERE tenant = $1`, tenant); err != nil {
+			return fmt.Errorf("failed to reset change counters: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return deleted, nil
+}
+
+func (s *Storage) CreateAPIKey(ctx context.Context, apiKey model.APIKey) error {
+	data, err := json.Marshal(apiKey)
+	if err != nil {
+		return fmt.Errorf("failed to marshal api key: %w", err)
+	}
+	tag, err := s.pool.Exec(ctx, `INSERT INTO api_keys (tenant, id, data) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING`,
+		apiKey.Tenant, apiKey.Id, data)
+	if err != nil {
+		return fmt.Errorf("failed to insert api key: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("api key %s already exists: %w", apiKey.Id, storage.ErrAlreadyExists)
+	}
+	return nil
+}
+
+func (s *Storage) GetAPIKey(ctx context.Context, tenant string, id string) (model.APIKey, error) {
+	var apiKey model.APIKey
+	if err := s.pool.QueryRow(ctx, `SELECT data FROM api_keys WHERE tenant = $1 AND id = $2`, tenant, id).Scan(&apiKey); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return model.APIKey{}, fmt.Errorf("api key not found: %s/%s, %w", tenant, id, storage.ErrNotFound)
+		}
+		return model.APIKey{}, fmt.Errorf("failed to get api key: %w", err)
+	}
+	return apiKey, nil
+}
+
+func (s *Storage) ListAPIKeys(ctx context.Context, tenant string) ([]model.APIKey, error) {
+	rows, err := s.pool.Query(ctx, `SELECT data FROM api_keys WHERE tenant = $1 ORDER BY id`, tenant)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list api keys: %w", err)
+	}
+	keys, err := pgx.CollectRows(rows, pgx.RowTo[model.APIKey])
+	if err != nil {
+		return nil, fmt.Errorf("failed to read api keys: %w", err)
+	}
+	if keys == nil {
+		keys = []model.APIKey{}
+	}
+	return keys, nil
+}
+
+func (s *Storage) RevokeAPIKey(ctx context.Context, tenant string, id string) error {
+	tag, err := s.pool.Exec(ctx, `UPDATE api_keys SET data = jsonb_set(data, '{Revoked}', 'true')
+		WHERE tenant = $1 AND id = $2`, tenant, id)
+	if err != nil {
+		return fmt.Errorf("failed to revoke api key: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("api key not found: %s/%s, %w", tenant, id, storage.ErrNotFound)
+	}
+	return nil
+}
+
+// GetRateBucket returns an empty bucket if there's none.
+func (s *Storage) GetRateBucket(ctx context.Context, key string) (storage.RateBucket, error) {
+	var bucket storage.RateBucket
+	var updatedAt int64
+	err := s.pool.QueryRow(ctx, `SELECT tokens, updated_at, expires_at FROM rate_buckets WHERE key = $1`, key).
+		Scan(&bucket.Tokens, &updatedAt, &bucket.ExpiresAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return storage.RateBucket{}, nil
+		}
+		return storage.RateBucket{}, fmt.Errorf("failed to get rate bucket: %w", err)
+	}
+	bucket.UpdatedAt = time.Unix(0, updatedAt)
+	return bucket, nil
+}
+
+// PutRateBucket writes the bucket if it wasn't changed since prev. Zero prev means the bucket doesn't exist.
+func (s *Storage) PutRateBucket(ctx context.Context, key string, prev time.Time, bucket storage.RateBucket) error {
+	var sql string
+	args := []any{key, bucket.Tokens, bucket.UpdatedAt.UnixNano(), bucket.ExpiresAt}
+	if prev.IsZero() {
+		sql = `INSERT INTO rate_buckets (key, tokens, updated_at, expires_at) VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING`
+	} else {
+		sql = `UPDATE rate_buckets SET tokens = $2, updated_at = $3, expires_at = $4 WHERE key = $1 AND updated_at = $5`
+		args = append(args, prev.UnixNano())
+	}
+	tag, err := s.pool.Exec(ctx, sql, args...)
+	if err != nil {
+		return fmt.Errorf("failed to put rate bucket: %w", err)
+	}
+	if tag.RowsAffected() == 0 {
+		return fmt.Errorf("rate bucket %s was changed: %w", key, storage.ErrVersionMismatch)
+	}
+	return nil
+}
+
+// WriteAudit keeps records for retention, 0 means forever. Expired records are not returned, deleting them
+// is left to a periodic job, e.g. DELETE FROM audit WHERE expires_at < now().
+func (s *Storage) WriteAudit(ctx context.Context, records []model.AuditRecord, retention time.Duration) error {
+	var expiresAt *time.Time
+	if retention > 0 {
+		t := time.Now().Add(retention)
+		expiresAt = &t
+	}
+	batch := &pgx.Batch{}
+	for _, r := range records {
+		batch.Queue(`INSERT INTO audit (tenant, owner, time, expires_at, record) VALUES ($1, $2, $3, $4, $5)`,
+			r.Tenant, r.Owner, r.Time.UnixNano(), expiresAt, r)
+	}
+	return s.inTx(ctx, func(tx pgx.Tx) error {
+		if err := tx.SendBatch(ctx, batch).Close(); err != nil {
+			return fmt.Errorf("failed to write audit: %w", err)
+		}
+		return nil
+	})
+}
+
+// auditCursorSize is the length of the time and the sequence of the last returned record.
+const auditCursorSize = 16
+
+func (s *Storage) QueryAudit(ctx context.Context, query storage.AuditQuery) (storage.AuditResult, error) {
+	// Keyset pagination on (time, seq), newest first
+	beforeTime, beforeSeq := int64(1<<63-1), int64(1<<63-1)
+	if !query.To.IsZero() {
+		beforeTime, beforeSeq = query.To.UnixNano(), 0 // seq starts with 1, so all records of To are excluded
+	}
+	if query.Cursor != "" {
+		c, err := base64.RawURLEncoding.DecodeString(query.Cursor)
+		if err != nil || len(c) != auditCursorSize {
+			return storage.AuditResult{}, fmt.Errorf("cursor is malformed: %w", storage.ErrBadCursor)
+		}
+		beforeTime, beforeSeq = int64(binary.BigEndian.Uint64(c)), int64(binary.BigEndian.Uint64(c[8:]))
+	}
+	from := int64(-1 << 63)
+	if !query.From.IsZero() {
+		from = query.From.UnixNano()
+	}
+	limit := int64(-1) // LIMIT NULL is no limit
+	if query.Limit > 0 {
+		limit = int64(query.Limit) + 1 // One more to know if there's a next page
+	}
+
+	rows, err := s.pool.Query(ctx, `SELECT seq, time, record FROM audit
+		WHERE tenant = $1 AND owner = $2 AND (time, seq) < ($3, $4) AND time >= $5
+			AND ($6::text = '' OR record->>'medicationId' = $6) AND (expires_at IS NULL OR expires_at > now())
+		ORDER BY time DESC, seq DESC LIMIT nullif($7::bigint, -1)`,
+		query.Tenant, query.Owner, beforeTime, beforeSeq, from, query.MedicationId, limit)
+	if err != nil {
+		return storage.AuditResult{}, fmt.Errorf("failed to query audit: %w", err)
+	}
+	defer rows.Close()
+
+	result := storage.AuditResult{Records: []model.AuditRecord{}}
+	var lastTime, lastSeq int64
+	for rows.Next() {
+		if query.Limit > 0 && len(result.Records) == int(query.Limit) {
+			c := binary.BigEndian.AppendUint64(nil, uint64(lastTime))
+			c = binary.BigEndian.AppendUint64(c, uint64(lastSeq))
+			result.Cursor = base64.RawURLEncoding.EncodeToString(c)
+			break
+		}
+		var r model.AuditRecord
+		if err := rows.Scan(&lastSeq, &lastTime, &r); err != nil {
+			return storage.AuditResult{}, fmt.Errorf("failed to scan audit record: %w", err)
+		}
+		result.Records = append(result.Records, r)
+	}
+	if err := rows.Err(); err != nil {
+		return storage.AuditResult{}, fmt.Errorf("failed to query audit: %w", err)
+	}
+	return result, nil
+}
@@ -0,0 +1,133 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/testcontainers/testcontainers-go"
+	tcpostgres "github.com/testcontainers/testcontainers-go/modules/postgres"
+
+	"github.com/chestnut42/test-medication/internal/storage"
+	"github.com/chestnut42/test-medication/internal/storage/storagetest"
+)
+
+var (
+	dsnOnce   sync.Once
+	dsn       string
+	dsnErr    error
+	container *tcpostgres.PostgresContainer
+)
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if container != nil {
+		if err := testcontainers.TerminateContainer(container); err != nil {
+			log.Printf("failed to terminate container: %s", err)
+		}
+	}
+	os.Exit(code)
+}
+
+// testDSN starts Postgres on first use.
+func testDSN(t *testing.T) string {
+	t.Helper()
+	dsnOnce.Do(func() {
+		// Create a logger that discards all logs (silences testcontainers-go)
+		noopLogger := log.New(io.Discard, "", 0)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+
+		container, dsnErr = tcpostgres.Run(ctx, "postgres:17-alpine",
+			tcpostgres.BasicWaitStrategies(),
+			testcontainers.WithLogger(noopLogger)) // Remove this to debug containers
+		if dsnErr != nil {
+			dsnErr = fmt.Errorf("failed to start postgres container: %w", dsnErr)
+			return
+		}
+		dsn, dsnErr = container.ConnectionString(ctx, "sslmode=disable")
+	})
+	if dsnErr != nil {
+		t.Fatal(dsnErr)
+	}
+	return dsn
+}
+
+var schemaNameReplacer = strings.NewReplacer("/", "_", " ", "_", "-", "_")
+
+// newTestStorage opens a storage in a separate schema, so that tests do not interfere with each other.
+func newTestStorage(t *testing.T) *Storage {
+	t.Helper()
+	ctx := t.Context()
+
+	schema := strings.ToLower(schemaNameReplacer.Replace(t.Name()))
+	conn, err := pgx.Connect(ctx, testDSN(t))
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	defer conn.Close(ctx)
+	if _, err := conn.Exec(ctx, "CREATE SCHEMA "+pgx.Identifier{schema}.Sanitize()); err != nil {
+		t.Fatalf("failed to create schema %s: %v", schema, err)
+	}
+
+	u, err := url.Parse(testDSN(t))
+	if err != nil {
+		t.Fatalf("failed to parse dsn: %v", err)
+	}
+	q := u.Query()
+	q.Set("search_path", schema)
+	u.RawQuery = q.Encode()
+
+	s, err := Open(ctx, u.String())
+	if err != nil {
+		t.Fatalf("failed to open storage: %v", err)
+	}
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T) storage.Storage {
+		s := newTestStorage(t)
+		if _, err := s.Migrate(t.Context()); err != nil {
+			t.Fatalf("failed to migrate: %v", err)
+		}
+		return s
+	})
+}
+
+func TestMigrate(t *testing.T) {
+	s := newTestStorage(t)
+	migrations, err := loadMigrations()
+	if err != nil {
+		t.Fatalf("failed to load migrations: %v", err)
+	}
+	latest := migrations[len(migrations)-1].version
+
+	for i := 0; i < 2; i++ {
+		version, err := s.Migrate(t.Context())
+		if err != nil {
+			t.Fatalf("failed to migrate: %v", err)
+		}
+		if version != latest {
+			t.Fatalf("got version %d, expected %d", version, latest)
+		}
+	}
+
+	var applied int
+	if err := s.pool.QueryRow(t.Context(), "SELECT count(*) FROM schema_migrations").Scan(&applied); err != nil {
+		t.Fatalf("failed to count migrations: %v", err)
+	}
+	if applied != len(migrations) {
+		t.Fatalf("applied %d migrations, expected %d", applied, len(migrations))
+	}
+}
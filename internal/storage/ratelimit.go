@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+const rateBucketSortKey = "bucket"
+
+// RateBucket is a token bucket shared by replicas.
+type RateBucket struct {
+	Tokens    float64
+	UpdatedAt time.Time
+	ExpiresAt time.Time // The bucket is full by then, so it can be deleted by DynamoDB TTL
+}
+
+// UpdatedAt is stored as unix nanoseconds, so that it can be compared exactly in the condition.
+// ExpiresAt is unix seconds as required by DynamoDB TTL.
+type wrappedRateBucket struct {
+	PartitionKey string  `dynamodbav:"PK"`
+	SortKey      string  `dynamodbav:"SK"`
+	Tokens       float64 `dynamodbav:"Tokens"`
+	UpdatedAt    int64   `dynamodbav:"UpdatedAt"`
+	ExpiresAt    int64   `dynamodbav:"ExpiresAt"`
+}
+
+func getRateBucketPartition(key string) string {
+	return "#ratelimit#" + key
+}
+
+func (s *Service) GetRateBucket(ctx context.Context, key string) (RateBucket, error) {
+	resp, err := s.database.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.cfg.MedicationTable),
+		Key: map[string]types.AttributeValue{
+			"PK": &types.AttributeValueMemberS{Value: getRateBucketPartition(key)},
+			"SK": &types.AttributeValueMemberS{Value: rateBucketSortKey},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return RateBucket{}, fmt.Errorf("failed to get item: %w", err)
+	}
+	if resp.Item == nil {
+		return RateBucket{}, nil
+	}
+
+	var item wrappedRateBucket
+	if err = attributevalue.UnmarshalMap(resp.Item, &item); err != nil {
+		return RateBucket{}, fmt.Errorf("failed to unmarshal item: %w", err)
+	}
+	return RateBucket{
+		Tokens:    item.Tokens,
+		UpdatedAt: time.Unix(0, item.UpdatedAt),
+		ExpiresAt: time.Unix(item.ExpiresAt, 0),
+	}, nil
+}
+
+// PutRateBucket writes the bucket if it hasn't been changed since prev (zero prev means there was no bucket).
+func (s *Service) PutRateBucket(ctx context.Context, key string, prev time.Time, bucket RateBucket) error {
+	item, err := attributevalue.MarshalMap(wrappedRateBucket{
+		PartitionKey: getRateBucketPartition(key),
+		SortKey:      rateBucketSortKey,
+		Tokens:       bucket.Tokens,
+		UpdatedAt:    bucket.UpdatedAt.UnixNano(),
+		ExpiresAt:    bucket.ExpiresAt.Unix() + 1,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal item: %w", err)
+	}
+
+	cond := expression.Name("PK").AttributeNotExists()
+	if !prev.IsZero() {
+		cond = expression.Name("UpdatedAt").Equal(expression.Value(prev.UnixNano()))
+	}
+	expr, err := expression.NewBuilder().WithCondition(cond).Build()
+	if err != nil {
+		return fmt.Errorf("failed to build expression: %w", err)
+	}
+
+	if _, err := s.database.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:                 aws.String(s.cfg.MedicationTable),
+		Item:                      item,
+		ConditionExpression:       expr.Condition(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	}); err != nil {
+		var cfe *types.ConditionalCheckFailedException
+		if errors.As(err, &cfe) {
+			return fmt.Errorf("rate bucket %s was changed: %w", key, ErrVersionMismatch)
+		}
+		return fmt.Errorf("failed to put item: %w", err)
+	}
+	return nil
+}
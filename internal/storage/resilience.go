@@ -0,0 +1,288 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/smithy-go"
+	"github.com/aws/smithy-go/middleware"
+	"go.opentelemetry.io/otel/metric"
+
+	"github.com/chestnut42/test-medication/internal/utils/metrics"
+)
+
+// A DynamoDB call is retried by the SDK with jittered exponential backoff. Throttling backs off from a bigger base
+// delay than transient errors, as capacity takes longer to recover than a dropped connection.
+//
+// Every call (all of its attempts) gets a timeout: OperationTimeout, or less if the request deadline is closer.
+// DeadlineReserve of the request deadline is left to answer the client.
+//
+// The breaker counts calls, not attempts. It opens after BreakerFailures consecutive failed calls and rejects
+// calls with ErrUnavailable for BreakerCooldown. Then a single call is let through: it closes the breaker
+// if it succeeds and opens it again otherwise. Only errors that tell DynamoDB is unhealthy are failures,
+// e.g. a failed condition check is a healthy answer.
+
+var (
+	ErrUnavailable = errors.New("storage is unavailable")
+
+	errNoTimeLeft = fmt.Errorf("no time left for the call: %w", context.DeadlineExceeded)
+)
+
+type ResilienceConfig struct {
+	MaxAttempts       int
+	RetryBaseDelay    time.Duration
+	ThrottleBaseDelay time.Duration
+	MaxBackoff        time.Duration
+	OperationTimeout  time.Duration // Zero disables the timeout
+	DeadlineReserve   time.Duration
+	BreakerFailures   int // Zero disables the breaker
+	BreakerCooldown   time.Duration
+}
+
+// UnavailableError is returned without calling DynamoDB while the breaker is open. It wraps ErrUnavailable.
+type UnavailableError struct {
+	retryAfter time.Duration
+}
+
+func (e *UnavailableError) Error() string {
+	return fmt.Sprintf("%s, retry after %s", ErrUnavailable, e.retryAfter)
+}
+
+func (e *UnavailableError) Unwrap() error {
+	return ErrUnavailable
+}
+
+// RetryAfter is when the breaker lets a call through again.
+func (e *UnavailableError) RetryAfter() time.Duration {
+	return e.retryAfter
+}
+
+// WithResilience returns DynamoDB client options that set up retries, timeouts and the breaker.
+// Breaker may be nil, e.g. for one-off commands.
+func WithResilience(cfg ResilienceConfig, breaker *Breaker) func(*dynamodb.Options) {
+	return func(o *dynamodb.Options) {
+		o.Retryer = retry.NewStandard(func(so *retry.StandardOptions) {
+			so.MaxAttempts = cfg.MaxAttempts
+			so.MaxBackoff = cfg.MaxBackoff
+			so.Backoff = &jitterBackoff{cfg: cfg, random: rand.Float64}
+		})
+		o.APIOptions = append(o.APIOptions, func(stack *middleware.Stack) error {
+			// Breaker goes first: it must see the timeout of the call as a failure and must not count the caller
+			// giving up as one.
+			if breaker != nil {
+				if err := stack.Initialize.Add(middleware.InitializeMiddlewareFunc("MedBreaker", breaker.middleware), middleware.After); err != nil {
+					return err
+				}
+			}
+			return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("MedTimeout", cfg.timeout), middleware.After)
+		})
+	}
+}
+
+func (cfg ResilienceConfig) timeout(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+	timeout := cfg.OperationTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		remaining := time.Until(deadline) - cfg.DeadlineReserve
+		if remaining <= 0 {
+			return middleware.InitializeOutput{}, middleware.Metadata{}, errNoTimeLeft
+		}
+		if timeout <= 0 || remaining < timeout {
+			timeout = remaining
+		}
+	}
+	if timeout <= 0 {
+		return next.HandleInitialize(ctx, in)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return next.HandleInitialize(ctx, in)
+}
+
+// jitterBackoff is "full jitter": a random delay up to the exponentially growing one.
+type jitterBackoff struct {
+	cfg    ResilienceConfig
+	random func() float64
+}
+
+func (b *jitterBackoff) BackoffDelay(attempt int, err error) (time.Duration, error) {
+	base := b.cfg.RetryBaseDelay
+	if isThrottling(err) {
+		base = b.cfg.ThrottleBaseDelay
+	}
+	delay := b.cfg.MaxBackoff
+	// Attempts start from 1, the shift is bounded to not overflow
+	if attempt < 32 && base<<(attempt-1) < delay {
+		delay = base << (attempt - 1)
+	}
+	return time.Duration(b.random() * float64(delay)), nil
+}
+
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerHalfOpen
+	BreakerOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerHalfOpen:
+		return "half-open"
+	case BreakerOpen:
+		return "open"
+	default:
+		return "unknown"
+	}
+}
+
+type Breaker struct {
+	failures int
+	cooldown time.Duration
+
+	mu          sync.Mutex
+	state       BreakerState
+	consecutive int
+	openedAt    time.Time
+	probing     bool // A call is let through in the half-open state
+
+	rejected metric.Int64Counter
+	now      func() time.Time
+}
+
+func NewBreaker(cfg ResilienceConfig) *Breaker {
+	meter := metrics.Meter("github.com/chestnut42/test-medication/internal/storage")
+	// Instruments never fail with a valid name
+	rejected, _ := meter.Int64Counter("dynamodb.breaker.rejected",
+		metric.WithDescription("DynamoDB calls rejected by the open breaker"))
+	b := &Breaker{
+		failures: cfg.BreakerFailures,
+		cooldown: cfg.BreakerCooldown,
+		rejected: rejected,
+		now:      time.Now,
+	}
+	_, _ = meter.Int64ObservableGauge("dynamodb.breaker.state",
+		metric.WithDescription("DynamoDB breaker state: 0 closed, 1 half-open, 2 open"),
+		metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+			o.Observe(int64(b.State()))
+			return nil
+		}))
+	return b
+}
+
+// State of the breaker. Open turns into half-open once the cooldown has passed.
+func (b *Breaker) State() BreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.current()
+}
+
+func (b *Breaker) current() BreakerState {
+	if b.state == BreakerOpen && b.now().Sub(b.openedAt) >= b.cooldown {
+		b.state = BreakerHalfOpen
+	}
+	return b.state
+}
+
+// Check is a readiness check that fails while the breaker is open.
+func (b *Breaker) Check(context.Context) error {
+	if state := b.State(); state == BreakerOpen {
+		return fmt.Errorf("dynamodb breaker is %s", state)
+	}
+	return nil
+}
+
+// allow returns nil if the call can proceed. It must be followed by record then, with probe as it's returned.
+// Probe is the single call let through in the half-open state.
+func (b *Breaker) allow() (probe bool, err error) {
+	if b.failures <= 0 {
+		return false, nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.current() {
+	case BreakerOpen:
+		return false, &UnavailableError{retryAfter: b.cooldown - b.now().Sub(b.openedAt)}
+	case BreakerHalfOpen:
+		if b.probing {
+			return false, &UnavailableError{retryAfter: b.cooldown}
+		}
+		b.probing = true
+		return true, nil
+	}
+	return false, nil
+}
+
+// record takes the outcome of an allowed call. Neutral calls (e.g. canceled by the caller) don't change the state.
+// In the half-open state only the probe does: other calls have started before the breaker opened.
+func (b *Breaker) record(probe bool, failed bool, neutral bool) {
+	if b.failures <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	state := b.current()
+	if probe {
+		b.probing = false
+	} else if state == BreakerHalfOpen {
+		return
+	}
+	switch {
+	case neutral:
+	case failed:
+		b.consecutive++
+		if state == BreakerHalfOpen || b.consecutive >= b.failures {
+			b.state = BreakerOpen
+			b.openedAt = b.now()
+		}
+	default:
+		b.consecutive = 0
+		b.state = BreakerClosed
+	}
+}
+
+func (b *Breaker) middleware(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+	probe, err := b.allow()
+	if err != nil {
+		b.rejected.Add(ctx, 1)
+		return middleware.InitializeOutput{}, middleware.Metadata{}, err
+	}
+	out, md, err := next.HandleInitialize(ctx, in)
+	failed, neutral := classifyFailure(ctx, err)
+	b.record(probe, failed, neutral)
+	return out, md, err
+}
+
+var retryables = retry.IsErrorRetryables(retry.DefaultRetryables)
+
+// classifyFailure tells whether the error of a call means DynamoDB is unhealthy.
+// The call is neutral if the caller has given up, there is nothing to learn from it.
+func classifyFailure(ctx context.Context, err error) (failed bool, neutral bool) {
+	switch {
+	case err == nil:
+		return false, false
+	case ctx.Err() != nil, errors.Is(err, errNoTimeLeft):
+		return false, true
+	case errors.Is(err, context.DeadlineExceeded), isThrottling(err), isServerFault(err):
+		return true, false
+	default:
+		return retryables.IsErrorRetryable(err) == aws.TrueTernary, false
+	}
+}
+
+func isServerFault(err error) bool {
+	var apiErr smithy.APIError
+	return errors.As(err, &apiErr) && apiErr.ErrorFault() == smithy.FaultServer
+}
@@ -0,0 +1,205 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/smithy-go"
+	"github.com/aws/smithy-go/middleware"
+)
+
+func TestBreaker(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := NewBreaker(ResilienceConfig{BreakerFailures: 3, BreakerCooldown: 10 * time.Second})
+	b.now = func() time.Time { return now }
+
+	call := func(failed bool) error {
+		probe, err := b.allow()
+		if err != nil {
+			return err
+		}
+		b.record(probe, failed, false)
+		return nil
+	}
+	expectState := func(t *testing.T, state BreakerState) {
+		t.Helper()
+		if got := b.State(); got != state {
+			t.Fatalf("got state %s, expected %s", got, state)
+		}
+	}
+
+	// A success resets consecutive failures
+	for _, failed := range []bool{true, true, false, true, true} {
+		if err := call(failed); err != nil {
+			t.Fatalf("call is rejected: %v", err)
+		}
+	}
+	expectState(t, BreakerClosed)
+
+	// Neutral calls don't count
+	if _, err := b.allow(); err != nil {
+		t.Fatalf("call is rejected: %v", err)
+	}
+	b.record(false, false, true)
+	expectState(t, BreakerClosed)
+
+	// A slow call that has started before the breaker opens, it finishes in the half-open state
+	slow, err := b.allow()
+	if err != nil {
+		t.Fatalf("call is rejected: %v", err)
+	}
+
+	if err := call(true); err != nil {
+		t.Fatalf("call is rejected: %v", err)
+	}
+	expectState(t, BreakerOpen)
+	if err := b.Check(t.Context()); err == nil {
+		t.Fatal("readiness check passes with the open breaker")
+	}
+
+	now = now.Add(4 * time.Second)
+	err = call(false)
+	var unavailable *UnavailableError
+	if !errors.As(err, &unavailable) || !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("got %v, expected %v", err, ErrUnavailable)
+	}
+	if unavailable.RetryAfter() != 6*time.Second {
+		t.Fatalf("got retry after %s, expected 6s", unavailable.RetryAfter())
+	}
+
+	// Half-open lets a single call through, its failure opens the breaker again
+	now = now.Add(6 * time.Second)
+	expectState(t, BreakerHalfOpen)
+	probe, err := b.allow()
+	if err != nil || !probe {
+		t.Fatalf("probe is rejected: %v", err)
+	}
+	if _, err := b.allow(); !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("second call in half-open state got %v, expected %v", err, ErrUnavailable)
+	}
+
+	// The slow call neither decides the state nor lets another probe in
+	b.record(slow, false, false)
+	expectState(t, BreakerHalfOpen)
+	if _, err := b.allow(); !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("call while the probe is running got %v, expected %v", err, ErrUnavailable)
+	}
+
+	b.record(probe, true, false)
+	expectState(t, BreakerOpen)
+
+	// And its success closes it
+	now = now.Add(10 * time.Second)
+	if err := call(false); err != nil {
+		t.Fatalf("probe is rejected: %v", err)
+	}
+	expectState(t, BreakerClosed)
+	if err := b.Check(t.Context()); err != nil {
+		t.Fatalf("readiness check fails with the closed breaker: %v", err)
+	}
+}
+
+func TestClassifyFailure(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		err     error
+		failed  bool
+		neutral bool
+	}{
+		{name: "success", ctx: context.Background()},
+		{name: "condition check", ctx: context.Background(), err: &types.ConditionalCheckFailedException{}},
+		{name: "throttling", ctx: context.Background(), err: &types.ProvisionedThroughputExceededException{}, failed: true},
+		{name: "server error", ctx: context.Background(), err: &types.InternalServerError{}, failed: true},
+		{name: "transient", ctx: context.Background(), err: &smithy.GenericAPIError{Code: "RequestTimeout"}, failed: true},
+		{name: "timeout", ctx: context.Background(), err: fmt.Errorf("call: %w", context.DeadlineExceeded), failed: true},
+		{name: "no time left", ctx: context.Background(), err: errNoTimeLeft, neutral: true},
+		{name: "caller gave up", ctx: canceled, err: context.Canceled, neutral: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			failed, neutral := classifyFailure(test.ctx, test.err)
+			if failed != test.failed || neutral != test.neutral {
+				t.Fatalf("got failed %v neutral %v, expected %v %v", failed, neutral, test.failed, test.neutral)
+			}
+		})
+	}
+}
+
+func TestJitterBackoff(t *testing.T) {
+	b := &jitterBackoff{
+		cfg:    ResilienceConfig{RetryBaseDelay: 10 * time.Millisecond, ThrottleBaseDelay: 100 * time.Millisecond, MaxBackoff: time.Second},
+		random: func() float64 { return 1 },
+	}
+	tests := []struct {
+		attempt  int
+		err      error
+		expected time.Duration
+	}{
+		{attempt: 1, err: errors.New("transient"), expected: 10 * time.Millisecond},
+		{attempt: 3, err: errors.New("transient"), expected: 40 * time.Millisecond},
+		{attempt: 1, err: &types.ProvisionedThroughputExceededException{}, expected: 100 * time.Millisecond},
+		{attempt: 5, err: &types.ProvisionedThroughputExceededException{}, expected: time.Second},
+		{attempt: 100, err: errors.New("transient"), expected: time.Second},
+	}
+	for _, test := range tests {
+		got, err := b.BackoffDelay(test.attempt, test.err)
+		if err != nil {
+			t.Fatalf("failed to get delay: %v", err)
+		}
+		if got != test.expected {
+			t.Fatalf("attempt %d of %v: got %s, expected %s", test.attempt, test.err, got, test.expected)
+		}
+	}
+}
+
+func TestOperationTimeout(t *testing.T) {
+	cfg := ResilienceConfig{OperationTimeout: time.Second, DeadlineReserve: 100 * time.Millisecond}
+
+	tests := []struct {
+		name     string
+		deadline time.Duration // Of the caller, zero means none
+		expected time.Duration
+		err      error
+	}{
+		{name: "no deadline", expected: time.Second},
+		{name: "far deadline", deadline: time.Minute, expected: time.Second},
+		{name: "close deadline", deadline: 500 * time.Millisecond, expected: 400 * time.Millisecond},
+		{name: "no time left", deadline: 50 * time.Millisecond, err: errNoTimeLeft},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := t.Context()
+			if test.deadline > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, test.deadline)
+				defer cancel()
+			}
+
+			var got time.Duration
+			next := middleware.InitializeHandlerFunc(func(ctx context.Context, _ middleware.InitializeInput) (middleware.InitializeOutput, middleware.Metadata, error) {
+				deadline, _ := ctx.Deadline()
+				got = time.Until(deadline)
+				return middleware.InitializeOutput{}, middleware.Metadata{}, nil
+			})
+			_, _, err := cfg.timeout(ctx, middleware.InitializeInput{}, next)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("got %v, expected %v", err, test.err)
+			}
+			if test.err != nil {
+				return
+			}
+			// Some time passes between setting the deadline and checking it
+			if got > test.expected || got < test.expected-50*time.Millisecond {
+				t.Fatalf("got timeout %s, expected %s", got, test.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,398 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// ExpiresAtAttribute is the TTL attribute of every table. Rate buckets, audit records, history and outbox
+// items set it, medications never do.
+const ExpiresAtAttribute = "ExpiresAt"
+
+// TableDefinition is the expected state of a table. All tables have string PK and SK keys, indexes project
+// all attributes and use string keys too.
+type TableDefinition struct {
+	Name                string
+	Indexes             []IndexDefinition
+	TTLAttribute        string // Empty means TTL is not used
+	PointInTimeRecovery bool   // False means it's not checked, PITR is never disabled
+}
+
+type IndexDefinition struct {
+	Name     string
+	HashKey  string
+	RangeKey string
+}
+
+// Tables defines the tables of the service. Tables with empty names are skipped. PITR is off for DynamoDB Local,
+// which doesn't support it.
+func Tables(cfg Config, pitr bool) []TableDefinition {
+	tables := []TableDefinition{{
+		Name:                cfg.MedicationTable,
+		Indexes:             []IndexDefinition{{Name: ListIndex, HashKey: "LK", RangeKey: "SK"}},
+		TTLAttribute:        ExpiresAtAttribute,
+		PointInTimeRecovery: pitr,
+	}, {
+		Name:                cfg.AuditTable,
+		TTLAttribute:        ExpiresAtAttribute,
+		PointInTimeRecovery: pitr,
+	}, {
+		Name:                cfg.HistoryTable,
+		TTLAttribute:        ExpiresAtAttribute,
+		PointInTimeRecovery: pitr,
+	}, {
+		// Changes expire and clients resync if they are lost, backups are pointless
+		Name:         cfg.OutboxTable,
+		TTLAttribute: ExpiresAtAttribute,
+	}}
+	return slices.DeleteFunc(tables, func(t TableDefinition) bool { return t.Name == "" })
+}
+
+type SchemaDatabase interface {
+	CreateTable(ctx context.Context, params *dynamodb.CreateTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.CreateTableOutput, error)
+	DescribeTable(ctx context.Context, params *dynamodb.DescribeTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DescribeTableOutput, error)
+	UpdateTable(ctx context.Context, params *dynamodb.UpdateTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateTableOutput, error)
+	DescribeTimeToLive(ctx context.Context, params *dynamodb.DescribeTimeToLiveInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DescribeTimeToLiveOutput, error)
+	UpdateTimeToLive(ctx context.Context, params *dynamodb.UpdateTimeToLiveInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateTimeToLiveOutput, error)
+	DescribeContinuousBackups(ctx context.Context, params *dynamodb.DescribeContinuousBackupsInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DescribeContinuousBackupsOutput, error)
+	UpdateContinuousBackups(ctx context.Context, params *dynamodb.UpdateContinuousBackupsInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateContinuousBackupsOutput, error)
+}
+
+// Drift is a difference between the expected and the actual state of a table.
+type Drift struct {
+	Table    string
+	Field    string // e.g. "table", "key schema", "index ListIndex", "ttl", "pitr"
+	Expected string
+	Actual   string
+
+	fix func(ctx context.Context) error // Nil if the table must be changed by hand
+}
+
+// Fixable drift is fixed by Apply. Others would need a table to be recreated or could break a running release,
+// e.g. removing an index.
+func (d Drift) Fixable() bool {
+	return d.fix != nil
+}
+
+func (d Drift) String() string {
+	mark := "!"
+	if d.Fixable() {
+		mark = "~"
+	}
+	return fmt.Sprintf("%s %s: %s: expected %s, actual %s", mark, d.Table, d.Field, d.Expected, d.Actual)
+}
+
+// Schema compares tables with their definitions and brings them up to date.
+type Schema struct {
+	database     SchemaDatabase
+	tables       []TableDefinition
+	pollInterval time.Duration // How often Apply checks whether a table or an index is active
+}
+
+func NewSchema(database SchemaDatabase, tables []TableDefinition) *Schema {
+	return &Schema{
+		database:     database,
+		tables:       tables,
+		pollInterval: time.Second,
+	}
+}
+
+// maxApplyPasses bounds Apply. A new table needs two: one creates it, the next one enables TTL and PITR.
+const maxApplyPasses = 3
+
+// Apply fixes what it can and returns the drift that is left. Nothing is ever deleted. Creating an index
+// waits for the backfill, which takes a while for big tables.
+func (s *Schema) Apply(ctx context.Context) ([]Drift, error) {
+	for range maxApplyPasses {
+		drift, err := s.Diff(ctx)
+		if err != nil {
+			return nil, err
+		}
+		fixable := slices.ContainsFunc(drift, Drift.Fixable)
+		if !fixable {
+			return drift, nil
+		}
+		for _, d := range drift {
+			if !d.Fixable() {
+				continue
+			}
+			if err := d.fix(ctx); err != nil {
+				return nil, fmt.Errorf("fixing %s %s: %w", d.Table, d.Field, err)
+			}
+		}
+	}
+	return s.Diff(ctx)
+}
+
+// Diff returns the drift of all tables, empty if the schema is up to date.
+func (s *Schema) Diff(ctx context.Context) ([]Drift, error) {
+	var drift []Drift
+	for _, table := range s.tables {
+		d, err := s.diffTable(ctx, table)
+		if err != nil {
+			return nil, fmt.Errorf("checking table %s: %w", table.Name, err)
+		}
+		drift = append(drift, d...)
+	}
+	return drift, nil
+}
+
+func (s *Schema) diffTable(ctx context.Context, table TableDefinition) ([]Drift, error) {
+	resp, err := s.database.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(table.Name)})
+	if err != nil {
+		var notFound *types.ResourceNotFoundException
+		if errors.As(err, &notFound) {
+			// The rest is checked once the table exists
+			return []Drift{{
+				Table:    table.Name,
+				Field:    "table",
+				Expected: "exists",
+				Actual:   "missing",
+				fix:      func(ctx context.Context) error { return s.createTable(ctx, table) },
+			}}, nil
+		}
+		return nil, fmt.Errorf("failed to describe table: %w", err)
+	}
+	desc := resp.Table
+
+	var drift []Drift
+	if want, got := "PK/SK", keySchema(desc.KeySchema, desc.AttributeDefinitions); got != want {
+		drift = append(drift, Drift{Table: table.Name, Field: "key schema", Expected: want, Actual: got})
+	}
+
+	actualIndexes := make(map[string]types.GlobalSecondaryIndexDescription)
+	for _, gsi := range desc.GlobalSecondaryIndexes {
+		actualIndexes[aws.ToString(gsi.IndexName)] = gsi
+	}
+	for _, index := range table.Indexes {
+		field := "index " + index.Name
+		want := index.HashKey + "/" + index.RangeKey + " " + string(types.ProjectionTypeAll)
+		gsi, ok := actualIndexes[index.Name]
+		if !ok {
+			drift = append(drift, Drift{
+				Table:    table.Name,
+				Field:    field,
+				Expected: want,
+				Actual:   "missing",
+				fix:      func(ctx context.Context) error { return s.createIndex(ctx, table.Name, index) },
+			})
+			continue
+		}
+		delete(actualIndexes, index.Name)
+		got := keySchema(gsi.KeySchema, desc.AttributeDefinitions)
+		if gsi.Projection != nil {
+			got += " " + string(gsi.Projection.ProjectionType)
+		}
+		if got != want {
+			drift = append(drift, Drift{Table: table.Name, Field: field, Expected: want, Actual: got})
+		}
+	}
+	for _, gsi := range desc.GlobalSecondaryIndexes {
+		if _, ok := actualIndexes[aws.ToString(gsi.IndexName)]; !ok {
+			continue // Expected
+		}
+		drift = append(drift, Drift{
+			Table:    table.Name,
+			Field:    "index " + aws.ToString(gsi.IndexName),
+			Expected: "none",
+			Actual:   keySchema(gsi.KeySchema, desc.AttributeDefinitions),
+		})
+	}
+
+	ttlDrift, err := s.diffTTL(ctx, table)
+	if err != nil {
+		return nil, err
+	}
+	drift = append(drift, ttlDrift...)
+
+	if table.PointInTimeRecovery {
+		pitrDrift, err := s.diffPITR(ctx, table)
+		if err != nil {
+			return nil, err
+		}
+		drift = append(drift, pitrDrift...)
+	}
+	return drift, nil
+}
+
+func (s *Schema) diffTTL(ctx context.Context, table TableDefinition) ([]Drift, error) {
+	resp, err := s.database.DescribeTimeToLive(ctx, &dynamodb.DescribeTimeToLiveInput{TableName: aws.String(table.Name)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe ttl: %w", err)
+	}
+	got := "disabled"
+	if ttl := resp.TimeToLiveDescription; ttl != nil &&
+		(ttl.TimeToLiveStatus == types.TimeToLiveStatusEnabled || ttl.TimeToLiveStatus == types.TimeToLiveStatusEnabling) {
+		got = aws.ToString(ttl.AttributeName)
+	}
+	want := table.TTLAttribute
+	if want == "" {
+		want = "disabled"
+	}
+	if got == want {
+		return nil, nil
+	}
+
+	d := Drift{Table: table.Name, Field: "ttl", Expected: want, Actual: got}
+	// Changing the attribute needs TTL to be disabled first, which takes up to an hour and can't be reverted meanwhile
+	if got == "disabled" {
+		d.fix = func(ctx context.Context) error {
+			if _, err := s.database.UpdateTimeToLive(ctx, &dynamodb.UpdateTimeToLiveInput{
+				TableName: aws.String(table.Name),
+				TimeToLiveSpecification: &types.TimeToLiveSpecification{
+					AttributeName: aws.String(table.TTLAttribute),
+					Enabled:       aws.Bool(true),
+				},
+			}); err != nil {
+				return fmt.Errorf("failed to update ttl: %w", err)
+			}
+			return nil
+		}
+	}
+	return []Drift{d}, nil
+}
+
+func (s *Schema) diffPITR(ctx context.Context, table TableDefinition) ([]Drift, error) {
+	resp, err := s.database.DescribeContinuousBackups(ctx, &dynamodb.DescribeContinuousBackupsInput{TableName: aws.String(table.Name)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe continuous backups: %w", err)
+	}
+	if desc := resp.ContinuousBackupsDescription; desc != nil && desc.PointInTimeRecoveryDescription != nil &&
+		desc.PointInTimeRecoveryDescription.PointInTimeRecoveryStatus == types.PointInTimeRecoveryStatusEnabled {
+		return nil, nil
+	}
+	return []Drift{{
+		Table:    table.Name,
+		Field:    "pitr",
+		Expected: "enabled",
+		Actual:   "disabled",
+		fix: func(ctx context.Context) error {
+			if _, err := s.database.UpdateContinuousBackups(ctx, &dynamodb.UpdateContinuousBackupsInput{
+				TableName: aws.String(table.Name),
+				PointInTimeRecoverySpecification: &types.PointInTimeRecoverySpecification{
+					PointInTimeRecoveryEnabled: aws.Bool(true),
+				},
+			}); err != nil {
+				return fmt.Errorf("failed to update continuous backups: %w", err)
+			}
+			return nil
+		},
+	}}, nil
+}
+
+func (s *Schema) createTable(ctx context.Context, table TableDefinition) error {
+	attributes := []string{"PK", "SK"}
+	var indexes []types.GlobalSecondaryIndex
+	for _, index := range table.Indexes {
+		attributes = append(attributes, index.HashKey, index.RangeKey)
+		indexes = append(indexes, types.GlobalSecondaryIndex{
+			IndexName:  aws.String(index.Name),
+			KeySchema:  keySchemaElements(index.HashKey, index.RangeKey),
+			Projection: &types.Projection{ProjectionType: types.ProjectionTypeAll},
+		})
+	}
+	if _, err := s.database.CreateTable(ctx, &dynamodb.CreateTableInput{
+		TableName:              aws.String(table.Name),
+		AttributeDefinitions:   attributeDefinitions(attributes),
+		KeySchema:              keySchemaElements("PK", "SK"),
+		GlobalSecondaryIndexes: indexes,
+		BillingMode:            types.BillingModePayPerRequest,
+	}); err != nil {
+		return fmt.Errorf("failed to create table: %w", err)
+	}
+	return s.waitActive(ctx, table.Name)
+}
+
+// createIndex adds an index to an existing table. DynamoDB allows one index to be created at a time, so it waits
+// for the backfill before returning.
+func (s *Schema) createIndex(ctx context.Context, tableName string, index IndexDefinition) error {
+	if _, err := s.database.UpdateTable(ctx, &dynamodb.UpdateTableInput{
+		TableName:            aws.String(tableName),
+		AttributeDefinitions: attributeDefinitions([]string{index.HashKey, index.RangeKey}),
+		GlobalSecondaryIndexUpdates: []types.GlobalSecondaryIndexUpdate{{
+			Create: &types.CreateGlobalSecondaryIndexAction{
+				IndexName:  aws.String(index.Name),
+				KeySchema:  keySchemaElements(index.HashKey, index.RangeKey),
+				Projection: &types.Projection{ProjectionType: types.ProjectionTypeAll},
+			},
+		}},
+	}); err != nil {
+		return fmt.Errorf("failed to create index: %w", err)
+	}
+	return s.waitActive(ctx, tableName)
+}
+
+// waitActive waits for the table and all its indexes to become active.
+func (s *Schema) waitActive(ctx context.Context, tableName string) error {
+	for {
+		resp, err := s.database.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(tableName)})
+		if err != nil {
+			return fmt.Errorf("failed to describe table: %w", err)
+		}
+		active := resp.Table.TableStatus == types.TableStatusActive
+		for _, gsi := range resp.Table.GlobalSecondaryIndexes {
+			active = active && gsi.IndexStatus == types.IndexStatusActive
+		}
+		if active {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for table %s: %w", tableName, ctx.Err())
+		case <-time.After(s.pollInterval):
+		}
+	}
+}
+
+// keySchema formats a key schema as HASH/RANGE, non-string attributes have their type, e.g. PK/SK(N).
+func keySchema(elements []types.KeySchemaElement, attributes []types.AttributeDefinition) string {
+	var hash, rangeKey string
+	for _, e := range elements {
+		name := aws.ToString(e.AttributeName)
+		for _, a := range attributes {
+			if aws.ToString(a.AttributeName) == name && a.AttributeType != types.ScalarAttributeTypeS {
+				name += "(" + string(a.AttributeType) + ")"
+			}
+		}
+		switch e.KeyType {
+		case types.KeyTypeHash:
+			hash = name
+		case types.KeyTypeRange:
+			rangeKey = name
+		}
+	}
+	return strings.TrimSuffix(hash+"/"+rangeKey, "/")
+}
+
+func keySchemaElements(hash string, rangeKey string) []types.KeySchemaElement {
+	return []types.KeySchemaElement{{
+		AttributeName: aws.String(hash),
+		KeyType:       types.KeyTypeHash,
+	}, {
+		AttributeName: aws.String(rangeKey),
+		KeyType:       types.KeyTypeRange,
+	}}
+}
+
+func attributeDefinitions(names []string) []types.AttributeDefinition {
+	var defs []types.AttributeDefinition
+	for _, name := range names {
+		if slices.ContainsFunc(defs, func(d types.AttributeDefinition) bool { return aws.ToString(d.AttributeName) == name }) {
+			continue
+		}
+		defs = append(defs, types.AttributeDefinition{
+			AttributeName: aws.String(name),
+			AttributeType: types.ScalarAttributeTypeS,
+		})
+	}
+	return defs
+}
@@ -0,0 +1,227 @@
+package storage
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// fakeSchemaDatabase keeps table descriptions. Tables and indexes are active right away.
+type fakeSchemaDatabase struct {
+	tables map[string]*types.TableDescription
+	ttl    map[string]string
+	pitr   map[string]bool
+}
+
+func newFakeSchemaDatabase() *fakeSchemaDatabase {
+	return &fakeSchemaDatabase{
+		tables: make(map[string]*types.TableDescription),
+		ttl:    make(map[string]string),
+		pitr:   make(map[string]bool),
+	}
+}
+
+func (f *fakeSchemaDatabase) table(name *string) (*types.TableDescription, error) {
+	t, ok := f.tables[aws.ToString(name)]
+	if !ok {
+		return nil, &types.ResourceNotFoundException{Message: aws.String("table not found")}
+	}
+	return t, nil
+}
+
+func (f *fakeSchemaDatabase) CreateTable(_ context.Context, params *dynamodb.CreateTableInput, _ ...func(*dynamodb.Options)) (*dynamodb.CreateTableOutput, error) {
+	desc := &types.TableDescription{
+		TableName:            params.TableName,
+		TableStatus:          types.TableStatusActive,
+		KeySchema:            params.KeySchema,
+		AttributeDefinitions: params.AttributeDefinitions,
+	}
+	for _, gsi := range params.GlobalSecondaryIndexes {
+		desc.GlobalSecondaryIndexes = append(desc.GlobalSecondaryIndexes, types.GlobalSecondaryIndexDescription{
+			IndexName:   gsi.IndexName,
+			KeySchema:   gsi.KeySchema,
+			Projection:  gsi.Projection,
+			IndexStatus: types.IndexStatusActive,
+		})
+	}
+	f.tables[aws.ToString(params.TableName)] = desc
+	return &dynamodb.CreateTableOutput{TableDescription: desc}, nil
+}
+
+func (f *fakeSchemaDatabase) DescribeTable(_ context.Context, params *dynamodb.DescribeTableInput, _ ...func(*dynamodb.Options)) (*dynamodb.DescribeTableOutput, error) {
+	t, err := f.table(params.TableName)
+	if err != nil {
+		return nil, err
+	}
+	return &dynamodb.DescribeTableOutput{Table: t}, nil
+}
+
+func (f *fakeSchemaDatabase) UpdateTable(_ context.Context, params *dynamodb.UpdateTableInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateTableOutput, error) {
+	t, err := f.table(params.TableName)
+	if err != nil {
+		return nil, err
+	}
+	for _, def := range params.AttributeDefinitions {
+		if !slices.ContainsFunc(t.AttributeDefinitions, func(d types.AttributeDefinition) bool {
+			return aws.ToString(d.AttributeName) == aws.ToString(def.AttributeName)
+		}) {
+			t.AttributeDefinitions = append(t.AttributeDefinitions, def)
+		}
+	}
+	for _, u := range params.GlobalSecondaryIndexUpdates {
+		t.GlobalSecondaryIndexes = append(t.GlobalSecondaryIndexes, types.GlobalSecondaryIndexDescription{
+			IndexName:   u.Create.IndexName,
+			KeySchema:   u.Create.KeySchema,
+			Projection:  u.Create.Projection,
+			IndexStatus: types.IndexStatusActive,
+		})
+	}
+	return &dynamodb.UpdateTableOutput{TableDescription: t}, nil
+}
+
+func (f *fakeSchemaDatabase) DescribeTimeToLive(_ context.Context, params *dynamodb.DescribeTimeToLiveInput, _ ...func(*dynamodb.Options)) (*dynamodb.DescribeTimeToLiveOutput, error) {
+	if _, err := f.table(params.TableName); err != nil {
+		return nil, err
+	}
+	desc := &types.TimeToLiveDescription{TimeToLiveStatus: types.TimeToLiveStatusDisabled}
+	if attr, ok := f.ttl[aws.ToString(params.TableName)]; ok {
+		desc = &types.TimeToLiveDescription{TimeToLiveStatus: types.TimeToLiveStatusEnabled, AttributeName: aws.String(attr)}
+	}
+	return &dynamodb.DescribeTimeToLiveOutput{TimeToLiveDescription: desc}, nil
+}
+
+func (f *fakeSchemaDatabase) UpdateTimeToLive(_ context.Context, params *dynamodb.UpdateTimeToLiveInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateTimeToLiveOutput, error) {
+	if _, err := f.table(params.TableName); err != nil {
+		return nil, err
+	}
+	f.ttl[aws.ToString(params.TableName)] = aws.ToString(params.TimeToLiveSpecification.AttributeName)
+	return &dynamodb.UpdateTimeToLiveOutput{}, nil
+}
+
+func (f *fakeSchemaDatabase) DescribeContinuousBackups(_ context.Context, params *dynamodb.DescribeContinuousBackupsInput, _ ...func(*dynamodb.Options)) (*dynamodb.DescribeContinuousBackupsOutput, error) {
+	if _, err := f.table(params.TableName); err != nil {
+		return nil, err
+	}
+	status := types.PointInTimeRecoveryStatusDisabled
+	if f.pitr[aws.ToString(params.TableName)] {
+		status = types.PointInTimeRecoveryStatusEnabled
+	}
+	return &dynamodb.DescribeContinuousBackupsOutput{ContinuousBackupsDescription: &types.ContinuousBackupsDescription{
+		PointInTimeRecoveryDescription: &types.PointInTimeRecoveryDescription{PointInTimeRecoveryStatus: status},
+	}}, nil
+}
+
+func (f *fakeSchemaDatabase) UpdateContinuousBackups(_ context.Context, params *dynamodb.UpdateContinuousBackupsInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateContinuousBackupsOutput, error) {
+	if _, err := f.table(params.TableName); err != nil {
+		return nil, err
+	}
+	f.pitr[aws.ToString(params.TableName)] = aws.ToBool(params.PointInTimeRecoverySpecification.PointInTimeRecoveryEnabled)
+	return &dynamodb.UpdateContinuousBackupsOutput{}, nil
+}
+
+func driftStrings(drift []Drift) []string {
+	var out []string
+	for _, d := range drift {
+		out = append(out, d.String())
+	}
+	return out
+}
+
+func TestSchema(t *testing.T) {
+	tables := Tables(Config{MedicationTable: "medication", OutboxTable: "outbox"}, true)
+
+	tests := []struct {
+		name  string
+		setup func(db *fakeSchemaDatabase)
+		diff  []string
+		left  []string // Drift after Apply
+	}{
+		{
+			name: "empty",
+			diff: []string{
+				"~ medication: table: expected exists, actual missing",
+				"~ outbox: table: expected exists, actual missing",
+			},
+		},
+		{
+			name: "up to date",
+			setup: func(db *fakeSchemaDatabase) {
+				_, _ = NewSchema(db, tables).Apply(context.Background())
+			},
+		},
+		{
+			name: "missing index, ttl and pitr",
+			setup: func(db *fakeSchemaDatabase) {
+				_, _ = db.CreateTable(context.Background(), &dynamodb.CreateTableInput{
+					TableName:            aws.String("medication"),
+					KeySchema:            keySchemaElements("PK", "SK"),
+					AttributeDefinitions: attributeDefinitions([]string{"PK", "SK"}),
+				})
+				db.ttl["outbox"] = ExpiresAtAttribute
+				_, _ = db.CreateTable(context.Background(), &dynamodb.CreateTableInput{
+					TableName:            aws.String("outbox"),
+					KeySchema:            keySchemaElements("PK", "SK"),
+					AttributeDefinitions: attributeDefinitions([]string{"PK", "SK"}),
+				})
+			},
+			diff: []string{
+				"~ medication: index ListIndex: expected LK/SK ALL, actual missing",
+				"~ medication: ttl: expected ExpiresAt, actual disabled",
+				"~ medication: pitr: expected enabled, actual disabled",
+			},
+		},
+		{
+			name: "drift that can't be fixed",
+			setup: func(db *fakeSchemaDatabase) {
+				_, _ = NewSchema(db, tables).Apply(context.Background())
+				db.tables["outbox"].KeySchema = []types.KeySchemaElement{{AttributeName: aws.String("Id"), KeyType: types.KeyTypeHash}}
+				db.tables["outbox"].GlobalSecondaryIndexes = []types.GlobalSecondaryIndexDescription{{
+					IndexName: aws.String("Extra"),
+					KeySchema: keySchemaElements("LK", "SK"),
+				}}
+				db.ttl["medication"] = "TTL"
+			},
+			diff: []string{
+				"! medication: ttl: expected ExpiresAt, actual TTL",
+				"! outbox: key schema: expected PK/SK, actual Id",
+				"! outbox: index Extra: expected none, actual LK/SK",
+			},
+			left: []string{
+				"! medication: ttl: expected ExpiresAt, actual TTL",
+				"! outbox: key schema: expected PK/SK, actual Id",
+				"! outbox: index Extra: expected none, actual LK/SK",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := t.Context()
+			db := newFakeSchemaDatabase()
+			if test.setup != nil {
+				test.setup(db)
+			}
+			schema := NewSchema(db, tables)
+
+			diff, err := schema.Diff(ctx)
+			if err != nil {
+				t.Fatalf("failed to diff: %v", err)
+			}
+			if got := driftStrings(diff); !slices.Equal(got, test.diff) {
+				t.Fatalf("got diff:\n%v\nexpected:\n%v", got, test.diff)
+			}
+
+			left, err := schema.Apply(ctx)
+			if err != nil {
+				t.Fatalf("failed to apply: %v", err)
+			}
+			if got := driftStrings(left); !slices.Equal(got, test.left) {
+				t.Fatalf("got drift after apply:\n%v\nexpected:\n%v", got, test.left)
+			}
+		})
+	}
+}
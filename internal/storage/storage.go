@@ -2,22 +2,108 @@ package storage
 
 import (
 	"context"
+	"fmt"
+	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"github.com/chestnut42/test-medication/internal/model"
 )
 
+// ListIndex is a GSI name used for listing medications of an owner.
+// Hash key is LK (list key), range key is SK.
+const ListIndex = "ListIndex"
+
+// Storage is the contract of a storage backend. Service is the DynamoDB one, memory and bolt packages implement it
+// for tests and local development. Backends must pass storagetest.Run.
+//
+// Semantics every backend follows:
+//   - Medications are addressed by tenant, owner and id. Create fails with ErrAlreadyExists if the id has ever
+//     been used by the owner, deleted medications included.
+//   - Update replaces the medication if the stored version is equal to the given one (ErrVersionMismatch otherwise).
+//   - Delete leaves a tombstone. Tombstones are ErrNotFound for get, update and delete, and are only visible
+//     to export.
+//   - List is ordered by id. Cursors are opaque and only valid for the owner they were issued for (ErrBadCursor).
+//     A page may contain fewer medications than the limit while the cursor is not empty.
+//   - Get is strongly consistent if the context is marked with WithConsistentRead. It may return a stale
+//     medication otherwise. Backends without replicas are always consistent.
+//   - Move turns the source into a tombstone that redirects to the target: get returns MovedError, which is
+//     ErrNotFound too. The target keeps the source's version. Collisions with the target id follow Collision,
+//     with CollisionKeepTarget the target is returned as it is, even if it's deleted.
+//   - Every create, update, delete and move appends a change to the owner's log, numbered from 1 without gaps
+//     in the order of writes. Changes after the requested one that are no longer kept are ErrChangesExpired.
+//     Wiping the tenant expires all of its changes.
+//   - Audit records are append-only. Retention is enforced by backends that can expire data, others keep everything.
+type Storage interface {
+	Ping(ctx context.Context) error
+
+	CreateMedication(ctx context.Context, medication model.Medication) error
+	GetMedication(ctx context.Context, identity model.Identity) (model.Medication, error)
+	UpdateMedication(ctx context.Context, oldVersion string, medication model.Medication) (model.Medication, error)
+	DeleteMedication(ctx context.Context, identity model.Identity) (model.Medication, error)
+	ListMedications(ctx context.Context, query ListQuery) (ListResult, error)
+	MoveMedication(ctx context.Context, source model.Identity, target model.Identity, collision Collision) (model.Medication, error)
+	ListChanges(ctx context.Context, query ChangesQuery) (ChangesResult, error)
+
+	GetTenantSettings(ctx context.Context, tenant string) (model.TenantSettings, error)
+	PutTenantSettings(ctx context.Context, settings model.TenantSettings) error
+	ExportTenant(ctx context.Context, tenant string, fn func(ExportedMedication) error) error
+	WipeTenant(ctx context.Context, tenant string) (int, error)
+
+	CreateAPIKey(ctx context.Context, key model.APIKey) error
+	GetAPIKey(ctx context.Context, tenant string, id string) (model.APIKey, error)
+	ListAPIKeys(ctx context.Context, tenant string) ([]model.APIKey, error)
+	RevokeAPIKey(ctx context.Context, tenant string, id string) error
+
+	GetRateBucket(ctx context.Context, key string) (RateBucket, error)
+	PutRateBucket(ctx context.Context, key string, prev time.Time, bucket RateBucket) error
+
+	WriteAudit(ctx context.Context, records []model.AuditRecord, retention time.Duration) error
+	QueryAudit(ctx context.Context, query AuditQuery) (AuditResult, error)
+}
+
+var _ Storage = (*Service)(nil)
+
+type consistentReadKey struct{}
+
+// WithConsistentRead marks reads of the context as strongly consistent: they must see every write acknowledged
+// before them. Caches in front of the storage are bypassed.
+func WithConsistentRead(ctx context.Context) context.Context {
+	return context.WithValue(ctx, consistentReadKey{}, true)
+}
+
+func IsConsistentRead(ctx context.Context) bool {
+	v, _ := ctx.Value(consistentReadKey{}).(bool)
+	return v
+}
+
 type Config struct {
 	MedicationTable string
+	AuditTable      string // Same key schema as the medication table, TTL on ExpiresAt
+	HistoryTable    string // Every state of medications, see history.go. Empty means history is not kept
+	OutboxTable     string // Change logs of owners, see changes.go. Empty means changes are not logged
+	UpgradeOnWrite  bool   // Rewrite items of an older schema when they are flagged as deleted, see encoding.go
+
+	HistoryRetention time.Duration // Zero means history items never expire
+	ChangeRetention  time.Duration // Zero means changes never expire
 }
 
 type Database interface {
 	GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(options *dynamodb.Options)) (*dynamodb.GetItemOutput, error)
 	PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(options *dynamodb.Options)) (*dynamodb.PutItemOutput, error)
+	UpdateItem(ctx context.Context, params *dynamodb.UpdateItemInput, optFns ...func(options *dynamodb.Options)) (*dynamodb.UpdateItemOutput, error)
+	Query(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(options *dynamodb.Options)) (*dynamodb.QueryOutput, error)
+	Scan(ctx context.Context, params *dynamodb.ScanInput, optFns ...func(options *dynamodb.Options)) (*dynamodb.ScanOutput, error)
+	BatchWriteItem(ctx context.Context, params *dynamodb.BatchWriteItemInput, optFns ...func(options *dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error)
+	TransactWriteItems(ctx context.Context, params *dynamodb.TransactWriteItemsInput, optFns ...func(options *dynamodb.Options)) (*dynamodb.TransactWriteItemsOutput, error)
 }
 
 type Service struct {
 	cfg      Config
 	database Database
+	cipher   Cipher // Optional, see WithCipher
 }
 
 func NewService(cfg Config, database Database) *Service {
@@ -26,3 +112,18 @@ func NewService(cfg Config, database Database) *Service {
 		database: database,
 	}
 }
+
+// Ping checks the table is reachable by reading an item that never exists. Unlike DescribeTable it exercises
+// the same permissions and the same capacity as regular requests and doesn't hit the control plane rate limits.
+func (s *Service) Ping(ctx context.Context) error {
+	if _, err := s.database.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.cfg.MedicationTable),
+		Key: map[string]types.AttributeValue{
+			"PK": &types.AttributeValueMemberS{Value: "#ping"},
+			"SK": &types.AttributeValueMemberS{Value: "ping"},
+		},
+	}); err != nil {
+		return fmt.Errorf("failed to get item: %w", err)
+	}
+	return nil
+}
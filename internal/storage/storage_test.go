@@ -1,10 +1,15 @@
 package storage
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"io"
 	"log"
+	"os"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -20,178 +25,665 @@ import (
 	"github.com/chestnut42/test-medication/internal/model"
 )
 
-func TestStorage(t *testing.T) {
-	// Create a logger that discards all logs (silences testcontainers-go)
-	noopLogger := log.New(io.Discard, "", 0)
-
-	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
-	defer cancel()
+var (
+	clientOnce sync.Once
+	client     *dynamodb.Client
+	clientErr  error
+	container  *tcdynamodb.DynamoDBContainer
+)
 
-	// Running a container
-	ctr, err := tcdynamodb.Run(ctx, "amazon/dynamodb-local:2.6.1",
-		testcontainers.WithWaitStrategy(wait.ForListeningPort("8000/tcp")),
-		testcontainers.WithLogger(noopLogger)) // Remove this to debug containers
-	if err != nil {
-		t.Fatalf("failed to start dynamodb container: %v", err)
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if container != nil {
+		if err := testcontainers.TerminateContainer(container); err != nil {
+			log.Printf("failed to terminate container: %s", err)
+		}
 	}
-	defer func() {
-		if err := testcontainers.TerminateContainer(ctr); err != nil {
-			t.Logf("failed to terminate container: %s", err)
+	os.Exit(code)
+}
+
+// testClient starts DynamoDB Local on first use, so tests that don't need it don't require Docker.
+func testClient(t *testing.T) *dynamodb.Client {
+	t.Helper()
+	clientOnce.Do(func() {
+		// Create a logger that discards all logs (silences testcontainers-go)
+		noopLogger := log.New(io.Discard, "", 0)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+
+		// Running a container
+		container, clientErr = tcdynamodb.Run(ctx, "amazon/dynamodb-local:2.6.1",
+			testcontainers.WithWaitStrategy(wait.ForListeningPort("8000/tcp")),
+			testcontainers.WithLogger(noopLogger)) // Remove this to debug containers
+		if clientErr != nil {
+			clientErr = fmt.Errorf("failed to start dynamodb container: %w", clientErr)
+			return
 		}
-	}()
 
-	// Creating dynamo client
-	endPoint, err := ctr.PortEndpoint(ctx, "8000/tcp", "http")
-	if err != nil {
-		t.Fatalf("failed to get port endpoint: %v", err)
+		// Creating dynamo client
+		endPoint, err := container.PortEndpoint(ctx, "8000/tcp", "http")
+		if err != nil {
+			clientErr = fmt.Errorf("failed to get port endpoint: %w", err)
+			return
+		}
+
+		cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion("localhost"))
+		if err != nil {
+			clientErr = fmt.Errorf("failed to load config: %w", err)
+			return
+		}
+
+		client = dynamodb.NewFromConfig(cfg, func(o *dynamodb.Options) {
+			o.BaseEndpoint = aws.String(endPoint)
+			o.Credentials = credentials.NewStaticCredentialsProvider("dummy", "dummy", "")
+		})
+	})
+	if clientErr != nil {
+		t.Fatal(clientErr)
 	}
+	return client
+}
+
+var tableNameReplacer = strings.NewReplacer("/", "_", " ", "_")
+
+// newTestService creates a separate table for each test so that tests do not interfere with each other.
+func newTestService(t *testing.T) *Service {
+	t.Helper()
+	client := testClient(t)
 
-	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion("localhost"))
+	tableName := tableNameReplacer.Replace(t.Name())
+	cfg := Config{
+		MedicationTable: tableName + "_table",
+		AuditTable:      tableName + "_audit",
+		HistoryTable:    tableName + "_history",
+		OutboxTable:     tableName + "_outbox",
+	}
+	// Tables are created the same way the service does it, DynamoDB Local doesn't support PITR
+	schema := NewSchema(client, Tables(cfg, false))
+	schema.pollInterval = 10 * time.Millisecond
+	drift, err := schema.Apply(t.Context())
 	if err != nil {
-		t.Fatalf("failed to load config: %v", err)
+		t.Fatalf("failed to create tables: %v", err)
+	}
+	if len(drift) > 0 {
+		t.Fatalf("tables are not up to date: %v", drift)
 	}
 
-	client := dynamodb.NewFromConfig(cfg, func(o *dynamodb.Options) {
-		o.BaseEndpoint = aws.String(endPoint)
-		o.Credentials = credentials.NewStaticCredentialsProvider("dummy", "dummy", "")
-	})
+	return NewService(cfg, client)
+}
 
+// Backend independent behaviour is checked by the conformance suite, see conformance_test.go.
+func TestStorage(t *testing.T) {
 	tests := []struct {
 		name string
 		test func(t *testing.T, ctx context.Context, service *Service)
 	}{
-		{name: "testStorage_Create", test: testStorageCreate},
-		{name: "testStorage_Get", test: testStorageGet},
+		{name: "testStorage_Encryption", test: testStorageEncryption},
+		{name: "testStorage_Migration", test: testStorageMigration},
+		{name: "testStorage_Encoding", test: testStorageEncoding},
+		{name: "testStorage_History", test: testStorageHistory},
+		{name: "testStorage_MoveHistory", test: testStorageMoveHistory},
+		{name: "testStorage_ChangesExpired", test: testStorageChangesExpired},
 	}
 
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			// For each test we are creating a separate table so that tests do not interfere with each other
-			tableName := test.name + "_table"
-			if _, err := client.CreateTable(ctx, &dynamodb.CreateTableInput{
-				AttributeDefinitions: []types.AttributeDefinition{{
-					AttributeName: aws.String("PK"),
-					AttributeType: types.ScalarAttributeTypeS,
-				}, {
-					AttributeName: aws.String("SK"),
-					AttributeType: types.ScalarAttributeTypeS,
-				}},
-				KeySchema: []types.KeySchemaElement{{
-					AttributeName: aws.String("PK"),
-					KeyType:       types.KeyTypeHash,
-				}, {
-					AttributeName: aws.String("SK"),
-					KeyType:       types.KeyTypeRange,
-				}},
-				TableName:   aws.String(tableName),
-				BillingMode: types.BillingModePayPerRequest,
-			}); err != nil {
-				t.Fatalf("failed to create table: %s: %v", tableName, err)
-			}
-
-			cfg := Config{
-				MedicationTable: tableName,
-			}
-			svc := NewService(cfg, client)
-			test.test(t, ctx, svc)
+			test.test(t, t.Context(), newTestService(t))
 		})
 	}
 }
 
-func testStorageCreate(t *testing.T, ctx context.Context, service *Service) {
-	t.Run("happy create", func(t *testing.T) {
-		err := service.CreateMedication(ctx, model.Medication{
-			Identity: model.Identity{
-				Id:    "some id",
-				Owner: "owner",
-			},
+// fakeCipher is not secure, it only makes sure storage never sees the plaintext and respects the tenant, key id
+// and aad.
+type fakeCipher struct {
+	current string
+}
+
+func (f *fakeCipher) Encrypt(_ context.Context, tenant string, plaintext []byte, aad []byte) (string, []byte, error) {
+	ciphertext := append(append([]byte(tenant+"|"+f.current+"|"), aad...), '|')
+	for _, b := range plaintext {
+		ciphertext = append(ciphertext, b^0x5a)
+	}
+	return f.current, ciphertext, nil
+}
+
+func (f *fakeCipher) Decrypt(_ context.Context, tenant string, keyId string, ciphertext []byte, aad []byte) ([]byte, error) {
+	prefix := []byte(tenant + "|" + keyId + "|" + string(aad) + "|")
+	if !bytes.HasPrefix(ciphertext, prefix) {
+		return nil, errors.New("wrong tenant, key or aad")
+	}
+	var plaintext []byte
+	for _, b := range ciphertext[len(prefix):] {
+		plaintext = append(plaintext, b^0x5a)
+	}
+	return plaintext, nil
+}
+
+func (f *fakeCipher) CurrentKeyId(context.Context, string) (string, error) {
+	return f.current, nil
+}
+
+func testStorageEncryption(t *testing.T, ctx context.Context, service *Service) {
+	cipher := &fakeCipher{current: "k1"}
+	encrypted := service.WithCipher(cipher)
+
+	newMedication := func(id string) model.Medication {
+		return model.Medication{
+			Identity: model.Identity{Id: id, Owner: "owner", Tenant: "acme"},
 			MedicationData: model.MedicationData{
-				Name:   "my name",
-				Dosage: "dosage 500mg",
-				Form:   "Plasma",
+				Name:   "Paracetamol " + id,
+				Dosage: "500mg",
+				Form:   model.FormTablet,
+				Prescription: model.Prescription{
+					Indication: model.Indication{Text: "headache"},
+					Status:     model.StatusActive,
+				},
 			},
+			Version: "v1",
+		}
+	}
+	rawKeyId := func(t *testing.T, identity model.Identity) string {
+		t.Helper()
+		resp, err := service.database.GetItem(ctx, &dynamodb.GetItemInput{
+			TableName: aws.String(service.cfg.MedicationTable),
+			Key:       getKey(identity),
 		})
 		if err != nil {
-			t.Fatalf("failed to create medication: %v", err)
+			t.Fatalf("failed to get item: %v", err)
+		}
+		for _, name := range sensitiveAttributes {
+			if _, ok := resp.Item[name]; ok {
+				t.Fatalf("%s is stored in plaintext", name)
+			}
+		}
+		item, err := decodeMedication(resp.Item)
+		if err != nil {
+			t.Fatalf("failed to decode item: %v", err)
+		}
+		if item.Encrypted == nil {
+			t.Fatal("item is not encrypted")
+		}
+		return item.Encrypted.KeyId
+	}
+
+	legacy := newMedication("legacy")
+	if err := service.CreateMedication(ctx, legacy); err != nil {
+		t.Fatalf("failed to create: %v", err)
+	}
+	created := newMedication("created")
+	if err := encrypted.CreateMedication(ctx, created); err != nil {
+		t.Fatalf("failed to create: %v", err)
+	}
+
+	t.Run("written encrypted", func(t *testing.T) {
+		if got := rawKeyId(t, created.Identity); got != "k1" {
+			t.Fatalf("encrypted with %s, expected k1", got)
+		}
+		got, err := encrypted.GetMedication(ctx, created.Identity)
+		if err != nil {
+			t.Fatalf("failed to get: %v", err)
+		}
+		if got != created {
+			t.Fatalf("got %+v, expected %+v", got, created)
 		}
 	})
 
-	t.Run("already exists", func(t *testing.T) {
-		err := service.CreateMedication(ctx, model.Medication{
-			Identity: model.Identity{
-				Id:    "some id", // the same id
-				Owner: "owner",
-			},
-			MedicationData: model.MedicationData{
-				Name:   "my other name",
-				Dosage: "other dosage 500mg",
-				Form:   "Liquid",
-			},
-		})
-		if !errors.Is(err, ErrAlreadyExists) {
-			t.Fatalf("creating medication with existing id: want: %v got: %v", ErrAlreadyExists, err)
+	t.Run("plaintext encrypted on read", func(t *testing.T) {
+		got, err := encrypted.GetMedication(ctx, legacy.Identity)
+		if err != nil {
+			t.Fatalf("failed to get: %v", err)
+		}
+		if got != legacy {
+			t.Fatalf("got %+v, expected %+v", got, legacy)
+		}
+		if got := rawKeyId(t, legacy.Identity); got != "k1" {
+			t.Fatalf("encrypted with %s, expected k1", got)
+		}
+	})
+
+	t.Run("not readable without cipher", func(t *testing.T) {
+		if _, err := service.GetMedication(ctx, created.Identity); err == nil {
+			t.Fatal("encrypted medication is read without cipher")
+		}
+	})
+
+	t.Run("list", func(t *testing.T) {
+		res, err := encrypted.ListMedications(ctx, ListQuery{Tenant: "acme", Owner: "owner"})
+		if err != nil {
+			t.Fatalf("failed to list: %v", err)
+		}
+		if len(res.Medications) != 2 || res.Medications[0] != created || res.Medications[1] != legacy {
+			t.Fatalf("unexpected list: %+v", res.Medications)
+		}
+	})
+
+	t.Run("rotation", func(t *testing.T) {
+		cipher.current = "k2"
+		if _, err := encrypted.DeleteMedication(ctx, legacy.Identity); err != nil {
+			t.Fatalf("failed to delete: %v", err)
+		}
+
+		count, err := encrypted.ReencryptMedications(ctx)
+		if err != nil {
+			t.Fatalf("failed to re-encrypt: %v", err)
+		}
+		if count != 2 {
+			t.Fatalf("re-encrypted %d medications, expected 2", count)
+		}
+		for _, identity := range []model.Identity{created.Identity, legacy.Identity} {
+			if got := rawKeyId(t, identity); got != "k2" {
+				t.Fatalf("%s is encrypted with %s, expected k2", identity.Id, got)
+			}
+		}
+		if _, err := encrypted.GetMedication(ctx, legacy.Identity); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("deleted medication must stay deleted, got %v", err)
+		}
+
+		if count, err := encrypted.ReencryptMedications(ctx); err != nil || count != 0 {
+			t.Fatalf("second re-encryption: %d, %v", count, err)
+		}
+	})
+}
+
+func testStorageMigration(t *testing.T, ctx context.Context, service *Service) {
+	putLegacy := func(t *testing.T, id string) model.Medication {
+		t.Helper()
+		m := model.Medication{
+			Identity:       model.Identity{Id: id, Owner: "owner", Tenant: "acme"},
+			MedicationData: model.MedicationData{Name: "Paracetamol", Dosage: "500mg", Form: model.FormTablet},
+			Version:        "v1",
+		}
+		item := wrapMedication(m)
+		item.ListKey = "" // Created before ListIndex
+		av, err := encodeMedication(item)
+		if err != nil {
+			t.Fatalf("failed to encode: %v", err)
+		}
+		delete(av, "LK")
+		delete(av, schemaAttribute)
+		if _, err := service.database.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName: aws.String(service.cfg.MedicationTable),
+			Item:      av,
+		}); err != nil {
+			t.Fatalf("failed to put item: %v", err)
+		}
+		return m
+	}
+	listIds := func(t *testing.T) []string {
+		t.Helper()
+		res, err := service.ListMedications(ctx, ListQuery{Tenant: "acme", Owner: "owner"})
+		if err != nil {
+			t.Fatalf("failed to list: %v", err)
+		}
+		var ids []string
+		for _, m := range res.Medications {
+			ids = append(ids, m.Id)
+		}
+		return ids
+	}
+
+	for i := range 5 {
+		putLegacy(t, fmt.Sprintf("id%d", i))
+	}
+	opts := MigrationOptions{Segments: 2, PageSize: 2, CapacityPerSecond: 1000}
+
+	t.Run("dry run", func(t *testing.T) {
+		dryOpts := opts
+		dryOpts.DryRun = true
+		res, err := service.RunMigrations(ctx, dryOpts)
+		if err != nil {
+			t.Fatalf("failed to run migrations: %v", err)
+		}
+		if res[0].Scanned != 5 || res[0].Changed != 5 {
+			t.Fatalf("unexpected result: %+v", res[0])
+		}
+		if ids := listIds(t); len(ids) != 0 {
+			t.Fatalf("dry run has changed medications: %v", ids)
+		}
+		states, err := service.MigrationStatus(ctx)
+		if err != nil {
+			t.Fatalf("failed to get status: %v", err)
+		}
+		if states[0].Status != MigrationPending {
+			t.Fatalf("got status %s, expected %s", states[0].Status, MigrationPending)
 		}
 	})
 
-	// Okay to create the very same medication, but with the new id
-	t.Run("okay to create duplicate with different ID", func(t *testing.T) {
-		err := service.CreateMedication(ctx, model.Medication{
-			Identity: model.Identity{
-				Id:    "some id 2",
-				Owner: "owner",
+	t.Run("run", func(t *testing.T) {
+		res, err := service.RunMigrations(ctx, opts)
+		if err != nil {
+			t.Fatalf("failed to run migrations: %v", err)
+		}
+		if res[0].Scanned != 5 || res[0].Changed != 5 {
+			t.Fatalf("unexpected result: %+v", res[0])
+		}
+		if ids := listIds(t); strings.Join(ids, ",") != "id0,id1,id2,id3,id4" {
+			t.Fatalf("unexpected list after migration: %v", ids)
+		}
+
+		states, err := service.MigrationStatus(ctx)
+		if err != nil {
+			t.Fatalf("failed to get status: %v", err)
+		}
+		if states[0].Status != MigrationDone || states[0].Scanned != 5 || states[0].Changed != 5 {
+			t.Fatalf("unexpected state: %+v", states[0])
+		}
+
+		// Done migrations are not run again, even if there are items to migrate
+		putLegacy(t, "id5")
+		res, err = service.RunMigrations(ctx, opts)
+		if err != nil {
+			t.Fatalf("failed to run migrations: %v", err)
+		}
+		if res[0].Changed != 5 {
+			t.Fatalf("migration has run again: %+v", res[0])
+		}
+	})
+
+	t.Run("re-key", func(t *testing.T) {
+		rekey := Migration{
+			Id: "test-rekey",
+			Transform: func(item wrappedMedication) (wrappedMedication, bool, error) {
+				if strings.HasPrefix(item.SortKey, "med#") {
+					return item, false, nil
+				}
+				item.SortKey = "med#" + item.Id
+				return item, true, nil
 			},
-			MedicationData: model.MedicationData{
-				Name:   "my name",
-				Dosage: "dosage 500mg",
-				Form:   "Plasma",
+		}
+		res, err := service.runMigrations(ctx, []Migration{rekey}, opts)
+		if err != nil {
+			t.Fatalf("failed to run migrations: %v", err)
+		}
+		if res[0].Changed != 6 {
+			t.Fatalf("unexpected result: %+v", res[0])
+		}
+
+		resp, err := service.database.GetItem(ctx, &dynamodb.GetItemInput{
+			TableName: aws.String(service.cfg.MedicationTable),
+			Key: map[string]types.AttributeValue{
+				"PK": &types.AttributeValueMemberS{Value: getPartition(model.Identity{Id: "id0", Owner: "owner", Tenant: "acme"})},
+				"SK": &types.AttributeValueMemberS{Value: "med#id0"},
 			},
 		})
-		if err != nil {
-			t.Fatalf("failed to create medication: %v", err)
+		if err != nil || resp.Item == nil {
+			t.Fatalf("re-keyed item is not found: %v", err)
+		}
+		if _, err := service.GetMedication(ctx, model.Identity{Id: "id0", Owner: "owner", Tenant: "acme"}); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("old item is not deleted: %v", err)
+		}
+	})
+
+	t.Run("lease", func(t *testing.T) {
+		run := &migrationRun{s: service, migration: Migration{Id: "test-lease"}, runId: "first", segments: 1}
+		if _, err := run.acquire(ctx); err != nil {
+			t.Fatalf("failed to acquire: %v", err)
+		}
+		other := &migrationRun{s: service, migration: Migration{Id: "test-lease"}, runId: "second", segments: 1}
+		if _, err := other.acquire(ctx); !errors.Is(err, ErrMigrationRunning) {
+			t.Fatalf("got error: %v, expected: %v", err, ErrMigrationRunning)
 		}
 	})
 }
 
-func testStorageGet(t *testing.T, ctx context.Context, service *Service) {
-	expected := model.Medication{
-		Identity: model.Identity{
-			Id:    "42",
-			Owner: "owner",
-		},
-		MedicationData: model.MedicationData{
-			Name:   "my other name",
-			Dosage: "other dosage 500mg",
-			Form:   "Liquid",
-		},
-		Version: "some version",
-	}
-	err := service.CreateMedication(ctx, expected)
-	if err != nil {
-		t.Fatalf("failed to create medication: %v", err)
+func testStorageEncoding(t *testing.T, ctx context.Context, service *Service) {
+	putLegacy := func(t *testing.T, id string) model.Medication {
+		t.Helper()
+		m := model.Medication{
+			Identity:       model.Identity{Id: id, Owner: "owner", Tenant: "acme"},
+			MedicationData: model.MedicationData{Name: "Paracetamol", Dosage: "500mg", Form: model.FormTablet},
+			Version:        "v1",
+		}
+		av, err := encodeMedication(wrapMedication(m))
+		if err != nil {
+			t.Fatalf("failed to encode: %v", err)
+		}
+		delete(av, schemaAttribute) // Written before the schema attribute
+		if _, err := service.database.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName: aws.String(service.cfg.MedicationTable),
+			Item:      av,
+		}); err != nil {
+			t.Fatalf("failed to put item: %v", err)
+		}
+		return m
+	}
+	rawSchema := func(t *testing.T, identity model.Identity) (int, bool) {
+		t.Helper()
+		resp, err := service.database.GetItem(ctx, &dynamodb.GetItemInput{
+			TableName: aws.String(service.cfg.MedicationTable),
+			Key:       getKey(identity),
+		})
+		if err != nil {
+			t.Fatalf("failed to get item: %v", err)
+		}
+		item, err := decodeMedication(resp.Item)
+		if err != nil {
+			t.Fatalf("failed to decode item: %v", err)
+		}
+		return item.Schema, item.Deleted
 	}
 
-	t.Run("ok", func(t *testing.T) {
-		got, err := service.GetMedication(ctx, model.Identity{Id: "42", Owner: "owner"})
+	t.Run("legacy read", func(t *testing.T) {
+		m := putLegacy(t, "read")
+		got, err := service.GetMedication(ctx, m.Identity)
 		if err != nil {
-			t.Fatalf("failed to get medication: %v", err)
+			t.Fatalf("failed to get: %v", err)
+		}
+		if got != m {
+			t.Fatalf("got %+v, expected %+v", got, m)
 		}
-		if got != expected {
-			t.Fatalf("got: %v, expected: %v", got, expected)
+		if schema, _ := rawSchema(t, m.Identity); schema != 0 {
+			t.Fatalf("read has rewritten the item with schema %d", schema)
 		}
 	})
 
-	t.Run("not found id", func(t *testing.T) {
-		gotMed, err := service.GetMedication(ctx, model.Identity{Id: "43", Owner: "owner"})
-		if !errors.Is(err, ErrNotFound) {
-			t.Logf("got med: %v", gotMed)
-			t.Fatalf("got error: %v, expected: %v", err, ErrNotFound)
+	t.Run("written with current schema", func(t *testing.T) {
+		m := putLegacy(t, "update")
+		m.Name = "Ibuprofen"
+		if _, err := service.UpdateMedication(ctx, m.Version, m); err != nil {
+			t.Fatalf("failed to update: %v", err)
+		}
+		if schema, _ := rawSchema(t, m.Identity); schema != currentMedicationSchema {
+			t.Fatalf("got schema %d, expected %d", schema, currentMedicationSchema)
 		}
 	})
 
-	t.Run("not found owner", func(t *testing.T) {
-		_, err = service.GetMedication(ctx, model.Identity{Id: "42", Owner: "owner2"})
-		if !errors.Is(err, ErrNotFound) {
-			t.Fatalf("got error: %v, expected: %v", err, ErrNotFound)
+	t.Run("delete", func(t *testing.T) {
+		m := putLegacy(t, "delete")
+		if _, err := service.DeleteMedication(ctx, m.Identity); err != nil {
+			t.Fatalf("failed to delete: %v", err)
+		}
+		if schema, deleted := rawSchema(t, m.Identity); schema != 0 || !deleted {
+			t.Fatalf("got schema %d, deleted %v, expected legacy tombstone", schema, deleted)
 		}
 	})
+
+	t.Run("delete with upgrade on write", func(t *testing.T) {
+		upgrading := *service
+		upgrading.cfg.UpgradeOnWrite = true
+
+		m := putLegacy(t, "delete-upgrade")
+		if _, err := upgrading.DeleteMedication(ctx, m.Identity); err != nil {
+			t.Fatalf("failed to delete: %v", err)
+		}
+		if schema, deleted := rawSchema(t, m.Identity); schema != currentMedicationSchema || !deleted {
+			t.Fatalf("got schema %d, deleted %v, expected upgraded tombstone", schema, deleted)
+		}
+		if _, err := upgrading.GetMedication(ctx, m.Identity); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("got %v, expected %v", err, ErrNotFound)
+		}
+	})
+}
+
+func testStorageHistory(t *testing.T, ctx context.Context, service *Service) {
+	encrypted := service.WithCipher(&fakeCipher{current: "k1"})
+
+	m := model.Medication{
+		Identity:       model.Identity{Id: "history", Owner: "owner", Tenant: "acme"},
+		MedicationData: model.MedicationData{Name: "Paracetamol", Dosage: "500mg", Form: model.FormTablet},
+		Version:        "v1",
+	}
+	before := time.Now()
+	if err := encrypted.CreateMedication(ctx, m); err != nil {
+		t.Fatalf("failed to create: %v", err)
+	}
+	created := time.Now()
+	updated := m
+	updated.Name = "Ibuprofen"
+	updated.Version = "v2"
+	if _, err := encrypted.UpdateMedication(ctx, m.Version, updated); err != nil {
+		t.Fatalf("failed to update: %v", err)
+	}
+	changed := time.Now()
+	if _, err := encrypted.DeleteMedication(ctx, m.Identity); err != nil {
+		t.Fatalf("failed to delete: %v", err)
+	}
+
+	// Rejected changes don't get to history
+	if err := encrypted.CreateMedication(ctx, m); !errors.Is(err, ErrAlreadyExists) {
+		t.Fatalf("got %v, expected %v", err, ErrAlreadyExists)
+	}
+	if _, err := encrypted.UpdateMedication(ctx, "v0", m); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("got %v, expected %v", err, ErrNotFound)
+	}
+
+	if _, err := encrypted.MedicationAt(ctx, m.Identity, before.Add(-time.Second)); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("got %v, expected %v", err, ErrNotFound)
+	}
+	tests := []struct {
+		name     string
+		at       time.Time
+		expected model.Medication
+		deleted  bool
+	}{
+		{name: "created", at: created, expected: m},
+		{name: "updated", at: changed, expected: updated},
+		{name: "deleted", at: time.Now(), expected: updated, deleted: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := encrypted.MedicationAt(ctx, m.Identity, test.at)
+			if err != nil {
+				t.Fatalf("failed to get history: %v", err)
+			}
+			if got.Medication != test.expected || got.Deleted != test.deleted {
+				t.Fatalf("got %+v, expected %+v deleted %v", got, test.expected, test.deleted)
+			}
+			if got.Time.After(test.at) {
+				t.Fatalf("got the state written at %s, after %s", got.Time, test.at)
+			}
+		})
+	}
+
+	// Sensitive fields are encrypted in history too
+	if _, err := service.MedicationAt(ctx, m.Identity, time.Now()); err == nil {
+		t.Fatal("history is readable without cipher")
+	}
+}
+
+func testStorageMoveHistory(t *testing.T, ctx context.Context, service *Service) {
+	encrypted := service.WithCipher(&fakeCipher{current: "k1"})
+
+	m := model.Medication{
+		Identity:       model.Identity{Id: "moved", Owner: "owner", Tenant: "acme"},
+		MedicationData: model.MedicationData{Name: "Paracetamol", Dosage: "500mg", Form: model.FormTablet},
+		Version:        "v1",
+	}
+	if err := encrypted.CreateMedication(ctx, m); err != nil {
+		t.Fatalf("failed to create: %v", err)
+	}
+	created := time.Now()
+	updated := m
+	updated.Name = "Ibuprofen"
+	updated.Version = "v2"
+	if _, err := encrypted.UpdateMedication(ctx, m.Version, updated); err != nil {
+		t.Fatalf("failed to update: %v", err)
+	}
+
+	// Another tenant, so the medication and its history are re-encrypted with its data key and another aad
+	target := model.Identity{Id: "moved", Owner: "other", Tenant: "globex"}
+	if _, err := encrypted.MoveMedication(ctx, m.Identity, target, CollisionFail); err != nil {
+		t.Fatalf("failed to move: %v", err)
+	}
+
+	current, err := encrypted.GetMedication(ctx, target)
+	if err != nil {
+		t.Fatalf("failed to get: %v", err)
+	}
+	expected := updated
+	expected.Identity = target
+	if current != expected {
+		t.Fatalf("got %+v, expected %+v", current, expected)
+	}
+	var moved *MovedError
+	if _, err := encrypted.GetMedication(ctx, m.Identity); !errors.As(err, &moved) || moved.Target != target {
+		t.Fatalf("got %v, expected a redirect to %+v", err, target)
+	}
+
+	got, err := encrypted.MedicationAt(ctx, target, created)
+	if err != nil {
+		t.Fatalf("failed to get history: %v", err)
+	}
+	expected = m
+	expected.Identity = target
+	if got.Medication != expected {
+		t.Fatalf("got %+v, expected %+v", got.Medication, expected)
+	}
+	got, err = encrypted.MedicationAt(ctx, m.Identity, time.Now())
+	if err != nil {
+		t.Fatalf("failed to get history: %v", err)
+	}
+	if !got.Deleted || got.Medication != updated {
+		t.Fatalf("got %+v, expected the deleted %+v", got, updated)
+	}
+}
+
+func testStorageChangesExpired(t *testing.T, ctx context.Context, service *Service) {
+	encrypted := service.WithCipher(&fakeCipher{current: "k1"})
+
+	var created []model.Medication
+	for _, id := range []string{"a", "b", "c"} {
+		m := model.Medication{
+			Identity:       model.Identity{Id: id, Owner: "owner", Tenant: "acme"},
+			MedicationData: model.MedicationData{Name: "Paracetamol", Dosage: "500mg", Form: model.FormTablet},
+			Version:        "v1",
+		}
+		if err := encrypted.CreateMedication(ctx, m); err != nil {
+			t.Fatalf("failed to create: %v", err)
+		}
+		created = append(created, m)
+	}
+
+	// Encrypted fields of changes are decrypted with the medication's aad
+	res, err := encrypted.ListChanges(ctx, ChangesQuery{Tenant: "acme", Owner: "owner", After: 1, Limit: 10})
+	if err != nil {
+		t.Fatalf("failed to list changes: %v", err)
+	}
+	if len(res.Changes) != 2 || res.Changes[0].Medication != created[1] || res.Changes[1].Medication != created[2] {
+		t.Fatalf("got %+v, expected the last two medications", res.Changes)
+	}
+
+	// Expired by TTL
+	if err := service.batchWriteTable(ctx, service.cfg.OutboxTable, []types.WriteRequest{{
+		DeleteRequest: &types.DeleteRequest{Key: map[string]types.AttributeValue{
+			"PK": &types.AttributeValueMemberS{Value: getListKey("acme", "owner")},
+			"SK": &types.AttributeValueMemberS{Value: getChangeSortKey(2)},
+		}},
+	}}); err != nil {
+		t.Fatalf("failed to delete change: %v", err)
+	}
+	for _, after := range []int64{0, 1} {
+		_, err := encrypted.ListChanges(ctx, ChangesQuery{Tenant: "acme", Owner: "owner", After: after, Limit: 10})
+		if !errors.Is(err, ErrChangesExpired) {
+			t.Fatalf("after %d got error: %v, expected: %v", after, err, ErrChangesExpired)
+		}
+	}
+	res, err = encrypted.ListChanges(ctx, ChangesQuery{Tenant: "acme", Owner: "owner", After: 2, Limit: 10})
+	if err != nil {
+		t.Fatalf("failed to list changes: %v", err)
+	}
+	if len(res.Changes) != 1 || res.Changes[0].Seq != 3 {
+		t.Fatalf("got %+v, expected the last change", res.Changes)
+	}
 }
@@ -0,0 +1,930 @@
+package storagetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chestnut42/test-medication/internal/model"
+	"github.com/chestnut42/test-medication/internal/storage"
+)
+
+// Run checks a backend against the storage.Storage contract. newStorage must return an empty storage on every call.
+func Run(t *testing.T, newStorage func(t *testing.T) storage.Storage) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, ctx context.Context, service storage.Storage)
+	}{
+		{name: "testStorage_Create", test: testStorageCreate},
+		{name: "testStorage_Get", test: testStorageGet},
+		{name: "testStorage_Update", test: testStorageUpdate},
+		{name: "testStorage_Delete", test: testStorageDelete},
+		{name: "testStorage_List", test: testStorageList},
+		{name: "testStorage_Move", test: testStorageMove},
+		{name: "testStorage_Search", test: testStorageSearch},
+		{name: "testStorage_Changes", test: testStorageChanges},
+		{name: "testStorage_Tenant", test: testStorageTenant},
+		{name: "testStorage_APIKey", test: testStorageAPIKey},
+		{name: "testStorage_RateBucket", test: testStorageRateBucket},
+		{name: "testStorage_Audit", test: testStorageAudit},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.test(t, t.Context(), newStorage(t))
+		})
+	}
+}
+
+func testStorageCreate(t *testing.T, ctx context.Context, service storage.Storage) {
+	t.Run("happy create", func(t *testing.T) {
+		err := service.CreateMedication(ctx, model.Medication{
+			Identity: model.Identity{
+				Id:    "some id",
+				Owner: "owner",
+			},
+			MedicationData: model.MedicationData{
+				Name:   "my name",
+				Dosage: "dosage 500mg",
+				Form:   "Plasma",
+			},
+		})
+		if err != nil {
+			t.Fatalf("failed to create medication: %v", err)
+		}
+	})
+
+	t.Run("already exists", func(t *testing.T) {
+		err := service.CreateMedication(ctx, model.Medication{
+			Identity: model.Identity{
+				Id:    "some id", // the same id
+				Owner: "owner",
+			},
+			MedicationData: model.MedicationData{
+				Name:   "my other name",
+				Dosage: "other dosage 500mg",
+				Form:   "Liquid",
+			},
+		})
+		if !errors.Is(err, storage.ErrAlreadyExists) {
+			t.Fatalf("creating medication with existing id: want: %v got: %v", storage.ErrAlreadyExists, err)
+		}
+	})
+
+	// Okay to create the very same medication, but with the new id
+	t.Run("okay to create duplicate with different ID", func(t *testing.T) {
+		err := service.CreateMedication(ctx, model.Medication{
+			Identity: model.Identity{
+				Id:    "some id 2",
+				Owner: "owner",
+			},
+			MedicationData: model.MedicationData{
+				Name:   "my name",
+				Dosage: "dosage 500mg",
+				Form:   "Plasma",
+			},
+		})
+		if err != nil {
+			t.Fatalf("failed to create medication: %v", err)
+		}
+	})
+}
+
+func testStorageGet(t *testing.T, ctx context.Context, service storage.Storage) {
+	expected := model.Medication{
+		Identity: model.Identity{
+			Id:    "42",
+			Owner: "owner",
+		},
+		MedicationData: model.MedicationData{
+			Name:   "my other name",
+			Dosage: "other dosage 500mg",
+			Form:   "Liquid",
+		},
+		Version: "some version",
+	}
+	err := service.CreateMedication(ctx, expected)
+	if err != nil {
+		t.Fatalf("failed to create medication: %v", err)
+	}
+
+	t.Run("ok", func(t *testing.T) {
+		got, err := service.GetMedication(ctx, model.Identity{Id: "42", Owner: "owner"})
+		if err != nil {
+			t.Fatalf("failed to get medication: %v", err)
+		}
+		if got != expected {
+			t.Fatalf("got: %v, expected: %v", got, expected)
+		}
+	})
+
+	t.Run("not found id", func(t *testing.T) {
+		gotMed, err := service.GetMedication(ctx, model.Identity{Id: "43", Owner: "owner"})
+		if !errors.Is(err, storage.ErrNotFound) {
+			t.Logf("got med: %v", gotMed)
+			t.Fatalf("got error: %v, expected: %v", err, storage.ErrNotFound)
+		}
+	})
+
+	t.Run("not found owner", func(t *testing.T) {
+		_, err = service.GetMedication(ctx, model.Identity{Id: "42", Owner: "owner2"})
+		if !errors.Is(err, storage.ErrNotFound) {
+			t.Fatalf("got error: %v, expected: %v", err, storage.ErrNotFound)
+		}
+	})
+}
+
+func testStorageUpdate(t *testing.T, ctx context.Context, service storage.Storage) {
+	created := model.Medication{
+		Identity: model.Identity{Id: "42", Owner: "owner"},
+		MedicationData: model.MedicationData{
+			Name:   "name",
+			Dosage: "500mg",
+			Form:   "tablet",
+		},
+		Version: "v1",
+	}
+	if err := service.CreateMedication(ctx, created); err != nil {
+		t.Fatalf("failed to create medication: %v", err)
+	}
+
+	updated := created
+	updated.Version = "v2"
+	updated.Dosage = "250mg"
+	updated.Status = model.StatusPaused
+
+	t.Run("ok", func(t *testing.T) {
+		got, err := service.UpdateMedication(ctx, "v1", updated)
+		if err != nil {
+			t.Fatalf("failed to update medication: %v", err)
+		}
+		if got != updated {
+			t.Fatalf("got: %v, expected: %v", got, updated)
+		}
+
+		stored, err := service.GetMedication(ctx, created.Identity)
+		if err != nil {
+			t.Fatalf("failed to get medication: %v", err)
+		}
+		if stored != updated {
+			t.Fatalf("got: %v, expected: %v", stored, updated)
+		}
+	})
+
+	t.Run("version mismatch", func(t *testing.T) {
+		again := updated
+		again.Version = "v3"
+		_, err := service.UpdateMedication(ctx, "v1", again)
+		if !errors.Is(err, storage.ErrVersionMismatch) {
+			t.Fatalf("got error: %v, expected: %v", err, storage.ErrVersionMismatch)
+		}
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		missing := updated
+		missing.Id = "43"
+		_, err := service.UpdateMedication(ctx, "v1", missing)
+		if !errors.Is(err, storage.ErrNotFound) {
+			t.Fatalf("got error: %v, expected: %v", err, storage.ErrNotFound)
+		}
+	})
+}
+
+func testStorageDelete(t *testing.T, ctx context.Context, service storage.Storage) {
+	created := model.Medication{
+		Identity: model.Identity{Id: "42", Owner: "owner"},
+		MedicationData: model.MedicationData{
+			Name:   "name",
+			Dosage: "500mg",
+			Form:   "tablet",
+		},
+		Version: "v1",
+	}
+	if err := service.CreateMedication(ctx, created); err != nil {
+		t.Fatalf("failed to create medication: %v", err)
+	}
+
+	deleted, err := service.DeleteMedication(ctx, created.Identity)
+	if err != nil {
+		t.Fatalf("failed to delete medication: %v", err)
+	}
+	if deleted != created {
+		t.Fatalf("got deleted: %v, expected: %v", deleted, created)
+	}
+
+	t.Run("get deleted", func(t *testing.T) {
+		_, err := service.GetMedication(ctx, created.Identity)
+		if !errors.Is(err, storage.ErrNotFound) {
+			t.Fatalf("got error: %v, expected: %v", err, storage.ErrNotFound)
+		}
+	})
+
+	t.Run("delete deleted", func(t *testing.T) {
+		_, err := service.DeleteMedication(ctx, created.Identity)
+		if !errors.Is(err, storage.ErrNotFound) {
+			t.Fatalf("got error: %v, expected: %v", err, storage.ErrNotFound)
+		}
+	})
+
+	t.Run("update deleted", func(t *testing.T) {
+		updated := created
+		updated.Version = "v2"
+		_, err := service.UpdateMedication(ctx, "v1", updated)
+		if !errors.Is(err, storage.ErrNotFound) {
+			t.Fatalf("got error: %v, expected: %v", err, storage.ErrNotFound)
+		}
+	})
+
+	t.Run("create deleted", func(t *testing.T) {
+		err := service.CreateMedication(ctx, created)
+		if !errors.Is(err, storage.ErrAlreadyExists) {
+			t.Fatalf("got error: %v, expected: %v", err, storage.ErrAlreadyExists)
+		}
+	})
+
+	t.Run("delete missing", func(t *testing.T) {
+		_, err := service.DeleteMedication(ctx, model.Identity{Id: "43", Owner: "owner"})
+		if !errors.Is(err, storage.ErrNotFound) {
+			t.Fatalf("got error: %v, expected: %v", err, storage.ErrNotFound)
+		}
+	})
+}
+
+func testStorageMove(t *testing.T, ctx context.Context, service storage.Storage) {
+	newMedication := func(owner string, id string, name string) model.Medication {
+		m := model.Medication{
+			Identity:       model.Identity{Id: id, Owner: owner, Tenant: "acme"},
+			MedicationData: model.MedicationData{Name: name, Dosage: "500mg", Form: "tablet"},
+			Version:        "v-" + owner + "-" + id,
+		}
+		if err := service.CreateMedication(ctx, m); err != nil {
+			t.Fatalf("failed to create medication: %v", err)
+		}
+		return m
+	}
+	expectGet := func(t *testing.T, identity model.Identity, expected model.Medication) {
+		t.Helper()
+		got, err := service.GetMedication(ctx, identity)
+		if err != nil {
+			t.Fatalf("failed to get medication: %v", err)
+		}
+		if got != expected {
+			t.Fatalf("got %+v, expected %+v", got, expected)
+		}
+	}
+	expectMoved := func(t *testing.T, identity model.Identity, target model.Identity) {
+		t.Helper()
+		_, err := service.GetMedication(ctx, identity)
+		var moved *storage.MovedError
+		if !errors.As(err, &moved) || !errors.Is(err, storage.ErrNotFound) {
+			t.Fatalf("got error: %v, expected moved and %v", err, storage.ErrNotFound)
+		}
+		if moved.Target != target {
+			t.Fatalf("got moved to %v, expected %v", moved.Target, target)
+		}
+	}
+
+	t.Run("move", func(t *testing.T) {
+		source := newMedication("from", "1", "Paracetamol")
+		target := model.Identity{Id: "1", Owner: "to", Tenant: "other"}
+
+		moved, err := service.MoveMedication(ctx, source.Identity, target, storage.CollisionFail)
+		if err != nil {
+			t.Fatalf("failed to move medication: %v", err)
+		}
+		expected := source
+		expected.Identity = target
+		if moved != expected {
+			t.Fatalf("got moved %+v, expected %+v", moved, expected)
+		}
+		expectGet(t, target, expected)
+		expectMoved(t, source.Identity, target)
+
+		if _, err := service.MoveMedication(ctx, source.Identity, target, storage.CollisionFail); !errors.Is(err, storage.ErrNotFound) {
+			t.Fatalf("moving again got error: %v, expected: %v", err, storage.ErrNotFound)
+		}
+		if _, err := service.UpdateMedication(ctx, source.Version, source); !errors.Is(err, storage.ErrNotFound) {
+			t.Fatalf("updating moved got error: %v, expected: %v", err, storage.ErrNotFound)
+		}
+		if err := service.CreateMedication(ctx, source); !errors.Is(err, storage.ErrAlreadyExists) {
+			t.Fatalf("creating moved got error: %v, expected: %v", err, storage.ErrAlreadyExists)
+		}
+		res, err := service.ListMedications(ctx, storage.ListQuery{Tenant: "acme", Owner: "from"})
+		if err != nil {
+			t.Fatalf("failed to list medications: %v", err)
+		}
+		if len(res.Medications) != 0 {
+			t.Fatalf("got %d medications of the source owner, expected none", len(res.Medications))
+		}
+	})
+
+	tests := []struct {
+		name      string
+		collision storage.Collision
+		err       error
+		keeps     string // Which one the target is after the move, empty if nothing is changed
+	}{
+		{name: "collision fail", collision: storage.CollisionFail, err: storage.ErrAlreadyExists},
+		{name: "collision keep target", collision: storage.CollisionKeepTarget, keeps: "target"},
+		{name: "collision keep source", collision: storage.CollisionKeepSource, keeps: "source"},
+	}
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			id := fmt.Sprintf("collision-%d", i)
+			source := newMedication("from", id, "Paracetamol")
+			target := newMedication("to", id, "Ibuprofen")
+
+			moved, err := service.MoveMedication(ctx, source.Identity, target.Identity, test.collision)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("got error: %v, expected: %v", err, test.err)
+			}
+			switch test.keeps {
+			case "":
+				expectGet(t, source.Identity, source)
+				expectGet(t, target.Identity, target)
+			case "target":
+				if moved != target {
+					t.Fatalf("got moved %+v, expected %+v", moved, target)
+				}
+				expectGet(t, target.Identity, target)
+				expectMoved(t, source.Identity, target.Identity)
+			case "source":
+				expected := source
+				expected.Identity = target.Identity
+				if moved != expected {
+					t.Fatalf("got moved %+v, expected %+v", moved, expected)
+				}
+				expectGet(t, target.Identity, expected)
+				expectMoved(t, source.Identity, target.Identity)
+			}
+		})
+	}
+}
+
+func testStorageList(t *testing.T, ctx context.Context, service storage.Storage) {
+	statuses := []model.Status{
+		model.StatusActive, model.StatusPaused, model.StatusDiscontinued, model.StatusActive, model.StatusCompleted,
+	}
+	for i, st := range statuses {
+		for _, owner := range []string{"owner", "other owner"} {
+			if err := service.CreateMedication(ctx, model.Medication{
+				Identity: model.Identity{Id: fmt.Sprintf("id%d", i), Owner: owner},
+				MedicationData: model.MedicationData{
+					Name:         "name",
+					Dosage:       "500mg",
+					Form:         "tablet",
+					Prescription: model.Prescription{Status: st},
+				},
+				Version: "v1",
+			}); err != nil {
+				t.Fatalf("failed to create medication: %v", err)
+			}
+		}
+	}
+	if _, err := service.DeleteMedication(ctx, model.Identity{Id: "id3", Owner: "owner"}); err != nil {
+		t.Fatalf("failed to delete medication: %v", err)
+	}
+
+	listAll := func(t *testing.T, query storage.ListQuery) []string {
+		var ids []string
+		for {
+			res, err := service.ListMedications(ctx, query)
+			if err != nil {
+				t.Fatalf("failed to list medications: %v", err)
+			}
+			for _, m := range res.Medications {
+				if m.Owner != query.Owner {
+					t.Fatalf("got medication of %s, expected %s", m.Owner, query.Owner)
+				}
+				ids = append(ids, m.Id)
+			}
+			if res.Cursor == "" {
+				return ids
+			}
+			query.Cursor = res.Cursor
+		}
+	}
+
+	t.Run("all", func(t *testing.T) {
+		got := listAll(t, storage.ListQuery{Owner: "owner", Limit: 2})
+		if want := []string{"id0", "id1", "id2", "id4"}; !slices.Equal(got, want) {
+			t.Fatalf("got: %v, expected: %v", got, want)
+		}
+	})
+
+	t.Run("by status", func(t *testing.T) {
+		got := listAll(t, storage.ListQuery{
+			Owner:    "owner",
+			Statuses: []model.Status{model.StatusActive, model.StatusDiscontinued},
+			Limit:    2,
+		})
+		if want := []string{"id0", "id2"}; !slices.Equal(got, want) {
+			t.Fatalf("got: %v, expected: %v", got, want)
+		}
+	})
+
+	t.Run("foreign cursor", func(t *testing.T) {
+		res, err := service.ListMedications(ctx, storage.ListQuery{Owner: "other owner", Limit: 1})
+		if err != nil {
+			t.Fatalf("failed to list medications: %v", err)
+		}
+		_, err = service.ListMedications(ctx, storage.ListQuery{Owner: "owner", Cursor: res.Cursor})
+		if !errors.Is(err, storage.ErrBadCursor) {
+			t.Fatalf("got error: %v, expected: %v", err, storage.ErrBadCursor)
+		}
+	})
+}
+
+func testStorageSearch(t *testing.T, ctx context.Context, service storage.Storage) {
+	create := func(id string, name string, form model.Form) model.Medication {
+		m := model.Medication{
+			Identity:       model.Identity{Id: id, Owner: "owner", Tenant: "acme"},
+			MedicationData: model.MedicationData{Name: name, Dosage: "500mg", Form: form},
+			Version:        "v1",
+		}
+		if err := service.CreateMedication(ctx, m); err != nil {
+			t.Fatalf("failed to create medication: %v", err)
+		}
+		return m
+	}
+	create("id0", "Paracetamol 500mg", "tablet")
+	create("id1", "Paracetamol", "liquid")
+	updated := create("id2", "Ibuprofen", "tablet")
+	create("id3", "Co-codamol 30/500", "tablet")
+
+	// Stored times can be rounded to milliseconds
+	time.Sleep(5 * time.Millisecond)
+	since := time.Now()
+	time.Sleep(5 * time.Millisecond)
+	updated.Version = "v2"
+	if _, err := service.UpdateMedication(ctx, "v1", updated); err != nil {
+		t.Fatalf("failed to update medication: %v", err)
+	}
+
+	tests := []struct {
+		name  string
+		query storage.ListQuery
+		want  []string
+	}{
+		{name: "form", query: storage.ListQuery{Form: "tablet"}, want: []string{"id0", "id2", "id3"}},
+		{name: "name", query: storage.ListQuery{Name: "para"}, want: []string{"id0", "id1"}},
+		{name: "name words", query: storage.ListQuery{Name: "codamol 500"}, want: []string{"id3"}},
+		{name: "name typo", query: storage.ListQuery{Name: "ibuprfen"}, want: []string{"id2"}},
+		{name: "name and form", query: storage.ListQuery{Name: "para", Form: "liquid"}, want: []string{"id1"}},
+		{name: "updated since", query: storage.ListQuery{UpdatedSince: since}, want: []string{"id2"}},
+		{name: "nothing", query: storage.ListQuery{Name: "aspirin"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			query := test.query
+			query.Tenant = "acme"
+			query.Owner = "owner"
+			query.Limit = 1
+			var got []string
+			for {
+				res, err := service.ListMedications(ctx, query)
+				if err != nil {
+					t.Fatalf("failed to list medications: %v", err)
+				}
+				for _, m := range res.Medications {
+					got = append(got, m.Id)
+				}
+				if res.Cursor == "" {
+					break
+				}
+				query.Cursor = res.Cursor
+			}
+			if !slices.Equal(got, test.want) {
+				t.Fatalf("got: %v, expected: %v", got, test.want)
+			}
+		})
+	}
+}
+
+func testStorageChanges(t *testing.T, ctx context.Context, service storage.Storage) {
+	newMedication := func(owner string, id string, version string) model.Medication {
+		return model.Medication{
+			Identity:       model.Identity{Id: id, Owner: owner, Tenant: "acme"},
+			MedicationData: model.MedicationData{Name: "Paracetamol", Dosage: "500mg", Form: "tablet"},
+			Version:        version,
+		}
+	}
+	listAll := func(t *testing.T, owner string, after int64) []storage.Change {
+		t.Helper()
+		var changes []storage.Change
+		for {
+			res, err := service.ListChanges(ctx, storage.ChangesQuery{Tenant: "acme", Owner: owner, After: after, Limit: 2})
+			if err != nil {
+				t.Fatalf("failed to list changes: %v", err)
+			}
+			changes = append(changes, res.Changes...)
+			if len(res.Changes) == 0 {
+				return changes
+			}
+			after = res.Changes[len(res.Changes)-1].Seq
+		}
+	}
+
+	a := newMedication("owner", "a", "v1")
+	if err := service.CreateMedication(ctx, a); err != nil {
+		t.Fatalf("failed to create medication: %v", err)
+	}
+	if err := service.CreateMedication(ctx, newMedication("other", "b", "v1")); err != nil {
+		t.Fatalf("failed to create medication: %v", err)
+	}
+	updated := a
+	updated.Version = "v2"
+	updated.Dosage = "1g"
+	if _, err := service.UpdateMedication(ctx, "v1", updated); err != nil {
+		t.Fatalf("failed to update medication: %v", err)
+	}
+	c := newMedication("owner", "c", "v1")
+	if err := service.CreateMedication(ctx, c); err != nil {
+		t.Fatalf("failed to create medication: %v", err)
+	}
+	if _, err := service.DeleteMedication(ctx, a.Identity); err != nil {
+		t.Fatalf("failed to delete medication: %v", err)
+	}
+	movedTo := c
+	movedTo.Owner = "other"
+	if _, err := service.MoveMedication(ctx, c.Identity, movedTo.Identity, storage.CollisionFail); err != nil {
+		t.Fatalf("failed to move medication: %v", err)
+	}
+
+	t.Run("list", func(t *testing.T) {
+		expected := []storage.Change{
+			{Seq: 1, Medication: a},
+			{Seq: 2, Medication: updated},
+			{Seq: 3, Medication: c},
+			{Seq: 4, Medication: model.Medication{Identity: a.Identity, Version: "v2"}, Deleted: true},
+			{Seq: 5, Medication: model.Medication{Identity: c.Identity, Version: "v1"}, Deleted: true},
+		}
+		if got := listAll(t, "owner", 0); !slices.Equal(got, expected) {
+			t.Fatalf("got changes %+v, expected %+v", got, expected)
+		}
+		expected = []storage.Change{{Seq: 1, Medication: newMedication("other", "b", "v1")}, {Seq: 2, Medication: movedTo}}
+		if got := listAll(t, "other", 0); !slices.Equal(got, expected) {
+			t.Fatalf("got changes %+v, expected %+v", got, expected)
+		}
+		if got := listAll(t, "owner", 3); len(got) != 2 || got[0].Seq != 4 {
+			t.Fatalf("got changes %+v, expected the last two", got)
+		}
+		if got := listAll(t, "nobody", 0); len(got) != 0 {
+			t.Fatalf("got changes %+v, expected none", got)
+		}
+	})
+
+	t.Run("last", func(t *testing.T) {
+		res, err := service.ListChanges(ctx, storage.ChangesQuery{Tenant: "acme", Owner: "owner"})
+		if err != nil {
+			t.Fatalf("failed to list changes: %v", err)
+		}
+		if res.Last != 5 || len(res.Changes) != 0 {
+			t.Fatalf("got %+v, expected only the last change", res)
+		}
+		if _, err := service.ListChanges(ctx, storage.ChangesQuery{Tenant: "acme", Owner: "owner", After: 6, Limit: 10}); !errors.Is(err, storage.ErrChangesExpired) {
+			t.Fatalf("got error: %v, expected: %v", err, storage.ErrChangesExpired)
+		}
+	})
+
+	t.Run("wipe", func(t *testing.T) {
+		if _, err := service.WipeTenant(ctx, "acme"); err != nil {
+			t.Fatalf("failed to wipe tenant: %v", err)
+		}
+		for _, after := range []int64{0, 4, 5} {
+			_, err := service.ListChanges(ctx, storage.ChangesQuery{Tenant: "acme", Owner: "owner", After: after, Limit: 10})
+			if !errors.Is(err, storage.ErrChangesExpired) {
+				t.Fatalf("after %d got error: %v, expected: %v", after, err, storage.ErrChangesExpired)
+			}
+		}
+
+		// A client that starts over gets changes after the wipe
+		res, err := service.ListChanges(ctx, storage.ChangesQuery{Tenant: "acme", Owner: "owner"})
+		if err != nil {
+			t.Fatalf("failed to list changes: %v", err)
+		}
+		if err := service.CreateMedication(ctx, a); err != nil {
+			t.Fatalf("failed to create medication: %v", err)
+		}
+		got := listAll(t, "owner", res.Last)
+		if len(got) != 1 || got[0].Seq != res.Last+1 || got[0].Medication != a {
+			t.Fatalf("got changes %+v after %d, expected %+v", got, res.Last, a)
+		}
+	})
+}
+
+func testStorageTenant(t *testing.T, ctx context.Context, service storage.Storage) {
+	for _, tenant := range []string{"acme", "acme2", "other"} {
+		for i := range 30 { // More than a single BatchWriteItem
+			if err := service.CreateMedication(ctx, model.Medication{
+				Identity: model.Identity{Id: fmt.Sprintf("id%d", i), Owner: "owner", Tenant: tenant},
+				MedicationData: model.MedicationData{
+					Name:   "name",
+					Dosage: "500mg",
+					Form:   "tablet",
+				},
+				Version: "v1",
+			}); err != nil {
+				t.Fatalf("failed to create medication: %v", err)
+			}
+		}
+	}
+	if _, err := service.DeleteMedication(ctx, model.Identity{Id: "id0", Owner: "owner", Tenant: "acme"}); err != nil {
+		t.Fatalf("failed to delete medication: %v", err)
+	}
+
+	t.Run("tenants are isolated", func(t *testing.T) {
+		res, err := service.ListMedications(ctx, storage.ListQuery{Tenant: "acme2", Owner: "owner", Limit: 100})
+		if err != nil {
+			t.Fatalf("failed to list medications: %v", err)
+		}
+		if len(res.Medications) != 30 {
+			t.Fatalf("got %d medications, expected 30", len(res.Medications))
+		}
+	})
+
+	t.Run("settings", func(t *testing.T) {
+		_, err := service.GetTenantSettings(ctx, "acme")
+		if !errors.Is(err, storage.ErrNotFound) {
+			t.Fatalf("got error: %v, expected: %v", err, storage.ErrNotFound)
+		}
+
+		settings := model.TenantSettings{
+			Tenant:               "acme",
+			AllowedForms:         []model.Form{model.FormTablet},
+			StrictNameValidation: true,
+			RateLimit:            model.RateLimit{RequestsPerSecond: 10, Burst: 20},
+		}
+		if err := service.PutTenantSettings(ctx, settings); err != nil {
+			t.Fatalf("failed to put settings: %v", err)
+		}
+		got, err := service.GetTenantSettings(ctx, "acme")
+		if err != nil {
+			t.Fatalf("failed to get settings: %v", err)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(settings) {
+			t.Fatalf("got: %v, expected: %v", got, settings)
+		}
+	})
+
+	t.Run("export", func(t *testing.T) {
+		count, deleted := 0, 0
+		err := service.ExportTenant(ctx, "acme", func(m storage.ExportedMedication) error {
+			if m.Tenant != "acme" {
+				t.Fatalf("exported medication of %s", m.Tenant)
+			}
+			count++
+			if m.Deleted {
+				deleted++
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("failed to export: %v", err)
+		}
+		if count != 30 || deleted != 1 {
+			t.Fatalf("exported %d (%d deleted), expected 30 (1 deleted)", count, deleted)
+		}
+	})
+
+	t.Run("wipe", func(t *testing.T) {
+		n, err := service.WipeTenant(ctx, "acme")
+		if err != nil {
+			t.Fatalf("failed to wipe: %v", err)
+		}
+		if n != 30 {
+			t.Fatalf("wiped %d, expected 30", n)
+		}
+
+		for _, tenant := range []string{"acme", "acme2"} {
+			count := 0
+			if err := service.ExportTenant(ctx, tenant, func(storage.ExportedMedication) error {
+				count++
+				return nil
+			}); err != nil {
+				t.Fatalf("failed to export: %v", err)
+			}
+			if want := map[string]int{"acme": 0, "acme2": 30}[tenant]; count != want {
+				t.Fatalf("%s has %d medications, expected %d", tenant, count, want)
+			}
+		}
+
+		if _, err := service.GetTenantSettings(ctx, "acme"); err != nil {
+			t.Fatalf("settings must be kept: %v", err)
+		}
+	})
+}
+
+func testStorageAudit(t *testing.T, ctx context.Context, service storage.Storage) {
+	base := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	var records []model.AuditRecord
+	for i := 0; i < 30; i++ {
+		records = append(records, model.AuditRecord{
+			Time:         base.Add(time.Duration(i) * time.Second),
+			RequestId:    fmt.Sprintf("req-%d", i),
+			Tenant:       "acme",
+			Owner:        "owner",
+			MedicationId: []string{"a", "b", "c"}[i%3],
+			Action:       "medication.get",
+			Status:       200,
+		})
+	}
+	if err := service.WriteAudit(ctx, records, time.Hour); err != nil {
+		t.Fatalf("failed to write audit: %v", err)
+	}
+
+	t.Run("pages newest first", func(t *testing.T) {
+		query := storage.AuditQuery{Tenant: "acme", Owner: "owner", Limit: 7}
+		var got []model.AuditRecord
+		for pages := 0; ; pages++ {
+			if pages > 10 {
+				t.Fatal("too many pages")
+			}
+			res, err := service.QueryAudit(ctx, query)
+			if err != nil {
+				t.Fatalf("failed to query audit: %v", err)
+			}
+			got = append(got, res.Records...)
+			if res.Cursor == "" {
+				break
+			}
+			query.Cursor = res.Cursor
+		}
+		if len(got) != len(records) {
+			t.Fatalf("got %d records, expected %d", len(got), len(records))
+		}
+		for i, r := range got {
+			if want := records[len(records)-1-i].RequestId; r.RequestId != want {
+				t.Fatalf("record %d is %s, expected %s", i, r.RequestId, want)
+			}
+		}
+	})
+
+	t.Run("medication and time range", func(t *testing.T) {
+		res, err := service.QueryAudit(ctx, storage.AuditQuery{
+			Tenant:       "acme",
+			Owner:        "owner",
+			MedicationId: "b",
+			From:         base.Add(10 * time.Second),
+			To:           base.Add(20 * time.Second),
+		})
+		if err != nil {
+			t.Fatalf("failed to query audit: %v", err)
+		}
+		var ids []string
+		for _, r := range res.Records {
+			ids = append(ids, r.RequestId)
+		}
+		if want := "req-19,req-16,req-13,req-10"; strings.Join(ids, ",") != want {
+			t.Fatalf("got %v, expected %s", ids, want)
+		}
+	})
+
+	t.Run("other owner", func(t *testing.T) {
+		res, err := service.QueryAudit(ctx, storage.AuditQuery{Tenant: "acme", Owner: "other"})
+		if err != nil {
+			t.Fatalf("failed to query audit: %v", err)
+		}
+		if len(res.Records) != 0 {
+			t.Fatalf("got %d records of another owner", len(res.Records))
+		}
+	})
+
+	t.Run("bad cursor", func(t *testing.T) {
+		_, err := service.QueryAudit(ctx, storage.AuditQuery{Tenant: "acme", Owner: "owner", Cursor: "!!"})
+		if !errors.Is(err, storage.ErrBadCursor) {
+			t.Fatalf("expected bad cursor, got %v", err)
+		}
+	})
+}
+
+func testStorageAPIKey(t *testing.T, ctx context.Context, service storage.Storage) {
+	keys := []model.APIKey{
+		{Id: "k2", Tenant: "acme", Name: "second", SecretHash: "hash2", CreatedAt: time.Unix(200, 0).UTC()},
+		{Id: "k1", Tenant: "acme", Owner: "owner", Name: "first", SecretHash: "hash1", CreatedAt: time.Unix(100, 0).UTC()},
+		{Id: "k1", Tenant: "other", Name: "other", SecretHash: "hash3", CreatedAt: time.Unix(300, 0).UTC()},
+	}
+	for _, key := range keys {
+		if err := service.CreateAPIKey(ctx, key); err != nil {
+			t.Fatalf("failed to create api key: %v", err)
+		}
+	}
+
+	t.Run("already exists", func(t *testing.T) {
+		err := service.CreateAPIKey(ctx, keys[0])
+		if !errors.Is(err, storage.ErrAlreadyExists) {
+			t.Fatalf("got error: %v, expected: %v", err, storage.ErrAlreadyExists)
+		}
+	})
+
+	t.Run("get", func(t *testing.T) {
+		got, err := service.GetAPIKey(ctx, "acme", "k1")
+		if err != nil {
+			t.Fatalf("failed to get api key: %v", err)
+		}
+		if !got.CreatedAt.Equal(keys[1].CreatedAt) {
+			t.Fatalf("got created at: %v, expected: %v", got.CreatedAt, keys[1].CreatedAt)
+		}
+		got.CreatedAt = keys[1].CreatedAt
+		if got != keys[1] {
+			t.Fatalf("got: %v, expected: %v", got, keys[1])
+		}
+
+		_, err = service.GetAPIKey(ctx, "acme", "k3")
+		if !errors.Is(err, storage.ErrNotFound) {
+			t.Fatalf("got error: %v, expected: %v", err, storage.ErrNotFound)
+		}
+	})
+
+	t.Run("list", func(t *testing.T) {
+		got, err := service.ListAPIKeys(ctx, "acme")
+		if err != nil {
+			t.Fatalf("failed to list api keys: %v", err)
+		}
+		var ids []string
+		for _, key := range got {
+			ids = append(ids, key.Id)
+		}
+		if want := []string{"k1", "k2"}; !slices.Equal(ids, want) {
+			t.Fatalf("got: %v, expected: %v", ids, want)
+		}
+
+		got, err = service.ListAPIKeys(ctx, "nobody")
+		if err != nil {
+			t.Fatalf("failed to list api keys: %v", err)
+		}
+		if got == nil || len(got) != 0 {
+			t.Fatalf("got: %v, expected an empty list", got)
+		}
+	})
+
+	t.Run("revoke", func(t *testing.T) {
+		if err := service.RevokeAPIKey(ctx, "acme", "k1"); err != nil {
+			t.Fatalf("failed to revoke api key: %v", err)
+		}
+		got, err := service.GetAPIKey(ctx, "acme", "k1")
+		if err != nil {
+			t.Fatalf("failed to get api key: %v", err)
+		}
+		if !got.Revoked {
+			t.Fatal("api key is not revoked")
+		}
+		other, err := service.GetAPIKey(ctx, "other", "k1")
+		if err != nil {
+			t.Fatalf("failed to get api key: %v", err)
+		}
+		if other.Revoked {
+			t.Fatal("api key of another tenant is revoked")
+		}
+
+		err = service.RevokeAPIKey(ctx, "acme", "k3")
+		if !errors.Is(err, storage.ErrNotFound) {
+			t.Fatalf("got error: %v, expected: %v", err, storage.ErrNotFound)
+		}
+	})
+}
+
+func testStorageRateBucket(t *testing.T, ctx context.Context, service storage.Storage) {
+	empty, err := service.GetRateBucket(ctx, "key")
+	if err != nil {
+		t.Fatalf("failed to get bucket: %v", err)
+	}
+	if !empty.UpdatedAt.IsZero() || empty.Tokens != 0 {
+		t.Fatalf("got: %v, expected an empty bucket", empty)
+	}
+
+	first := storage.RateBucket{Tokens: 5, UpdatedAt: time.Unix(100, 123), ExpiresAt: time.Unix(200, 0)}
+	if err := service.PutRateBucket(ctx, "key", time.Time{}, first); err != nil {
+		t.Fatalf("failed to put bucket: %v", err)
+	}
+
+	t.Run("created concurrently", func(t *testing.T) {
+		err := service.PutRateBucket(ctx, "key", time.Time{}, first)
+		if !errors.Is(err, storage.ErrVersionMismatch) {
+			t.Fatalf("got error: %v, expected: %v", err, storage.ErrVersionMismatch)
+		}
+	})
+
+	t.Run("updated", func(t *testing.T) {
+		got, err := service.GetRateBucket(ctx, "key")
+		if err != nil {
+			t.Fatalf("failed to get bucket: %v", err)
+		}
+		if got.Tokens != first.Tokens || !got.UpdatedAt.Equal(first.UpdatedAt) {
+			t.Fatalf("got: %v, expected: %v", got, first)
+		}
+
+		second := storage.RateBucket{Tokens: 4, UpdatedAt: time.Unix(101, 0), ExpiresAt: time.Unix(201, 0)}
+		if err := service.PutRateBucket(ctx, "key", got.UpdatedAt, second); err != nil {
+			t.Fatalf("failed to put bucket: %v", err)
+		}
+		err = service.PutRateBucket(ctx, "key", got.UpdatedAt, second)
+		if !errors.Is(err, storage.ErrVersionMismatch) {
+			t.Fatalf("got error: %v, expected: %v", err, storage.ErrVersionMismatch)
+		}
+	})
+}
@@ -0,0 +1,194 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/expression"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"github.com/chestnut42/test-medication/internal/model"
+)
+
+const (
+	tenantSettingsSortKey = "settings"
+
+	// BatchWriteItem limit
+	maxBatchWrite = 25
+)
+
+// Tenant settings live in the same table. The partition starts with "#" which tenant ids never do,
+// so it can't clash with medications.
+type wrappedTenantSettings struct {
+	PartitionKey string `dynamodbav:"PK"`
+	SortKey      string `dynamodbav:"SK"`
+	model.TenantSettings
+}
+
+func getTenantSettingsPartition(tenant string) string {
+	return "#tenant#" + tenant
+}
+
+func getTenantSettingsKey(tenant string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"PK": &types.AttributeValueMemberS{Value: getTenantSettingsPartition(tenant)},
+		"SK": &types.AttributeValueMemberS{Value: tenantSettingsSortKey},
+	}
+}
+
+// GetTenantSettings returns ErrNotFound if the tenant has never been configured.
+func (s *Service) GetTenantSettings(ctx context.Context, tenant string) (model.TenantSettings, error) {
+	resp, err := s.database.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(s.cfg.MedicationTable),
+		Key:       getTenantSettingsKey(tenant),
+	})
+	if err != nil {
+		return model.TenantSettings{}, fmt.Errorf("failed to get item: %w", err)
+	}
+	if resp.Item == nil {
+		return model.TenantSettings{}, fmt.Errorf("tenant settings not found: %s, %w", tenant, ErrNotFound)
+	}
+
+	var item wrappedTenantSettings
+	if err = attributevalue.UnmarshalMap(resp.Item, &item); err != nil {
+		return model.TenantSettings{}, fmt.Errorf("failed to unmarshal item: %w", err)
+	}
+	return item.TenantSettings, nil
+}
+
+func (s *Service) PutTenantSettings(ctx context.Context, settings model.TenantSettings) error {
+	item, err := attributevalue.MarshalMap(wrappedTenantSettings{
+		PartitionKey:   getTenantSettingsPartition(settings.Tenant),
+		SortKey:        tenantSettingsSortKey,
+		TenantSettings: settings,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal item: %w", err)
+	}
+
+	if _, err := s.database.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.cfg.MedicationTable),
+		Item:      item,
+	}); err != nil {
+		return fmt.Errorf("failed to put item: %w", err)
+	}
+	return nil
+}
+
+type ExportedMedication struct {
+	model.Medication
+	Deleted bool
+}
+
+// ExportTenant calls fn for every medication of the tenant including deleted ones.
+// It scans the whole table, so it's meant for rare administrative tasks only.
+func (s *Service) ExportTenant(ctx context.Context, tenant string, fn func(ExportedMedication) error) error {
+	expr, err := expression.NewBuilder().
+		WithFilter(expression.Name("PK").BeginsWith(getTenantPrefix(tenant))).
+		Build()
+	if err != nil {
+		return fmt.Errorf("failed to build expression: %w", err)
+	}
+
+	paginator := dynamodb.NewScanPaginator(s.database, &dynamodb.ScanInput{
+		TableName:                 aws.String(s.cfg.MedicationTable),
+		FilterExpression:          expr.Filter(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+		ConsistentRead:            aws.Bool(true),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to scan: %w", err)
+		}
+
+		items, err := s.unmarshalMedications(ctx, page.Items)
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			if err := fn(ExportedMedication{Medication: item.Medication, Deleted: item.Deleted}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// WipeTenant physically deletes all medications of the tenant including tombstones. Settings are kept.
+// Changes are deleted too and every change log is reset, see wipeChanges. It's safe to re-run if interrupted.
+func (s *Service) WipeTenant(ctx context.Context, tenant string) (int, error) {
+	expr, err := expression.NewBuilder().
+		WithFilter(expression.Name("PK").BeginsWith(getTenantPrefix(tenant))).
+		WithProjection(expression.NamesList(expression.Name("PK"), expression.Name("SK"))).
+		Build()
+	if err != nil {
+		return 0, fmt.Errorf("failed to build expression: %w", err)
+	}
+
+	deleted := 0
+	paginator := dynamodb.NewScanPaginator(s.database, &dynamodb.ScanInput{
+		TableName:                 aws.String(s.cfg.MedicationTable),
+		FilterExpression:          expr.Filter(),
+		ProjectionExpression:      expr.Projection(),
+		ExpressionAttributeNames:  expr.Names(),
+		ExpressionAttributeValues: expr.Values(),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return deleted, fmt.Errorf("failed to scan: %w", err)
+		}
+
+		for start := 0; start < len(page.Items); start += maxBatchWrite {
+			chunk := page.Items[start:min(start+maxBatchWrite, len(page.Items))]
+			requests := make([]types.WriteRequest, 0, len(chunk))
+			for _, key := range chunk {
+				requests = append(requests, types.WriteRequest{DeleteRequest: &types.DeleteRequest{Key: key}})
+			}
+			if err := s.batchWrite(ctx, requests); err != nil {
+				return deleted, err
+			}
+			deleted += len(chunk)
+		}
+	}
+	return deleted, s.wipeChanges(ctx, tenant)
+}
+
+// batchWrite retries unprocessed items with exponential backoff as recommended by AWS.
+func (s *Service) batchWrite(ctx context.Context, requests []types.WriteRequest) error {
+	return s.batchWriteTable(ctx, s.cfg.MedicationTable, requests)
+}
+
+func (s *Service) batchWriteTable(ctx context.Context, table string, requests []types.WriteRequest) error {
+	const maxAttempts = 8
+
+	backoff := 50 * time.Millisecond
+	for attempt := 0; len(requests) > 0; attempt++ {
+		if attempt >= maxAttempts {
+			return fmt.Errorf("failed to write %d items after %d attempts", len(requests), maxAttempts)
+		}
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+
+		resp, err := s.database.BatchWriteItem(ctx, &dynamodb.BatchWriteItemInput{
+			RequestItems: map[string][]types.WriteRequest{table: requests},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to batch write: %w", err)
+		}
+		requests = resp.UnprocessedItems[table]
+	}
+	return nil
+}
@@ -0,0 +1,29 @@
+package storage
+
+import (
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/chestnut42/test-medication/internal/model"
+)
+
+// DynamoDB calls themselves are traced by AWS SDK instrumentation. Spans here group them per storage operation
+// and carry what the SDK doesn't know: whose data it is and how much capacity it cost.
+
+var tracer = otel.Tracer("github.com/chestnut42/test-medication/internal/storage")
+
+func identityAttributes(identity model.Identity) trace.SpanStartOption {
+	return trace.WithAttributes(
+		attribute.String("med.tenant", identity.Tenant),
+		attribute.String("med.owner", identity.Owner),
+		attribute.String("med.id", identity.Id))
+}
+
+func recordCapacity(span trace.Span, cc *types.ConsumedCapacity) {
+	if cc == nil || cc.CapacityUnits == nil {
+		return
+	}
+	span.SetAttributes(attribute.Float64("aws.dynamodb.consumed_capacity", *cc.CapacityUnits))
+}
@@ -0,0 +1,132 @@
+package tenant
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/chestnut42/test-medication/internal/model"
+	"github.com/chestnut42/test-medication/internal/storage"
+)
+
+// Tenant settings are read on every request, so they are cached in-process.
+// Settings changed through this service are invalidated immediately. Other replicas pick changes up
+// once their cache entry expires, thus cacheTTL is the maximum staleness.
+
+var ErrBadInput = errors.New("bad request")
+
+type Storage interface {
+	GetTenantSettings(ctx context.Context, tenant string) (model.TenantSettings, error)
+	PutTenantSettings(ctx context.Context, settings model.TenantSettings) error
+	ExportTenant(ctx context.Context, tenant string, fn func(storage.ExportedMedication) error) error
+	WipeTenant(ctx context.Context, tenant string) (int, error)
+}
+
+type Config struct {
+	CacheTTL time.Duration
+}
+
+type cacheEntry struct {
+	settings model.TenantSettings
+	expires  time.Time
+}
+
+type Service struct {
+	cfg   Config
+	store Storage
+
+	mu    sync.Mutex
+	cache map[string]cacheEntry
+	now   func() time.Time
+}
+
+func NewService(cfg Config, store Storage) *Service {
+	return &Service{
+		cfg:   cfg,
+		store: store,
+		cache: make(map[string]cacheEntry),
+		now:   time.Now,
+	}
+}
+
+// Settings returns tenant settings. Tenants that have never been configured get zero settings
+// (no restrictions), which is cached as well.
+func (s *Service) Settings(ctx context.Context, tenant string) (model.TenantSettings, error) {
+	s.mu.Lock()
+	entry, ok := s.cache[tenant]
+	s.mu.Unlock()
+	if ok && s.now().Before(entry.expires) {
+		return entry.settings, nil
+	}
+
+	settings, err := s.store.GetTenantSettings(ctx, tenant)
+	if err != nil {
+		if !errors.Is(err, storage.ErrNotFound) {
+			return model.TenantSettings{}, fmt.Errorf("getting tenant settings: %w", err)
+		}
+		settings = model.TenantSettings{Tenant: tenant}
+	}
+
+	s.mu.Lock()
+	s.cache[tenant] = cacheEntry{settings: settings, expires: s.now().Add(s.cfg.CacheTTL)}
+	s.mu.Unlock()
+	return settings, nil
+}
+
+func (s *Service) UpdateSettings(ctx context.Context, settings model.TenantSettings) error {
+	if err := validateSettings(settings); err != nil {
+		return err
+	}
+
+	if err := s.store.PutTenantSettings(ctx, settings); err != nil {
+		return fmt.Errorf("putting tenant settings: %w", err)
+	}
+	s.Invalidate(settings.Tenant)
+	return nil
+}
+
+// Invalidate drops cached settings of the tenant.
+func (s *Service) Invalidate(tenant string) {
+	s.mu.Lock()
+	delete(s.cache, tenant)
+	s.mu.Unlock()
+}
+
+func (s *Service) Export(ctx context.Context, tenant string, fn func(storage.ExportedMedication) error) error {
+	if err := s.store.ExportTenant(ctx, tenant, fn); err != nil {
+		return fmt.Errorf("exporting tenant %s: %w", tenant, err)
+	}
+	return nil
+}
+
+func (s *Service) Wipe(ctx context.Context, tenant string) (int, error) {
+	n, err := s.store.WipeTenant(ctx, tenant)
+	if err != nil {
+		return n, fmt.Errorf("wiping tenant %s: %w", tenant, err)
+	}
+	return n, nil
+}
+
+func validateSettings(settings model.TenantSettings) error {
+	if !model.ValidTenant(settings.Tenant) {
+		return fmt.Errorf("<%s> is not a valid tenant: %w", settings.Tenant, ErrBadInput)
+	}
+	for _, f := range settings.AllowedForms {
+		if def, ok := model.CurrentCatalogue().Lookup(string(f)); !ok || def.Code != f {
+			return fmt.Errorf("<%s> is not a catalogue form code: %w", f, ErrBadInput)
+		}
+	}
+	if settings.Webhook.URL != "" {
+		u, err := url.Parse(settings.Webhook.URL)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("webhook url must be an absolute https url: %w", ErrBadInput)
+		}
+	}
+	if settings.RateLimit.RequestsPerSecond < 0 || settings.RateLimit.Burst < 0 {
+		return fmt.Errorf("rate limit must not be negative: %w", ErrBadInput)
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package tenant
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/chestnut42/test-medication/internal/model"
+	"github.com/chestnut42/test-medication/internal/storage"
+)
+
+type memoryStore struct {
+	settings map[string]model.TenantSettings
+	gets     int
+}
+
+func (m *memoryStore) GetTenantSettings(_ context.Context, tenant string) (model.TenantSettings, error) {
+	m.gets++
+	s, ok := m.settings[tenant]
+	if !ok {
+		return model.TenantSettings{}, fmt.Errorf("%s: %w", tenant, storage.ErrNotFound)
+	}
+	return s, nil
+}
+
+func (m *memoryStore) PutTenantSettings(_ context.Context, settings model.TenantSettings) error {
+	m.settings[settings.Tenant] = settings
+	return nil
+}
+
+func (m *memoryStore) ExportTenant(context.Context, string, func(storage.ExportedMedication) error) error {
+	return nil
+}
+
+func (m *memoryStore) WipeTenant(context.Context, string) (int, error) {
+	return 0, nil
+}
+
+func TestSettingsCache(t *testing.T) {
+	ctx := context.Background()
+	store := &memoryStore{settings: map[string]model.TenantSettings{}}
+	svc := NewService(Config{CacheTTL: time.Minute}, store)
+	now := time.Now()
+	svc.now = func() time.Time { return now }
+
+	got, err := svc.Settings(ctx, "acme")
+	if err != nil {
+		t.Fatalf("failed to get settings: %v", err)
+	}
+	if got.Tenant != "acme" || got.StrictNameValidation {
+		t.Fatalf("unconfigured tenant must get defaults, got: %v", got)
+	}
+
+	// Not found is cached as well
+	if _, err := svc.Settings(ctx, "acme"); err != nil {
+		t.Fatalf("failed to get settings: %v", err)
+	}
+	if store.gets != 1 {
+		t.Fatalf("store was called %d times, expected 1", store.gets)
+	}
+
+	// Update invalidates the cache
+	if err := svc.UpdateSettings(ctx, model.TenantSettings{Tenant: "acme", StrictNameValidation: true}); err != nil {
+		t.Fatalf("failed to update settings: %v", err)
+	}
+	if got, _ := svc.Settings(ctx, "acme"); !got.StrictNameValidation {
+		t.Fatalf("got stale settings: %v", got)
+	}
+
+	// Changes made elsewhere are picked up after TTL
+	store.settings["acme"] = model.TenantSettings{Tenant: "acme"}
+	if got, _ := svc.Settings(ctx, "acme"); !got.StrictNameValidation {
+		t.Fatalf("cache was not used: %v", got)
+	}
+	now = now.Add(2 * time.Minute)
+	if got, _ := svc.Settings(ctx, "acme"); got.StrictNameValidation {
+		t.Fatalf("cache has not expired: %v", got)
+	}
+}
+
+func TestValidateSettings(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings model.TenantSettings
+		wantErr  bool
+	}{
+		{name: "empty", settings: model.TenantSettings{Tenant: "acme"}},
+		{name: "bad tenant", settings: model.TenantSettings{Tenant: "Acme#1"}, wantErr: true},
+		{name: "forms", settings: model.TenantSettings{Tenant: "acme", AllowedForms: []model.Form{"tablet", "patch"}}},
+		{name: "unknown form", settings: model.TenantSettings{Tenant: "acme", AllowedForms: []model.Form{"plasma"}}, wantErr: true},
+		{name: "webhook", settings: model.TenantSettings{Tenant: "acme", Webhook: model.Webhook{URL: "https://example.com/hook"}}},
+		{name: "http webhook", settings: model.TenantSettings{Tenant: "acme", Webhook: model.Webhook{URL: "http://example.com/hook"}}, wantErr: true},
+		{name: "negative rate", settings: model.TenantSettings{Tenant: "acme", RateLimit: model.RateLimit{Burst: -1}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateSettings(tt.settings)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error: %v, expected error: %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrBadInput) {
+				t.Fatalf("got error: %v, expected: %v", err, ErrBadInput)
+			}
+		})
+	}
+}
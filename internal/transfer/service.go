@@ -0,0 +1,180 @@
+package transfer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/chestnut42/test-medication/internal/model"
+	"github.com/chestnut42/test-medication/internal/storage"
+	"github.com/chestnut42/test-medication/internal/utils/logx"
+)
+
+// Transfer moves all medications of one owner to another one, e.g. when two records of the same patient are merged.
+// The target owner may be in another tenant, moved medications are then encrypted with that tenant's data key.
+// Every medication is moved in its own storage transaction, which leaves a redirect tombstone behind and carries
+// the history along (see storage.MoveMedication). A transfer is done page by page: moved medications drop out of
+// the source owner's list, so a failed or interrupted transfer is resumed with the cursor it has got, or started
+// again from the beginning.
+
+var ErrBadInput = errors.New("bad request")
+
+type Storage interface {
+	ListMedications(ctx context.Context, query storage.ListQuery) (storage.ListResult, error)
+	MoveMedication(ctx context.Context, source model.Identity, target model.Identity, collision storage.Collision) (model.Medication, error)
+}
+
+// Collision is what happens to a medication whose id is already used by the target owner.
+type Collision string
+
+const (
+	CollisionFail       Collision = "fail"        // The medication is reported as a conflict and left as it is
+	CollisionKeepTarget Collision = "keep-target" // The target's medication is kept, the source redirects to it
+	CollisionKeepSource Collision = "keep-source" // The target's medication is overwritten
+	CollisionRename     Collision = "rename"      // The medication is moved under a new id, see renamedId
+)
+
+const (
+	DefaultLimit = 100
+	MaxLimit     = 1000
+)
+
+type Request struct {
+	Tenant    string
+	From      string // Source owner
+	To        string // Target owner
+	ToTenant  string // Tenant of the target owner, empty means the same tenant
+	Collision Collision
+	Cursor    string // Empty means the first page
+	Limit     int32  // Medications listed per call
+}
+
+type Move struct {
+	Id       string
+	TargetId string // Differs from Id if renamed
+}
+
+type Result struct {
+	Moved     []Move
+	Conflicts []string // Ids left with the source owner
+	Cursor    string   // Empty if the transfer is done
+}
+
+type Service struct {
+	store Storage
+}
+
+func NewService(store Storage) *Service {
+	return &Service{store: store}
+}
+
+// Transfer moves a page of medications. The same request with the returned cursor continues the transfer.
+// On error, the request can be repeated as it is: medications that have been moved are not listed again.
+func (s *Service) Transfer(ctx context.Context, req Request) (Result, error) {
+	if err := validateRequest(req); err != nil {
+		return Result{}, err
+	}
+	limit := req.Limit
+	if limit <= 0 {
+		limit = DefaultLimit
+	}
+	limit = min(limit, MaxLimit)
+
+	res, err := s.store.ListMedications(ctx, storage.ListQuery{
+		Tenant: req.Tenant,
+		Owner:  req.From,
+		Cursor: req.Cursor,
+		Limit:  limit,
+	})
+	if err != nil {
+		if errors.Is(err, storage.ErrBadCursor) {
+			return Result{}, fmt.Errorf("listing medications: %w: %w", ErrBadInput, err)
+		}
+		return Result{}, fmt.Errorf("listing medications: %w", err)
+	}
+
+	out := Result{Cursor: res.Cursor}
+	for _, m := range res.Medications {
+		move, err := s.move(ctx, req, m.Id)
+		switch {
+		case errors.Is(err, storage.ErrAlreadyExists):
+			out.Conflicts = append(out.Conflicts, m.Id)
+		case errors.Is(err, storage.ErrNotFound):
+			// Deleted or moved since it has been listed
+		case err != nil:
+			return out, fmt.Errorf("moving medication %s: %w", m.Id, err)
+		default:
+			out.Moved = append(out.Moved, move)
+		}
+	}
+	logx.Logger(ctx).Info("medications transferred",
+		slog.String("tenant", req.Tenant),
+		slog.String("from", req.From),
+		slog.String("to_tenant", req.targetTenant()),
+		slog.String("to", req.To),
+		slog.Int("moved", len(out.Moved)),
+		slog.Int("conflicts", len(out.Conflicts)))
+	return out, nil
+}
+
+func (s *Service) move(ctx context.Context, req Request, id string) (Move, error) {
+	source := model.Identity{Id: id, Owner: req.From, Tenant: req.Tenant}
+	target := model.Identity{Id: id, Owner: req.To, Tenant: req.targetTenant()}
+
+	collision := storage.Collision(req.Collision)
+	if req.Collision == CollisionRename {
+		collision = storage.CollisionFail
+	}
+	_, err := s.store.MoveMedication(ctx, source, target, collision)
+	if errors.Is(err, storage.ErrAlreadyExists) && req.Collision == CollisionRename {
+		target.Id = renamedId(id, req.From)
+		_, err = s.store.MoveMedication(ctx, source, target, storage.CollisionFail)
+	}
+	if err != nil {
+		return Move{}, err
+	}
+	return Move{Id: id, TargetId: target.Id}, nil
+}
+
+// renamedId is the same for the same medication, so that a repeated transfer doesn't rename it twice.
+// The source owner is hashed as owners may be personal data. It's kept within the API limit of 64 characters.
+func renamedId(id string, from string) string {
+	const maxIdLength = 63 - 9
+
+	hash := sha256.Sum256([]byte(from))
+	if len(id) > maxIdLength {
+		id = id[:maxIdLength]
+	}
+	return id + "-" + hex.EncodeToString(hash[:4])
+}
+
+func (r Request) targetTenant() string {
+	if r.ToTenant == "" {
+		return r.Tenant
+	}
+	return r.ToTenant
+}
+
+func validateRequest(req Request) error {
+	if !model.ValidTenant(req.Tenant) {
+		return fmt.Errorf("<%s> is not a valid tenant: %w", req.Tenant, ErrBadInput)
+	}
+	if req.ToTenant != "" && !model.ValidTenant(req.ToTenant) {
+		return fmt.Errorf("<%s> is not a valid target tenant: %w", req.ToTenant, ErrBadInput)
+	}
+	if req.From == "" || req.To == "" {
+		return fmt.Errorf("source and target owners are required: %w", ErrBadInput)
+	}
+	if req.From == req.To && req.Tenant == req.targetTenant() {
+		return fmt.Errorf("source and target owners are the same: %w", ErrBadInput)
+	}
+	switch req.Collision {
+	case CollisionFail, CollisionKeepTarget, CollisionKeepSource, CollisionRename:
+		return nil
+	default:
+		return fmt.Errorf("<%s> is not a valid collision strategy: %w", req.Collision, ErrBadInput)
+	}
+}
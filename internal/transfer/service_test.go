@@ -0,0 +1,219 @@
+package transfer
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/chestnut42/test-medication/internal/model"
+	"github.com/chestnut42/test-medication/internal/storage"
+	"github.com/chestnut42/test-medication/internal/storage/memory"
+)
+
+func newMedication(owner string, id string, name string) model.Medication {
+	return model.Medication{
+		Identity:       model.Identity{Id: id, Owner: owner, Tenant: "acme"},
+		MedicationData: model.MedicationData{Name: name, Dosage: "500mg", Form: model.FormTablet},
+		Version:        "v-" + owner,
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	tests := []struct {
+		name          string
+		collision     Collision
+		wantMoved     []Move
+		wantConflicts []string
+		wantTarget    map[string]string // id -> name of the target owner's medications after the transfer
+	}{
+		{
+			name:          "fail",
+			collision:     CollisionFail,
+			wantMoved:     []Move{{Id: "a", TargetId: "a"}},
+			wantConflicts: []string{"b"},
+			wantTarget:    map[string]string{"a": "Paracetamol", "b": "Aspirin"},
+		},
+		{
+			name:       "keep target",
+			collision:  CollisionKeepTarget,
+			wantMoved:  []Move{{Id: "a", TargetId: "a"}, {Id: "b", TargetId: "b"}},
+			wantTarget: map[string]string{"a": "Paracetamol", "b": "Aspirin"},
+		},
+		{
+			name:       "keep source",
+			collision:  CollisionKeepSource,
+			wantMoved:  []Move{{Id: "a", TargetId: "a"}, {Id: "b", TargetId: "b"}},
+			wantTarget: map[string]string{"a": "Paracetamol", "b": "Ibuprofen"},
+		},
+		{
+			name:       "rename",
+			collision:  CollisionRename,
+			wantMoved:  []Move{{Id: "a", TargetId: "a"}, {Id: "b", TargetId: renamedId("b", "from")}},
+			wantTarget: map[string]string{"a": "Paracetamol", "b": "Aspirin", renamedId("b", "from"): "Ibuprofen"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := t.Context()
+			store := memory.New()
+			for _, m := range []model.Medication{
+				newMedication("from", "a", "Paracetamol"),
+				newMedication("from", "b", "Ibuprofen"),
+				newMedication("to", "b", "Aspirin"),
+			} {
+				if err := store.CreateMedication(ctx, m); err != nil {
+					t.Fatalf("failed to create: %v", err)
+				}
+			}
+
+			res, err := NewService(store).Transfer(ctx, Request{Tenant: "acme", From: "from", To: "to", Collision: tt.collision})
+			if err != nil {
+				t.Fatalf("failed to transfer: %v", err)
+			}
+			if !slices.Equal(res.Moved, tt.wantMoved) || !slices.Equal(res.Conflicts, tt.wantConflicts) || res.Cursor != "" {
+				t.Fatalf("got %+v, expected moved %v and conflicts %v", res, tt.wantMoved, tt.wantConflicts)
+			}
+
+			listed, err := store.ListMedications(ctx, storage.ListQuery{Tenant: "acme", Owner: "to", Limit: 10})
+			if err != nil {
+				t.Fatalf("failed to list: %v", err)
+			}
+			got := make(map[string]string)
+			for _, m := range listed.Medications {
+				got[m.Id] = m.Name
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.wantTarget) {
+				t.Fatalf("got target medications %v, expected %v", got, tt.wantTarget)
+			}
+			for _, move := range res.Moved {
+				_, err := store.GetMedication(ctx, model.Identity{Id: move.Id, Owner: "from", Tenant: "acme"})
+				var moved *storage.MovedError
+				if !errors.As(err, &moved) || moved.Target.Id != move.TargetId || moved.Target.Owner != "to" {
+					t.Fatalf("got %v, expected a redirect to %s", err, move.TargetId)
+				}
+			}
+		})
+	}
+}
+
+func TestTransferToTenant(t *testing.T) {
+	ctx := t.Context()
+	store := memory.New()
+	if err := store.CreateMedication(ctx, newMedication("from", "a", "Paracetamol")); err != nil {
+		t.Fatalf("failed to create: %v", err)
+	}
+
+	req := Request{Tenant: "acme", From: "from", To: "to", ToTenant: "globex", Collision: CollisionFail}
+	res, err := NewService(store).Transfer(ctx, req)
+	if err != nil {
+		t.Fatalf("failed to transfer: %v", err)
+	}
+	if !slices.Equal(res.Moved, []Move{{Id: "a", TargetId: "a"}}) || len(res.Conflicts) != 0 {
+		t.Fatalf("got %+v, expected a moved", res)
+	}
+
+	target := model.Identity{Id: "a", Owner: "to", Tenant: "globex"}
+	m, err := store.GetMedication(ctx, target)
+	if err != nil {
+		t.Fatalf("failed to get the moved medication: %v", err)
+	}
+	if m.Identity != target || m.Name != "Paracetamol" {
+		t.Fatalf("got %+v, expected Paracetamol of %+v", m, target)
+	}
+	if _, err := store.GetMedication(ctx, model.Identity{Id: "a", Owner: "to", Tenant: "acme"}); !errors.Is(err, storage.ErrNotFound) {
+		t.Fatalf("got %v, expected nothing in the source tenant", err)
+	}
+
+	_, err = store.GetMedication(ctx, model.Identity{Id: "a", Owner: "from", Tenant: "acme"})
+	var moved *storage.MovedError
+	if !errors.As(err, &moved) || moved.Target != target {
+		t.Fatalf("got %v, expected a redirect to %+v", err, target)
+	}
+}
+
+func TestTransferResume(t *testing.T) {
+	ctx := t.Context()
+	store := memory.New()
+	for i := range 5 {
+		if err := store.CreateMedication(ctx, newMedication("from", fmt.Sprint(i), "Paracetamol")); err != nil {
+			t.Fatalf("failed to create: %v", err)
+		}
+	}
+	svc := NewService(store)
+
+	req := Request{Tenant: "acme", From: "from", To: "to", Collision: CollisionFail, Limit: 2}
+	var moved []string
+	for calls := 1; ; calls++ {
+		res, err := svc.Transfer(ctx, req)
+		if err != nil {
+			t.Fatalf("failed to transfer: %v", err)
+		}
+		for _, m := range res.Moved {
+			moved = append(moved, m.Id)
+		}
+		if res.Cursor == "" {
+			break
+		}
+		if calls > 5 {
+			t.Fatalf("transfer isn't done after %d calls", calls)
+		}
+		req.Cursor = res.Cursor
+	}
+	if strings.Join(moved, ",") != "0,1,2,3,4" {
+		t.Fatalf("got moved %v, expected all of them", moved)
+	}
+
+	// Starting over finds nothing to move
+	res, err := svc.Transfer(ctx, Request{Tenant: "acme", From: "from", To: "to", Collision: CollisionFail})
+	if err != nil {
+		t.Fatalf("failed to transfer: %v", err)
+	}
+	if len(res.Moved) != 0 || len(res.Conflicts) != 0 {
+		t.Fatalf("got %+v, expected nothing", res)
+	}
+}
+
+func TestValidateRequest(t *testing.T) {
+	valid := Request{Tenant: "acme", From: "from", To: "to", Collision: CollisionFail}
+	tests := []struct {
+		name    string
+		modify  func(r *Request)
+		wantErr bool
+	}{
+		{name: "valid", modify: func(r *Request) {}},
+		{name: "bad tenant", modify: func(r *Request) { r.Tenant = "" }, wantErr: true},
+		{name: "no source", modify: func(r *Request) { r.From = "" }, wantErr: true},
+		{name: "same owner", modify: func(r *Request) { r.To = r.From }, wantErr: true},
+		{name: "same owner of the same tenant", modify: func(r *Request) { r.To, r.ToTenant = r.From, r.Tenant }, wantErr: true},
+		{name: "same owner of another tenant", modify: func(r *Request) { r.To, r.ToTenant = r.From, "globex" }},
+		{name: "bad target tenant", modify: func(r *Request) { r.ToTenant = "no tenant" }, wantErr: true},
+		{name: "unknown collision", modify: func(r *Request) { r.Collision = "merge" }, wantErr: true},
+		{name: "no collision", modify: func(r *Request) { r.Collision = "" }, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := valid
+			tt.modify(&req)
+			err := validateRequest(req)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validateRequest() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !errors.Is(err, ErrBadInput) {
+				t.Fatalf("got %v, expected %v", err, ErrBadInput)
+			}
+		})
+	}
+}
+
+func TestRenamedId(t *testing.T) {
+	long := strings.Repeat("x", 63)
+	if got := renamedId(long, "from"); len(got) != 63 {
+		t.Fatalf("got %d characters, expected 63", len(got))
+	}
+	if renamedId("a", "from") == renamedId("a", "other") {
+		t.Fatalf("expected different ids for different owners")
+	}
+}
@@ -0,0 +1,142 @@
+package admin
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/chestnut42/test-medication/internal/apikey"
+	"github.com/chestnut42/test-medication/internal/model"
+	"github.com/chestnut42/test-medication/internal/utils/httpx"
+	"github.com/chestnut42/test-medication/internal/utils/logx"
+)
+
+type createAPIKeyService interface {
+	Create(ctx context.Context, tenant string, owner string, name string) (string, model.APIKey, error)
+}
+
+type listAPIKeyService interface {
+	List(ctx context.Context, tenant string) ([]model.APIKey, error)
+}
+
+type revokeAPIKeyService interface {
+	Revoke(ctx context.Context, tenant string, id string) error
+}
+
+type createAPIKeyInput struct {
+	Owner string `json:"owner"` // Optional. Empty means the key can act on behalf of any owner of the tenant
+	Name  string `json:"name"`
+}
+
+type apiKeyOutput struct {
+	Id        string    `json:"id"`
+	Key       string    `json:"key,omitempty"` // Only returned once, on creation
+	Owner     string    `json:"owner,omitempty"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"createdAt"`
+	Revoked   bool      `json:"revoked"`
+}
+
+func newAPIKeyOutput(key model.APIKey) apiKeyOutput {
+	return apiKeyOutput{
+		Id:        key.Id,
+		Owner:     key.Owner,
+		Name:      key.Name,
+		CreatedAt: key.CreatedAt,
+		Revoked:   key.Revoked,
+	}
+}
+
+func CreateAPIKey(svc createAPIKeyService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger := logx.Logger(r.Context())
+
+		tenantId := r.PathValue("tenant")
+		if !model.ValidTenant(tenantId) {
+			httpx.Error(w, r, "invalid tenant", http.StatusBadRequest)
+			return
+		}
+		logger = logger.With(slog.String("tenant", tenantId))
+
+		var req createAPIKeyInput
+		if err := readJson(r, &req); err != nil {
+			httpx.Error(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Name == "" {
+			httpx.Error(w, r, "name is required", http.StatusBadRequest)
+			return
+		}
+
+		raw, key, err := svc.Create(r.Context(), tenantId, req.Owner, req.Name)
+		if err != nil {
+			if errors.Is(err, apikey.ErrBadInput) {
+				httpx.Error(w, r, err.Error(), http.StatusBadRequest)
+				return
+			}
+			logger.Error("svc.Create", slog.Any("error", err))
+			httpx.ServerError(w, r, err)
+			return
+		}
+		logger.Info("api key created", slog.String("key_id", key.Id), slog.String("owner", key.Owner))
+
+		out := newAPIKeyOutput(key)
+		out.Key = raw
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusCreated)
+		writeJson(r.Context(), w, out)
+	})
+}
+
+func ListAPIKeys(svc listAPIKeyService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenantId := r.PathValue("tenant")
+		if !model.ValidTenant(tenantId) {
+			httpx.Error(w, r, "invalid tenant", http.StatusBadRequest)
+			return
+		}
+
+		keys, err := svc.List(r.Context(), tenantId)
+		if err != nil {
+			logx.Logger(r.Context()).Error("svc.List",
+				slog.String("tenant", tenantId),
+				slog.Any("error", err))
+			httpx.ServerError(w, r, err)
+			return
+		}
+
+		out := make([]apiKeyOutput, 0, len(keys))
+		for _, key := range keys {
+			out = append(out, newAPIKeyOutput(key))
+		}
+		writeJson(r.Context(), w, out)
+	})
+}
+
+func RevokeAPIKey(svc revokeAPIKeyService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger := logx.Logger(r.Context())
+
+		tenantId := r.PathValue("tenant")
+		if !model.ValidTenant(tenantId) {
+			httpx.Error(w, r, "invalid tenant", http.StatusBadRequest)
+			return
+		}
+		id := r.PathValue("id")
+		logger = logger.With(slog.String("tenant", tenantId), slog.String("key_id", id))
+
+		if err := svc.Revoke(r.Context(), tenantId, id); err != nil {
+			if errors.Is(err, apikey.ErrNotFound) {
+				httpx.Error(w, r, "api key is not found", http.StatusNotFound)
+				return
+			}
+			logger.Error("svc.Revoke", slog.Any("error", err))
+			httpx.ServerError(w, r, err)
+			return
+		}
+		logger.Info("api key revoked")
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,85 @@
+package admin
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/chestnut42/test-medication/internal/audit"
+	"github.com/chestnut42/test-medication/internal/model"
+	"github.com/chestnut42/test-medication/internal/utils/httpx"
+	"github.com/chestnut42/test-medication/internal/utils/logx"
+)
+
+type queryAuditService interface {
+	Query(ctx context.Context, query audit.Query) (audit.Result, error)
+}
+
+type auditOutput struct {
+	Records []model.AuditRecord `json:"records"`
+	Cursor  string              `json:"cursor,omitempty"`
+}
+
+// QueryAudit returns audit records of an owner, the newest first.
+// Query parameters: owner (required), medicationId, from and to (RFC 3339), cursor and limit.
+func QueryAudit(svc queryAuditService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenantId := r.PathValue("tenant")
+		if !model.ValidTenant(tenantId) {
+			httpx.Error(w, r, "invalid tenant", http.StatusBadRequest)
+			return
+		}
+
+		values := r.URL.Query()
+		query := audit.Query{
+			Tenant:       tenantId,
+			Owner:        values.Get("owner"),
+			MedicationId: values.Get("medicationId"),
+			Cursor:       values.Get("cursor"),
+		}
+		if query.Owner == "" {
+			httpx.Error(w, r, "owner is required", http.StatusBadRequest)
+			return
+		}
+		for name, dst := range map[string]*time.Time{"from": &query.From, "to": &query.To} {
+			if v := values.Get(name); v != "" {
+				t, err := time.Parse(time.RFC3339, v)
+				if err != nil {
+					httpx.Error(w, r, name+" must be RFC 3339 time", http.StatusBadRequest)
+					return
+				}
+				*dst = t
+			}
+		}
+		if v := values.Get("limit"); v != "" {
+			limit, err := strconv.ParseInt(v, 10, 32)
+			if err != nil || limit <= 0 {
+				httpx.Error(w, r, "limit must be a positive number", http.StatusBadRequest)
+				return
+			}
+			query.Limit = int32(limit)
+		}
+
+		res, err := svc.Query(r.Context(), query)
+		if err != nil {
+			if errors.Is(err, audit.ErrBadInput) {
+				httpx.Error(w, r, err.Error(), http.StatusBadRequest)
+				return
+			}
+			logx.Logger(r.Context()).Error("svc.Query",
+				slog.String("tenant", tenantId),
+				slog.Any("error", err))
+			httpx.ServerError(w, r, err)
+			return
+		}
+
+		out := auditOutput{Records: res.Records, Cursor: res.Cursor}
+		if out.Records == nil {
+			out.Records = []model.AuditRecord{}
+		}
+		writeJson(r.Context(), w, out)
+	})
+}
@@ -0,0 +1,86 @@
+package admin
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/chestnut42/test-medication/internal/model"
+	"github.com/chestnut42/test-medication/internal/utils/httpx"
+	"github.com/chestnut42/test-medication/internal/utils/logx"
+)
+
+type listDataKeyService interface {
+	List(ctx context.Context, tenant string) ([]model.DataKey, error)
+}
+
+type rotateDataKeyService interface {
+	Rotate(ctx context.Context, tenant string) (model.DataKey, error)
+}
+
+// dataKeyOutput never includes the key, not even the wrapped one.
+type dataKeyOutput struct {
+	Id          string    `json:"id"`
+	MasterKeyId string    `json:"masterKeyId"`
+	CreatedAt   time.Time `json:"createdAt"`
+	Current     bool      `json:"current"`
+}
+
+func ListDataKeys(svc listDataKeyService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenantId := r.PathValue("tenant")
+		if !model.ValidTenant(tenantId) {
+			httpx.Error(w, r, "invalid tenant", http.StatusBadRequest)
+			return
+		}
+
+		keys, err := svc.List(r.Context(), tenantId)
+		if err != nil {
+			logx.Logger(r.Context()).Error("svc.List",
+				slog.String("tenant", tenantId),
+				slog.Any("error", err))
+			httpx.ServerError(w, r, err)
+			return
+		}
+
+		out := make([]dataKeyOutput, 0, len(keys))
+		for i, key := range keys {
+			out = append(out, dataKeyOutput{
+				Id:          key.Id,
+				MasterKeyId: key.MasterKeyId,
+				CreatedAt:   key.CreatedAt,
+				Current:     i == 0,
+			})
+		}
+		writeJson(r.Context(), w, out)
+	})
+}
+
+// RotateDataKey creates a new current data key of the tenant. Replicas pick it up once their cache expires.
+func RotateDataKey(svc rotateDataKeyService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenantId := r.PathValue("tenant")
+		if !model.ValidTenant(tenantId) {
+			httpx.Error(w, r, "invalid tenant", http.StatusBadRequest)
+			return
+		}
+		logger := logx.Logger(r.Context()).With(slog.String("tenant", tenantId))
+
+		key, err := svc.Rotate(r.Context(), tenantId)
+		if err != nil {
+			logger.Error("svc.Rotate", slog.Any("error", err))
+			httpx.ServerError(w, r, err)
+			return
+		}
+		logger.Info("data key rotated", slog.String("key_id", key.Id))
+
+		w.WriteHeader(http.StatusCreated)
+		writeJson(r.Context(), w, dataKeyOutput{
+			Id:          key.Id,
+			MasterKeyId: key.MasterKeyId,
+			CreatedAt:   key.CreatedAt,
+			Current:     true,
+		})
+	})
+}
@@ -0,0 +1,91 @@
+package admin
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"time"
+
+	"github.com/chestnut42/test-medication/internal/utils/httpx"
+	"github.com/chestnut42/test-medication/internal/utils/logx"
+)
+
+const redacted = "[REDACTED]"
+
+// Config dumps the service configuration. Fields tagged with `redact:"true"` are replaced with a placeholder
+// unless empty, so that one can still see whether a secret is set.
+func Config(cfg any) http.Handler {
+	dump := redactConfig(cfg)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJson(r.Context(), w, dump)
+	})
+}
+
+// redactConfig flattens a config struct into field name -> value.
+func redactConfig(cfg any) map[string]any {
+	out := make(map[string]any)
+	v := reflect.Indirect(reflect.ValueOf(cfg))
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		value := v.Field(i)
+		switch {
+		case field.Tag.Get("redact") == "true":
+			if value.IsZero() {
+				out[field.Name] = ""
+			} else {
+				out[field.Name] = redacted
+			}
+		case value.Type() == reflect.TypeOf(time.Duration(0)):
+			out[field.Name] = value.Interface().(time.Duration).String()
+		case value.Kind() == reflect.Struct:
+			out[field.Name] = redactConfig(value.Interface())
+		default:
+			if s, ok := value.Interface().(fmt.Stringer); ok {
+				out[field.Name] = s.String()
+			} else {
+				out[field.Name] = value.Interface()
+			}
+		}
+	}
+	return out
+}
+
+type logLevelJson struct {
+	Level string `json:"level"`
+}
+
+// GetLogLevel returns the current log level.
+func GetLogLevel(level *slog.LevelVar) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJson(r.Context(), w, logLevelJson{Level: level.Level().String()})
+	})
+}
+
+// PutLogLevel changes the log level until the next restart. Accepts slog level names, e.g. "debug" or "warn".
+func PutLogLevel(level *slog.LevelVar) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req logLevelJson
+		if err := readJson(r, &req); err != nil {
+			httpx.Error(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var newLevel slog.Level
+		if err := newLevel.UnmarshalText([]byte(req.Level)); err != nil {
+			httpx.Error(w, r, fmt.Sprintf("<%s> is not a valid log level", req.Level), http.StatusBadRequest)
+			return
+		}
+
+		prev := level.Level()
+		level.Set(newLevel)
+		logx.Logger(r.Context()).Warn("log level changed",
+			slog.String("from", prev.String()),
+			slog.String("to", newLevel.String()))
+		writeJson(r.Context(), w, logLevelJson{Level: newLevel.String()})
+	})
+}
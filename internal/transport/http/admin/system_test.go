@@ -0,0 +1,47 @@
+package admin
+
+import (
+	"log/slog"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRedactConfig(t *testing.T) {
+	type nested struct {
+		Password string `redact:"true"`
+		User     string
+	}
+	cfg := struct {
+		Listen   string
+		Level    slog.Level
+		Timeout  time.Duration
+		Token    string `redact:"true"`
+		Empty    string `redact:"true"`
+		Database nested
+		hidden   string
+	}{
+		Listen:   ":8080",
+		Level:    slog.LevelWarn,
+		Timeout:  time.Second,
+		Token:    "s3cr3t",
+		Database: nested{Password: "pa$$", User: "med"},
+		hidden:   "x",
+	}
+
+	got := redactConfig(cfg)
+	want := map[string]any{
+		"Listen":  ":8080",
+		"Level":   "WARN",
+		"Timeout": "1s",
+		"Token":   redacted,
+		"Empty":   "",
+		"Database": map[string]any{
+			"Password": redacted,
+			"User":     "med",
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
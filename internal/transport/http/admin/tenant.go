@@ -0,0 +1,257 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"github.com/chestnut42/test-medication/internal/model"
+	"github.com/chestnut42/test-medication/internal/storage"
+	"github.com/chestnut42/test-medication/internal/tenant"
+	"github.com/chestnut42/test-medication/internal/utils/httpx"
+	"github.com/chestnut42/test-medication/internal/utils/logx"
+)
+
+type getTenantService interface {
+	Settings(ctx context.Context, tenant string) (model.TenantSettings, error)
+}
+
+type putTenantService interface {
+	UpdateSettings(ctx context.Context, settings model.TenantSettings) error
+}
+
+type exportTenantService interface {
+	Export(ctx context.Context, tenant string, fn func(storage.ExportedMedication) error) error
+}
+
+type wipeTenantService interface {
+	Wipe(ctx context.Context, tenant string) (int, error)
+}
+
+type webhookJson struct {
+	URL       string `json:"url"`
+	Secret    string `json:"secret,omitempty"`
+	SecretSet bool   `json:"secretSet,omitempty"` // Output only. Secret is never sent back
+}
+
+type rateLimitJson struct {
+	RequestsPerSecond float64 `json:"requestsPerSecond"`
+	Burst             int     `json:"burst"`
+}
+
+type tenantSettingsJson struct {
+	Tenant               string        `json:"tenant"`
+	AllowedForms         []string      `json:"allowedForms"`
+	StrictNameValidation bool          `json:"strictNameValidation"`
+	Webhook              webhookJson   `json:"webhook"`
+	RateLimit            rateLimitJson `json:"rateLimit"`
+}
+
+func GetTenant(svc getTenantService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenantId := r.PathValue("tenant")
+		if !model.ValidTenant(tenantId) {
+			httpx.Error(w, r, "invalid tenant", http.StatusBadRequest)
+			return
+		}
+
+		settings, err := svc.Settings(r.Context(), tenantId)
+		if err != nil {
+			logx.Logger(r.Context()).Error("svc.Settings",
+				slog.String("tenant", tenantId),
+				slog.Any("error", err))
+			httpx.ServerError(w, r, err)
+			return
+		}
+
+		out := tenantSettingsJson{
+			Tenant:               settings.Tenant,
+			AllowedForms:         make([]string, 0, len(settings.AllowedForms)),
+			StrictNameValidation: settings.StrictNameValidation,
+			Webhook: webhookJson{
+				URL:       settings.Webhook.URL,
+				SecretSet: settings.Webhook.Secret != "",
+			},
+			RateLimit: rateLimitJson{
+				RequestsPerSecond: settings.RateLimit.RequestsPerSecond,
+				Burst:             settings.RateLimit.Burst,
+			},
+		}
+		for _, f := range settings.AllowedForms {
+			out.AllowedForms = append(out.AllowedForms, string(f))
+		}
+		writeJson(r.Context(), w, out)
+	})
+}
+
+// PutTenant replaces tenant settings. Webhook secret is kept if omitted.
+func PutTenant(getSvc getTenantService, putSvc putTenantService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger := logx.Logger(r.Context())
+
+		tenantId := r.PathValue("tenant")
+		if !model.ValidTenant(tenantId) {
+			httpx.Error(w, r, "invalid tenant", http.StatusBadRequest)
+			return
+		}
+		logger = logger.With(slog.String("tenant", tenantId))
+
+		var req tenantSettingsJson
+		if err := readJson(r, &req); err != nil {
+			httpx.Error(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		settings := model.TenantSettings{
+			Tenant:               tenantId,
+			StrictNameValidation: req.StrictNameValidation,
+			Webhook: model.Webhook{
+				URL:    req.Webhook.URL,
+				Secret: req.Webhook.Secret,
+			},
+			RateLimit: model.RateLimit{
+				RequestsPerSecond: req.RateLimit.RequestsPerSecond,
+				Burst:             req.RateLimit.Burst,
+			},
+		}
+		for _, f := range req.AllowedForms {
+			form, ok := model.ParseForm(f)
+			if !ok {
+				httpx.Error(w, r, fmt.Sprintf("<%s> is not a valid form", f), http.StatusBadRequest)
+				return
+			}
+			settings.AllowedForms = append(settings.AllowedForms, form)
+		}
+
+		if settings.Webhook.Secret == "" && settings.Webhook.URL != "" {
+			current, err := getSvc.Settings(r.Context(), tenantId)
+			if err != nil {
+				logger.Error("svc.Settings", slog.Any("error", err))
+				httpx.ServerError(w, r, err)
+				return
+			}
+			settings.Webhook.Secret = current.Webhook.Secret
+		}
+
+		if err := putSvc.UpdateSettings(r.Context(), settings); err != nil {
+			if errors.Is(err, tenant.ErrBadInput) {
+				httpx.Error(w, r, err.Error(), http.StatusBadRequest)
+				return
+			}
+			logger.Error("svc.UpdateSettings", slog.Any("error", err))
+			httpx.ServerError(w, r, err)
+			return
+		}
+		logger.Info("tenant settings updated")
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+type exportedMedicationJson struct {
+	Id           string `json:"id"`
+	Owner        string `json:"owner"`
+	Version      string `json:"version"`
+	Deleted      bool   `json:"deleted,omitempty"`
+	Name         string `json:"name"`
+	Dosage       string `json:"dosage"`
+	Form         string `json:"form"`
+	Prescriber   any    `json:"prescriber,omitempty"`
+	Indication   any    `json:"indication,omitempty"`
+	StartDate    string `json:"startDate,omitempty"`
+	EndDate      string `json:"endDate,omitempty"`
+	Status       string `json:"status"`
+	StatusReason string `json:"statusReason,omitempty"`
+}
+
+// ExportTenant streams all medications of the tenant, including deleted, as JSON lines.
+func ExportTenant(svc exportTenantService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger := logx.Logger(r.Context())
+
+		tenantId := r.PathValue("tenant")
+		if !model.ValidTenant(tenantId) {
+			httpx.Error(w, r, "invalid tenant", http.StatusBadRequest)
+			return
+		}
+		logger = logger.With(slog.String("tenant", tenantId))
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		enc := json.NewEncoder(w)
+		count := 0
+		err := svc.Export(r.Context(), tenantId, func(m storage.ExportedMedication) error {
+			count++
+			out := exportedMedicationJson{
+				Id:           m.Id,
+				Owner:        m.Owner,
+				Version:      m.Version,
+				Deleted:      m.Deleted,
+				Name:         m.Name,
+				Dosage:       m.Dosage,
+				Form:         string(m.Form),
+				StartDate:    m.StartDate,
+				EndDate:      m.EndDate,
+				Status:       string(m.Status.OrActive()),
+				StatusReason: m.StatusReason,
+			}
+			if m.Prescriber != (model.Prescriber{}) {
+				out.Prescriber = map[string]string{"id": m.Prescriber.Id, "name": m.Prescriber.Name}
+			}
+			if m.Indication != (model.Indication{}) {
+				out.Indication = map[string]string{
+					"text": m.Indication.Text, "code": m.Indication.Code, "system": m.Indication.System,
+				}
+			}
+			return enc.Encode(out)
+		})
+		if err != nil {
+			// Part of the response may have been sent already, so the best we can do is to break it.
+			logger.Error("svc.Export", slog.Int("exported", count), slog.Any("error", err))
+			panic(http.ErrAbortHandler)
+		}
+		logger.Info("tenant exported", slog.Int("exported", count))
+	})
+}
+
+type wipeTenantOutput struct {
+	Deleted int `json:"deleted"`
+}
+
+// WipeTenant physically deletes all medications of the tenant.
+func WipeTenant(svc wipeTenantService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger := logx.Logger(r.Context())
+
+		tenantId := r.PathValue("tenant")
+		if !model.ValidTenant(tenantId) {
+			httpx.Error(w, r, "invalid tenant", http.StatusBadRequest)
+			return
+		}
+		logger = logger.With(slog.String("tenant", tenantId))
+
+		n, err := svc.Wipe(r.Context(), tenantId)
+		if err != nil {
+			logger.Error("svc.Wipe", slog.Int("deleted", n), slog.Any("error", err))
+			httpx.ServerError(w, r, err)
+			return
+		}
+		logger.Warn("tenant wiped", slog.Int("deleted", n))
+		writeJson(r.Context(), w, wipeTenantOutput{Deleted: n})
+	})
+}
+
+func readJson(r *http.Request, v any) error {
+	const maxJsonBytes = 1024 * 1024
+
+	return json.NewDecoder(io.LimitReader(r.Body, maxJsonBytes)).Decode(v)
+}
+
+func writeJson(ctx context.Context, w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logx.Logger(ctx).Error("writing response", slog.Any("error", err))
+	}
+}
@@ -0,0 +1,89 @@
+package admin
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/chestnut42/test-medication/internal/model"
+	"github.com/chestnut42/test-medication/internal/transfer"
+	"github.com/chestnut42/test-medication/internal/utils/httpx"
+	"github.com/chestnut42/test-medication/internal/utils/logx"
+)
+
+type transferService interface {
+	Transfer(ctx context.Context, req transfer.Request) (transfer.Result, error)
+}
+
+type transferInput struct {
+	To        string `json:"to"`
+	ToTenant  string `json:"toTenant,omitempty"` // Empty means the tenant of the path
+	Collision string `json:"collision"`
+	Cursor    string `json:"cursor,omitempty"`
+	Limit     int32  `json:"limit,omitempty"`
+}
+
+type movedJson struct {
+	Id       string `json:"id"`
+	TargetId string `json:"targetId"`
+}
+
+type transferOutput struct {
+	Moved     []movedJson `json:"moved"`
+	Conflicts []string    `json:"conflicts"`
+	Cursor    string      `json:"cursor,omitempty"` // Empty when the transfer is done
+}
+
+// TransferOwner moves a page of medications of the owner to another owner, of another tenant if toTenant is set.
+// It's called again with the returned cursor until there's none.
+func TransferOwner(svc transferService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger := logx.Logger(r.Context())
+
+		tenantId := r.PathValue("tenant")
+		if !model.ValidTenant(tenantId) {
+			httpx.Error(w, r, "invalid tenant", http.StatusBadRequest)
+			return
+		}
+		owner := r.PathValue("owner")
+		logger = logger.With(slog.String("tenant", tenantId), slog.String("owner", owner))
+
+		var req transferInput
+		if err := readJson(r, &req); err != nil {
+			httpx.Error(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		res, err := svc.Transfer(r.Context(), transfer.Request{
+			Tenant:    tenantId,
+			From:      owner,
+			To:        req.To,
+			ToTenant:  req.ToTenant,
+			Collision: transfer.Collision(req.Collision),
+			Cursor:    req.Cursor,
+			Limit:     req.Limit,
+		})
+		if err != nil {
+			if errors.Is(err, transfer.ErrBadInput) {
+				httpx.Error(w, r, err.Error(), http.StatusBadRequest)
+				return
+			}
+			logger.Error("svc.Transfer", slog.String("to_tenant", req.ToTenant), slog.String("to", req.To),
+				slog.Any("error", err))
+			httpx.ServerError(w, r, err)
+			return
+		}
+
+		out := transferOutput{
+			Moved:     make([]movedJson, 0, len(res.Moved)),
+			Conflicts: make([]string, 0, len(res.Conflicts)),
+			Cursor:    res.Cursor,
+		}
+		for _, m := range res.Moved {
+			out.Moved = append(out.Moved, movedJson{Id: m.Id, TargetId: m.TargetId})
+		}
+		out.Conflicts = append(out.Conflicts, res.Conflicts...)
+		writeJson(r.Context(), w, out)
+	})
+}
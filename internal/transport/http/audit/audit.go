@@ -0,0 +1,91 @@
+package audit
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/felixge/httpsnoop"
+
+	"github.com/chestnut42/test-medication/internal/model"
+	"github.com/chestnut42/test-medication/internal/transport/http/principal"
+	"github.com/chestnut42/test-medication/internal/utils/logx"
+)
+
+type recorder interface {
+	Record(ctx context.Context, record model.AuditRecord)
+}
+
+type Auditor struct {
+	rec recorder
+	now func() time.Time
+}
+
+func NewAuditor(rec recorder) *Auditor {
+	return &Auditor{
+		rec: rec,
+		now: time.Now,
+	}
+}
+
+// Audit wraps a route handler and records every call of it, including reads and rejected calls. Action names the
+// route, e.g. medication.get. Medication id is taken from {id} path value. Routes that touch several medications
+// (list, import) report them with AddMedicationIds, and the call is recorded once per medication, so that
+// the audit of a medication shows them too. Must be used after principal is resolved, i.e. inside
+// principal.WithAuthentication.
+func (a *Auditor) Audit(action string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started := a.now()
+		ids := &medicationIds{}
+		m := httpsnoop.CaptureMetrics(h, w, r.WithContext(context.WithValue(r.Context(), medicationIdsKey{}, ids)))
+
+		// Principal has been checked by authentication. If it's broken anyway, the call is recorded without it.
+		p, _ := principal.FromRequest(r)
+		record := model.AuditRecord{
+			Time:         started,
+			RequestId:    logx.RequestId(r.Context()),
+			Tenant:       p.Tenant,
+			Owner:        p.Owner,
+			KeyId:        p.KeyId,
+			MedicationId: r.PathValue("id"),
+			Action:       action,
+			Status:       m.Code,
+			SourceIP:     sourceIP(r),
+			ForwardedFor: r.Header.Get("X-Forwarded-For"),
+		}
+		if len(ids.ids) == 0 {
+			a.rec.Record(r.Context(), record)
+			return
+		}
+		for _, id := range ids.ids {
+			record.MedicationId = id
+			a.rec.Record(r.Context(), record)
+		}
+	})
+}
+
+type medicationIdsKey struct{}
+
+type medicationIds struct {
+	mu  sync.Mutex
+	ids []string
+}
+
+// AddMedicationIds reports medications returned or changed by the call, see Audit. No-op outside of Audit.
+func AddMedicationIds(ctx context.Context, ids ...string) {
+	if m, ok := ctx.Value(medicationIdsKey{}).(*medicationIds); ok {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.ids = append(m.ids, ids...)
+	}
+}
+
+func sourceIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
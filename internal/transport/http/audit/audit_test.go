@@ -0,0 +1,110 @@
+package audit
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/chestnut42/test-medication/internal/model"
+	"github.com/chestnut42/test-medication/internal/transport/http/principal"
+	"github.com/chestnut42/test-medication/internal/utils/logx"
+)
+
+type fakeRecorder struct {
+	records []model.AuditRecord
+}
+
+func (f *fakeRecorder) Record(_ context.Context, record model.AuditRecord) {
+	f.records = append(f.records, record)
+}
+
+func TestAudit(t *testing.T) {
+	now := time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)
+	rec := &fakeRecorder{}
+	a := NewAuditor(rec)
+	a.now = func() time.Time { return now }
+
+	router := http.NewServeMux()
+	router.Handle("GET /v1/medication/{id}", a.Audit("medication.get", http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+		})))
+
+	r := httptest.NewRequest(http.MethodGet, "/v1/medication/med-1", nil)
+	r.RemoteAddr = "10.0.0.1:12345"
+	r.Header.Set("X-Med-Tenant", "acme")
+	r.Header.Set("X-Med-Owner", "owner-1")
+	r.Header.Set("X-Forwarded-For", "1.2.3.4")
+	r = r.WithContext(logx.WithRequestId(r.Context(), "req-1"))
+	router.ServeHTTP(httptest.NewRecorder(), r)
+
+	want := model.AuditRecord{
+		Time:         now,
+		RequestId:    "req-1",
+		Tenant:       "acme",
+		Owner:        "owner-1",
+		MedicationId: "med-1",
+		Action:       "medication.get",
+		Status:       http.StatusNotFound,
+		SourceIP:     "10.0.0.1",
+		ForwardedFor: "1.2.3.4",
+	}
+	if len(rec.records) != 1 {
+		t.Fatalf("got %d records, expected 1", len(rec.records))
+	}
+	if rec.records[0] != want {
+		t.Fatalf("got %+v, expected %+v", rec.records[0], want)
+	}
+}
+
+func TestAuditKey(t *testing.T) {
+	rec := &fakeRecorder{}
+	h := principal.WithAuthentication(NewAuditor(rec).Audit("medication.list", http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {})), fakeAuth{}, func(error) bool { return false }, true)
+
+	r := httptest.NewRequest(http.MethodGet, "/v1/medication", nil)
+	r.Header.Set("X-Api-Key", "acme.key-1.secret")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	if len(rec.records) != 1 {
+		t.Fatalf("got %d records, expected 1", len(rec.records))
+	}
+	got := rec.records[0]
+	if got.Tenant != "acme" || got.Owner != "owner-1" || got.KeyId != "key-1" || got.Status != http.StatusOK {
+		t.Fatalf("unexpected record: %+v", got)
+	}
+}
+
+type fakeAuth struct{}
+
+func (fakeAuth) Authenticate(context.Context, string) (model.APIKey, error) {
+	return model.APIKey{Id: "key-1", Tenant: "acme", Owner: "owner-1"}, nil
+}
+
+func TestAuditMedicationIds(t *testing.T) {
+	rec := &fakeRecorder{}
+	h := NewAuditor(rec).Audit("medication.list", http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			AddMedicationIds(r.Context(), "med-1")
+			AddMedicationIds(r.Context(), "med-2")
+		}))
+
+	r := httptest.NewRequest(http.MethodGet, "/v1/medication", nil)
+	r = r.WithContext(logx.WithRequestId(r.Context(), "req-1"))
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	if len(rec.records) != 2 {
+		t.Fatalf("got %d records, expected 2", len(rec.records))
+	}
+	for i, id := range []string{"med-1", "med-2"} {
+		got := rec.records[i]
+		if got.MedicationId != id || got.RequestId != "req-1" || got.Action != "medication.list" {
+			t.Fatalf("unexpected record %d: %+v", i, got)
+		}
+	}
+
+	// Outside of Audit it's a no-op
+	AddMedicationIds(t.Context(), "med-3")
+}
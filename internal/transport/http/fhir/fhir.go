@@ -0,0 +1,287 @@
+package fhir
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/chestnut42/test-medication/internal/fhir"
+	"github.com/chestnut42/test-medication/internal/medication"
+	"github.com/chestnut42/test-medication/internal/model"
+	"github.com/chestnut42/test-medication/internal/transport/http/audit"
+	"github.com/chestnut42/test-medication/internal/transport/http/principal"
+	"github.com/chestnut42/test-medication/internal/utils/httpx"
+	"github.com/chestnut42/test-medication/internal/utils/logx"
+)
+
+const maxBundleBytes = 10 * 1024 * 1024
+
+type getMedicationService interface {
+	GetMedication(ctx context.Context, identity model.Identity) (model.Medication, error)
+}
+
+type searchMedicationService interface {
+	ListMedications(ctx context.Context, query medication.ListQuery) (medication.ListResult, error)
+}
+
+type importMedicationService interface {
+	CreateMedication(ctx context.Context, identity model.Identity, data model.MedicationData) (model.Medication, error)
+}
+
+// GetMedicationStatement renders a medication as MedicationStatement. A medication moved to another owner is 410
+// with the new tenant, owner and id in X-Med-Moved-To-* headers, same as GET /v1/medication/{id}.
+func GetMedicationStatement(svc getMedicationService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger := logx.Logger(r.Context())
+
+		id := r.PathValue("id")
+		if err := validateId(id); err != nil {
+			writeOutcome(w, r, http.StatusBadRequest, fhir.IssueInvalid, err.Error())
+			return
+		}
+		p, err := principal.FromRequest(r)
+		if err != nil {
+			writeOutcome(w, r, http.StatusBadRequest, fhir.IssueInvalid, err.Error())
+			return
+		}
+		logger = logger.With(slog.String("id", id), slog.String("tenant", p.Tenant), slog.String("owner", p.Owner))
+
+		med, err := svc.GetMedication(r.Context(), p.Identity(id))
+		if err != nil {
+			var moved *medication.MovedError
+			if errors.As(err, &moved) {
+				w.Header().Set("X-Med-Moved-To-Tenant", moved.Target.Tenant)
+				w.Header().Set("X-Med-Moved-To-Owner", moved.Target.Owner)
+				w.Header().Set("X-Med-Moved-To-Id", moved.Target.Id)
+				writeOutcome(w, r, http.StatusGone, fhir.IssueNotFound, "medication statement is moved to another owner")
+				return
+			}
+			if errors.Is(err, medication.ErrNotFound) {
+				writeOutcome(w, r, http.StatusNotFound, fhir.IssueNotFound, "medication statement is not found")
+				return
+			}
+			logger.Error("svc.GetMedication", slog.Any("error", err))
+			writeServerError(w, r, err)
+			return
+		}
+
+		w.Header().Set("ETag", fmt.Sprintf(`W/"%s"`, med.Version))
+		writeResource(w, http.StatusOK, fhir.NewMedicationStatement(med))
+	})
+}
+
+// SearchMedicationStatement returns a searchset Bundle of owner's medications.
+// Supported parameters: status (comma separated FHIR codes), _count and _cursor for the next page.
+func SearchMedicationStatement(svc searchMedicationService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger := logx.Logger(r.Context())
+
+		p, err := principal.FromRequest(r)
+		if err != nil {
+			writeOutcome(w, r, http.StatusBadRequest, fhir.IssueInvalid, err.Error())
+			return
+		}
+
+		values := r.URL.Query()
+		query := medication.ListQuery{
+			Tenant: p.Tenant,
+			Owner:  p.Owner,
+			Cursor: values.Get("_cursor"),
+		}
+		logger = logger.With(slog.String("tenant", p.Tenant), slog.String("owner", p.Owner))
+
+		if rawStatus := values.Get("status"); rawStatus != "" {
+			for _, code := range strings.Split(rawStatus, ",") {
+				status, ok := fhir.ParseStatementStatus(code)
+				if !ok {
+					writeOutcome(w, r, http.StatusBadRequest, fhir.IssueNotSupported,
+						fmt.Sprintf("status <%s> is not supported", code))
+					return
+				}
+				query.Statuses = append(query.Statuses, status)
+			}
+		}
+		if rawCount := values.Get("_count"); rawCount != "" {
+			count, err := strconv.ParseInt(rawCount, 10, 32)
+			if err != nil || count <= 0 || count > medication.MaxListLimit {
+				writeOutcome(w, r, http.StatusBadRequest, fhir.IssueInvalid,
+					fmt.Sprintf("_count must be a number from 1 to %d", medication.MaxListLimit))
+				return
+			}
+			query.Limit = int32(count)
+		}
+		for key := range values {
+			if key != "status" && key != "_count" && key != "_cursor" {
+				writeOutcome(w, r, http.StatusBadRequest, fhir.IssueNotSupported,
+					fmt.Sprintf("search parameter <%s> is not supported", key))
+				return
+			}
+		}
+
+		res, err := svc.ListMedications(r.Context(), query)
+		if err != nil {
+			if errors.Is(err, medication.ErrBadInput) {
+				writeOutcome(w, r, http.StatusBadRequest, fhir.IssueInvalid, "invalid _cursor")
+				return
+			}
+			logger.Error("svc.ListMedications", slog.Any("error", err))
+			writeServerError(w, r, err)
+			return
+		}
+
+		bundle := fhir.Bundle{
+			ResourceType: fhir.ResourceBundle,
+			Type:         "searchset",
+			Entry:        make([]fhir.BundleEntry, 0, len(res.Medications)),
+		}
+		for _, med := range res.Medications {
+			raw, err := json.Marshal(fhir.NewMedicationStatement(med))
+			if err != nil {
+				logger.Error("json.Marshal", slog.Any("error", err))
+				writeOutcome(w, r, http.StatusInternalServerError, fhir.IssueException, "something went wrong")
+				return
+			}
+			bundle.Entry = append(bundle.Entry, fhir.BundleEntry{
+				FullUrl:  "MedicationStatement/" + med.Id,
+				Resource: raw,
+			})
+			audit.AddMedicationIds(r.Context(), med.Id)
+		}
+		if res.Cursor != "" {
+			next := url.Values{}
+			for key, v := range values {
+				next[key] = v
+			}
+			next.Set("_cursor", res.Cursor)
+			bundle.Link = append(bundle.Link, fhir.BundleLink{
+				Relation: "next",
+				Url:      r.URL.Path + "?" + next.Encode(),
+			})
+		}
+		writeResource(w, http.StatusOK, bundle)
+	})
+}
+
+// ImportBundle creates medications from MedicationStatement and MedicationRequest entries of a Bundle.
+// Each entry is processed independently and gets its own response with an OperationOutcome listing
+// everything that couldn't be mapped. Entries with errors are not imported.
+func ImportBundle(svc importMedicationService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger := logx.Logger(r.Context())
+
+		p, err := principal.FromRequest(r)
+		if err != nil {
+			writeOutcome(w, r, http.StatusBadRequest, fhir.IssueInvalid, err.Error())
+			return
+		}
+		logger = logger.With(slog.String("tenant", p.Tenant), slog.String("owner", p.Owner))
+
+		var bundle fhir.Bundle
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxBundleBytes)).Decode(&bundle); err != nil {
+			writeOutcome(w, r, http.StatusBadRequest, fhir.IssueInvalid, err.Error())
+			return
+		}
+		if bundle.ResourceType != fhir.ResourceBundle {
+			writeOutcome(w, r, http.StatusBadRequest, fhir.IssueInvalid, "resource must be a Bundle")
+			return
+		}
+
+		resp := fhir.Bundle{
+			ResourceType: fhir.ResourceBundle,
+			Type:         "batch-response",
+			Entry:        make([]fhir.BundleEntry, 0, len(bundle.Entry)),
+		}
+		for _, entry := range bundle.Entry {
+			imported := fhir.ImportResource(entry.Resource)
+			resp.Entry = append(resp.Entry, fhir.BundleEntry{
+				Response: importEntry(r.Context(), logger, svc, p, imported),
+			})
+		}
+		writeResource(w, http.StatusOK, resp)
+	})
+}
+
+func importEntry(ctx context.Context, logger *slog.Logger, svc importMedicationService,
+	p principal.Principal, imported fhir.Imported) *fhir.BundleEntryResponse {
+
+	var outcome *fhir.OperationOutcome
+	if len(imported.Issues) > 0 {
+		outcome = fhir.NewOperationOutcome(imported.Issues...)
+	}
+	if imported.Failed() {
+		return &fhir.BundleEntryResponse{Status: "400 Bad Request", Outcome: outcome}
+	}
+
+	med, err := svc.CreateMedication(ctx, p.Identity(imported.Id), imported.Data)
+	if err != nil {
+		var issue fhir.Issue
+		var status string
+		switch {
+		case errors.Is(err, medication.ErrAlreadyExists):
+			status, issue = "409 Conflict", fhir.Issue{Code: fhir.IssueConflict, Diagnostics: "already exists"}
+		case errors.Is(err, medication.ErrBadInput):
+			status, issue = "400 Bad Request", fhir.Issue{Code: fhir.IssueInvalid, Diagnostics: err.Error()}
+		default:
+			logger.Error("svc.CreateMedication", slog.String("id", imported.Id), slog.Any("error", err))
+			status, issue = "500 Internal Server Error", fhir.Issue{Code: fhir.IssueException, Diagnostics: "something went wrong"}
+		}
+		issue.Severity = fhir.SeverityError
+		return &fhir.BundleEntryResponse{
+			Status:  status,
+			Outcome: fhir.NewOperationOutcome(append(imported.Issues, issue)...),
+		}
+	}
+
+	audit.AddMedicationIds(ctx, med.Id)
+	return &fhir.BundleEntryResponse{
+		Status:   "201 Created",
+		Location: "MedicationStatement/" + med.Id + "/_history/" + med.Version,
+		Etag:     fmt.Sprintf(`W/"%s"`, med.Version),
+		Outcome:  outcome,
+	}
+}
+
+// writeOutcome adds the request id to diagnostics, so that a client can refer to it in a report.
+func writeOutcome(w http.ResponseWriter, r *http.Request, code int, issueCode string, diagnostics string) {
+	if id := logx.RequestId(r.Context()); id != "" {
+		diagnostics = fmt.Sprintf("%s (request id: %s)", diagnostics, id)
+	}
+	writeResource(w, code, fhir.NewOperationOutcome(fhir.Issue{
+		Severity:    fhir.SeverityError,
+		Code:        issueCode,
+		Diagnostics: diagnostics,
+	}))
+}
+
+// writeServerError is httpx.ServerError as an OperationOutcome.
+func writeServerError(w http.ResponseWriter, r *http.Request, err error) {
+	if httpx.RetryAfter(w, err) {
+		writeOutcome(w, r, http.StatusServiceUnavailable, fhir.IssueTransient, "service is temporarily unavailable, retry later")
+		return
+	}
+	writeOutcome(w, r, http.StatusInternalServerError, fhir.IssueException, "something went wrong")
+}
+
+func writeResource(w http.ResponseWriter, code int, resource any) {
+	w.Header().Set("Content-Type", fhir.ContentType)
+	w.WriteHeader(code)
+	// nolint:errcheck
+	_ = json.NewEncoder(w).Encode(resource) // Headers are sent already, nothing to do with the error
+}
+
+func validateId(id string) error {
+	if id == "" {
+		return errors.New("id must not be empty")
+	}
+	if len(id) >= 64 {
+		return errors.New("id must be less than 64 characters")
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package fhir
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/chestnut42/test-medication/internal/fhir"
+	"github.com/chestnut42/test-medication/internal/medication"
+	"github.com/chestnut42/test-medication/internal/model"
+	"github.com/chestnut42/test-medication/internal/storage/memory"
+)
+
+type getServiceFunc func(ctx context.Context, identity model.Identity) (model.Medication, error)
+
+func (f getServiceFunc) GetMedication(ctx context.Context, identity model.Identity) (model.Medication, error) {
+	return f(ctx, identity)
+}
+
+func TestGetMedicationStatement(t *testing.T) {
+	tests := []struct {
+		name        string
+		id          string
+		svcErr      error
+		wantCode    int
+		wantHeaders map[string]string
+	}{
+		{name: "ok", id: "id1", wantCode: http.StatusOK, wantHeaders: map[string]string{"ETag": `W/"v1"`}},
+		{name: "long id", id: strings.Repeat("a", 64), wantCode: http.StatusBadRequest},
+		{name: "not found", id: "id1", svcErr: medication.ErrNotFound, wantCode: http.StatusNotFound},
+		{
+			name: "moved",
+			id:   "id1",
+			svcErr: &medication.MovedError{
+				Identity: model.Identity{Id: "id1", Owner: "default-owner", Tenant: model.DefaultTenant},
+				Target:   model.Identity{Id: "id2", Owner: "other", Tenant: "globex"},
+			},
+			wantCode: http.StatusGone,
+			wantHeaders: map[string]string{
+				"X-Med-Moved-To-Tenant": "globex",
+				"X-Med-Moved-To-Owner":  "other",
+				"X-Med-Moved-To-Id":     "id2",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := getServiceFunc(func(ctx context.Context, identity model.Identity) (model.Medication, error) {
+				if tt.svcErr != nil {
+					return model.Medication{}, fmt.Errorf("wrapped: %w", tt.svcErr)
+				}
+				return model.Medication{Identity: identity, Version: "v1"}, nil
+			})
+
+			mux := http.NewServeMux()
+			mux.Handle("GET /fhir/MedicationStatement/{id}", GetMedicationStatement(svc))
+
+			req := httptest.NewRequest(http.MethodGet, "/fhir/MedicationStatement/"+tt.id, nil)
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantCode {
+				t.Fatalf("got code: %d, expected: %d, body: %s", rec.Code, tt.wantCode, rec.Body.String())
+			}
+			for key, value := range tt.wantHeaders {
+				if got := rec.Header().Get(key); got != value {
+					t.Fatalf("got %s: %s, expected: %s", key, got, value)
+				}
+			}
+		})
+	}
+}
+
+type noSettings struct{}
+
+func (noSettings) Settings(ctx context.Context, tenant string) (model.TenantSettings, error) {
+	return model.TenantSettings{}, nil
+}
+
+func TestImportBundle(t *testing.T) {
+	statement := func(id string, extra string) string {
+		return `{"resource": {
+			"resourceType": "MedicationStatement",
+			"id": "` + id + `",
+			"status": "active",
+			"contained": [{"resourceType": "Medication", "id": "m", "code": {"text": "Ibuprofen"}, "form": {"text": "tablet"}}],
+			"medicationReference": {"reference": "#m"},
+			"dosage": [{"text": "200mg"}]` + extra + `
+		}}`
+	}
+
+	tests := []struct {
+		name       string
+		entry      string
+		wantStatus string
+		wantIssue  string // part of diagnostics
+	}{
+		{
+			name:       "ok",
+			entry:      statement("s1", ""),
+			wantStatus: "201 Created",
+		},
+		{
+			name:       "code without system",
+			entry:      statement("s2", `, "reasonCode": [{"coding": [{"code": "R51"}]}]`),
+			wantStatus: "400 Bad Request",
+			wantIssue:  "indication.system is required",
+		},
+		{
+			name:       "long prescriber",
+			entry:      statement("s3", `, "informationSource": {"display": "`+strings.Repeat("a", 1024)+`"}`),
+			wantStatus: "400 Bad Request",
+			wantIssue:  "prescriber.name must be less than 1024 characters",
+		},
+		{
+			name:       "long indication",
+			entry:      statement("s4", `, "reasonCode": [{"text": "`+strings.Repeat("a", 1024)+`"}]`),
+			wantStatus: "400 Bad Request",
+			wantIssue:  "indication.text must be less than 1024 characters",
+		},
+		{
+			name:       "bad date",
+			entry:      statement("s5", `, "effectivePeriod": {"start": "2025-13-01"}`),
+			wantStatus: "400 Bad Request",
+			wantIssue:  "is not a full date",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := medication.NewService(memory.New(), noSettings{})
+			body := `{"resourceType": "Bundle", "type": "batch", "entry": [` + tt.entry + `]}`
+			req := httptest.NewRequest(http.MethodPost, "/fhir", strings.NewReader(body))
+			rec := httptest.NewRecorder()
+			ImportBundle(svc).ServeHTTP(rec, req)
+
+			if rec.Code != http.StatusOK {
+				t.Fatalf("got code: %d, expected: %d, body: %s", rec.Code, http.StatusOK, rec.Body.String())
+			}
+			var bundle fhir.Bundle
+			if err := json.NewDecoder(rec.Body).Decode(&bundle); err != nil {
+				t.Fatalf("failed to decode: %v", err)
+			}
+			resp := bundle.Entry[0].Response
+			if resp.Status != tt.wantStatus {
+				t.Fatalf("got status: %s, expected: %s, outcome: %+v", resp.Status, tt.wantStatus, resp.Outcome)
+			}
+			if tt.wantIssue == "" {
+				return
+			}
+			for _, issue := range resp.Outcome.Issue {
+				if issue.Severity == fhir.SeverityError && strings.Contains(issue.Diagnostics, tt.wantIssue) {
+					return
+				}
+			}
+			t.Fatalf("got outcome: %+v, expected an error with <%s>", resp.Outcome, tt.wantIssue)
+		})
+	}
+}
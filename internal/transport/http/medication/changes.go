@@ -0,0 +1,124 @@
+package medication
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/chestnut42/test-medication/internal/medication"
+	"github.com/chestnut42/test-medication/internal/transport/http/audit"
+	"github.com/chestnut42/test-medication/internal/transport/http/principal"
+	"github.com/chestnut42/test-medication/internal/utils/httpx"
+	"github.com/chestnut42/test-medication/internal/utils/logx"
+)
+
+type changesService interface {
+	Changes(ctx context.Context, query medication.ChangesQuery) (medication.ChangesResult, error)
+}
+
+type changeOutput struct {
+	Id         string            `json:"id"`
+	Version    string            `json:"version"`
+	Deleted    bool              `json:"deleted,omitempty"`
+	Medication *medicationOutput `json:"medication,omitempty"` // Absent if deleted
+}
+
+type changesOutput struct {
+	Changes        []changeOutput `json:"changes"`
+	Token          string         `json:"token"`
+	HasMore        bool           `json:"hasMore"`
+	ResyncRequired bool           `json:"resyncRequired"`
+}
+
+// Changes returns medications of the owner created, updated or deleted since the sync token, oldest first.
+// Query parameters:
+//   - since: token from the previous response, empty on the first sync
+//   - limit: number of changes
+//
+// Every response has a token for the next call. resyncRequired means the changes since the token are not known
+// anymore (or there's no token): the client lists all medications and continues with the token it has got.
+func Changes(svc changesService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger := logx.Logger(r.Context())
+
+		query, err := parseChangesQuery(r)
+		if err != nil {
+			httpx.Error(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logger = logger.With(slog.String("tenant", query.Tenant), slog.String("owner", query.Owner))
+
+		res, err := svc.Changes(r.Context(), query)
+		if err != nil {
+			if errors.Is(err, medication.ErrBadInput) {
+				httpx.Error(w, r, "invalid token", http.StatusBadRequest)
+				return
+			}
+			logger.Error("svc.Changes",
+				slog.Any("error", err))
+			httpx.ServerError(w, r, err)
+			return
+		}
+		if res.ResyncRequired {
+			logger.Info("changes resync required", slog.Bool("first", query.Token == ""))
+		}
+
+		out := changesOutput{
+			Changes:        make([]changeOutput, 0, len(res.Changes)),
+			Token:          res.Token,
+			HasMore:        res.HasMore,
+			ResyncRequired: res.ResyncRequired,
+		}
+		for _, c := range res.Changes {
+			change := changeOutput{Id: c.Medication.Id, Version: c.Medication.Version, Deleted: c.Deleted}
+			if !c.Deleted {
+				m := newMedicationOutput(c.Medication)
+				change.Medication = &m
+			}
+			out.Changes = append(out.Changes, change)
+			audit.AddMedicationIds(r.Context(), c.Medication.Id)
+		}
+		if err := json.NewEncoder(w).Encode(out); err != nil {
+			logger.Error("svc.Changes")
+			return
+		}
+	})
+}
+
+// changesParameters are query parameters Changes supports.
+var changesParameters = []string{"since", "limit"}
+
+func parseChangesQuery(r *http.Request) (medication.ChangesQuery, error) {
+	p, err := principal.FromRequest(r)
+	if err != nil {
+		return medication.ChangesQuery{}, err
+	}
+
+	values := r.URL.Query()
+	for name := range values {
+		if !slices.Contains(changesParameters, name) {
+			return medication.ChangesQuery{}, fmt.Errorf("unsupported query parameter <%s>, supported: %s",
+				name, strings.Join(changesParameters, ", "))
+		}
+	}
+	query := medication.ChangesQuery{
+		Tenant: p.Tenant,
+		Owner:  p.Owner,
+		Token:  values.Get("since"),
+	}
+
+	if rawLimit := values.Get("limit"); rawLimit != "" {
+		limit, err := strconv.ParseInt(rawLimit, 10, 32)
+		if err != nil || limit <= 0 || limit > medication.MaxChangesLimit {
+			return medication.ChangesQuery{}, fmt.Errorf("limit must be a number from 1 to %d", medication.MaxChangesLimit)
+		}
+		query.Limit = int32(limit)
+	}
+	return query, nil
+}
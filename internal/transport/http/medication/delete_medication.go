@@ -1,14 +1,49 @@
 package medication
 
 import (
+	"context"
+	"errors"
+	"log/slog"
 	"net/http"
+
+	"github.com/chestnut42/test-medication/internal/medication"
+	"github.com/chestnut42/test-medication/internal/model"
+	"github.com/chestnut42/test-medication/internal/transport/http/principal"
+	"github.com/chestnut42/test-medication/internal/utils/httpx"
+	"github.com/chestnut42/test-medication/internal/utils/logx"
 )
 
 type deleteMedicationService interface {
+	DeleteMedication(ctx context.Context, identity model.Identity) error
 }
 
 func DeleteMedication(svc deleteMedicationService) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		http.Error(w, "Not Implemented", http.StatusNotImplemented)
+		logger := logx.Logger(r.Context())
+
+		id := r.PathValue("id")
+		if err := validateId(id); err != nil {
+			httpx.Error(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		p, err := principal.FromRequest(r)
+		if err != nil {
+			httpx.Error(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logger = logger.With(slog.String("id", id), slog.String("tenant", p.Tenant), slog.String("owner", p.Owner))
+
+		if err := svc.DeleteMedication(r.Context(), p.Identity(id)); err != nil {
+			if errors.Is(err, medication.ErrNotFound) {
+				httpx.Error(w, r, "not found", http.StatusNotFound)
+				return
+			}
+			logger.Error("svc.DeleteMedication",
+				slog.Any("error", err))
+			httpx.ServerError(w, r, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
 	})
 }
@@ -1,14 +1,88 @@
 package medication
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
 	"net/http"
+
+	"github.com/chestnut42/test-medication/internal/medication"
+	"github.com/chestnut42/test-medication/internal/model"
+	"github.com/chestnut42/test-medication/internal/transport/http/principal"
+	"github.com/chestnut42/test-medication/internal/utils/httpx"
+	"github.com/chestnut42/test-medication/internal/utils/logx"
 )
 
 type getMedicationService interface {
+	GetMedication(ctx context.Context, identity model.Identity) (model.Medication, error)
+	GetMedicationSeen(ctx context.Context, identity model.Identity, version string) (model.Medication, error)
 }
 
+// GetMedication returns the medication with its version as ETag. Reads are eventually consistent, see readContext
+// to make one consistent. A client that sends a version it has seen (If-None-Match or If-Match) never gets an older
+// one: the read is made consistent if the stored version is different. Then If-None-Match is answered with 304 if
+// the version is the same, and If-Match with 412 if it's different. A medication moved to another owner is 410 with
+// the new tenant, owner and id in X-Med-Moved-To-* headers.
 func GetMedication(svc getMedicationService) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		http.Error(w, "Not Implemented", http.StatusNotImplemented)
+		logger := logx.Logger(r.Context())
+
+		id := r.PathValue("id")
+		if err := validateId(id); err != nil {
+			httpx.Error(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		p, err := principal.FromRequest(r)
+		if err != nil {
+			httpx.Error(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logger = logger.With(slog.String("id", id), slog.String("tenant", p.Tenant), slog.String("owner", p.Owner))
+
+		ifMatch := etagVersion(r.Header.Get("If-Match"))
+		ifNoneMatch := etagVersion(r.Header.Get("If-None-Match"))
+		var respObject model.Medication
+		switch {
+		case ifMatch != "":
+			respObject, err = svc.GetMedicationSeen(readContext(r), p.Identity(id), ifMatch)
+		case ifNoneMatch != "":
+			respObject, err = svc.GetMedicationSeen(readContext(r), p.Identity(id), ifNoneMatch)
+		default:
+			respObject, err = svc.GetMedication(readContext(r), p.Identity(id))
+		}
+		if err != nil {
+			var moved *medication.MovedError
+			if errors.As(err, &moved) {
+				w.Header().Set("X-Med-Moved-To-Tenant", moved.Target.Tenant)
+				w.Header().Set("X-Med-Moved-To-Owner", moved.Target.Owner)
+				w.Header().Set("X-Med-Moved-To-Id", moved.Target.Id)
+				httpx.Error(w, r, "moved to another owner", http.StatusGone)
+				return
+			}
+			if errors.Is(err, medication.ErrNotFound) {
+				httpx.Error(w, r, "not found", http.StatusNotFound)
+				return
+			}
+			logger.Error("svc.GetMedication",
+				slog.Any("error", err))
+			httpx.ServerError(w, r, err)
+			return
+		}
+
+		w.Header().Set("ETag", etag(respObject.Version))
+		if ifMatch != "" && respObject.Version != ifMatch {
+			httpx.Error(w, r, "version mismatch", http.StatusPreconditionFailed)
+			return
+		}
+		if ifMatch == "" && ifNoneMatch == respObject.Version {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		if err := json.NewEncoder(w).Encode(newMedicationOutput(respObject)); err != nil {
+			logger.Error("svc.GetMedication")
+			return
+		}
 	})
 }
@@ -0,0 +1,50 @@
+package medication
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/chestnut42/test-medication/internal/model"
+	"github.com/chestnut42/test-medication/internal/utils/logx"
+)
+
+type formOutput struct {
+	Code    string   `json:"code"`
+	Name    string   `json:"name"`
+	Aliases []string `json:"aliases"`
+	Units   []string `json:"units"`
+}
+
+type listFormsOutput struct {
+	Version string       `json:"version"`
+	Forms   []formOutput `json:"forms"`
+}
+
+// ListForms returns the form catalogue. Names are localised with the lang query parameter.
+func ListForms() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lang := r.URL.Query().Get("lang")
+		if lang == "" {
+			lang = model.DefaultLanguage
+		}
+
+		catalogue := model.CurrentCatalogue()
+		out := listFormsOutput{
+			Version: catalogue.Version,
+			Forms:   make([]formOutput, 0, len(catalogue.Forms)),
+		}
+		for _, f := range catalogue.Forms {
+			out.Forms = append(out.Forms, formOutput{
+				Code:    string(f.Code),
+				Name:    f.DisplayName(lang),
+				Aliases: f.Aliases,
+				Units:   f.Units,
+			})
+		}
+
+		if err := json.NewEncoder(w).Encode(out); err != nil {
+			logx.Logger(r.Context()).Error("ListForms")
+			return
+		}
+	})
+}
@@ -0,0 +1,143 @@
+package medication
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/chestnut42/test-medication/internal/medication"
+	"github.com/chestnut42/test-medication/internal/model"
+	"github.com/chestnut42/test-medication/internal/transport/http/audit"
+	"github.com/chestnut42/test-medication/internal/transport/http/principal"
+	"github.com/chestnut42/test-medication/internal/utils/httpx"
+	"github.com/chestnut42/test-medication/internal/utils/logx"
+)
+
+type listMedicationService interface {
+	ListMedications(ctx context.Context, query medication.ListQuery) (medication.ListResult, error)
+}
+
+type listMedicationOutput struct {
+	Medications []medicationOutput `json:"medications"`
+	Cursor      string             `json:"cursor,omitempty"`
+}
+
+// ListMedications lists medications of the owner. Filters are combined, any other query parameter is 400.
+// Query parameters:
+//   - q: name search, see model.MatchName
+//   - form: form code or alias
+//   - status: comma separated statuses, discontinued medications are only returned if requested explicitly
+//   - updatedSince: RFC 3339 time, medications created or updated since then
+//   - cursor: cursor from the previous page
+//   - limit: page size
+//
+// Filters don't fill the page up: it can have fewer medications than the limit, even none, and still a cursor.
+func ListMedications(svc listMedicationService) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger := logx.Logger(r.Context())
+
+		query, err := parseListQuery(r)
+		if err != nil {
+			httpx.Error(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logger = logger.With(slog.String("tenant", query.Tenant), slog.String("owner", query.Owner))
+
+		res, err := svc.ListMedications(r.Context(), query)
+		if err != nil {
+			if errors.Is(err, medication.ErrBadInput) {
+				httpx.Error(w, r, "invalid cursor", http.StatusBadRequest)
+				return
+			}
+			logger.Error("svc.ListMedications",
+				slog.Any("error", err))
+			httpx.ServerError(w, r, err)
+			return
+		}
+
+		out := listMedicationOutput{
+			Medications: make([]medicationOutput, 0, len(res.Medications)),
+			Cursor:      res.Cursor,
+		}
+		for _, m := range res.Medications {
+			out.Medications = append(out.Medications, newMedicationOutput(m))
+			audit.AddMedicationIds(r.Context(), m.Id)
+		}
+		if err := json.NewEncoder(w).Encode(out); err != nil {
+			logger.Error("svc.ListMedications")
+			return
+		}
+	})
+}
+
+// listParameters are query parameters ListMedications supports.
+var listParameters = []string{"q", "form", "status", "updatedSince", "cursor", "limit"}
+
+func parseListQuery(r *http.Request) (medication.ListQuery, error) {
+	p, err := principal.FromRequest(r)
+	if err != nil {
+		return medication.ListQuery{}, err
+	}
+
+	values := r.URL.Query()
+	for name := range values {
+		if !slices.Contains(listParameters, name) {
+			return medication.ListQuery{}, fmt.Errorf("unsupported query parameter <%s>, supported: %s",
+				name, strings.Join(listParameters, ", "))
+		}
+	}
+	query := medication.ListQuery{
+		Tenant: p.Tenant,
+		Owner:  p.Owner,
+		Cursor: values.Get("cursor"),
+	}
+
+	if q := values.Get("q"); q != "" {
+		if len(strings.Join(model.NameQueryWords(q), "")) < model.MinNameQuery {
+			return medication.ListQuery{}, fmt.Errorf("q must have at least %d letters or digits", model.MinNameQuery)
+		}
+		query.Name = q
+	}
+
+	if rawForm := values.Get("form"); rawForm != "" {
+		form, ok := model.ParseForm(rawForm)
+		if !ok {
+			return medication.ListQuery{}, fmt.Errorf("<%s> is not a valid form", rawForm)
+		}
+		query.Form = form
+	}
+
+	if rawSince := values.Get("updatedSince"); rawSince != "" {
+		since, err := time.Parse(time.RFC3339Nano, rawSince)
+		if err != nil {
+			return medication.ListQuery{}, errors.New("updatedSince must be an RFC 3339 time, e.g. 2026-01-02T15:04:05Z")
+		}
+		query.UpdatedSince = since
+	}
+
+	if rawStatus := values.Get("status"); rawStatus != "" {
+		for _, s := range strings.Split(rawStatus, ",") {
+			status, ok := model.ParseStatus(s)
+			if !ok {
+				return medication.ListQuery{}, fmt.Errorf("<%s> is not a valid status", s)
+			}
+			query.Statuses = append(query.Statuses, status)
+		}
+	}
+
+	if rawLimit := values.Get("limit"); rawLimit != "" {
+		limit, err := strconv.ParseInt(rawLimit, 10, 32)
+		if err != nil || limit <= 0 || limit > medication.MaxListLimit {
+			return medication.ListQuery{}, fmt.Errorf("limit must be a number from 1 to %d", medication.MaxListLimit)
+		}
+		query.Limit = int32(limit)
+	}
+	return query, nil
+}
@@ -1,4 +1,379 @@
 package medication
 
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/chestnut42/test-medication/internal/medication"
+	"github.com/chestnut42/test-medication/internal/model"
+	"github.com/chestnut42/test-medication/internal/storage"
+)
+
 // TODO: write tests for all validation cases
 // See https://pkg.go.dev/net/http/httptest
+
+type updateServiceFunc func(ctx context.Context, identity model.Identity, version string, data model.MedicationData) (model.Medication, error)
+
+func (f updateServiceFunc) UpdateMedication(ctx context.Context, identity model.Identity, version string, data model.MedicationData) (model.Medication, error) {
+	return f(ctx, identity, version, data)
+}
+
+func TestUpdateMedication(t *testing.T) {
+	tests := []struct {
+		name     string
+		body     string
+		ifMatch  string
+		svcErr   error
+		wantCode int
+	}{
+		{
+			name:     "ok",
+			body:     `{"version":"v1","name":"Paracetamol","dosage":"500mg","form":"tablet","status":"paused"}`,
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "version in If-Match",
+			body:     `{"name":"Paracetamol","dosage":"500mg","form":"tablet"}`,
+			ifMatch:  `"v1"`,
+			wantCode: http.StatusOK,
+		},
+		{
+			name:     "no version",
+			body:     `{"name":"Paracetamol","dosage":"500mg","form":"tablet"}`,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "bad status",
+			body:     `{"version":"v1","name":"Paracetamol","dosage":"500mg","form":"tablet","status":"stopped"}`,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "bad input",
+			body:     `{"version":"v1","name":"Paracetamol","dosage":"500mg","form":"tablet","startDate":"01.02.2025"}`,
+			svcErr:   medication.ErrBadInput,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "version conflict",
+			body:     `{"version":"v1","name":"Paracetamol","dosage":"500mg","form":"tablet"}`,
+			svcErr:   medication.ErrVersionConflict,
+			wantCode: http.StatusConflict,
+		},
+		{
+			name:     "invalid transition",
+			body:     `{"version":"v1","name":"Paracetamol","dosage":"500mg","form":"tablet","status":"active"}`,
+			svcErr:   medication.ErrInvalidTransition,
+			wantCode: http.StatusUnprocessableEntity,
+		},
+		{
+			name:     "not found",
+			body:     `{"version":"v1","name":"Paracetamol","dosage":"500mg","form":"tablet"}`,
+			svcErr:   medication.ErrNotFound,
+			wantCode: http.StatusNotFound,
+		},
+		{
+			name:     "internal",
+			body:     `{"version":"v1","name":"Paracetamol","dosage":"500mg","form":"tablet"}`,
+			svcErr:   errors.New("boom"),
+			wantCode: http.StatusInternalServerError,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := updateServiceFunc(func(ctx context.Context, identity model.Identity, version string, data model.MedicationData) (model.Medication, error) {
+				if tt.svcErr != nil {
+					return model.Medication{}, fmt.Errorf("wrapped: %w", tt.svcErr)
+				}
+				if version != "v1" {
+					return model.Medication{}, fmt.Errorf("got version %s: %w", version, medication.ErrVersionConflict)
+				}
+				return model.Medication{Identity: identity, MedicationData: data, Version: "v2"}, nil
+			})
+
+			mux := http.NewServeMux()
+			mux.Handle("PATCH /v1/medication/{id}", UpdateMedication(svc))
+
+			req := httptest.NewRequest(http.MethodPatch, "/v1/medication/id1", strings.NewReader(tt.body))
+			if tt.ifMatch != "" {
+				req.Header.Set("If-Match", tt.ifMatch)
+			}
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantCode {
+				t.Fatalf("got code: %d, expected: %d, body: %s", rec.Code, tt.wantCode, rec.Body.String())
+			}
+		})
+	}
+}
+
+// fakeGetService stores medications by id. Eventually consistent reads return stale ones if there are any,
+// and don't see missing ones.
+type fakeGetService struct {
+	current map[string]model.Medication
+	stale   map[string]model.Medication
+	missing map[string]bool
+	moved   map[string]model.Identity
+	reads   []string // "consistent" or "eventual"
+}
+
+func (f *fakeGetService) GetMedication(ctx context.Context, identity model.Identity) (model.Medication, error) {
+	consistent := storage.IsConsistentRead(ctx)
+	if consistent {
+		f.reads = append(f.reads, "consistent")
+	} else {
+		f.reads = append(f.reads, "eventual")
+	}
+	if target, ok := f.moved[identity.Id]; ok {
+		return model.Medication{}, &medication.MovedError{Identity: identity, Target: target}
+	}
+	m, ok := f.stale[identity.Id]
+	if !ok || consistent {
+		m, ok = f.current[identity.Id]
+	}
+	if !ok || (f.missing[identity.Id] && !consistent) {
+		return model.Medication{}, medication.ErrNotFound
+	}
+	return m, nil
+}
+
+func (f *fakeGetService) GetMedicationSeen(ctx context.Context, identity model.Identity, version string) (model.Medication, error) {
+	m, err := f.GetMedication(ctx, identity)
+	if err == nil && m.Version == version {
+		return m, nil
+	}
+	return f.GetMedication(storage.WithConsistentRead(ctx), identity)
+}
+
+func TestGetMedication(t *testing.T) {
+	tests := []struct {
+		name      string
+		url       string
+		headers   map[string]string
+		wantCode  int
+		wantETag  string
+		wantReads []string
+		wantMoved string // X-Med-Moved-To-Id
+	}{
+		{
+			name:      "eventual",
+			url:       "/v1/medication/updated",
+			wantCode:  http.StatusOK,
+			wantETag:  `"v1"`,
+			wantReads: []string{"eventual"},
+		},
+		{
+			name:      "consistent by query",
+			url:       "/v1/medication/updated?consistentRead=true",
+			wantCode:  http.StatusOK,
+			wantETag:  `"v2"`,
+			wantReads: []string{"consistent"},
+		},
+		{
+			name:      "consistent by header",
+			url:       "/v1/medication/updated",
+			headers:   map[string]string{"Cache-Control": "no-cache"},
+			wantCode:  http.StatusOK,
+			wantETag:  `"v2"`,
+			wantReads: []string{"consistent"},
+		},
+		{
+			name:      "not modified",
+			url:       "/v1/medication/same",
+			headers:   map[string]string{"If-None-Match": `W/"v1"`},
+			wantCode:  http.StatusNotModified,
+			wantETag:  `"v1"`,
+			wantReads: []string{"eventual"},
+		},
+		{
+			name:      "seen a newer version",
+			url:       "/v1/medication/updated",
+			headers:   map[string]string{"If-None-Match": `"v2"`},
+			wantCode:  http.StatusNotModified,
+			wantETag:  `"v2"`,
+			wantReads: []string{"eventual", "consistent"},
+		},
+		{
+			name:      "changed since seen",
+			url:       "/v1/medication/same",
+			headers:   map[string]string{"If-None-Match": `"v0"`},
+			wantCode:  http.StatusOK,
+			wantETag:  `"v1"`,
+			wantReads: []string{"eventual", "consistent"},
+		},
+		{
+			name:      "if match a newer version",
+			url:       "/v1/medication/updated",
+			headers:   map[string]string{"If-Match": `"v2"`},
+			wantCode:  http.StatusOK,
+			wantETag:  `"v2"`,
+			wantReads: []string{"eventual", "consistent"},
+		},
+		{
+			name:      "if match failed",
+			url:       "/v1/medication/same",
+			headers:   map[string]string{"If-Match": `"v0"`},
+			wantCode:  http.StatusPreconditionFailed,
+			wantETag:  `"v1"`,
+			wantReads: []string{"eventual", "consistent"},
+		},
+		{
+			name:      "created recently",
+			url:       "/v1/medication/created",
+			headers:   map[string]string{"If-Match": `"v1"`},
+			wantCode:  http.StatusOK,
+			wantETag:  `"v1"`,
+			wantReads: []string{"eventual", "consistent"},
+		},
+		{
+			name:      "moved",
+			url:       "/v1/medication/moved",
+			wantCode:  http.StatusGone,
+			wantReads: []string{"eventual"},
+			wantMoved: "target",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			identity := func(id string) model.Identity {
+				return model.Identity{Id: id}
+			}
+			svc := &fakeGetService{
+				current: map[string]model.Medication{
+					"same":    {Identity: identity("same"), Version: "v1"},
+					"updated": {Identity: identity("updated"), Version: "v2"},
+					"created": {Identity: identity("created"), Version: "v1"},
+				},
+				stale: map[string]model.Medication{
+					"updated": {Identity: identity("updated"), Version: "v1"},
+				},
+				missing: map[string]bool{"created": true},
+				moved:   map[string]model.Identity{"moved": {Id: "target", Owner: "other"}},
+			}
+
+			mux := http.NewServeMux()
+			mux.Handle("GET /v1/medication/{id}", GetMedication(svc))
+
+			req := httptest.NewRequest(http.MethodGet, tt.url, nil)
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantCode {
+				t.Fatalf("got code: %d, expected: %d, body: %s", rec.Code, tt.wantCode, rec.Body.String())
+			}
+			if got := rec.Header().Get("ETag"); got != tt.wantETag {
+				t.Fatalf("got ETag %s, expected %s", got, tt.wantETag)
+			}
+			if !slices.Equal(svc.reads, tt.wantReads) {
+				t.Fatalf("got reads %v, expected %v", svc.reads, tt.wantReads)
+			}
+			if got := rec.Header().Get("X-Med-Moved-To-Id"); got != tt.wantMoved {
+				t.Fatalf("got moved to %q, expected %q", got, tt.wantMoved)
+			}
+		})
+	}
+}
+
+func TestParseListQuery(t *testing.T) {
+	tests := []struct {
+		query   string
+		want    []model.Status
+		wantErr bool
+	}{
+		{query: ""},
+		{query: "status=active", want: []model.Status{model.StatusActive}},
+		{query: "status=Discontinued,paused", want: []model.Status{model.StatusDiscontinued, model.StatusPaused}},
+		{query: "status=stopped", wantErr: true},
+		{query: "limit=0", wantErr: true},
+		{query: "limit=abc", wantErr: true},
+		{query: "limit=10"},
+		{query: "q=para&form=Tablet&updatedSince=2026-01-02T15:04:05Z&status=active", want: []model.Status{model.StatusActive}},
+		{query: "q=p", wantErr: true},
+		{query: "q=-+-", wantErr: true},
+		{query: "form=potion", wantErr: true},
+		{query: "updatedSince=yesterday", wantErr: true},
+		{query: "name=para", wantErr: true}, // Unsupported
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			got, err := parseListQuery(httptest.NewRequest(http.MethodGet, "/v1/medication?"+tt.query, nil))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error: %v, expected error: %v", err, tt.wantErr)
+			}
+			if fmt.Sprint(got.Statuses) != fmt.Sprint(tt.want) {
+				t.Fatalf("got statuses: %v, expected: %v", got.Statuses, tt.want)
+			}
+		})
+	}
+}
+
+type changesServiceFunc func(ctx context.Context, query medication.ChangesQuery) (medication.ChangesResult, error)
+
+func (f changesServiceFunc) Changes(ctx context.Context, query medication.ChangesQuery) (medication.ChangesResult, error) {
+	return f(ctx, query)
+}
+
+func TestChanges(t *testing.T) {
+	changes := []medication.Change{
+		{Medication: model.Medication{
+			Identity:       model.Identity{Id: "a"},
+			MedicationData: model.MedicationData{Name: "Paracetamol", Dosage: "500mg", Form: model.FormTablet},
+			Version:        "v1",
+		}},
+		{Medication: model.Medication{Identity: model.Identity{Id: "b"}, Version: "v2"}, Deleted: true},
+	}
+	tests := []struct {
+		name     string
+		query    string
+		svcErr   error
+		wantCode int
+		wantBody string
+	}{
+		{
+			name:     "ok",
+			query:    "since=t1&limit=2",
+			wantCode: http.StatusOK,
+			wantBody: `{"changes":[{"id":"a","version":"v1","medication":{"id":"a","version":"v1","name":"Paracetamol","dosage":"500mg","form":"tablet","status":"active"}},{"id":"b","version":"v2","deleted":true}],"token":"t2","hasMore":true,"resyncRequired":false}`,
+		},
+		{name: "bad limit", query: "limit=5000", wantCode: http.StatusBadRequest},
+		{name: "unsupported", query: "cursor=t1", wantCode: http.StatusBadRequest},
+		{name: "bad token", query: "since=t1", svcErr: medication.ErrBadInput, wantCode: http.StatusBadRequest},
+		{name: "error", svcErr: errors.New("boom"), wantCode: http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := changesServiceFunc(func(_ context.Context, query medication.ChangesQuery) (medication.ChangesResult, error) {
+				if tt.svcErr != nil {
+					return medication.ChangesResult{}, tt.svcErr
+				}
+				if query.Token != "t1" || query.Limit != 2 {
+					t.Fatalf("got query %+v", query)
+				}
+				return medication.ChangesResult{Changes: changes, Token: "t2", HasMore: true}, nil
+			})
+			req := httptest.NewRequest(http.MethodGet, "/v1/medication:changes?"+tt.query, nil)
+			rec := httptest.NewRecorder()
+			Changes(svc).ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantCode {
+				t.Fatalf("got code %d, expected %d: %s", rec.Code, tt.wantCode, rec.Body.String())
+			}
+			if tt.wantBody != "" && strings.TrimSpace(rec.Body.String()) != tt.wantBody {
+				t.Fatalf("got body %s, expected %s", rec.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
@@ -8,9 +8,26 @@ import (
 )
 
 type medicationDataInput struct {
-	Name   string `json:"name"`
-	Dosage string `json:"dosage"`
-	Form   string `json:"form"`
+	Name         string          `json:"name"`
+	Dosage       string          `json:"dosage"`
+	Form         string          `json:"form"`
+	Prescriber   prescriberInput `json:"prescriber"`
+	Indication   indicationInput `json:"indication"`
+	StartDate    string          `json:"startDate"`
+	EndDate      string          `json:"endDate"`
+	Status       string          `json:"status"`
+	StatusReason string          `json:"statusReason"`
+}
+
+type prescriberInput struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type indicationInput struct {
+	Text   string `json:"text"`
+	Code   string `json:"code"`
+	System string `json:"system"`
 }
 
 func (cmi medicationDataInput) toMedicationData() (model.MedicationData, error) {
@@ -33,13 +50,80 @@ func (cmi medicationDataInput) toMedicationData() (model.MedicationData, error)
 		return model.MedicationData{}, fmt.Errorf("<%s> is not a valid form", cmi.Form)
 	}
 
+	prescription, err := cmi.toPrescription()
+	if err != nil {
+		return model.MedicationData{}, err
+	}
+
 	return model.MedicationData{
-		Name:   cmi.Name,
-		Dosage: cmi.Dosage,
-		Form:   parsedForm,
+		Name:         cmi.Name,
+		Dosage:       cmi.Dosage,
+		Form:         parsedForm,
+		Prescription: prescription,
+	}, nil
+}
+
+func (cmi medicationDataInput) toPrescription() (model.Prescription, error) {
+	var status model.Status
+	if cmi.Status != "" {
+		var ok bool
+		if status, ok = model.ParseStatus(cmi.Status); !ok {
+			return model.Prescription{}, fmt.Errorf("<%s> is not a valid status", cmi.Status)
+		}
+	}
+
+	return model.Prescription{
+		Prescriber: model.Prescriber{
+			Id:   cmi.Prescriber.Id,
+			Name: cmi.Prescriber.Name,
+		},
+		Indication: model.Indication{
+			Text:   cmi.Indication.Text,
+			Code:   cmi.Indication.Code,
+			System: cmi.Indication.System,
+		},
+		StartDate:    cmi.StartDate,
+		EndDate:      cmi.EndDate,
+		Status:       status,
+		StatusReason: cmi.StatusReason,
 	}, nil
 }
 
+type medicationOutput struct {
+	Id           string           `json:"id"`
+	Version      string           `json:"version"`
+	Name         string           `json:"name"`
+	Dosage       string           `json:"dosage"`
+	Form         string           `json:"form"`
+	Prescriber   *prescriberInput `json:"prescriber,omitempty"`
+	Indication   *indicationInput `json:"indication,omitempty"`
+	StartDate    string           `json:"startDate,omitempty"`
+	EndDate      string           `json:"endDate,omitempty"`
+	Status       string           `json:"status"`
+	StatusReason string           `json:"statusReason,omitempty"`
+}
+
+func newMedicationOutput(m model.Medication) medicationOutput {
+	out := medicationOutput{
+		Id:           m.Id,
+		Version:      m.Version,
+		Name:         m.Name,
+		Dosage:       m.Dosage,
+		Form:         string(m.Form),
+		StartDate:    m.StartDate,
+		EndDate:      m.EndDate,
+		Status:       string(m.Status.OrActive()),
+		StatusReason: m.StatusReason,
+	}
+	if m.Prescriber != (model.Prescriber{}) {
+		out.Prescriber = &prescriberInput{Id: m.Prescriber.Id, Name: m.Prescriber.Name}
+	}
+	if m.Indication != (model.Indication{}) {
+		out.Indication = &indicationInput{Text: m.Indication.Text, Code: m.Indication.Code, System: m.Indication.System}
+	}
+	return out
+}
+
 func validateId(id string) error {
 	if id == "" {
 		return errors.New("id must not be empty")
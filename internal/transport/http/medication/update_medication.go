@@ -1,14 +1,90 @@
 package medication
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
 	"net/http"
+
+	"github.com/chestnut42/test-medication/internal/medication"
+	"github.com/chestnut42/test-medication/internal/model"
+	"github.com/chestnut42/test-medication/internal/transport/http/principal"
+	"github.com/chestnut42/test-medication/internal/utils/httpx"
+	"github.com/chestnut42/test-medication/internal/utils/logx"
 )
 
 type updateMedicationService interface {
+	UpdateMedication(ctx context.Context, identity model.Identity, version string, data model.MedicationData) (model.Medication, error)
+}
+
+type updateMedicationInput struct {
+	medicationDataInput
+	Version string `json:"version"`
 }
 
+// UpdateMedication replaces medication data. The request must contain the version the client has seen
+// (in the body or If-Match), 409 is returned if the object has been changed since then. Status is kept if omitted.
 func UpdateMedication(svc updateMedicationService) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		http.Error(w, "Not Implemented", http.StatusNotImplemented)
+		logger := logx.Logger(r.Context())
+
+		id := r.PathValue("id")
+		if err := validateId(id); err != nil {
+			httpx.Error(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logger = logger.With(slog.String("id", id))
+
+		var req updateMedicationInput
+		if err := readJson(r, &req); err != nil {
+			httpx.Error(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Version == "" {
+			req.Version = etagVersion(r.Header.Get("If-Match"))
+		}
+		if req.Version == "" {
+			httpx.Error(w, r, "version must not be empty", http.StatusBadRequest)
+			return
+		}
+
+		mData, err := req.toMedicationData()
+		if err != nil {
+			httpx.Error(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		p, err := principal.FromRequest(r)
+		if err != nil {
+			httpx.Error(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logger = logger.With(slog.String("tenant", p.Tenant), slog.String("owner", p.Owner))
+
+		respObject, err := svc.UpdateMedication(r.Context(), p.Identity(id), req.Version, mData)
+		if err != nil {
+			switch {
+			case errors.Is(err, medication.ErrNotFound):
+				httpx.Error(w, r, "not found", http.StatusNotFound)
+			case errors.Is(err, medication.ErrVersionConflict):
+				httpx.Error(w, r, "version conflict", http.StatusConflict)
+			case errors.Is(err, medication.ErrInvalidTransition):
+				httpx.Error(w, r, err.Error(), http.StatusUnprocessableEntity)
+			case errors.Is(err, medication.ErrBadInput):
+				httpx.Error(w, r, err.Error(), http.StatusBadRequest)
+			default:
+				logger.Error("svc.UpdateMedication",
+					slog.Any("error", err))
+				httpx.ServerError(w, r, err)
+			}
+			return
+		}
+
+		w.Header().Set("ETag", etag(respObject.Version))
+		if err := json.NewEncoder(w).Encode(newMedicationOutput(respObject)); err != nil {
+			logger.Error("svc.UpdateMedication")
+			return
+		}
 	})
 }
@@ -1,25 +1,42 @@
 package medication
 
 import (
+	"context"
 	"encoding/json"
 	"io"
 	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/chestnut42/test-medication/internal/storage"
 )
 
-// TODO: we should have some sort of API keys or user authorisation (typically JWT)
-// for now we just accept X-Med-Owner header to test the functionality
-func getOwner(r *http.Request) string {
-	const defaultOwner = "default-owner"
+func readJson(r *http.Request, v any) error {
+	const maxJsonBytes = 10 * 1024 * 1024
+
+	return json.NewDecoder(io.LimitReader(r.Body, maxJsonBytes)).Decode(v)
+}
 
-	ownerHeader := r.Header.Get("X-Med-Owner")
-	if ownerHeader == "" {
-		return defaultOwner
+// readContext makes reads of the request strongly consistent if the client asks for it with ?consistentRead=true
+// or Cache-Control: no-cache.
+func readContext(r *http.Request) context.Context {
+	consistent, _ := strconv.ParseBool(r.URL.Query().Get("consistentRead"))
+	if consistent || strings.Contains(strings.ToLower(r.Header.Get("Cache-Control")), "no-cache") {
+		return storage.WithConsistentRead(r.Context())
 	}
-	return ownerHeader
+	return r.Context()
 }
 
-func readJson(r *http.Request, v any) error {
-	const maxJsonBytes = 10 * 1024 * 1024
+// etagVersion returns the version of an If-Match/If-None-Match header. Only a single (weak or strong) tag is
+// supported, "*" and lists are ignored.
+func etagVersion(header string) string {
+	tag := strings.TrimPrefix(strings.TrimSpace(header), "W/")
+	if len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' || strings.Contains(tag, ",") {
+		return ""
+	}
+	return tag[1 : len(tag)-1]
+}
 
-	return json.NewDecoder(io.LimitReader(r.Body, maxJsonBytes)).Decode(v)
+func etag(version string) string {
+	return `"` + version + `"`
 }
@@ -0,0 +1,112 @@
+package principal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/chestnut42/test-medication/internal/model"
+	"github.com/chestnut42/test-medication/internal/utils/httpx"
+	"github.com/chestnut42/test-medication/internal/utils/logx"
+)
+
+const defaultOwner = "default-owner"
+
+// Principal is who the request is made on behalf of.
+type Principal struct {
+	Tenant string
+	Owner  string
+	KeyId  string // Empty if the request is not authenticated with an API key
+}
+
+func (p Principal) Identity(id string) model.Identity {
+	return model.Identity{
+		Id:     id,
+		Owner:  p.Owner,
+		Tenant: p.Tenant,
+	}
+}
+
+type Authenticator interface {
+	Authenticate(ctx context.Context, rawKey string) (model.APIKey, error)
+}
+
+type contextKey struct{}
+
+// WithAuthentication resolves the principal and puts it into the request context.
+//
+// Requests with X-Api-Key header are authenticated by the key. The key defines the tenant, and the owner
+// if the key is bound to one. Otherwise, the owner comes from X-Med-Owner (set by a gateway that authorises users).
+//
+// Requests without a key are rejected if keyRequired. Otherwise, X-Med-Tenant and X-Med-Owner headers are trusted,
+// which is only meant for local development and tests.
+func WithAuthentication(h http.Handler, auth Authenticator, unauthenticated func(error) bool, keyRequired bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p Principal
+		if rawKey := r.Header.Get("X-Api-Key"); rawKey != "" {
+			key, err := auth.Authenticate(r.Context(), rawKey)
+			if err != nil {
+				if unauthenticated(err) {
+					logx.Logger(r.Context()).Info("authentication failed", slog.Any("error", err))
+					httpx.Error(w, r, "invalid api key", http.StatusUnauthorized)
+					return
+				}
+				logx.Logger(r.Context()).Error("auth.Authenticate", slog.Any("error", err))
+				httpx.ServerError(w, r, err)
+				return
+			}
+			p = Principal{Tenant: key.Tenant, Owner: key.Owner, KeyId: key.Id}
+			if p.Owner == "" {
+				p.Owner = r.Header.Get("X-Med-Owner")
+			}
+			if p.Owner == "" {
+				httpx.Error(w, r, "X-Med-Owner header is required", http.StatusBadRequest)
+				return
+			}
+		} else {
+			if keyRequired {
+				httpx.Error(w, r, "X-Api-Key header is required", http.StatusUnauthorized)
+				return
+			}
+			var err error
+			if p, err = fromHeaders(r); err != nil {
+				httpx.Error(w, r, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, p)))
+	})
+}
+
+// FromRequest returns the principal of the request. The error is safe to be sent back to the client.
+// Requests that haven't passed through WithAuthentication are treated as unauthenticated development requests.
+func FromRequest(r *http.Request) (Principal, error) {
+	if p, ok := r.Context().Value(contextKey{}).(Principal); ok {
+		return p, nil
+	}
+	return fromHeaders(r)
+}
+
+func fromHeaders(r *http.Request) (Principal, error) {
+	p := Principal{
+		Tenant: r.Header.Get("X-Med-Tenant"),
+		Owner:  r.Header.Get("X-Med-Owner"),
+	}
+	if p.Tenant == "" {
+		p.Tenant = model.DefaultTenant
+	}
+	if p.Owner == "" {
+		p.Owner = defaultOwner
+	}
+
+	if !model.ValidTenant(p.Tenant) {
+		return Principal{}, fmt.Errorf("<%s> is not a valid tenant", p.Tenant)
+	}
+	if p.Owner == "" {
+		return Principal{}, errors.New("owner must not be empty")
+	}
+	return p, nil
+}
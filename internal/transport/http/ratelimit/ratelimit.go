@@ -0,0 +1,94 @@
+package ratelimit
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/chestnut42/test-medication/internal/model"
+	"github.com/chestnut42/test-medication/internal/ratelimit"
+	"github.com/chestnut42/test-medication/internal/transport/http/principal"
+	"github.com/chestnut42/test-medication/internal/utils/httpx"
+	"github.com/chestnut42/test-medication/internal/utils/logx"
+)
+
+type tenantSettingsService interface {
+	Settings(ctx context.Context, tenant string) (model.TenantSettings, error)
+}
+
+// Limiter limits requests per API key, or per owner if the request is made without a key.
+// Tenant settings override the default limit.
+type Limiter struct {
+	limiter  ratelimit.Limiter
+	tenants  tenantSettingsService
+	defaults model.RateLimit
+}
+
+func NewLimiter(limiter ratelimit.Limiter, tenants tenantSettingsService, defaults model.RateLimit) *Limiter {
+	return &Limiter{
+		limiter:  limiter,
+		tenants:  tenants,
+		defaults: defaults,
+	}
+}
+
+// Limit wraps a route handler. Cost is the number of tokens the route takes. Must be used after principal
+// is resolved, i.e. inside principal.WithAuthentication.
+//
+// Responses carry RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset headers
+// (https://datatracker.ietf.org/doc/draft-ietf-httpapi-ratelimit-headers/). Rejected requests get 429 with Retry-After.
+// If the limiter fails (e.g. storage is unavailable) the request is let through: rate limiting protects
+// the storage, so it must not add to an outage of it. A contended shared bucket is not a failure, it's a 429.
+func (l *Limiter) Limit(cost int, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger := logx.Logger(r.Context())
+
+		p, err := principal.FromRequest(r)
+		if err != nil {
+			httpx.Error(w, r, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		limit := l.defaults
+		settings, err := l.tenants.Settings(r.Context(), p.Tenant)
+		if err != nil {
+			logger.Error("tenants.Settings", slog.String("tenant", p.Tenant), slog.Any("error", err))
+		} else if settings.RateLimit.RequestsPerSecond > 0 {
+			limit = settings.RateLimit
+		}
+		if limit.RequestsPerSecond <= 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+		limit.Burst = max(limit.Burst, cost) // Otherwise the route can never be called
+
+		key := "owner:" + p.Tenant + "/" + p.Owner
+		if p.KeyId != "" {
+			key = "key:" + p.Tenant + "/" + p.KeyId
+		}
+		res, err := l.limiter.Take(r.Context(), key, cost, limit)
+		if err != nil {
+			logger.Error("limiter.Take", slog.String("key", key), slog.Any("error", err))
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(limit.Burst))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+		w.Header().Set("RateLimit-Reset", seconds(res.Reset))
+		if !res.Allowed {
+			logger.Info("rate limited", slog.String("key", key), slog.Int("cost", cost))
+			w.Header().Set("Retry-After", seconds(res.RetryAfter))
+			httpx.Error(w, r, "rate limit exceeded", http.StatusTooManyRequests)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func seconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
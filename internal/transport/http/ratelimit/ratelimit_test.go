@@ -0,0 +1,99 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/chestnut42/test-medication/internal/model"
+	"github.com/chestnut42/test-medication/internal/ratelimit"
+	"github.com/chestnut42/test-medication/internal/storage"
+)
+
+type tenants map[string]model.TenantSettings
+
+func (t tenants) Settings(_ context.Context, tenant string) (model.TenantSettings, error) {
+	return t[tenant], nil
+}
+
+func TestLimit(t *testing.T) {
+	l := NewLimiter(ratelimit.NewMemory(), tenants{
+		"big": {RateLimit: model.RateLimit{RequestsPerSecond: 100, Burst: 100}},
+	}, model.RateLimit{RequestsPerSecond: 0.001, Burst: 3})
+	h := l.Limit(2, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	call := func(tenant string, owner string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/v1/medication", nil)
+		r.Header.Set("X-Med-Tenant", tenant)
+		r.Header.Set("X-Med-Owner", owner)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		return rec
+	}
+
+	rec := call("small", "o1")
+	if rec.Code != http.StatusOK || rec.Header().Get("RateLimit-Limit") != "3" ||
+		rec.Header().Get("RateLimit-Remaining") != "1" {
+		t.Fatalf("unexpected response: %d %v", rec.Code, rec.Header())
+	}
+	rec = call("small", "o1")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected 429, got: %d %v", rec.Code, rec.Header())
+	}
+
+	// Owners are limited separately, tenant override applies
+	if rec := call("small", "o2"); rec.Code != http.StatusOK {
+		t.Fatalf("other owner must not be limited, got %d", rec.Code)
+	}
+	for i := 0; i < 10; i++ {
+		if rec := call("big", "o1"); rec.Code != http.StatusOK {
+			t.Fatalf("tenant override is not applied, got %d", rec.Code)
+		}
+	}
+}
+
+// sharedStore always loses the conditional write to another replica, or fails if err is set.
+type sharedStore struct {
+	err error
+}
+
+func (s sharedStore) GetRateBucket(_ context.Context, _ string) (storage.RateBucket, error) {
+	return storage.RateBucket{}, s.err
+}
+
+func (s sharedStore) PutRateBucket(_ context.Context, key string, _ time.Time, _ storage.RateBucket) error {
+	return fmt.Errorf("%s: %w", key, storage.ErrVersionMismatch)
+}
+
+func TestLimitShared(t *testing.T) {
+	tests := []struct {
+		name           string
+		store          sharedStore
+		wantCode       int
+		wantRetryAfter string
+	}{
+		{name: "contended", store: sharedStore{}, wantCode: http.StatusTooManyRequests, wantRetryAfter: "1"},
+		{name: "storage failure", store: sharedStore{err: errors.New("boom")}, wantCode: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewLimiter(ratelimit.NewShared(tt.store), tenants{}, model.RateLimit{RequestsPerSecond: 10, Burst: 10})
+			h := l.Limit(1, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/medication", nil))
+			if rec.Code != tt.wantCode || rec.Header().Get("Retry-After") != tt.wantRetryAfter {
+				t.Fatalf("got: %d %v, expected: %d with Retry-After <%s>", rec.Code, rec.Header(), tt.wantCode, tt.wantRetryAfter)
+			}
+		})
+	}
+}
@@ -0,0 +1,41 @@
+package httpx
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/chestnut42/test-medication/internal/utils/logx"
+)
+
+const RequestIdHeader = "X-Request-Id"
+
+// Incoming ids end up in logs and responses, so only reasonably short and safe ones are honoured.
+var requestIdRegexp = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// WithRequestId takes X-Request-Id from the request (e.g. set by a load balancer) or generates one,
+// puts it into the context and echoes it in the response.
+func WithRequestId(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIdHeader)
+		if !requestIdRegexp.MatchString(id) {
+			id = uuid.NewString()
+		}
+
+		trace.SpanFromContext(r.Context()).SetAttributes(attribute.String("http.request_id", id))
+		w.Header().Set(RequestIdHeader, id)
+		h.ServeHTTP(w, r.WithContext(logx.WithRequestId(r.Context(), id)))
+	})
+}
+
+// Error is http.Error that adds the request id to the message, so that a client can refer to it in a report.
+func Error(w http.ResponseWriter, r *http.Request, msg string, code int) {
+	if id := logx.RequestId(r.Context()); id != "" {
+		msg = fmt.Sprintf("%s (request id: %s)", msg, id)
+	}
+	http.Error(w, msg, code)
+}
@@ -0,0 +1,43 @@
+package httpx
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWithRequestId(t *testing.T) {
+	h := WithRequestId(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Error(w, r, "boom", http.StatusInternalServerError)
+	}))
+
+	tests := []struct {
+		name     string
+		incoming string
+		wantSame bool
+	}{
+		{name: "honoured", incoming: "lb-42.abc", wantSame: true},
+		{name: "generated", incoming: ""},
+		{name: "unsafe replaced", incoming: "a b\"<script>"},
+		{name: "too long replaced", incoming: strings.Repeat("a", 129)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.incoming != "" {
+				r.Header.Set(RequestIdHeader, tt.incoming)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, r)
+
+			id := rec.Header().Get(RequestIdHeader)
+			if id == "" || (id == tt.incoming) != tt.wantSame {
+				t.Fatalf("unexpected id: %q", id)
+			}
+			if body := rec.Body.String(); !strings.Contains(body, "boom (request id: "+id+")") {
+				t.Fatalf("id is not in the body: %s", body)
+			}
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package httpx
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	rtmetrics "runtime/metrics"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+
+	"github.com/chestnut42/test-medication/internal/utils/metrics"
+)
+
+// Load shedding protects a replica from dying under a load spike (and k8s scaling up replicas that die too).
+// Between soft and hard limits requests are rejected with a probability growing linearly from 0 to 1,
+// so that the load is reduced smoothly instead of flapping. Above the hard limit every request is rejected.
+// Zero limit disables the corresponding check.
+
+const heapMetric = "/memory/classes/heap/objects:bytes"
+
+type ShedConfig struct {
+	SoftHeapBytes  uint64
+	HardHeapBytes  uint64
+	SoftInFlight   int64
+	HardInFlight   int64
+	SampleInterval time.Duration // Heap is sampled in background, reading it on every request is too expensive
+	RetryAfter     time.Duration
+}
+
+type Shedder struct {
+	cfg      ShedConfig
+	heap     atomic.Uint64
+	inFlight atomic.Int64
+
+	shed   metric.Int64Counter
+	random func() float64
+}
+
+func NewShedder(cfg ShedConfig) (*Shedder, error) {
+	if cfg.SampleInterval <= 0 {
+		return nil, fmt.Errorf("sample interval must be positive, got %s", cfg.SampleInterval)
+	}
+	meter := metrics.Meter("github.com/chestnut42/test-medication/internal/utils/httpx")
+	// Instruments never fail with a valid name
+	shed, _ := meter.Int64Counter("http.server.shed_requests",
+		metric.WithDescription("Requests rejected by load shedding"))
+	s := &Shedder{
+		cfg:    cfg,
+		shed:   shed,
+		random: rand.Float64,
+	}
+	_, _ = meter.Int64ObservableGauge("http.server.in_flight_requests",
+		metric.WithDescription("Requests being served that are subject to load shedding"),
+		metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+			o.Observe(s.inFlight.Load())
+			return nil
+		}))
+	return s, nil
+}
+
+// Run samples the heap until the context is done.
+func (s *Shedder) Run(ctx context.Context) {
+	samples := []rtmetrics.Sample{{Name: heapMetric}}
+	ticker := time.NewTicker(s.cfg.SampleInterval)
+	defer ticker.Stop()
+
+	for {
+		rtmetrics.Read(samples)
+		if samples[0].Value.Kind() == rtmetrics.KindUint64 {
+			s.heap.Store(samples[0].Value.Uint64())
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// WithShedding rejects requests with 429 when the replica is overloaded. It wraps the public listener only, health
+// and metrics are served by the admin one.
+func WithShedding(h http.Handler, s *Shedder) http.Handler {
+	retryAfter := strconv.Itoa(max(1, int(s.cfg.RetryAfter.Seconds())))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		inFlight := s.inFlight.Add(1)
+		defer s.inFlight.Add(-1)
+
+		if reason, ok := s.reject(inFlight); ok {
+			s.shed.Add(r.Context(), 1, metric.WithAttributes(attribute.String("reason", reason)))
+			w.Header().Set("Retry-After", retryAfter)
+			Error(w, r, "server is overloaded, retry later", http.StatusTooManyRequests)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (s *Shedder) reject(inFlight int64) (string, bool) {
+	if s.overloaded(float64(s.heap.Load()), float64(s.cfg.SoftHeapBytes), float64(s.cfg.HardHeapBytes)) {
+		return "heap", true
+	}
+	if s.overloaded(float64(inFlight), float64(s.cfg.SoftInFlight), float64(s.cfg.HardInFlight)) {
+		return "in_flight", true
+	}
+	return "", false
+}
+
+func (s *Shedder) overloaded(value, soft, hard float64) bool {
+	switch {
+	case hard > 0 && value > hard:
+		return true
+	case soft > 0 && value > soft:
+		if hard <= soft {
+			return true
+		}
+		return s.random() < (value-soft)/(hard-soft)
+	default:
+		return false
+	}
+}
@@ -0,0 +1,86 @@
+package httpx
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWithShedding(t *testing.T) {
+	s, err := NewShedder(ShedConfig{
+		SoftHeapBytes:  100,
+		HardHeapBytes:  200,
+		SampleInterval: time.Second,
+		RetryAfter:     5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("NewShedder() error = %v", err)
+	}
+	h := WithShedding(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}), s)
+
+	tests := []struct {
+		name     string
+		heap     uint64
+		random   float64
+		path     string
+		wantCode int
+	}{
+		{name: "under soft", heap: 50, random: 0, path: "/v1/medication", wantCode: http.StatusOK},
+		{name: "between, lucky", heap: 150, random: 0.6, path: "/v1/medication", wantCode: http.StatusOK},
+		{name: "between, shed", heap: 150, random: 0.4, path: "/v1/medication", wantCode: http.StatusTooManyRequests},
+		{name: "over hard", heap: 250, random: 0.99, path: "/v1/medication", wantCode: http.StatusTooManyRequests},
+		{name: "over hard, fhir", heap: 250, random: 0, path: "/fhir", wantCode: http.StatusTooManyRequests},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s.heap.Store(tt.heap)
+			s.random = func() float64 { return tt.random }
+
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+			if rec.Code != tt.wantCode {
+				t.Fatalf("got code %d, want %d", rec.Code, tt.wantCode)
+			}
+			if tt.wantCode == http.StatusTooManyRequests && rec.Header().Get("Retry-After") != "5" {
+				t.Fatalf("unexpected Retry-After: %s", rec.Header().Get("Retry-After"))
+			}
+		})
+	}
+}
+
+func TestSheddingInFlight(t *testing.T) {
+	s, err := NewShedder(ShedConfig{HardInFlight: 1, SampleInterval: time.Second})
+	if err != nil {
+		t.Fatalf("NewShedder() error = %v", err)
+	}
+	inner := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) })
+
+	var nestedCode int
+	h := WithShedding(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// One request is in flight, the next one must be rejected
+		rec := httptest.NewRecorder()
+		WithShedding(inner, s).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/forms", nil))
+		nestedCode = rec.Code
+		w.WriteHeader(http.StatusOK)
+	}), s)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/forms", nil))
+	if rec.Code != http.StatusOK || nestedCode != http.StatusTooManyRequests {
+		t.Fatalf("got codes %d and %d", rec.Code, nestedCode)
+	}
+	if s.inFlight.Load() != 0 {
+		t.Fatalf("in flight counter leaked: %d", s.inFlight.Load())
+	}
+}
+
+func TestNewShedder(t *testing.T) {
+	for _, interval := range []time.Duration{0, -time.Second} {
+		if _, err := NewShedder(ShedConfig{SampleInterval: interval}); err == nil {
+			t.Fatalf("sample interval %s is accepted", interval)
+		}
+	}
+}
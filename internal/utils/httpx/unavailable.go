@@ -0,0 +1,48 @@
+package httpx
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// unavailable is implemented by errors of a dependency that is known to be down for a while,
+// e.g. storage.UnavailableError of an open breaker.
+type unavailable interface {
+	RetryAfter() time.Duration
+}
+
+// RetryAfter reports whether err is caused by an unavailable dependency. If so, it sets Retry-After.
+func RetryAfter(w http.ResponseWriter, err error) bool {
+	var u unavailable
+	if !errors.As(err, &u) {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(max(1, int(u.RetryAfter().Round(time.Second).Seconds()))))
+	return true
+}
+
+// ServerError answers 503 with Retry-After if err is caused by an unavailable dependency, and 500 otherwise.
+// Clients are expected to retry 503, so it's not used for anything else.
+func ServerError(w http.ResponseWriter, r *http.Request, err error) {
+	if RetryAfter(w, err) {
+		Error(w, r, "service is temporarily unavailable, retry later", http.StatusServiceUnavailable)
+		return
+	}
+	Error(w, r, "something went wrong", http.StatusInternalServerError)
+}
+
+// WithDeadline sets the deadline of the request. Storage derives timeouts of its calls from it.
+// Zero timeout leaves requests without a deadline.
+func WithDeadline(h http.Handler, timeout time.Duration) http.Handler {
+	if timeout <= 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
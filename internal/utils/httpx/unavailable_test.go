@@ -0,0 +1,40 @@
+package httpx
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type retryAfterError time.Duration
+
+func (e retryAfterError) Error() string             { return "unavailable" }
+func (e retryAfterError) RetryAfter() time.Duration { return time.Duration(e) }
+
+func TestServerError(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		code       int
+		retryAfter string
+	}{
+		{name: "generic", err: errors.New("boom"), code: http.StatusInternalServerError},
+		{name: "unavailable", err: fmt.Errorf("getting: %w", retryAfterError(3*time.Second)), code: http.StatusServiceUnavailable, retryAfter: "3"},
+		{name: "at least a second", err: retryAfterError(10 * time.Millisecond), code: http.StatusServiceUnavailable, retryAfter: "1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			ServerError(rec, httptest.NewRequest(http.MethodGet, "/", nil), tt.err)
+			if rec.Code != tt.code {
+				t.Fatalf("got %d, expected %d", rec.Code, tt.code)
+			}
+			if got := rec.Header().Get("Retry-After"); got != tt.retryAfter {
+				t.Fatalf("got Retry-After %q, expected %q", got, tt.retryAfter)
+			}
+		})
+	}
+}
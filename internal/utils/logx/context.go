@@ -11,10 +11,14 @@ func WithLogger(ctx context.Context, logger *slog.Logger) context.Context {
 	return context.WithValue(ctx, contextKey{}, logger)
 }
 
+// Logger returns the logger of the context. Records it emits carry ids of the context, see Handler.
 func Logger(ctx context.Context) *slog.Logger {
 	l, ok := ctx.Value(contextKey{}).(*slog.Logger)
 	if !ok {
-		return slog.Default()
+		l = slog.Default()
+	}
+	if h, ok := l.Handler().(*Handler); ok {
+		return slog.New(h.bind(ctx))
 	}
 	return l
 }
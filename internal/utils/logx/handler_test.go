@@ -0,0 +1,69 @@
+package logx
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"testing"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+func TestHandler(t *testing.T) {
+	buf := &bytes.Buffer{}
+	logger := slog.New(NewHandler(slog.NewJSONHandler(buf, nil))).With(slog.String("static", "yes"))
+
+	tracer := sdktrace.NewTracerProvider().Tracer("test")
+	ctx, span := tracer.Start(context.Background(), "test")
+	defer span.End()
+	ctx = WithRequestId(ctx, "req-1")
+	ctx = WithLogger(ctx, logger)
+
+	tests := []struct {
+		name          string
+		log           func()
+		wantRequestId string
+		wantTrace     bool
+	}{
+		{
+			name:          "bound logger",
+			log:           func() { Logger(ctx).Info("msg") },
+			wantRequestId: "req-1",
+			wantTrace:     true,
+		},
+		{
+			name:          "explicit context",
+			log:           func() { logger.InfoContext(ctx, "msg") },
+			wantRequestId: "req-1",
+			wantTrace:     true,
+		},
+		{
+			name: "no context",
+			log:  func() { logger.Info("msg") },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf.Reset()
+			tt.log()
+
+			var rec map[string]any
+			if err := json.Unmarshal(buf.Bytes(), &rec); err != nil {
+				t.Fatalf("failed to decode record: %v", err)
+			}
+			if rec["static"] != "yes" {
+				t.Fatalf("attributes are lost: %v", rec)
+			}
+			if got, _ := rec["request_id"].(string); got != tt.wantRequestId {
+				t.Fatalf("got request_id %q, want %q", got, tt.wantRequestId)
+			}
+			if got := rec["trace_id"] == span.SpanContext().TraceID().String(); got != tt.wantTrace {
+				t.Fatalf("unexpected trace_id: %v", rec)
+			}
+			if tt.wantTrace && rec["span_id"] != span.SpanContext().SpanID().String() {
+				t.Fatalf("unexpected span_id: %v", rec)
+			}
+		})
+	}
+}
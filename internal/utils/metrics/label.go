@@ -0,0 +1,45 @@
+package metrics
+
+import (
+	"sync"
+)
+
+// OtherLabel replaces label values over the limit.
+const OtherLabel = "other"
+
+// BoundedLabel keeps cardinality of a label under control. The first max distinct values are passed as is,
+// the rest are reported as OtherLabel. Meant for values that are expected to be few but aren't enforced to,
+// e.g. tenants.
+type BoundedLabel struct {
+	max int
+
+	mu   sync.RWMutex
+	seen map[string]struct{}
+}
+
+func NewBoundedLabel(max int) *BoundedLabel {
+	return &BoundedLabel{
+		max:  max,
+		seen: make(map[string]struct{}),
+	}
+}
+
+func (b *BoundedLabel) Value(v string) string {
+	b.mu.RLock()
+	_, ok := b.seen[v]
+	b.mu.RUnlock()
+	if ok {
+		return v
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.seen[v]; ok {
+		return v
+	}
+	if len(b.seen) >= b.max {
+		return OtherLabel
+	}
+	b.seen[v] = struct{}{}
+	return v
+}
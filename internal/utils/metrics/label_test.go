@@ -0,0 +1,23 @@
+package metrics
+
+import (
+	"testing"
+)
+
+func TestBoundedLabel(t *testing.T) {
+	b := NewBoundedLabel(2)
+	for _, tt := range []struct {
+		in   string
+		want string
+	}{
+		{in: "a", want: "a"},
+		{in: "b", want: "b"},
+		{in: "c", want: OtherLabel},
+		{in: "a", want: "a"},
+		{in: "d", want: OtherLabel},
+	} {
+		if got := b.Value(tt.in); got != tt.want {
+			t.Fatalf("Value(%s) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
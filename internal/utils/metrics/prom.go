@@ -8,11 +8,13 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/exporters/prometheus"
+	otelmetric "go.opentelemetry.io/otel/metric"
 	"go.opentelemetry.io/otel/sdk/metric"
 )
 
 var _registerer = clientprom.DefaultRegisterer
 var _gatherer = clientprom.DefaultGatherer
+var _provider *metric.MeterProvider
 
 func init() {
 	exporter, err := prometheus.New(prometheus.WithRegisterer(_registerer))
@@ -20,8 +22,13 @@ func init() {
 		log.Fatalf("failed to initialize prometheus exporter: %v", err)
 	}
 
-	provider := metric.NewMeterProvider(metric.WithReader(exporter))
-	otel.SetMeterProvider(provider)
+	_provider = metric.NewMeterProvider(metric.WithReader(exporter))
+	otel.SetMeterProvider(_provider)
+}
+
+// Meter returns a meter of the provider exported via NewHandler. Name is the instrumented package.
+func Meter(name string) otelmetric.Meter {
+	return _provider.Meter(name)
 }
 
 func NewHandler() http.Handler {
@@ -3,12 +3,13 @@
 set -e
 
 base_url="http://localhost:8080"
+admin_url="http://localhost:8081"
 
 for i in $(seq 1 10); do
-  curl "$base_url/health" && break || sleep 1
+  curl -sf "$admin_url/readyz" && break || sleep 1
 done
 
-echo "health was waited for"
+echo "readiness was waited for"
 
 
 function check {
@@ -59,6 +60,34 @@ check "created dosage" "100mg" $(echo "$body" | jq -r .dosage)
 check "created form" "capsule" $(echo "$body" | jq -r .form)
 
 
+# Update with a wrong version
+response=$(curl -s -w "\n%{http_code}" -X PATCH "$base_url/v1/medication/myid1" \
+  -H "X-Med-Owner: owner1" \
+  -d '{"version":"wrong", "name":"Paracetamol", "dosage":"250mg", "form":"tablet"}')
+status=$(echo "$response" | tail -n1)
+
+check "status" "409" "$status"
+
+
+# Discontinue
+version=$(curl -s "$base_url/v1/medication/myid1" -H "X-Med-Owner: owner1" | jq -r .version)
+response=$(curl -s -w "\n%{http_code}" -X PATCH "$base_url/v1/medication/myid1" \
+  -H "X-Med-Owner: owner1" \
+  -d '{"version":"'"$version"'", "name":"Paracetamol", "dosage":"250mg", "form":"tablet", "status":"discontinued", "statusReason":"side effects"}')
+body=$(echo "$response" | head -n1)
+status=$(echo "$response" | tail -n1)
+
+check "status" "200" "$status"
+check "updated status" "discontinued" $(echo "$body" | jq -r .status)
+
+
+# Discontinued is not listed by default
+response=$(curl -s "$base_url/v1/medication" -H "X-Med-Owner: owner1")
+check "listed" "0" $(echo "$response" | jq -r '.medications | length')
+response=$(curl -s "$base_url/v1/medication?status=discontinued" -H "X-Med-Owner: owner1")
+check "listed discontinued" "1" $(echo "$response" | jq -r '.medications | length')
+
+
 # Bad name
 response=$(curl -s -w "\n%{http_code}" -X PUT "$base_url/v1/medication/myid3" \
   -H "X-Med-Owner: owner3" \
@@ -89,8 +118,51 @@ status=$(echo "$response" | tail -n1)
 check "status" "400" "$status"
 
 
+# Internal endpoints are not exposed publicly
+status=$(curl -s -o /dev/null -w "%{http_code}" "$base_url/metrics")
+check "public metrics status" "404" "$status"
+
+
+# API keys
+response=$(curl -s -w "\n%{http_code}" -X POST "$admin_url/admin/tenants/default/apikeys" \
+  -d '{"name":"test", "owner":"owner1"}')
+body=$(echo "$response" | head -n1)
+status=$(echo "$response" | tail -n1)
+check "status" "201" "$status"
+api_key=$(echo "$body" | jq -r .key)
+key_id=$(echo "$body" | jq -r .id)
+
+status=$(curl -s -o /dev/null -w "%{http_code}" "$base_url/v1/medication/myid1" -H "X-Api-Key: $api_key")
+check "status" "200" "$status"
+
+status=$(curl -s -o /dev/null -w "%{http_code}" -X DELETE "$admin_url/admin/tenants/default/apikeys/$key_id")
+check "status" "204" "$status"
+
+status=$(curl -s -o /dev/null -w "%{http_code}" "$base_url/v1/medication/myid1" -H "X-Api-Key: $api_key")
+check "status" "401" "$status"
+
+
+# Audit. Records are written asynchronously
+sleep 2
+response=$(curl -s -w "\n%{http_code}" "$admin_url/admin/tenants/default/audit?owner=owner1&medicationId=myid1")
+body=$(echo "$response" | head -n1)
+status=$(echo "$response" | tail -n1)
+check "status" "200" "$status"
+check "audited key" "$key_id" "$(echo "$body" | jq -r '.records[0].keyId')"
+check "audited action" "medication.get" "$(echo "$body" | jq -r '.records[0].action')"
+
+
+# Data key rotation. Medications encrypted with the old key stay readable
+status=$(curl -s -o /dev/null -w "%{http_code}" -X POST "$admin_url/admin/tenants/default/datakeys")
+check "status" "201" "$status"
+response=$(curl -s "$admin_url/admin/tenants/default/datakeys")
+check "data keys" "2" "$(echo "$response" | jq length)"
+status=$(curl -s -o /dev/null -w "%{http_code}" "$base_url/v1/medication/myid1" -H "X-Med-Owner: owner1")
+check "status" "200" "$status"
+
+
 # Metrics
-response=$(curl -s -X GET "$base_url/metrics")
+response=$(curl -s -X GET "$admin_url/metrics")
 
 if ! echo "$response" | grep "^go_memstats_" >/dev/null; then
   echo "❌ No Go metrics found"